@@ -1,8 +1,76 @@
 package amf0
 
+import "github.com/codingpa-ws/rtmp/amf/amf3"
+
 type ECMAArray map[string]any
 type ObjectEnd struct{}
 
+// Undefined is the undefined value. Unlike null, which is decoded as nil, undefined is decoded as Undefined{}, which is
+// encoded back as undefined (eg: to tell an omitted argument from an explicit null one). It's the same type as
+// amf3.Undefined.
+type Undefined = amf3.Undefined
+
+// TypedObject is an object of a registered class, like the objects of the ActionScript classes sent by Flash clients.
+type TypedObject struct {
+	ClassName  string
+	Properties map[string]any
+}
+
+// Property is a key of an object and its value.
+type Property struct {
+	Key   string
+	Value any
+}
+
+// OrderedObject is an object that keeps its properties in the order they were encoded in, so that it can be encoded
+// back byte for byte (see DecodeOrdered). Use Map to access its properties by key.
+type OrderedObject []Property
+
+// OrderedECMAArray is the ECMAArray counterpart of OrderedObject.
+type OrderedECMAArray []Property
+
+// XMLDocument is the source of an XML document, which is encoded like a long string.
+type XMLDocument string
+
+// Get returns the value of key, or nil if the object doesn't have it.
+func (o OrderedObject) Get(key string) any {
+	return properties(o).get(key)
+}
+
+// Map returns the properties of the object as a map. Nested ordered objects and arrays are left as they are.
+func (o OrderedObject) Map() map[string]any {
+	return properties(o).toMap()
+}
+
+// Get returns the value of key, or nil if the array doesn't have it.
+func (a OrderedECMAArray) Get(key string) any {
+	return properties(a).get(key)
+}
+
+// Map returns the properties of the array as an ECMAArray. Nested ordered objects and arrays are left as they are.
+func (a OrderedECMAArray) Map() ECMAArray {
+	return properties(a).toMap()
+}
+
+type properties []Property
+
+func (p properties) get(key string) any {
+	for _, property := range p {
+		if property.Key == key {
+			return property.Value
+		}
+	}
+	return nil
+}
+
+func (p properties) toMap() map[string]any {
+	m := make(map[string]any, len(p))
+	for _, property := range p {
+		m[property.Key] = property.Value
+	}
+	return m
+}
+
 const (
 	TypeNumber      byte = 0x00
 	TypeBoolean          = 0x01
@@ -21,4 +89,5 @@ const (
 	TypeRecordSet        = 0x0E // reserved, not supported
 	TypeXMLDocument      = 0x0F
 	TypeTypedObject      = 0x10
+	TypeAVMPlus          = 0x11 // the value that follows is encoded in AMF3
 )
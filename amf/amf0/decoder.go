@@ -10,57 +10,278 @@ import (
 	"time"
 )
 
+var ErrTruncated error = errors.New("amf0: truncated value")
+var ErrInvalidReference error = errors.New("amf0: invalid reference")
+
 // Decode returns the original form of the encoded value, or an error if any occurred.
-// Possible return types: float64, bool, string, map[string]any, nil, amf0.ECMAArray, time.Time
-// If the contents of b represent a Number (either int or float), it will be returned as a float64
+// Possible return types: float64, bool, string, map[string]any, nil, amf0.ECMAArray, []any, time.Time,
+// amf0.TypedObject, amf0.XMLDocument, amf0.ObjectEnd, amf0.Undefined, or any type returned by amf3.Decode for values that switch to AMF3
+// (see TypeAVMPlus)
+// If the contents of b represent a Number (either int or float), it will be returned as a float64.
+// Long strings are returned as strings. Null and unsupported values are returned as nil, and undefined values as
+// Undefined{} (see Undefined). References are returned as the object, ECMA array or strict array they refer to, decoded
+// earlier in bytes (or by the same Decoder), and a reference to a value that contains it is returned as nil.
 func Decode(bytes []byte) (any, error) {
+	value, _, err := DecodeNext(bytes)
+	return value, err
+}
+
+// DecodeNext decodes the value at the beginning of bytes like Decode, and also returns the number of bytes it spans.
+// Unlike Size, the number of bytes is the one actually read, so it's accurate even for values that have more than one
+// encoding (eg: short strings encoded as long strings, or unsupported values decoded as nil).
+func DecodeNext(bytes []byte) (value any, n int, err error) {
+	return decodeNext(bytes, false)
+}
+
+// DecodeOrdered is like DecodeNext, but decodes objects and ECMA arrays (including the ones nested in other values) as
+// OrderedObject and OrderedECMAArray, which keep the order of their properties. Encoding the returned value produces
+// the same bytes as the ones decoded, as long as strings are encoded with their shortest form.
+func DecodeOrdered(bytes []byte) (value any, n int, err error) {
+	return decodeNext(bytes, true)
+}
+
+func decodeNext(bytes []byte, ordered bool) (value any, n int, err error) {
+	src := &sliceSource{bytes: bytes}
+	d := decoder{src: src, ordered: ordered}
+	value, err = d.decodeValue()
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, src.pos, nil
+}
+
+// decoder decodes values from a source, which is either a byte slice or a reader (see Decoder).
+type decoder struct {
+	src source
+	// Decode objects and ECMA arrays as OrderedObject and OrderedECMAArray
+	ordered bool
+	// Objects, typed objects, ECMA arrays and strict arrays decoded, in the order they started, which references
+	// (TypeReference) refer to by index. Values still being decoded are nil.
+	references []any
+}
+
+// decodeComplex decodes a value that references can refer to with decode, and adds it to the references.
+func (d *decoder) decodeComplex(decode func() (any, error)) (any, error) {
+	index := len(d.references)
+	d.references = append(d.references, nil)
+	value, err := decode()
+	if err != nil {
+		return nil, err
+	}
+	d.references[index] = value
+	return value, nil
+}
+
+func (d *decoder) decodeReference() (any, error) {
+	b, err := d.src.read(2)
+	if err != nil {
+		return nil, err
+	}
+	index := int(binary.BigEndian.Uint16(b))
+	if index >= len(d.references) {
+		return nil, fmt.Errorf("%w: %d, %d objects decoded", ErrInvalidReference, index, len(d.references))
+	}
+	return d.references[index], nil
+}
+
+func (d *decoder) decodeValue() (any, error) {
 	// End of object
-	if bytes[0] == 0x00 && bytes[1] == 0x00 && bytes[2] == TypeObjectEnd {
+	if isEndOfObject(d.src.peek(3)) {
+		d.src.read(3)
 		return ObjectEnd{}, nil
 	}
-	switch bytes[0] {
+	marker, err := d.src.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch marker {
 	case TypeNumber:
-		return decodeNumber(bytes[1:]), nil
+		b, err := d.src.read(8)
+		if err != nil {
+			return nil, err
+		}
+		return decodeNumber(b), nil
 	case TypeBoolean:
-		return decodeBoolean(bytes[1]), nil
+		b, err := d.src.readByte()
+		if err != nil {
+			return nil, err
+		}
+		return decodeBoolean(b), nil
 	case TypeString:
-		length := uint32(binary.BigEndian.Uint16(bytes[1:3]))
-		return decodeString(bytes[3:], length), nil
+		return d.decodeShortString()
 	case TypeLongString:
-		length := binary.BigEndian.Uint32(bytes[1:5])
-		return decodeString(bytes[5:], length), nil
+		return d.decodeLongString()
+	case TypeXMLDocument:
+		s, err := d.decodeLongString()
+		if err != nil {
+			return nil, err
+		}
+		return XMLDocument(s), nil
 	case TypeObject:
-		return decodeObject(bytes[1:]), nil
-	case TypeNull:
+		return d.decodeComplex(func() (any, error) {
+			p, err := d.decodeProperties()
+			if err != nil {
+				return nil, err
+			}
+			if d.ordered {
+				return OrderedObject(p), nil
+			}
+			return p.toMap(), nil
+		})
+	case TypeTypedObject:
+		return d.decodeComplex(func() (any, error) {
+			className, err := d.decodeShortString()
+			if err != nil {
+				return nil, err
+			}
+			p, err := d.decodeProperties()
+			if err != nil {
+				return nil, err
+			}
+			return TypedObject{ClassName: className, Properties: p.toMap()}, nil
+		})
+	case TypeNull, TypeUnsupported:
 		return nil, nil
+	case TypeUndefined:
+		return Undefined{}, nil
+	case TypeReference:
+		return d.decodeReference()
 	case TypeECMAArray:
-		return decodeECMAArray(bytes[1:]), nil
+		return d.decodeComplex(func() (any, error) {
+			p, err := d.decodeECMAArray()
+			if err != nil {
+				return nil, err
+			}
+			if d.ordered {
+				return OrderedECMAArray(p), nil
+			}
+			return ECMAArray(p.toMap()), nil
+		})
+	case TypeStrictArray:
+		return d.decodeComplex(func() (any, error) {
+			return d.decodeStrictArray()
+		})
+	case TypeAVMPlus:
+		return d.src.decodeAMF3()
 	case TypeDate:
-		return decodeDate(bytes[1:]), nil
+		b, err := d.src.read(10)
+		if err != nil {
+			return nil, err
+		}
+		return decodeDate(b), nil
 	default:
-		return nil, errors.New(fmt.Sprintf("cannot decode type with header 0x%v (unsupported type)", hex.EncodeToString(bytes[0:1])))
+		return nil, errors.New(fmt.Sprintf("cannot decode type with header 0x%v (unsupported type)", hex.EncodeToString([]byte{marker})))
+	}
+}
+
+func (d *decoder) decodeECMAArray() (properties, error) {
+	b, err := d.src.read(4)
+	if err != nil {
+		return nil, err
+	}
+	// Number of properties the array has. Some encoders don't set it, so the properties are decoded until the end of
+	// object marker instead, like in objects.
+	associativeCount := binary.BigEndian.Uint32(b)
+	var ret properties
+	for {
+		next := d.src.peek(3)
+		if isEndOfObject(next) {
+			d.src.read(3)
+			return ret, nil
+		}
+		// Some encoders omit the end of object marker after the last property
+		if len(next) == 0 && uint32(len(ret)) >= associativeCount {
+			return ret, nil
+		}
+		key, val, err := d.decodeProperty()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, Property{Key: key, Value: val})
+	}
+}
+
+func (d *decoder) decodeStrictArray() ([]any, error) {
+	b, err := d.src.read(4)
+	if err != nil {
+		return nil, err
+	}
+	count := binary.BigEndian.Uint32(b)
+	// Don't trust the count to preallocate, every value spans at least 1 byte
+	capacity := d.src.remaining()
+	if capacity < 0 {
+		capacity = maxUnknownCapacity
 	}
+	if uint64(count) < uint64(capacity) {
+		capacity = int(count)
+	}
+	ret := make([]any, 0, capacity)
+	for i := uint32(0); i < count; i++ {
+		val, err := d.decodeValue()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, val)
+	}
+	return ret, nil
 }
 
-func decodeECMAArray(bytes []byte) ECMAArray {
-	ret := make(ECMAArray)
-	// Number of properties the object has
-	associativeCount := binary.BigEndian.Uint32(bytes[:4])
-	// Set the bytes slice to the first key
-	bytes = bytes[4:]
-	for i := uint32(0); i < associativeCount; i++ {
-		// Decode the key. Keys are always strings
-		keyLength := binary.BigEndian.Uint16(bytes) // First 2 bytes contain string length
-		key := decodeString(bytes[2:], uint32(keyLength))
-		// Update slice to start at next value
-		bytes = bytes[Size(key)-1:] // -1 because keys don't have the string header
+// decodeProperties decodes the properties of an object until (and including) the end of object marker.
+func (d *decoder) decodeProperties() (properties, error) {
+	var p properties
+	// Decode until an end of object is reached
+	for {
+		if isEndOfObject(d.src.peek(3)) {
+			d.src.read(3)
+			return p, nil
+		}
+		key, val, err := d.decodeProperty()
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, Property{Key: key, Value: val})
+	}
+}
+
+// decodeProperty decodes a key (always a string without the TypeString header) and its value.
+func (d *decoder) decodeProperty() (key string, val any, err error) {
+	key, err = d.decodeShortString()
+	if err != nil {
+		return "", nil, err
+	}
+	val, err = d.decodeValue()
+	if err != nil {
+		return "", nil, err
+	}
+	return key, val, nil
+}
 
-		val, _ := Decode(bytes)
-		ret[key] = val
-		// Update slice to start at next key
-		bytes = bytes[Size(val):]
+// decodeShortString decodes a string with a 2 bytes length (without the type header).
+func (d *decoder) decodeShortString() (string, error) {
+	b, err := d.src.read(2)
+	if err != nil {
+		return "", err
+	}
+	length := uint32(binary.BigEndian.Uint16(b))
+	b, err = d.src.read(int(length))
+	if err != nil {
+		return "", err
 	}
-	return ret
+	return decodeString(b, length), nil
+}
+
+// decodeLongString decodes a string with a 4 bytes length (without the type header).
+func (d *decoder) decodeLongString() (string, error) {
+	b, err := d.src.read(4)
+	if err != nil {
+		return "", err
+	}
+	length := binary.BigEndian.Uint32(b)
+	b, err = d.src.read(int(length))
+	if err != nil {
+		return "", err
+	}
+	return decodeString(b, length), nil
 }
 
 // Size returns the number of bytes the value v has in its AMF0 representation.
@@ -85,64 +306,71 @@ func Size(v any) uint64 {
 			// If it is a long string, its Size is 5 + n (5 header bytes + string Size)
 			return 5 + length
 		}
+	case XMLDocument:
+		// XML documents are always encoded like long strings
+		return 5 + uint64(len(v.(XMLDocument)))
 	case map[string]any:
-		// Calculate object Size recursively
-		var objSize uint64
-		for k, val := range v.(map[string]any) {
-			objSize += Size(k) - 1 // objects don't store the TypeString (0x02) header in the key
-			objSize += Size(val)
-		}
-		return objSize + 4 // Objects have a header of 1 byte and trailing marker of 3 bytes (0x00 0x00 0x09)
-	case nil:
-		// nil/null has a Size of 1
+		// Objects have a header of 1 byte and trailing marker of 3 bytes (0x00 0x00 0x09)
+		return propertiesSize(v.(map[string]any)) + 4
+	case TypedObject:
+		// Typed objects are objects preceded by their class name (without the TypeString header)
+		typedObject := v.(TypedObject)
+		return Size(typedObject.ClassName) - 1 + propertiesSize(typedObject.Properties) + 4
+	case nil, Undefined:
+		// nil/null and undefined have a Size of 1
 		return 1
+	case OrderedObject:
+		return orderedPropertiesSize(v.(OrderedObject)) + 4
 	case ECMAArray:
-		var objSize uint64
-		for k, val := range v.(ECMAArray) {
-			objSize += Size(k)
-			objSize += Size(val)
+		// ECMA arrays have a header of 5 bytes (1 byte to indicate ECMArray type, followed by 4 bytes for the associative count)
+		// and the same trailing marker as objects (3 bytes)
+		return propertiesSize(v.(ECMAArray)) + 8
+	case OrderedECMAArray:
+		return orderedPropertiesSize(v.(OrderedECMAArray)) + 8
+	case []any:
+		// Strict arrays have a header of 5 bytes (1 byte to indicate the type, followed by 4 bytes for the count)
+		size := uint64(5)
+		for _, val := range v.([]any) {
+			size += Size(val)
 		}
-		return objSize + 5 // Objects have a header of 5 bytes (1 byte to indicate ECMArray type, followed by 4 bytes for the associative count)
+		return size
 	case time.Time:
 		// Dates have 11 bytes
 		return 11
+	case ObjectEnd:
+		return 3
 	default:
 		return 0
 	}
 }
 
-func isEndOfObject(bytes []byte) bool {
-	return len(bytes) >= 3 && bytes[0] == 0x00 && bytes[1] == 0x00 && bytes[2] == TypeObjectEnd
+// propertiesSize returns the number of bytes of the properties of an object, without its header and trailing marker.
+func propertiesSize(m map[string]any) uint64 {
+	var size uint64
+	for k, val := range m {
+		size += Size(k) - 1 // keys don't store the TypeString (0x02) header
+		size += Size(val)
+	}
+	return size
 }
 
-func decodeObject(bytes []byte) map[string]any {
-	m := make(map[string]any)
-
-	// Decode until an end of object is reached
-	for {
-		// Decode key. Key is always a string, unless it is the end of an object
-		if isEndOfObject(bytes) {
-			return m
-		}
-		keyLength := binary.BigEndian.Uint16(bytes)
-		key := decodeString(bytes[2:], uint32(keyLength))
-		// Break out of the loop when we reach the end of an object
-		//if _, isEndOfObject := key.(ObjectEnd); isEndOfObject {
-		//	break
-		//}
-		// Update slice to start at next value (skip the first 2 bytes that indicate the string length + the string itself)
-		bytes = bytes[2+keyLength:]
-		// Decode value
-		val, _ := Decode(bytes)
-		m[key] = val
-		// Update our slice to start at the next key
-		bytes = bytes[Size(val):]
+func orderedPropertiesSize(p []Property) uint64 {
+	var size uint64
+	for _, property := range p {
+		size += Size(property.Key) - 1
+		size += Size(property.Value)
 	}
+	return size
+}
+
+func isEndOfObject(bytes []byte) bool {
+	return len(bytes) >= 3 && bytes[0] == 0x00 && bytes[1] == 0x00 && bytes[2] == TypeObjectEnd
 }
 
 func decodeDate(bytes []byte) time.Time {
-	milliseconds := int64(binary.BigEndian.Uint64(bytes))
-	return time.Unix(0, milliseconds*1000000)
+	// The 2 bytes of time zone that follow the milliseconds are ignored, as recommended by the spec
+	milliseconds := int64(decodeNumber(bytes))
+	return time.UnixMilli(milliseconds)
 }
 
 func decodeString(bytes []byte, length uint32) string {
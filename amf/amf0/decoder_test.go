@@ -0,0 +1,91 @@
+package amf0
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecodeNext(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want any
+	}{
+		{"number", []byte{TypeNumber, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0}, 1.0},
+		{"boolean", []byte{TypeBoolean, 1}, true},
+		{"string", []byte{TypeString, 0, 2, 'h', 'i'}, "hi"},
+		{"long string", []byte{TypeLongString, 0, 0, 0, 2, 'h', 'i'}, "hi"},
+		{"object", []byte{TypeObject, 0, 1, 'n', TypeNull, 0, 0, TypeObjectEnd}, map[string]any{"n": nil}},
+		{"null", []byte{TypeNull}, nil},
+		{"undefined", []byte{TypeUndefined}, Undefined{}},
+		{"ECMA array", []byte{TypeECMAArray, 0, 0, 0, 1, 0, 1, 'a', TypeBoolean, 1, 0, 0, TypeObjectEnd}, ECMAArray{"a": true}},
+		// Some encoders leave the associative count at 0, or omit the end of object marker
+		{"ECMA array without count", []byte{TypeECMAArray, 0, 0, 0, 0, 0, 1, 'a', TypeNull, 0, 0, TypeObjectEnd}, ECMAArray{"a": nil}},
+		{"ECMA array without end", []byte{TypeECMAArray, 0, 0, 0, 1, 0, 1, 'a', TypeNull}, ECMAArray{"a": nil}},
+		{"object end", []byte{0, 0, TypeObjectEnd}, ObjectEnd{}},
+		{"strict array", []byte{TypeStrictArray, 0, 0, 0, 2, TypeString, 0, 1, 'x', TypeNull}, []any{"x", nil}},
+		{"date", []byte{TypeDate, 0x42, 0x77, 0x48, 0x76, 0xe8, 0, 0, 0, 0, 0}, time.UnixMilli(1600000000000)},
+		{"XML document", []byte{TypeXMLDocument, 0, 0, 0, 3, '<', 'a', '>'}, XMLDocument("<a>")},
+		{"typed object", []byte{TypeTypedObject, 0, 1, 'C', 0, 1, 'k', TypeBoolean, 0, 0, 0, TypeObjectEnd}, TypedObject{"C", map[string]any{"k": false}}},
+		{
+			// {"a": {"n": null}, "b": <reference to a>}
+			"reference",
+			[]byte{TypeObject, 0, 1, 'a', TypeObject, 0, 1, 'n', TypeNull, 0, 0, TypeObjectEnd, 0, 1, 'b', TypeReference, 0, 1, 0, 0, TypeObjectEnd},
+			map[string]any{"a": map[string]any{"n": nil}, "b": map[string]any{"n": nil}},
+		},
+		{
+			// [[true], <reference to the nested array>]
+			"reference to a strict array",
+			[]byte{TypeStrictArray, 0, 0, 0, 2, TypeStrictArray, 0, 0, 0, 1, TypeBoolean, 1, TypeReference, 0, 1},
+			[]any{[]any{true}, []any{true}},
+		},
+		{
+			// An object referring to itself, whose decoding isn't complete
+			"reference to the value being decoded",
+			[]byte{TypeObject, 0, 1, 's', TypeReference, 0, 0, 0, 0, TypeObjectEnd},
+			map[string]any{"s": nil},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, n, err := DecodeNext(test.data)
+			if err != nil {
+				t.Fatalf("DecodeNext() = %v", err)
+			}
+			if !reflect.DeepEqual(value, test.want) || n != len(test.data) {
+				t.Errorf("DecodeNext() = %#v (%d bytes), want %#v (%d bytes)", value, n, test.want, len(test.data))
+			}
+		})
+	}
+}
+
+func TestDecodeInvalidReference(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no object decoded", []byte{TypeReference, 0, 0}},
+		{"index out of range", []byte{TypeStrictArray, 0, 0, 0, 2, TypeObject, 0, 0, TypeObjectEnd, TypeReference, 0, 2}},
+		{"truncated", []byte{TypeReference, 0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := DecodeNext(test.data); !errors.Is(err, ErrInvalidReference) && !errors.Is(err, ErrTruncated) {
+				t.Errorf("DecodeNext() = %v, want ErrInvalidReference or ErrTruncated", err)
+			}
+		})
+	}
+	// The references of a decoder span the values it decodes
+	d := NewDecoder(bytes.NewReader([]byte{TypeObject, 0, 0, TypeObjectEnd, TypeReference, 0, 0, TypeReference, 0, 1}))
+	for i, want := range []any{map[string]any{}, map[string]any{}} {
+		if value, err := d.Decode(); err != nil || !reflect.DeepEqual(value, want) {
+			t.Fatalf("Decode() of value %d = %v, %v, want %v", i, value, err, want)
+		}
+	}
+	if _, err := d.Decode(); !errors.Is(err, ErrInvalidReference) {
+		t.Errorf("Decode() of a reference to an object that wasn't decoded = %v, want ErrInvalidReference", err)
+	}
+}
@@ -6,9 +6,16 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"reflect"
+	"sort"
 	"time"
 )
 
+// Encode returns the AMF0 encoding of v. Numbers of any Go numeric type are encoded as numbers, strings as strings
+// (or long strings if they don't fit in a string), maps with string keys as objects, slices and arrays as strict
+// arrays, nil as null, Undefined{} as undefined, and time.Time as a date. ECMAArray, TypedObject and XMLDocument values are encoded as their
+// own types, and OrderedObject and OrderedECMAArray values as objects and ECMA arrays, in the order of their properties.
+// The properties of maps are encoded sorted by key, so that a value always has the same encoding.
 func Encode(v any) ([]byte, error) {
 	switch v.(type) {
 	case float64:
@@ -20,39 +27,138 @@ func Encode(v any) ([]byte, error) {
 	case string:
 		return encodeString(v.(string)), nil
 	case map[string]any:
-		return encodeObject(v.(map[string]any)), nil
+		return encodeObject(v.(map[string]any))
 	case nil:
 		return encodeNull(), nil
+	case Undefined:
+		return []byte{TypeUndefined}, nil
 	case ECMAArray:
-		return encodeECMAArray(v.(ECMAArray)), nil
+		return encodeECMAArray(v.(ECMAArray))
+	case OrderedObject:
+		return encodeOrderedObject(v.(OrderedObject))
+	case OrderedECMAArray:
+		return encodeOrderedECMAArray(v.(OrderedECMAArray))
+	case []any:
+		return encodeStrictArray(v.([]any))
+	case TypedObject:
+		return encodeTypedObject(v.(TypedObject))
+	case XMLDocument:
+		return encodeXMLDocument(v.(XMLDocument)), nil
 	case time.Time:
 		return encodeDate(v.(time.Time)), nil
 	default:
-		return nil, errors.New(fmt.Sprintf("cannot encode type %T", v))
+		return encodeReflect(v)
 	}
 }
 
+// encodeReflect encodes the values of named and composite types that Encode doesn't list (eg: amf.Metadata,
+// map[string]string, []string, or a named string type), as the AMF0 type of their underlying type.
+func encodeReflect(v any) ([]byte, error) {
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			break
+		}
+		m := make(map[string]any, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = iter.Value().Interface()
+		}
+		return encodeObject(m)
+	case reflect.Slice, reflect.Array:
+		values := make([]any, value.Len())
+		for i := range values {
+			values[i] = value.Index(i).Interface()
+		}
+		return encodeStrictArray(values)
+	case reflect.String:
+		return encodeString(value.String()), nil
+	case reflect.Bool:
+		return encodeBoolean(value.Bool()), nil
+	case reflect.Float32, reflect.Float64:
+		return encodeNumber(value.Float()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return encodeNumber(float64(value.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return encodeNumber(float64(value.Uint())), nil
+	}
+	return nil, errors.New(fmt.Sprintf("cannot encode type %T", v))
+}
+
 func encodeDate(t time.Time) []byte {
-	timestamp := t.UnixNano() / 1000000
 	var buf [11]byte
 	buf[0] = TypeDate
-	binary.BigEndian.PutUint64(buf[1:], uint64(timestamp))
+	// Milliseconds since the Unix epoch, as a number
+	binary.BigEndian.PutUint64(buf[1:], math.Float64bits(float64(t.UnixMilli())))
 	// Last 2 bytes are time zone (which should stay with a value of 0 as defined by the spec)
 
 	return buf[:]
 }
 
-func encodeECMAArray(ecmaArray ECMAArray) []byte {
-	obj := encodeObject(ecmaArray)
-	// The actual payload of the object is the length of the object buffer, minus the header byte (1 byte) and the endObject bytes (3 bytes).
-	objPayloadLength := len(obj) - 4
+func encodeECMAArray(ecmaArray ECMAArray) ([]byte, error) {
+	obj, err := encodeObject(ecmaArray)
+	if err != nil {
+		return nil, err
+	}
+	return ecmaArrayFromObject(obj, len(ecmaArray)), nil
+}
+
+func encodeOrderedECMAArray(ecmaArray OrderedECMAArray) ([]byte, error) {
+	obj, err := encodeOrderedObject(OrderedObject(ecmaArray))
+	if err != nil {
+		return nil, err
+	}
+	return ecmaArrayFromObject(obj, len(ecmaArray)), nil
+}
+
+// ecmaArrayFromObject turns the encoding of an object into the one of an ECMA array with the same properties.
+func ecmaArrayFromObject(obj []byte, associativeCount int) []byte {
+	// The actual payload of the object is the length of the object buffer, minus the header byte (1 byte). ECMA arrays
+	// end with the same endObject bytes (3 bytes) as objects.
+	objPayloadLength := len(obj) - 1
 	// An ECMA Array is an object that has additional information (associative count - 4 bytes, this is the number of keys)
 	buf := make([]byte, 1+4+objPayloadLength)
 	buf[0] = TypeECMAArray
 	// Put the associative count (how many keys the object has)
-	binary.BigEndian.PutUint32(buf[1:5], uint32(len(ecmaArray)))
-	// Copy the object's payload (starts at byte 1 to ignore the header of the object
-	copy(buf[5:], obj[1:1+objPayloadLength])
+	binary.BigEndian.PutUint32(buf[1:5], uint32(associativeCount))
+	// Copy the object's payload (starts at byte 1 to ignore the header of the object)
+	copy(buf[5:], obj[1:])
+	return buf
+}
+
+func encodeStrictArray(values []any) ([]byte, error) {
+	buf := make([]byte, 5)
+	buf[0] = TypeStrictArray
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(values)))
+	for _, value := range values {
+		encoded, err := Encode(value)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, encoded...)
+	}
+	return buf, nil
+}
+
+func encodeTypedObject(typedObject TypedObject) ([]byte, error) {
+	className := encodeString(typedObject.ClassName)
+	obj, err := encodeObject(typedObject.Properties)
+	if err != nil {
+		return nil, err
+	}
+	// The class name (without its TypeString header) goes between the header and the properties of the object
+	buf := make([]byte, 0, len(className)-1+len(obj))
+	buf = append(buf, TypeTypedObject)
+	buf = append(buf, className[1:]...)
+	return append(buf, obj[1:]...), nil
+}
+
+func encodeXMLDocument(document XMLDocument) []byte {
+	buf := make([]byte, 5+len(document))
+	buf[0] = TypeXMLDocument
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(document)))
+	copy(buf[5:], document)
 	return buf
 }
 
@@ -62,18 +168,47 @@ func encodeNull() []byte {
 	return buf[:]
 }
 
-func encodeObject(m map[string]any) []byte {
-	buf := &bytes.Buffer{}
+func encodeObject(m map[string]any) ([]byte, error) {
+	keys := make([]string, 0, len(m))
 	for key := range m {
-		// Encode property name
-		prop, _ := Encode(key)
-		// keys should not encode the type (ie. the TypeString header), it is assumed that keys are always normal strings (len(string) < 65535)
-		buf.Write(prop[1:])
-		// Encode property value
-		val, _ := Encode(m[key])
-		buf.Write(val)
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	buf := &bytes.Buffer{}
+	for _, key := range keys {
+		if err := encodeProperty(buf, key, m[key]); err != nil {
+			return nil, err
+		}
+	}
+	return objectFromProperties(buf), nil
+}
+
+func encodeOrderedObject(o OrderedObject) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	for _, property := range o {
+		if err := encodeProperty(buf, property.Key, property.Value); err != nil {
+			return nil, err
+		}
 	}
+	return objectFromProperties(buf), nil
+}
+
+func encodeProperty(buf *bytes.Buffer, key string, value any) error {
+	// Encode property name
+	prop := encodeString(key)
+	// keys should not encode the type (ie. the TypeString header), it is assumed that keys are always normal strings (len(string) < 65535)
+	buf.Write(prop[1:])
+	// Encode property value
+	val, err := Encode(value)
+	if err != nil {
+		return err
+	}
+	buf.Write(val)
+	return nil
+}
 
+// objectFromProperties returns the encoding of an object with the properties encoded in buf.
+func objectFromProperties(buf *bytes.Buffer) []byte {
 	buf.Write(encodeObjectEnd())
 	obj := make([]byte, 1+buf.Len())
 	obj[0] = TypeObject
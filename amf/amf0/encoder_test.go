@@ -0,0 +1,34 @@
+package amf0
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestEncodeSortedProperties checks that maps are encoded with their properties sorted by key, whatever the order Go
+// iterates over them in.
+func TestEncodeSortedProperties(t *testing.T) {
+	m := map[string]any{"width": 1280.0, "height": 720.0, "framerate": 30.0, "duration": 0.0, "audiocodecid": 10.0}
+	want := []byte{TypeObject}
+	for _, key := range []string{"audiocodecid", "duration", "framerate", "height", "width"} {
+		want = append(want, encodeString(key)[1:]...)
+		want = append(want, encodeNumber(m[key].(float64))...)
+	}
+	want = append(want, 0, 0, TypeObjectEnd)
+	for i := 0; i < 20; i++ {
+		encoded, err := Encode(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, want) {
+			t.Fatalf("Encode() = %x, want %x", encoded, want)
+		}
+	}
+	encoded, err := Encode(ECMAArray(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded[5:], want[1:]) {
+		t.Errorf("Encode() of an ECMA array = %x, want its properties sorted like %x", encoded, want)
+	}
+}
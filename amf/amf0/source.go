@@ -0,0 +1,146 @@
+package amf0
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/codingpa-ws/rtmp/amf/amf3"
+)
+
+// Capacity preallocated for strict arrays when the number of bytes left is unknown (ie. when decoding from a reader)
+const maxUnknownCapacity = 64
+
+// source is what a decoder reads values from.
+type source interface {
+	readByte() (byte, error)
+	// read returns the next n bytes. The returned slice is only valid until the next read.
+	read(n int) ([]byte, error)
+	// peek returns the next n bytes without consuming them, or less if the source ends before.
+	peek(n int) []byte
+	// remaining returns the number of bytes left, or -1 if it's unknown.
+	remaining() int
+	// decodeAMF3 decodes the AMF3 value that follows an AVM+ marker.
+	decodeAMF3() (any, error)
+}
+
+type sliceSource struct {
+	bytes []byte
+	pos   int
+}
+
+func (s *sliceSource) readByte() (byte, error) {
+	if s.pos >= len(s.bytes) {
+		return 0, ErrTruncated
+	}
+	b := s.bytes[s.pos]
+	s.pos++
+	return b, nil
+}
+
+func (s *sliceSource) read(n int) ([]byte, error) {
+	if n < 0 || n > len(s.bytes)-s.pos {
+		return nil, ErrTruncated
+	}
+	b := s.bytes[s.pos : s.pos+n]
+	s.pos += n
+	return b, nil
+}
+
+func (s *sliceSource) peek(n int) []byte {
+	if n > len(s.bytes)-s.pos {
+		n = len(s.bytes) - s.pos
+	}
+	return s.bytes[s.pos : s.pos+n]
+}
+
+func (s *sliceSource) remaining() int {
+	return len(s.bytes) - s.pos
+}
+
+func (s *sliceSource) decodeAMF3() (any, error) {
+	value, n, err := amf3.DecodeNext(s.bytes[s.pos:])
+	if err != nil {
+		return nil, err
+	}
+	s.pos += n
+	return value, nil
+}
+
+type readerSource struct {
+	reader *bufio.Reader
+}
+
+func (s *readerSource) readByte() (byte, error) {
+	b, err := s.reader.ReadByte()
+	return b, truncated(err)
+}
+
+func (s *readerSource) read(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, ErrTruncated
+	}
+	// Lengths can't be trusted to allocate the buffer upfront, so it grows as the bytes are actually read
+	b, err := io.ReadAll(io.LimitReader(s.reader, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < n {
+		return nil, truncated(io.EOF)
+	}
+	return b, nil
+}
+
+func (s *readerSource) peek(n int) []byte {
+	b, _ := s.reader.Peek(n)
+	return b
+}
+
+func (s *readerSource) remaining() int {
+	return -1
+}
+
+func (s *readerSource) decodeAMF3() (any, error) {
+	return amf3.NewDecoder(s.reader).Decode()
+}
+
+// truncated reports the end of the reader in the middle of a value as ErrTruncated (and io.ErrUnexpectedEOF).
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: %w", ErrTruncated, io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// Decoder decodes AMF0 values one after the other from a reader, such as the name, transaction ID and command object
+// of a command, without having to read all of them first.
+type Decoder struct {
+	decoder
+	reader *bufio.Reader
+}
+
+// NewDecoder returns a decoder reading from r. The decoder buffers r (unless it's a *bufio.Reader), so it may read
+// more bytes from r than the values it decodes span: r should end with the last value (eg: the payload of a message).
+func NewDecoder(r io.Reader) *Decoder {
+	reader, ok := r.(*bufio.Reader)
+	if !ok {
+		reader = bufio.NewReader(r)
+	}
+	return &Decoder{decoder: decoder{src: &readerSource{reader: reader}}, reader: reader}
+}
+
+// More returns whether there's another value to decode, eg: an optional argument of a command.
+func (d *Decoder) More() bool {
+	_, err := d.reader.Peek(1)
+	return err == nil
+}
+
+// Decode decodes the next value, like Decode. It returns io.EOF if there are no more values, and an error wrapping
+// ErrTruncated if the reader ends in the middle of a value.
+func (d *Decoder) Decode() (any, error) {
+	if _, err := d.reader.Peek(1); err != nil {
+		return nil, err
+	}
+	return d.decodeValue()
+}
@@ -0,0 +1,59 @@
+package amf0
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+// encodeValues encodes values one after the other, like the name, transaction ID, command object and arguments of a
+// command.
+func encodeValues(t *testing.T, values ...any) []byte {
+	t.Helper()
+	var encoded []byte
+	for _, value := range values {
+		b, err := Encode(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, b...)
+	}
+	return encoded
+}
+
+func TestDecoder(t *testing.T) {
+	values := []any{"publish", 5.0, nil, "live", map[string]any{"app": "live", "tcUrl": "rtmp://localhost/live"}}
+	command := encodeValues(t, values...)
+	// A reader returning a byte at a time makes values span multiple reads
+	d := NewDecoder(iotest.OneByteReader(bytes.NewReader(command)))
+	var decoded []any
+	for d.More() {
+		value, err := d.Decode()
+		if err != nil {
+			t.Fatalf("Decode() = %v after %v", err, decoded)
+		}
+		decoded = append(decoded, value)
+	}
+	if !reflect.DeepEqual(decoded, values) {
+		t.Errorf("decoded %v, want %v", decoded, values)
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("Decode() after the last value = %v, want io.EOF", err)
+	}
+}
+
+func TestDecoderTruncated(t *testing.T) {
+	command := encodeValues(t, "connect", 1.0, map[string]any{"app": "live"})
+	d := NewDecoder(bytes.NewReader(command[:len(command)-4]))
+	for i := 0; i < 2; i++ {
+		if _, err := d.Decode(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.Decode(); !errors.Is(err, ErrTruncated) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Decode() of a truncated object = %v, want ErrTruncated", err)
+	}
+}
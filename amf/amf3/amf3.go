@@ -5,6 +5,29 @@ const MinInt int = -268435456
 
 const UTF8Empty byte = 0x01
 
+// Undefined is the undefined value. Unlike null, which is decoded as nil, undefined is decoded as Undefined{}, which is
+// encoded back as undefined.
+type Undefined struct{}
+
+// TypedObject is an object of a registered class, like the objects of the ActionScript classes sent by Flash clients.
+// Objects of anonymous classes are decoded as map[string]any instead.
+type TypedObject struct {
+	ClassName  string
+	Properties map[string]any
+}
+
+// Array is an array with an associative part. Arrays that only have a dense part are decoded as []any instead.
+type Array struct {
+	Associative map[string]any
+	Dense       []any
+}
+
+// XMLDocument is the source of a legacy XML document (flash.xml.XMLDocument).
+type XMLDocument string
+
+// XML is the source of an E4X XML document.
+type XML string
+
 const (
 	TypeUndefined    byte = 0x00
 	TypeNull              = 0x01
@@ -1,27 +1,384 @@
 package amf3
 
-//func Decode(bytes []byte) (any, error) {
-//	switch bytes[0] {
-//	case TypeInteger:
-//		return decodeInteger(bytes[1:]), nil
-//	default:
-//		return nil, errors.New(fmt.Sprintf("cannot decode type with header 0x%v (unsupported type)", hex.EncodeToString(bytes[0:1])))
-//	}
-//}
-
-//func decodeInteger(bytes []byte) int32 {
-//	var i int32
-//	var buf [4]byte
-//	useNext := true
-//	useNextMask := 0x80
-//	count := 0
-//	for useNext {
-//		buf[count] :=
-//		if int(bytes[i]) & useNextMask == 0 {
-//			useNext = false
-//		}
-//		count++
-//	}
-//
-//	return i
-//}
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+var ErrTruncated error = errors.New("amf3: truncated value")
+var ErrInvalidReference error = errors.New("amf3: invalid reference")
+var ErrExternalizable error = errors.New("amf3: cannot decode externalizable object")
+
+// Decode returns the original form of the encoded value, or an error if any occurred.
+// Possible return types: int, float64, bool, string, nil, time.Time, []byte, []any, map[string]any, amf3.Array,
+// amf3.TypedObject, amf3.XMLDocument, amf3.XML, amf3.Undefined
+// Integers are returned as int and doubles as float64. Null values are returned as nil, and undefined values as
+// Undefined{}.
+func Decode(bytes []byte) (any, error) {
+	value, _, err := DecodeNext(bytes)
+	return value, err
+}
+
+// DecodeNext decodes the value at the beginning of bytes like Decode, and also returns the number of bytes it spans.
+// The reference tables (strings, objects and traits) start empty, as they do for every AMF3 value embedded in AMF0
+// (after the AVM+ marker).
+func DecodeNext(bytes []byte) (value any, n int, err error) {
+	src := &sliceSource{bytes: bytes}
+	d := &decoder{src: src}
+	value, err = d.decodeValue()
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, src.pos, nil
+}
+
+// traits describe the class of an object: its name and the names of its sealed members, which are sent before its
+// values. They're only sent once per message, objects of the same class reference them afterwards.
+type traits struct {
+	className      string
+	dynamic        bool
+	externalizable bool
+	members        []string
+}
+
+type decoder struct {
+	src source
+	// Reference tables. Strings, complex values and traits are sent once, and referenced by their index afterwards.
+	strings []string
+	objects []any
+	traits  []*traits
+}
+
+func (d *decoder) decodeValue() (any, error) {
+	marker, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeMarked(marker)
+}
+
+// decodeMarked decodes the value that follows its type marker.
+func (d *decoder) decodeMarked(marker byte) (any, error) {
+	switch marker {
+	case TypeUndefined:
+		return Undefined{}, nil
+	case TypeNull:
+		return nil, nil
+	case TypeFalse:
+		return false, nil
+	case TypeTrue:
+		return true, nil
+	case TypeInteger:
+		u, err := d.readU29()
+		if err != nil {
+			return nil, err
+		}
+		// Integers are 29 bits signed integers
+		if u&0x10000000 != 0 {
+			return int(u) - 0x20000000, nil
+		}
+		return int(u), nil
+	case TypeDouble:
+		return d.readDouble()
+	case TypeString:
+		return d.readString()
+	case TypeXmlDoc, TypeXml:
+		return d.decodeXML(marker)
+	case TypeDate:
+		return d.decodeDate()
+	case TypeArray:
+		return d.decodeArray()
+	case TypeObject:
+		return d.decodeObject()
+	case TypeByteArray:
+		return d.decodeByteArray()
+	default:
+		return nil, errors.New(fmt.Sprintf("cannot decode type with header 0x%v (unsupported type)", hex.EncodeToString([]byte{marker})))
+	}
+}
+
+// readHeader reads the U29 header of a value that can be sent by reference. If the value is a reference, it returns
+// the referenced value. Otherwise, it returns the header without its reference bit (eg: the length of the value).
+func (d *decoder) readHeader() (header uint32, reference any, isReference bool, err error) {
+	u, err := d.readU29()
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if u&1 == 0 {
+		index := int(u >> 1)
+		if index >= len(d.objects) {
+			return 0, nil, false, fmt.Errorf("%w: object %d", ErrInvalidReference, index)
+		}
+		return 0, d.objects[index], true, nil
+	}
+	return u >> 1, nil, false, nil
+}
+
+func (d *decoder) decodeXML(marker byte) (any, error) {
+	length, reference, isReference, err := d.readHeader()
+	if err != nil || isReference {
+		return reference, err
+	}
+	b, err := d.read(int(length))
+	if err != nil {
+		return nil, err
+	}
+	var value any = XML(b)
+	if marker == TypeXmlDoc {
+		value = XMLDocument(b)
+	}
+	d.objects = append(d.objects, value)
+	return value, nil
+}
+
+func (d *decoder) decodeDate() (any, error) {
+	_, reference, isReference, err := d.readHeader()
+	if err != nil || isReference {
+		return reference, err
+	}
+	milliseconds, err := d.readDouble()
+	if err != nil {
+		return nil, err
+	}
+	date := time.UnixMilli(int64(milliseconds))
+	d.objects = append(d.objects, date)
+	return date, nil
+}
+
+func (d *decoder) decodeByteArray() (any, error) {
+	length, reference, isReference, err := d.readHeader()
+	if err != nil || isReference {
+		return reference, err
+	}
+	b, err := d.read(int(length))
+	if err != nil {
+		return nil, err
+	}
+	byteArray := make([]byte, len(b))
+	copy(byteArray, b)
+	d.objects = append(d.objects, byteArray)
+	return byteArray, nil
+}
+
+func (d *decoder) decodeArray() (any, error) {
+	count, reference, isReference, err := d.readHeader()
+	if err != nil || isReference {
+		return reference, err
+	}
+	// The array is added to the table before its values, which can reference it, and set once it's decoded
+	index := len(d.objects)
+	d.objects = append(d.objects, nil)
+
+	// The associative part comes first, and ends with an empty key
+	var associative map[string]any
+	for {
+		key, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			break
+		}
+		if associative == nil {
+			associative = make(map[string]any)
+		}
+		if associative[key], err = d.decodeValue(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Don't trust the count to preallocate, every value spans at least 1 byte
+	if remaining := d.src.remaining(); remaining >= 0 && int(count) > remaining {
+		return nil, ErrTruncated
+	}
+	dense := make([]any, 0, d.capacity(int(count)))
+	for i := 0; i < int(count); i++ {
+		value, err := d.decodeValue()
+		if err != nil {
+			return nil, err
+		}
+		dense = append(dense, value)
+	}
+
+	var array any = dense
+	if associative != nil {
+		array = Array{Associative: associative, Dense: dense}
+	}
+	d.objects[index] = array
+	return array, nil
+}
+
+func (d *decoder) decodeObject() (any, error) {
+	header, reference, isReference, err := d.readHeader()
+	if err != nil || isReference {
+		return reference, err
+	}
+	t, err := d.readTraits(header)
+	if err != nil {
+		return nil, err
+	}
+	if t.externalizable {
+		return d.decodeExternalizable(t.className)
+	}
+
+	properties := make(map[string]any)
+	var object any = properties
+	if t.className != "" {
+		object = TypedObject{ClassName: t.className, Properties: properties}
+	}
+	d.objects = append(d.objects, object)
+
+	// Values of the sealed members come first, in the order of the traits
+	for _, member := range t.members {
+		if properties[member], err = d.decodeValue(); err != nil {
+			return nil, err
+		}
+	}
+	// Then the dynamic members, as key/value pairs, until an empty key
+	if t.dynamic {
+		for {
+			key, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			if key == "" {
+				break
+			}
+			if properties[key], err = d.decodeValue(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return object, nil
+}
+
+// readTraits reads the traits of an object, given the header of the object without its reference bit.
+func (d *decoder) readTraits(header uint32) (*traits, error) {
+	// Traits sent by reference
+	if header&1 == 0 {
+		index := int(header >> 1)
+		if index >= len(d.traits) {
+			return nil, fmt.Errorf("%w: traits %d", ErrInvalidReference, index)
+		}
+		return d.traits[index], nil
+	}
+	className, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	t := &traits{
+		className:      className,
+		externalizable: header&2 != 0,
+		dynamic:        header&4 != 0,
+	}
+	count := int(header >> 3)
+	if remaining := d.src.remaining(); remaining >= 0 && count > remaining {
+		return nil, ErrTruncated
+	}
+	t.members = make([]string, 0, d.capacity(count))
+	for i := 0; i < count; i++ {
+		member, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		t.members = append(t.members, member)
+	}
+	d.traits = append(d.traits, t)
+	return t, nil
+}
+
+// decodeExternalizable decodes the externalizable objects whose format is known: the Flex collections that wrap a
+// single value (eg: the array of an ArrayCollection), which is returned instead. The format of other externalizable
+// objects is specific to their class, so they can't be decoded.
+func (d *decoder) decodeExternalizable(className string) (any, error) {
+	switch className {
+	case "flex.messaging.io.ArrayCollection", "flex.messaging.io.ObjectProxy":
+		index := len(d.objects)
+		d.objects = append(d.objects, nil)
+		value, err := d.decodeValue()
+		if err != nil {
+			return nil, err
+		}
+		d.objects[index] = value
+		return value, nil
+	default:
+		return nil, fmt.Errorf("%w of class %q", ErrExternalizable, className)
+	}
+}
+
+func (d *decoder) readString() (string, error) {
+	u, err := d.readU29()
+	if err != nil {
+		return "", err
+	}
+	if u&1 == 0 {
+		index := int(u >> 1)
+		if index >= len(d.strings) {
+			return "", fmt.Errorf("%w: string %d", ErrInvalidReference, index)
+		}
+		return d.strings[index], nil
+	}
+	b, err := d.read(int(u >> 1))
+	if err != nil {
+		return "", err
+	}
+	s := string(b)
+	// The empty string is never sent by reference
+	if s != "" {
+		d.strings = append(d.strings, s)
+	}
+	return s, nil
+}
+
+// readU29 reads a variable length unsigned integer of up to 29 bits. The first 3 bytes use their high bit to indicate
+// that another byte follows, and the 4th byte (if any) uses all of its 8 bits.
+func (d *decoder) readU29() (uint32, error) {
+	var u uint32
+	for i := 0; i < 4; i++ {
+		b, err := d.readByte()
+		if err != nil {
+			return 0, err
+		}
+		if i == 3 {
+			return u<<8 | uint32(b), nil
+		}
+		u = u<<7 | uint32(b&0x7F)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return u, nil
+}
+
+func (d *decoder) readDouble() (float64, error) {
+	b, err := d.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+}
+
+func (d *decoder) readByte() (byte, error) {
+	return d.src.readByte()
+}
+
+func (d *decoder) read(n int) ([]byte, error) {
+	return d.src.read(n)
+}
+
+// capacity returns how many of the count values of an array (or members of traits) can be preallocated, before
+// decoding them.
+func (d *decoder) capacity(count int) int {
+	capacity := d.src.remaining()
+	if capacity < 0 {
+		capacity = maxUnknownCapacity
+	}
+	if count < capacity {
+		return count
+	}
+	return capacity
+}
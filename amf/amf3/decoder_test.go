@@ -0,0 +1,111 @@
+package amf3
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeNext(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want any
+	}{
+		{"undefined", "00", Undefined{}},
+		{"null", "01", nil},
+		{"false", "02", false},
+		{"true", "03", true},
+		{"integer", "0401", 1},
+		{"2 byte integer", "048100", 128},
+		{"largest integer", "04bfffffff", MaxInt},
+		{"negative integer", "04ffffffff", -1},
+		{"double", "053ff8000000000000", 1.5},
+		{"string", "060b68656c6c6f", "hello"},
+		{"empty string", "0601", ""},
+		{"date", "080142774876e8000000", time.UnixMilli(1600000000000)},
+		{"byte array", "0c07010203", []byte{1, 2, 3}},
+		{"XML document", "07093c612f3e", XMLDocument("<a/>")},
+		{"XML", "0b093c612f3e", XML("<a/>")},
+		{"dense array", "090501 0401 06056869", []any{1, "hi"}},
+		{"array with an associative part", "0903036104010106056869", Array{Associative: map[string]any{"a": 1}, Dense: []any{"hi"}}},
+		{"anonymous object", "0a0b01 03610401 036203 01", map[string]any{"a": 1, "b": true}},
+		{"typed object", "0a1307466f6f03780405", TypedObject{ClassName: "Foo", Properties: map[string]any{"x": 5}}},
+		// ["hi", <reference to "hi">]
+		{"string reference", "090501060568690600", []any{"hi", "hi"}},
+		// {"a": "hi", "b": <reference to "a">}: property names are in the string table too
+		{"property name reference", "0a0b010361060568690362060001", map[string]any{"a": "hi", "b": "a"}},
+		// [{"a": 1}, <reference to the object>]: the array is the first entry of the object table
+		{"object reference", "090501 0a0b0103610401 01 0a02", []any{map[string]any{"a": 1}, map[string]any{"a": 1}}},
+		// [Foo{x: 1}, Foo{x: 2}], the second one with a reference to the traits of the first one
+		{"traits reference", "0905010a1307466f6f037804010a010402", []any{
+			TypedObject{ClassName: "Foo", Properties: map[string]any{"x": 1}},
+			TypedObject{ClassName: "Foo", Properties: map[string]any{"x": 2}},
+		}},
+		{"date reference", "090501 080142774876e8000000 0802", []any{time.UnixMilli(1600000000000), time.UnixMilli(1600000000000)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := decodeHex(t, test.data)
+			value, n, err := DecodeNext(data)
+			if err != nil {
+				t.Fatalf("DecodeNext() = %v", err)
+			}
+			if !reflect.DeepEqual(value, test.want) || n != len(data) {
+				t.Errorf("DecodeNext() = %#v (%d bytes), want %#v (%d bytes)", value, n, test.want, len(data))
+			}
+		})
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want error
+	}{
+		{"truncated integer", "0481", ErrTruncated},
+		{"truncated string", "060b6865", ErrTruncated},
+		{"truncated object", "0a07436666", ErrTruncated},
+		{"string reference out of range", "0602", ErrInvalidReference},
+		{"object reference out of range", "0a02", ErrInvalidReference},
+		{"traits reference out of range", "0a01", ErrInvalidReference},
+		{"externalizable object", "0a0707466f6f", ErrExternalizable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := DecodeNext(decodeHex(t, test.data)); !errors.Is(err, test.want) {
+				t.Errorf("DecodeNext() = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// TestDecoder decodes the values of a message encoded in AMF3 only, whose reference tables span its values.
+func TestDecoder(t *testing.T) {
+	// "connect", 1, {"app": "live"}, <reference to "live">
+	d := NewDecoder(bytes.NewReader(decodeHex(t, "060f636f6e6e656374 0401 0a0b0107617070 06096c697665 01 0604")))
+	for i, want := range []any{"connect", 1, map[string]any{"app": "live"}, "live"} {
+		if value, err := d.Decode(); err != nil || !reflect.DeepEqual(value, want) {
+			t.Fatalf("Decode() of value %d = %#v, %v, want %#v", i, value, err, want)
+		}
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("Decode() after the last value = %v, want io.EOF", err)
+	}
+}
+
+// decodeHex decodes s, which can have spaces to separate values.
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
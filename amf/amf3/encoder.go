@@ -4,128 +4,241 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
+	"reflect"
 	"time"
 )
 
 // Encodes the value v into its AMF3 form.
 // If you encode a signed/unsigned int greater than MaxInt, it will be encoded as a double.
 // If you encode a signed int less than MinInt, it will be encoded as a double.
+// Strings are sent by reference after their first occurrence in v, and so are the traits of typed objects. Maps with
+// string keys are encoded as anonymous objects, []byte as a byte array, other slices as dense arrays, and time.Time as
+// a date.
 func Encode(v any) ([]byte, error) {
-	switch v.(type) {
+	e := &encoder{strings: make(map[string]int), traits: make(map[string]int)}
+	if err := e.encode(v); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+type encoder struct {
+	buf []byte
+	// Index of the strings and traits (by class name) already sent, in their reference tables
+	strings map[string]int
+	traits  map[string]int
+}
+
+func (e *encoder) encode(v any) error {
+	switch v := v.(type) {
 	case nil:
-		return encodeNull(), nil
+		e.buf = append(e.buf, TypeNull)
+	case Undefined:
+		e.buf = append(e.buf, TypeUndefined)
 	case bool:
-		return encodeBool(v.(bool)), nil
+		e.encodeBool(v)
 	case int:
-		return encodeInt(v.(int)), nil
-	case uint:
-		return encodeInt(int(v.(uint))), nil
-	//case string:
-	//	return encodeString(v.(string)), nil
+		e.encodeInt(v)
+	case float64:
+		e.encodeDouble(v)
+	case string:
+		e.buf = append(e.buf, TypeString)
+		e.writeString(v)
 	case time.Time:
-		return encodeDate(v.(time.Time)), nil
-	//case []any: // TODO: implement
-	//	return encodeArray(v.([]any)), nil
-	//case map[string]any:
-	//	return encodeObject(v.(map[string]any)), nil
+		e.encodeDate(v)
+	case []byte:
+		e.buf = append(e.buf, TypeByteArray)
+		e.writeU29(uint32(len(v))<<1 | 1)
+		e.buf = append(e.buf, v...)
+	case []any:
+		return e.encodeArray(nil, v)
+	case Array:
+		return e.encodeArray(v.Associative, v.Dense)
+	case map[string]any:
+		return e.encodeObject("", v)
+	case TypedObject:
+		return e.encodeObject(v.ClassName, v.Properties)
+	case XMLDocument:
+		e.encodeXML(TypeXmlDoc, string(v))
+	case XML:
+		e.encodeXML(TypeXml, string(v))
 	default:
-		return nil, errors.New(fmt.Sprintf("cannot encode type %T", v))
+		return e.encodeReflect(v)
 	}
-}
-
-// TODO: implement
-func encodeObject(i map[string]any) []byte {
 	return nil
 }
 
-func encodeDate(t time.Time) []byte {
-	buf := make([]byte, 0)
-	buf = append(buf, TypeDate)        // 1 byte header
-	buf = append(buf, encodeU29(1)...) // 1 indicates explicit timestamp (ie. not a reference)
-
-	timestamp := t.UnixNano() / 1000000
-	buf = append(buf, encodeDouble(float64(timestamp))...)
-	// Last 2 bytes are time zone (which should stay with a value of 0 as defined by the spec)
-
-	return buf
+// encodeReflect encodes the values of named and composite types that encode doesn't list (eg: map[string]string,
+// []string, or a named string type), as the AMF3 type of their underlying type.
+func (e *encoder) encodeReflect(v any) error {
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			break
+		}
+		m := make(map[string]any, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = iter.Value().Interface()
+		}
+		return e.encodeObject("", m)
+	case reflect.Slice, reflect.Array:
+		values := make([]any, value.Len())
+		for i := range values {
+			values[i] = value.Index(i).Interface()
+		}
+		return e.encodeArray(nil, values)
+	case reflect.String:
+		return e.encode(value.String())
+	case reflect.Bool:
+		e.encodeBool(value.Bool())
+		return nil
+	case reflect.Float32, reflect.Float64:
+		e.encodeDouble(value.Float())
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := value.Int(); i >= int64(MinInt) && i <= int64(MaxInt) {
+			e.encodeInt(int(i))
+		} else {
+			e.encodeDouble(float64(i))
+		}
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if u := value.Uint(); u <= uint64(MaxInt) {
+			e.encodeInt(int(u))
+		} else {
+			e.encodeDouble(float64(u))
+		}
+		return nil
+	}
+	return errors.New(fmt.Sprintf("cannot encode type %T", v))
 }
 
-// TODO: implement
-func encodeString(s string) []byte {
-	if s == "" {
-
+func (e *encoder) encodeObject(className string, properties map[string]any) error {
+	e.buf = append(e.buf, TypeObject)
+	if index, ok := e.traits[className]; ok {
+		// Traits sent by reference (bits: traits reference, inline object)
+		e.writeU29(uint32(index)<<2 | 1)
+	} else {
+		// Inline traits of a dynamic class without sealed members (bits: dynamic, not externalizable, inline traits,
+		// inline object)
+		e.traits[className] = len(e.traits)
+		e.writeU29(0x0B)
+		e.writeString(className)
+	}
+	// Every property is sent as a dynamic member, ending with an empty key
+	for key, value := range properties {
+		if key == "" {
+			continue
+		}
+		e.writeString(key)
+		if err := e.encode(value); err != nil {
+			return err
+		}
 	}
+	e.writeString("")
 	return nil
 }
 
-func encodeU29(i int) []byte {
-	// The high bit of the first 3 bytes are used as flags to determine whether the next byte is part of the integer.
-	useNextByte := 0x80 // all bits are zero except for the highest bit. This is equal to 1000 0000 in binary
-	i &= 0x1FFFFFFF
-	if i <= 0x7F {
-		// If number is less than 128 it can be stored in one byte
-		var ret [2]byte
-		ret[0] = TypeInteger
-		ret[1] = byte(i)
-		return ret[:]
-	} else if i <= 0x3FFF {
-		// If number is in range 128 - 16,383 (both inclusive)
-		var ret [3]byte
-		ret[0] = TypeInteger
-		ret[1] = byte((i >> 7) | useNextByte)
-		ret[2] = byte(i & 0x7F)
-		return ret[:]
-	} else if i <= 0x1FFFFF {
-		// If number is in range 16,384 - 2,097,151 (both inclusive)
-		var ret [4]byte
-		ret[0] = TypeInteger
-		ret[1] = byte((i >> 14) | useNextByte)
-		ret[2] = byte((i >> 7) | useNextByte)
-		ret[3] = byte(i & 0x7F)
-		return ret[:]
-	} else {
-		// If number is in range 2,097,152 - 1,073,741,823 (both inclusive)
-		var ret [5]byte
-		ret[0] = TypeInteger
-		ret[1] = byte((i >> 22) | useNextByte)
-		ret[2] = byte((i >> 15) | useNextByte)
-		ret[3] = byte((i >> 8) | useNextByte)
-		// a 4 byte integer, uses all 8 bits of the last byte completely
-		ret[4] = byte(i)
-		return ret[:]
+func (e *encoder) encodeArray(associative map[string]any, dense []any) error {
+	e.buf = append(e.buf, TypeArray)
+	e.writeU29(uint32(len(dense))<<1 | 1)
+	// The associative part comes first, and ends with an empty key
+	for key, value := range associative {
+		if key == "" {
+			continue
+		}
+		e.writeString(key)
+		if err := e.encode(value); err != nil {
+			return err
+		}
+	}
+	e.writeString("")
+	for _, value := range dense {
+		if err := e.encode(value); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func encodeInt(i int) []byte {
-	// AMF3 ints are variable sized. The largest UNSIGNED integer that can be represented is 2^29 - 1 (268,435,455 is the maximum SIGNED integer)
+func (e *encoder) encodeDate(t time.Time) {
+	e.buf = append(e.buf, TypeDate)
+	// 1 indicates an inline date (ie. not a reference)
+	e.writeU29(1)
+	e.writeDouble(float64(t.UnixMilli()))
+}
 
+func (e *encoder) encodeXML(marker byte, s string) {
+	e.buf = append(e.buf, marker)
+	e.writeU29(uint32(len(s))<<1 | 1)
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) encodeInt(i int) {
+	// AMF3 ints are variable sized. The largest UNSIGNED integer that can be represented is 2^29 - 1 (268,435,455 is the maximum SIGNED integer)
 	if i >= MinInt && i <= MaxInt {
-		return encodeU29(i)
+		e.buf = append(e.buf, TypeInteger)
+		e.writeU29(uint32(i))
 	} else {
 		// If the number is greater than MaxInt or less than MinInt, serialize it as a double (as per the spec)
-		return encodeDouble(float64(i))
+		e.encodeDouble(float64(i))
 	}
 }
 
-func encodeDouble(f float64) []byte {
-	var ret [9]byte
-	ret[0] = TypeDouble
-	binary.BigEndian.PutUint64(ret[1:], uint64(f))
-	return ret[:]
+func (e *encoder) encodeDouble(f float64) {
+	e.buf = append(e.buf, TypeDouble)
+	e.writeDouble(f)
 }
 
-func encodeBool(b bool) []byte {
-	var buf [1]byte
+func (e *encoder) encodeBool(b bool) {
 	if b {
-		buf[0] = TypeTrue
+		e.buf = append(e.buf, TypeTrue)
+	} else {
+		e.buf = append(e.buf, TypeFalse)
+	}
+}
+
+// writeString writes s (without a type marker), or a reference to it if it was already written. The empty string is
+// never sent by reference.
+func (e *encoder) writeString(s string) {
+	if s == "" {
+		e.buf = append(e.buf, UTF8Empty)
+		return
+	}
+	if index, ok := e.strings[s]; ok {
+		e.writeU29(uint32(index) << 1)
+		return
+	}
+	e.strings[s] = len(e.strings)
+	e.writeU29(uint32(len(s))<<1 | 1)
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) writeU29(i uint32) {
+	// The high bit of the first 3 bytes are used as flags to determine whether the next byte is part of the integer.
+	useNextByte := byte(0x80) // all bits are zero except for the highest bit. This is equal to 1000 0000 in binary
+	i &= 0x1FFFFFFF
+	if i <= 0x7F {
+		// If number is less than 128 it can be stored in one byte
+		e.buf = append(e.buf, byte(i))
+	} else if i <= 0x3FFF {
+		// If number is in range 128 - 16,383 (both inclusive)
+		e.buf = append(e.buf, byte(i>>7)|useNextByte, byte(i&0x7F))
+	} else if i <= 0x1FFFFF {
+		// If number is in range 16,384 - 2,097,151 (both inclusive)
+		e.buf = append(e.buf, byte(i>>14)|useNextByte, byte(i>>7)|useNextByte, byte(i&0x7F))
 	} else {
-		buf[0] = TypeFalse
+		// If number is in range 2,097,152 - 536,870,911 (both inclusive), a 4 byte integer uses all 8 bits of the last
+		// byte
+		e.buf = append(e.buf, byte(i>>22)|useNextByte, byte(i>>15)|useNextByte, byte(i>>8)|useNextByte, byte(i))
 	}
-	return buf[:]
 }
 
-func encodeNull() []byte {
-	var null [1]byte
-	null[0] = TypeNull
-	return null[:]
+func (e *encoder) writeDouble(f float64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(f))
+	e.buf = append(e.buf, b[:]...)
 }
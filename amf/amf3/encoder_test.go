@@ -0,0 +1,76 @@
+package amf3
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		want  string
+	}{
+		{"integer", 1, "0401"},
+		{"2 byte integer", 128, "048100"},
+		{"largest integer", MaxInt, "04bfffffff"},
+		{"negative integer", -1, "04ffffffff"},
+		// Integers out of the range of U29 are encoded as doubles
+		{"integer out of range", MaxInt + 1, "05 41b0000000000000"},
+		{"double", 1.5, "053ff8000000000000"},
+		{"empty string", "", "0601"},
+		{"string reference", []any{"hi", "hi", ""}, "090701 06056869 0600 0601"},
+		{"anonymous object", map[string]any{"a": 1}, "0a0b01 03610401 01"},
+		// Typed objects are encoded with dynamic traits, the second one by reference along with the name of its property
+		{"traits reference", []any{
+			TypedObject{ClassName: "Foo", Properties: map[string]any{"x": 1}},
+			TypedObject{ClassName: "Foo", Properties: map[string]any{"x": 2}},
+		}, "090501 0a0b07466f6f 03780401 01 0a01 02 0402 01"},
+		{"byte array", []byte{1, 2, 3}, "0c07010203"},
+		{"named type", []string{"x"}, "090301 060378"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Encode(test.value)
+			if err != nil {
+				t.Fatalf("Encode() = %v", err)
+			}
+			if want := decodeHex(t, test.want); !bytes.Equal(got, want) {
+				t.Errorf("Encode(%#v) = %x, want %x", test.value, got, want)
+			}
+		})
+	}
+}
+
+// TestEncodeDecode checks that values are decoded back as they were encoded.
+func TestEncodeDecode(t *testing.T) {
+	values := []any{
+		nil,
+		Undefined{},
+		true,
+		false,
+		MinInt,
+		"hello",
+		time.UnixMilli(1700000000000),
+		map[string]any{"app": "live", "objectEncoding": 3, "fpad": false, "capabilities": 239.0},
+		Array{Associative: map[string]any{"z": 1}, Dense: []any{2, "y"}},
+		[]any{map[string]any{"a": "b"}, TypedObject{ClassName: "Foo", Properties: map[string]any{"a": "b", "c": nil}}},
+		XML("<a/>"),
+		XMLDocument("<b/>"),
+	}
+	for _, value := range values {
+		encoded, err := Encode(value)
+		if err != nil {
+			t.Fatalf("Encode(%#v) = %v", value, err)
+		}
+		decoded, n, err := DecodeNext(encoded)
+		if err != nil || n != len(encoded) {
+			t.Fatalf("DecodeNext(Encode(%#v)) = %v (%d of %d bytes)", value, err, n, len(encoded))
+		}
+		if !reflect.DeepEqual(decoded, value) {
+			t.Errorf("DecodeNext(Encode(%#v)) = %#v", value, decoded)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package amf3
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Capacity preallocated for arrays and traits when the number of bytes left is unknown (ie. when decoding from a reader)
+const maxUnknownCapacity = 64
+
+// source is what a decoder reads values from.
+type source interface {
+	readByte() (byte, error)
+	// read returns the next n bytes. The returned slice is only valid until the next read.
+	read(n int) ([]byte, error)
+	// remaining returns the number of bytes left, or -1 if it's unknown.
+	remaining() int
+}
+
+type sliceSource struct {
+	bytes []byte
+	pos   int
+}
+
+func (s *sliceSource) readByte() (byte, error) {
+	if s.pos >= len(s.bytes) {
+		return 0, ErrTruncated
+	}
+	b := s.bytes[s.pos]
+	s.pos++
+	return b, nil
+}
+
+func (s *sliceSource) read(n int) ([]byte, error) {
+	if n < 0 || n > len(s.bytes)-s.pos {
+		return nil, ErrTruncated
+	}
+	b := s.bytes[s.pos : s.pos+n]
+	s.pos += n
+	return b, nil
+}
+
+func (s *sliceSource) remaining() int {
+	return len(s.bytes) - s.pos
+}
+
+// byteReader is implemented by readers that don't need to be buffered to be read byte by byte (eg: *bufio.Reader).
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+type readerSource struct {
+	reader byteReader
+}
+
+func (s *readerSource) readByte() (byte, error) {
+	b, err := s.reader.ReadByte()
+	return b, truncated(err)
+}
+
+func (s *readerSource) read(n int) ([]byte, error) {
+	if n < 0 {
+		return nil, ErrTruncated
+	}
+	// Lengths can't be trusted to allocate the buffer upfront, so it grows as the bytes are actually read
+	b, err := io.ReadAll(io.LimitReader(s.reader, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < n {
+		return nil, truncated(io.EOF)
+	}
+	return b, nil
+}
+
+func (s *readerSource) remaining() int {
+	return -1
+}
+
+// truncated reports the end of the reader in the middle of a value as ErrTruncated (and io.ErrUnexpectedEOF).
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: %w", ErrTruncated, io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// Decoder decodes AMF3 values one after the other from a reader. Unlike DecodeNext, the reference tables are kept
+// from one value to the next, as they are for the values of a message encoded in AMF3 only.
+type Decoder struct {
+	decoder
+	reader byteReader
+}
+
+// NewDecoder returns a decoder reading from r. Unless r implements io.ByteReader (eg: *bufio.Reader), the decoder
+// buffers it, so it may read more bytes from r than the values it decodes span: r should end with the last value.
+func NewDecoder(r io.Reader) *Decoder {
+	reader, ok := r.(byteReader)
+	if !ok {
+		reader = bufio.NewReader(r)
+	}
+	return &Decoder{decoder: decoder{src: &readerSource{reader: reader}}, reader: reader}
+}
+
+// Decode decodes the next value, like Decode. It returns io.EOF if there are no more values, and an error wrapping
+// ErrTruncated if the reader ends in the middle of a value.
+func (d *Decoder) Decode() (any, error) {
+	marker, err := d.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeMarked(marker)
+}
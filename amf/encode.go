@@ -0,0 +1,50 @@
+package amf
+
+import (
+	"io"
+
+	"github.com/codingpa-ws/rtmp/amf/amf0"
+)
+
+// Encode returns the AMF0 encoding of values, one after the other, eg: the name, transaction ID, command object and
+// arguments of a command, or the values of a data message. See amf0.Encode for how each Go type is encoded
+// (Metadata and other maps with string keys are encoded as objects, and slices as strict arrays).
+func Encode(values ...any) ([]byte, error) {
+	var encoded []byte
+	for _, value := range values {
+		b, err := amf0.Encode(value)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, b...)
+	}
+	return encoded, nil
+}
+
+// DecodeOrdered decodes every AMF0 value of payload (eg: the values of a data message such as @setDataFrame), keeping
+// the order of the properties of objects and ECMA arrays (see amf0.DecodeOrdered), so that encoding them back with
+// Encode produces payload again.
+func DecodeOrdered(payload []byte) ([]any, error) {
+	var values []any
+	for len(payload) > 0 {
+		value, n, err := amf0.DecodeOrdered(payload)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		payload = payload[n:]
+	}
+	return values, nil
+}
+
+// Undefined is the undefined value (see amf0.Undefined). Null values are nil.
+type Undefined = amf0.Undefined
+
+// Decoder decodes AMF0 values one after the other from a reader (see amf0.Decoder).
+type Decoder = amf0.Decoder
+
+// NewDecoder returns a decoder reading the AMF0 values of r, eg: the name, transaction ID, command object and arguments
+// of a command, which can then be decoded one by one with Decode until it returns io.EOF.
+func NewDecoder(r io.Reader) *Decoder {
+	return amf0.NewDecoder(r)
+}
@@ -0,0 +1,146 @@
+package amf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+
+	"github.com/codingpa-ws/rtmp/amf/amf0"
+)
+
+// @setDataFrame data message sent by FFmpeg, whose onMetaData ECMA array has more keys than a map would iterate in order
+const setDataFrame = "02000d40736574446174614672616d6502000a6f6e4d65746144617461080000000d00086475726174696f6e0000000000000000" +
+	"00000577696474680040940000000000000006686569676874004086800000000000000d766964656f64617461726174650040a38800" +
+	"0000000000096672616d657261746500403e000000000000000c766964656f636f646563696400401c000000000000000d617564696f" +
+	"6461746172617465004060000000000000000f617564696f73616d706c65726174650040e5888000000000000f617564696f73616d70" +
+	"6c6573697a65004030000000000000000673746572656f0101000c617564696f636f64656369640040240000000000000007656e636f" +
+	"64657202000d4c61766635382e37362e313030000866696c6573697a65000000000000000000000009"
+
+func TestDecodeOrdered(t *testing.T) {
+	payload, err := hex.DecodeString(setDataFrame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := DecodeOrdered(payload)
+	if err != nil {
+		t.Fatalf("DecodeOrdered() = %v", err)
+	}
+	if len(values) != 3 || values[0] != "@setDataFrame" || values[1] != "onMetaData" {
+		t.Fatalf("DecodeOrdered() = %v, want @setDataFrame, onMetaData and the metadata", values)
+	}
+	metadata, ok := values[2].(amf0.OrderedECMAArray)
+	if !ok {
+		t.Fatalf("metadata decoded as %T, want an ordered ECMA array", values[2])
+	}
+	var keys []string
+	for _, property := range metadata {
+		keys = append(keys, property.Key)
+	}
+	want := []string{"duration", "width", "height", "videodatarate", "framerate", "videocodecid", "audiodatarate",
+		"audiosamplerate", "audiosamplesize", "stereo", "audiocodecid", "encoder", "filesize"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("decoded the keys %q, want %q", keys, want)
+	}
+	// The properties are still accessible as Metadata
+	if encoder, err := Metadata(metadata.Map()).GetString("Encoder"); err != nil || encoder != "Lavf58.76.100" {
+		t.Errorf("GetString(\"Encoder\") = %q, %v", encoder, err)
+	}
+
+	// Decoding a map would shuffle the keys, so the same payload is re-encoded many times
+	for i := 0; i < 20; i++ {
+		values, err := DecodeOrdered(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := Encode(values...)
+		if err != nil {
+			t.Fatalf("Encode() = %v", err)
+		}
+		if !bytes.Equal(encoded, payload) {
+			t.Fatalf("Encode(DecodeOrdered(payload)) = %x, want %x", encoded, payload)
+		}
+	}
+}
+
+// TestDecoder decodes a play command value by value from a reader, including a value switched to AMF3 (after the AVM+
+// marker) as sent in AMF3 command messages.
+func TestDecoder(t *testing.T) {
+	command, err := Encode("play", 0.0, nil, "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// AVM+ marker followed by the AMF3 object {"start": -2}
+	command = append(command, 0x11, 0x0a, 0x0b, 0x01, 0x0b, 's', 't', 'a', 'r', 't', 0x04, 0xff, 0xff, 0xff, 0xfe, 0x01)
+	d := NewDecoder(iotest.OneByteReader(bytes.NewReader(command)))
+	want := []any{"play", 0.0, nil, "live", map[string]any{"start": -2}}
+	for i := range want {
+		value, err := d.Decode()
+		if err != nil {
+			t.Fatalf("Decode() of value %d = %v", i, err)
+		}
+		if !reflect.DeepEqual(value, want[i]) {
+			t.Errorf("Decode() of value %d = %#v, want %#v", i, value, want[i])
+		}
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("Decode() after the last value = %v, want io.EOF", err)
+	}
+
+	// A command cut in the middle of a value isn't mistaken for its end
+	d = NewDecoder(bytes.NewReader(command[:len(command)-3]))
+	for i := 0; i < len(want)-1; i++ {
+		if _, err := d.Decode(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.Decode(); err == nil || err == io.EOF {
+		t.Errorf("Decode() of a truncated value = %v, want an error", err)
+	}
+}
+
+// TestNullUndefined checks that null and undefined are told apart in both directions, at the top level and as
+// properties, and in both AMF0 and AMF3 values.
+func TestNullUndefined(t *testing.T) {
+	// null, undefined, {"n": null, "u": undefined}, AVM+ [null, undefined]
+	payload := []byte{
+		amf0.TypeNull,
+		amf0.TypeUndefined,
+		amf0.TypeObject, 0, 1, 'n', amf0.TypeNull, 0, 1, 'u', amf0.TypeUndefined, 0, 0, amf0.TypeObjectEnd,
+		amf0.TypeAVMPlus, 0x09, 0x05, 0x01, 0x01, 0x00,
+	}
+	values, err := DecodeOrdered(payload)
+	if err != nil {
+		t.Fatalf("DecodeOrdered() = %v", err)
+	}
+	want := []any{
+		nil,
+		Undefined{},
+		amf0.OrderedObject{{Key: "n", Value: nil}, {Key: "u", Value: Undefined{}}},
+		[]any{nil, Undefined{}},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Fatalf("DecodeOrdered() = %#v, want %#v", values, want)
+	}
+
+	// The AMF3 array is encoded back as an AMF0 strict array, keeping its markers
+	encoded, err := Encode(values...)
+	if err != nil {
+		t.Fatalf("Encode() = %v", err)
+	}
+	wantEncoded := append([]byte{}, payload[:len(payload)-6]...)
+	wantEncoded = append(wantEncoded, amf0.TypeStrictArray, 0, 0, 0, 2, amf0.TypeNull, amf0.TypeUndefined)
+	if !bytes.Equal(encoded, wantEncoded) {
+		t.Errorf("Encode() = %x, want %x", encoded, wantEncoded)
+	}
+
+	// Metadata treats both as the absence of a value
+	m := Metadata{"n": nil, "u": Undefined{}}
+	for key := range m {
+		if v := m.Get(key); v != nil {
+			t.Errorf("Get(%q) = %#v, want nil", key, v)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package amf
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/codingpa-ws/rtmp/amf/amf0"
+)
+
+var ErrInvalidTarget error = errors.New("amf: unmarshal target is not a non-nil pointer")
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Marshal returns the AMF0 encoding of v. Structs are encoded as objects with a property per exported field, in the
+// order of the fields. The name of the property is given by the amf tag of the field (eg: `amf:"tcUrl"`), or is the
+// name of the field with its first letter lowercased (eg: TcUrl is tcUrl). Fields tagged `amf:"-"` are skipped, and
+// fields tagged with the omitempty option (eg: `amf:"swfUrl,omitempty"`) are skipped if they have their zero value.
+// Pointers are encoded as the value they point to, or null. Other values are encoded like Encode does.
+func Marshal(v any) ([]byte, error) {
+	value, err := marshalValue(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return amf0.Encode(value)
+}
+
+// Unmarshal decodes the AMF0 (or AMF3, after the AVM+ marker) value at the beginning of data into the value pointed by
+// v. Objects are decoded into structs like Marshal encodes them, except that property names are matched
+// case-insensitively, like Metadata keys. Properties that don't match any field are ignored, and null (or undefined)
+// values leave their field untouched.
+func Unmarshal(data []byte, v any) error {
+	value, _, err := amf0.DecodeNext(data)
+	if err != nil {
+		return err
+	}
+	return unmarshalTarget(value, v)
+}
+
+// Unmarshal decodes the properties of the metadata into the value pointed by v (eg: a struct), like amf.Unmarshal.
+func (m Metadata) Unmarshal(v any) error {
+	return unmarshalTarget(map[string]any(m), v)
+}
+
+func unmarshalTarget(value any, v any) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return ErrInvalidTarget
+	}
+	return unmarshalValue(target.Elem(), value)
+}
+
+// field is an exported field of a struct, with the name of its property.
+type field struct {
+	index     int
+	name      string
+	omitEmpty bool
+}
+
+func structFields(t reflect.Type) []field {
+	fields := make([]field, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		if !structField.IsExported() {
+			continue
+		}
+		tag := structField.Tag.Get("amf")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			r, size := utf8.DecodeRuneInString(structField.Name)
+			name = string(unicode.ToLower(r)) + structField.Name[size:]
+		}
+		fields = append(fields, field{index: i, name: name, omitEmpty: options == "omitempty"})
+	}
+	return fields
+}
+
+func marshalValue(v reflect.Value) (any, error) {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return nil, nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return marshalValue(v.Elem())
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return v.Interface(), nil
+		}
+		var object amf0.OrderedObject
+		for _, f := range structFields(v.Type()) {
+			fieldValue := v.Field(f.index)
+			if f.omitEmpty && fieldValue.IsZero() {
+				continue
+			}
+			value, err := marshalValue(fieldValue)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", f.name, err)
+			}
+			object = append(object, amf0.Property{Key: f.name, Value: value})
+		}
+		return object, nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("cannot marshal map with %s keys", v.Type().Key())
+		}
+		if v.IsNil() {
+			return nil, nil
+		}
+		m := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			value, err := marshalValue(iter.Value())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", iter.Key().String(), err)
+			}
+			m[iter.Key().String()] = value
+		}
+		return m, nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil, nil
+		}
+		values := make([]any, v.Len())
+		for i := range values {
+			value, err := marshalValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+		}
+		return values, nil
+	default:
+		// Numbers, strings and booleans (and the named types of the amf0 package) are encoded by Encode
+		return v.Interface(), nil
+	}
+}
+
+func unmarshalValue(v reflect.Value, value any) error {
+	// Null and undefined values leave the target untouched
+	if _, undefined := value.(Undefined); value == nil || undefined {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return unmarshalValue(v.Elem(), value)
+	case reflect.Interface:
+		if reflect.TypeOf(value).AssignableTo(v.Type()) {
+			v.Set(reflect.ValueOf(value))
+			return nil
+		}
+	case reflect.Struct:
+		if t, ok := value.(time.Time); ok && v.Type() == timeType {
+			v.Set(reflect.ValueOf(t))
+			return nil
+		}
+		properties, ok := asMetadata(value)
+		if !ok {
+			break
+		}
+		for _, f := range structFields(v.Type()) {
+			if err := unmarshalValue(v.Field(f.index), properties.Get(f.name)); err != nil {
+				return fmt.Errorf("%s: %w", f.name, err)
+			}
+		}
+		return nil
+	case reflect.Map:
+		properties, ok := asMetadata(value)
+		if !ok || v.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), len(properties)))
+		}
+		for key, property := range properties {
+			element := reflect.New(v.Type().Elem()).Elem()
+			if err := unmarshalValue(element, property); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), element)
+		}
+		return nil
+	case reflect.Slice:
+		values, ok := value.([]any)
+		if !ok {
+			break
+		}
+		slice := reflect.MakeSlice(v.Type(), len(values), len(values))
+		for i, element := range values {
+			if err := unmarshalValue(slice.Index(i), element); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	case reflect.String:
+		if s, ok := value.(string); ok {
+			v.SetString(s)
+			return nil
+		}
+	case reflect.Bool:
+		if b, ok := value.(bool); ok {
+			v.SetBool(b)
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if number, ok := asFloat64(value); ok {
+			v.SetFloat(number)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if number, ok := asFloat64(value); ok {
+			if v.OverflowInt(int64(number)) {
+				return fmt.Errorf("%w: %v overflows %s", ErrWrongType, number, v.Type())
+			}
+			v.SetInt(int64(number))
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if number, ok := asFloat64(value); ok {
+			if number < 0 || v.OverflowUint(uint64(number)) {
+				return fmt.Errorf("%w: %v overflows %s", ErrWrongType, number, v.Type())
+			}
+			v.SetUint(uint64(number))
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: cannot unmarshal %T into %s", ErrWrongType, value, v.Type())
+}
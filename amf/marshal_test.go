@@ -0,0 +1,124 @@
+package amf
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/codingpa-ws/rtmp/amf/amf0"
+)
+
+type connectInfo struct {
+	App            string
+	FlashVer       string
+	TcUrl          string `amf:"tcUrl"`
+	SwfUrl         string `amf:"swfUrl,omitempty"`
+	FPad           bool   `amf:"fpad"`
+	Capabilities   float64
+	AudioCodecs    uint16
+	ObjectEncoding int
+	Params         *connectParams `amf:"params,omitempty"`
+	Ignored        string         `amf:"-"`
+}
+
+type connectParams struct {
+	Token string
+}
+
+func TestMarshal(t *testing.T) {
+	info := connectInfo{
+		App:          "live",
+		FlashVer:     "FMLE/3.0",
+		TcUrl:        "rtmp://localhost/live",
+		FPad:         true,
+		Capabilities: 239,
+		AudioCodecs:  3575,
+		Params:       &connectParams{Token: "abc"},
+		Ignored:      "ignored",
+	}
+	data, err := Marshal(info)
+	if err != nil {
+		t.Fatalf("Marshal() = %v", err)
+	}
+	values, err := DecodeOrdered(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The properties are in the order of the fields, without the skipped ones
+	want := amf0.OrderedObject{
+		{Key: "app", Value: "live"},
+		{Key: "flashVer", Value: "FMLE/3.0"},
+		{Key: "tcUrl", Value: "rtmp://localhost/live"},
+		{Key: "fpad", Value: true},
+		{Key: "capabilities", Value: 239.0},
+		{Key: "audioCodecs", Value: 3575.0},
+		{Key: "objectEncoding", Value: 0.0},
+		{Key: "params", Value: amf0.OrderedObject{{Key: "token", Value: "abc"}}},
+	}
+	if len(values) != 1 || !reflect.DeepEqual(values[0], want) {
+		t.Errorf("Marshal() encoded %#v, want %#v", values, want)
+	}
+
+	var decoded connectInfo
+	if err := Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal() = %v", err)
+	}
+	info.Ignored = ""
+	if !reflect.DeepEqual(decoded, info) {
+		t.Errorf("Unmarshal(Marshal(info)) = %+v, want %+v", decoded, info)
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	// A connect command object, with keys that don't match the case of the fields
+	data, err := Encode(map[string]any{
+		"APP":            "live",
+		"tcurl":          "rtmp://localhost/live",
+		"fpad":           false,
+		"audioCodecs":    3575.0,
+		"objectEncoding": 3.0,
+		"swfUrl":         nil,
+		"params":         amf0.ECMAArray{"token": "abc"},
+		"unknown":        "ignored",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Null values and missing properties leave their field untouched
+	info := connectInfo{SwfUrl: "default", FlashVer: "default"}
+	if err := Unmarshal(data, &info); err != nil {
+		t.Fatalf("Unmarshal() = %v", err)
+	}
+	want := connectInfo{
+		App:            "live",
+		FlashVer:       "default",
+		TcUrl:          "rtmp://localhost/live",
+		SwfUrl:         "default",
+		AudioCodecs:    3575,
+		ObjectEncoding: 3,
+		Params:         &connectParams{Token: "abc"},
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("Unmarshal() = %+v, want %+v", info, want)
+	}
+
+	tests := []struct {
+		name     string
+		metadata Metadata
+		want     error
+	}{
+		{"string into a number", Metadata{"objectEncoding": "3"}, ErrWrongType},
+		{"number into a string", Metadata{"app": 3.0}, ErrWrongType},
+		{"negative number into an unsigned field", Metadata{"audioCodecs": -1.0}, ErrWrongType},
+		{"overflow", Metadata{"audioCodecs": 70000.0}, ErrWrongType},
+	}
+	for _, test := range tests {
+		var info connectInfo
+		if err := test.metadata.Unmarshal(&info); !errors.Is(err, test.want) {
+			t.Errorf("%s: Unmarshal() = %v, want %v", test.name, err, test.want)
+		}
+	}
+	if err := Unmarshal(data, connectInfo{}); !errors.Is(err, ErrInvalidTarget) {
+		t.Errorf("Unmarshal() into a struct that isn't a pointer = %v, want ErrInvalidTarget", err)
+	}
+}
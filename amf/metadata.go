@@ -1,15 +1,34 @@
 package amf
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"strings"
+
+	"github.com/codingpa-ws/rtmp/amf/amf0"
+	"github.com/codingpa-ws/rtmp/amf/amf3"
 )
 
+var ErrKeyNotFound error = errors.New("amf: key not found in metadata")
+var ErrWrongType error = errors.New("amf: metadata value has the wrong type")
+
+// Metadata is an AMF object or ECMA array, such as the command object of connect. Its keys are case-insensitive.
+// A nil Metadata (eg: a null command object) is valid and has no keys, so all accessors can be called on it.
 type Metadata map[string]any
 
+// OrderedMetadata is an AMF object that keeps the order of its keys, so that it's encoded back in the same order (see
+// DecodeOrdered). Metadata(o.Map()) gives access to its keys as a Metadata.
+type OrderedMetadata = amf0.OrderedObject
+
+// Get returns the value of key, or nil if there's no such key. Undefined values are returned as nil too, like null
+// values, since they're both meant as the absence of a value. Index the map directly to tell them apart.
 func (m Metadata) Get(key string) any {
 	for k := range m {
 		if strings.EqualFold(k, key) {
+			if _, undefined := m[k].(Undefined); undefined {
+				return nil
+			}
 			return m[k]
 		}
 	}
@@ -17,18 +36,150 @@ func (m Metadata) Get(key string) any {
 	return nil
 }
 
+// GetString returns the string value of key. The error wraps ErrKeyNotFound if there's no such key (or it's null), or
+// ErrWrongType if the value isn't a string.
 func (m Metadata) GetString(key string) (string, error) {
 	result := m.Get(key)
 
 	if result == nil {
-		return "", fmt.Errorf("could not find key '%s' in metadata", key)
+		return "", fmt.Errorf("%w: '%s'", ErrKeyNotFound, key)
 	}
 
 	str, ok := result.(string)
 
 	if !ok {
-		return "", fmt.Errorf("metadata value forkey '%s' is not a string", key)
+		return "", fmt.Errorf("%w: value for key '%s' is not a string", ErrWrongType, key)
 	}
 
 	return str, nil
 }
+
+// GetFloat64 returns the number value of key. The error wraps ErrKeyNotFound if there's no such key (or it's null), or
+// ErrWrongType if the value isn't a number.
+func (m Metadata) GetFloat64(key string) (float64, error) {
+	result := m.Get(key)
+
+	if result == nil {
+		return 0, fmt.Errorf("%w: '%s'", ErrKeyNotFound, key)
+	}
+
+	number, ok := asFloat64(result)
+
+	if !ok {
+		return 0, fmt.Errorf("%w: value for key '%s' is not a number", ErrWrongType, key)
+	}
+
+	return number, nil
+}
+
+// GetFloat64Default returns the number value of key, or defaultValue if there's no such key or it isn't a number.
+func (m Metadata) GetFloat64Default(key string, defaultValue float64) float64 {
+	number, err := m.GetFloat64(key)
+	if err != nil {
+		return defaultValue
+	}
+	return number
+}
+
+// GetInt returns the number value of key as an int. The error wraps ErrKeyNotFound if there's no such key (or it's
+// null), or ErrWrongType if the value isn't a number or isn't an integer.
+func (m Metadata) GetInt(key string) (int, error) {
+	number, err := m.GetFloat64(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if number != math.Trunc(number) || number < math.MinInt || number > math.MaxInt {
+		return 0, fmt.Errorf("%w: value for key '%s' is not an integer", ErrWrongType, key)
+	}
+
+	return int(number), nil
+}
+
+// GetBool returns the boolean value of key. The error wraps ErrKeyNotFound if there's no such key (or it's null), or
+// ErrWrongType if the value isn't a boolean.
+func (m Metadata) GetBool(key string) (bool, error) {
+	result := m.Get(key)
+
+	if result == nil {
+		return false, fmt.Errorf("%w: '%s'", ErrKeyNotFound, key)
+	}
+
+	b, ok := result.(bool)
+
+	if !ok {
+		return false, fmt.Errorf("%w: value for key '%s' is not a boolean", ErrWrongType, key)
+	}
+
+	return b, nil
+}
+
+// GetMap returns the value of key, an object or an ECMA array, as Metadata. The error wraps ErrKeyNotFound if there's no
+// such key (or it's null), or ErrWrongType if the value is neither an object nor an ECMA array.
+func (m Metadata) GetMap(key string) (Metadata, error) {
+	result := m.Get(key)
+
+	if result == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrKeyNotFound, key)
+	}
+
+	properties, ok := asMetadata(result)
+
+	if !ok {
+		return nil, fmt.Errorf("%w: value for key '%s' is not an object", ErrWrongType, key)
+	}
+
+	return properties, nil
+}
+
+// GetSlice returns the value of key, a strict array. The error wraps ErrKeyNotFound if there's no such key (or it's
+// null), or ErrWrongType if the value isn't a strict array.
+func (m Metadata) GetSlice(key string) ([]any, error) {
+	result := m.Get(key)
+
+	if result == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrKeyNotFound, key)
+	}
+
+	values, ok := result.([]any)
+
+	if !ok {
+		return nil, fmt.Errorf("%w: value for key '%s' is not an array", ErrWrongType, key)
+	}
+
+	return values, nil
+}
+
+// asFloat64 returns the value of a number, which is a float64 in AMF0 and can also be an int in AMF3.
+func asFloat64(value any) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case int:
+		return float64(number), true
+	default:
+		return 0, false
+	}
+}
+
+// asMetadata returns the properties of an object or an ECMA array, whatever its representation.
+func asMetadata(value any) (Metadata, bool) {
+	switch value := value.(type) {
+	case map[string]any:
+		return value, true
+	case Metadata:
+		return value, true
+	case amf0.ECMAArray:
+		return Metadata(value), true
+	case amf0.TypedObject:
+		return value.Properties, true
+	case amf3.TypedObject:
+		return value.Properties, true
+	case amf0.OrderedObject:
+		return value.Map(), true
+	case amf0.OrderedECMAArray:
+		return Metadata(value.Map()), true
+	default:
+		return nil, false
+	}
+}
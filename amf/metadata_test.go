@@ -0,0 +1,115 @@
+package amf
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/codingpa-ws/rtmp/amf/amf0"
+)
+
+func TestMetadataGetters(t *testing.T) {
+	m := Metadata{
+		"Width":     1280.0,
+		"framerate": 29.97,
+		"level":     3,
+		"stereo":    true,
+		"encoder":   "Lavf58.76.100",
+		"ex":        amf0.ECMAArray{"code": 302.0},
+		"typed":     amf0.TypedObject{ClassName: "Flash", Properties: map[string]any{"a": "b"}},
+		"keyframes": []any{0.0, 2.0},
+		"null":      nil,
+		"undefined": amf0.Undefined{},
+	}
+	getters := map[string]func(string) (any, error){
+		"GetString":  func(key string) (any, error) { return m.GetString(key) },
+		"GetFloat64": func(key string) (any, error) { return m.GetFloat64(key) },
+		"GetInt":     func(key string) (any, error) { return m.GetInt(key) },
+		"GetBool":    func(key string) (any, error) { return m.GetBool(key) },
+		"GetMap":     func(key string) (any, error) { return m.GetMap(key) },
+		"GetSlice":   func(key string) (any, error) { return m.GetSlice(key) },
+	}
+	tests := []struct {
+		getter string
+		key    string
+		want   any
+		err    error
+	}{
+		{"GetString", "ENCODER", "Lavf58.76.100", nil},
+		{"GetString", "width", "", ErrWrongType},
+		{"GetString", "missing", "", ErrKeyNotFound},
+		{"GetFloat64", "width", 1280.0, nil},
+		{"GetFloat64", "level", 3.0, nil},
+		{"GetFloat64", "encoder", 0.0, ErrWrongType},
+		{"GetFloat64", "null", 0.0, ErrKeyNotFound},
+		{"GetInt", "width", 1280, nil},
+		{"GetInt", "framerate", 0, ErrWrongType},
+		{"GetInt", "undefined", 0, ErrKeyNotFound},
+		{"GetBool", "Stereo", true, nil},
+		{"GetBool", "width", false, ErrWrongType},
+		{"GetBool", "missing", false, ErrKeyNotFound},
+		{"GetMap", "ex", Metadata{"code": 302.0}, nil},
+		{"GetMap", "typed", Metadata{"a": "b"}, nil},
+		{"GetMap", "keyframes", Metadata(nil), ErrWrongType},
+		{"GetMap", "missing", Metadata(nil), ErrKeyNotFound},
+		{"GetSlice", "keyframes", []any{0.0, 2.0}, nil},
+		{"GetSlice", "ex", []any(nil), ErrWrongType},
+		{"GetSlice", "missing", []any(nil), ErrKeyNotFound},
+	}
+	for _, tt := range tests {
+		got, err := getters[tt.getter](tt.key)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s(%q) error = %v, want %v", tt.getter, tt.key, err, tt.err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s(%q) = %#v, want %#v", tt.getter, tt.key, got, tt.want)
+		}
+	}
+
+	if v := m.GetFloat64Default("framerate", 30); v != 29.97 {
+		t.Errorf("GetFloat64Default() = %v, want the value of the key", v)
+	}
+	for _, key := range []string{"missing", "encoder"} {
+		if v := m.GetFloat64Default(key, 30); v != 30 {
+			t.Errorf("GetFloat64Default(%q) = %v, want the default value", key, v)
+		}
+	}
+}
+
+// TestNilMetadata calls every accessor on a nil Metadata (eg: a null command object), which must behave like an empty
+// one instead of panicking.
+func TestNilMetadata(t *testing.T) {
+	var m Metadata
+	if v := m.Get("app"); v != nil {
+		t.Errorf("Get() = %v, want nil", v)
+	}
+	accessors := map[string]func() error{
+		"GetString":  func() error { _, err := m.GetString("app"); return err },
+		"GetFloat64": func() error { _, err := m.GetFloat64("objectEncoding"); return err },
+		"GetInt":     func() error { _, err := m.GetInt("objectEncoding"); return err },
+		"GetBool":    func() error { _, err := m.GetBool("fpad"); return err },
+		"GetMap":     func() error { _, err := m.GetMap("ex"); return err },
+		"GetSlice":   func() error { _, err := m.GetSlice("keyframes"); return err },
+	}
+	for name, accessor := range accessors {
+		if err := accessor(); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("%s() = %v, want ErrKeyNotFound", name, err)
+		}
+	}
+	if v := m.GetFloat64Default("objectEncoding", 3); v != 3 {
+		t.Errorf("GetFloat64Default() = %v, want the default value", v)
+	}
+
+	var commandObject struct {
+		App string
+	}
+	if err := m.Unmarshal(&commandObject); err != nil || commandObject.App != "" {
+		t.Errorf("Unmarshal() = %v, decoded %+v, want an empty struct", err, commandObject)
+	}
+
+	// A missing nested object gives a nil Metadata too, whose accessors can be chained
+	ex, _ := Metadata{"code": "NetConnection.Connect.Rejected"}.GetMap("ex")
+	if _, err := ex.GetString("redirect"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetString() on a missing nested object = %v, want ErrKeyNotFound", err)
+	}
+}
@@ -0,0 +1,78 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidASC error = errors.New("audio: invalid AudioSpecificConfig")
+
+// Sample rates of the sampling frequency indexes of the AudioSpecificConfig
+var aacSampleRates = [13]int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// ParseASC parses the AudioSpecificConfig of an AAC sequence header, as cached by SetAacSequenceHeaderForPublisher (ie.
+// the payload of the audio message, with its audio tag header or Enhanced RTMP extended header). It returns the sample
+// rate and the number of channels of the stream, which the audio tag header can't represent accurately (eg: 48000 Hz),
+// and the audio object type (eg: 2 for AAC LC). channels is 0 if the channel configuration is given by a program
+// config element.
+func ParseASC(payload []byte) (sampleRate int, channels int, objectType int, err error) {
+	header := ParseHeader(payload)
+	if header.Format != AAC || !header.IsSequenceHeader() {
+		return 0, 0, 0, fmt.Errorf("%w: not an AAC sequence header", ErrInvalidASC)
+	}
+	// Sound format and AAC packet type, or an extended header and its FourCC
+	offset := 2
+	if header.Extended {
+		offset = 5
+	}
+	if len(payload) < offset {
+		return 0, 0, 0, fmt.Errorf("%w: truncated audio tag header", ErrInvalidASC)
+	}
+
+	r := &bitReader{b: payload[offset:]}
+	objectType = int(r.bits(5))
+	if objectType == 31 {
+		// Escape value, the object type follows
+		objectType = 32 + int(r.bits(6))
+	}
+	frequencyIndex := r.bits(4)
+	if frequencyIndex == 15 {
+		// Explicit sample rate
+		sampleRate = int(r.bits(24))
+	} else if int(frequencyIndex) < len(aacSampleRates) {
+		sampleRate = aacSampleRates[frequencyIndex]
+	} else {
+		return 0, 0, 0, fmt.Errorf("%w: reserved sampling frequency index %d", ErrInvalidASC, frequencyIndex)
+	}
+	channels = int(r.bits(4))
+	if r.truncated {
+		return 0, 0, 0, fmt.Errorf("%w: truncated", ErrInvalidASC)
+	}
+	// Channel configuration 7 is 7.1, which has 8 channels
+	if channels == 7 {
+		channels = 8
+	} else if channels > 7 {
+		return 0, 0, 0, fmt.Errorf("%w: reserved channel configuration %d", ErrInvalidASC, channels)
+	}
+	return sampleRate, channels, objectType, nil
+}
+
+// bitReader reads bits MSB first. Reading past the end sets truncated, and every read that follows returns 0.
+type bitReader struct {
+	b         []byte
+	pos       int
+	truncated bool
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.b)*8 {
+			r.truncated = true
+			return 0
+		}
+		v = v<<1 | uint32(r.b[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
@@ -0,0 +1,56 @@
+package audio
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseASC(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    []byte
+		sampleRate int
+		channels   int
+		objectType int
+	}{
+		// Sent by OBS and FFmpeg
+		{"AAC LC 44.1 kHz stereo", []byte{0xaf, 0x00, 0x12, 0x10}, 44100, 2, 2},
+		{"AAC LC 48 kHz mono", []byte{0xaf, 0x00, 0x11, 0x88}, 48000, 1, 2},
+		// The audio tag header of AAC says 44 kHz stereo whatever the stream is
+		{"AAC LC 48 kHz 7.1", []byte{0xaf, 0x00, 0x11, 0xb8}, 48000, 8, 2},
+		{"HE-AAC with explicit SBR", []byte{0xaf, 0x00, 0x2b, 0x92, 0x08, 0x00}, 22050, 2, 5},
+		{"extended header", []byte{0x90, 'm', 'p', '4', 'a', 0x11, 0x90}, 48000, 2, 2},
+		{"escaped object type", []byte{0xaf, 0x00, 0xf8, 0x48, 0x40}, 44100, 2, 34},
+		{"explicit sample rate", []byte{0xaf, 0x00, 0x17, 0x80, 0x5d, 0xc0, 0x08}, 48000, 1, 2},
+		// The channels are given by a program config element
+		{"channel configuration 0", []byte{0xaf, 0x00, 0x12, 0x00}, 44100, 0, 2},
+	}
+	for _, tt := range tests {
+		sampleRate, channels, objectType, err := ParseASC(tt.payload)
+		if err != nil {
+			t.Errorf("ParseASC(%s) = %v", tt.name, err)
+			continue
+		}
+		if sampleRate != tt.sampleRate || channels != tt.channels || objectType != tt.objectType {
+			t.Errorf("ParseASC(%s) = %d Hz, %d channels, object type %d, want %d Hz, %d channels, object type %d", tt.name,
+				sampleRate, channels, objectType, tt.sampleRate, tt.channels, tt.objectType)
+		}
+	}
+}
+
+func TestParseASCInvalid(t *testing.T) {
+	for name, payload := range map[string][]byte{
+		"empty":                    nil,
+		"AAC frame":                {0xaf, 0x01, 0x12, 0x10},
+		"MP3 frame":                {0x2f, 0x00, 0x12, 0x10},
+		"Opus sequence start":      {0x90, 'O', 'p', 'u', 's', 0x4f, 0x70},
+		"truncated":                {0xaf, 0x00, 0x12},
+		"truncated sample rate":    {0xaf, 0x00, 0x17, 0x80, 0x5d},
+		"reserved frequency index": {0xaf, 0x00, 0x16, 0x90},
+		"reserved channels":        {0xaf, 0x00, 0x12, 0x40},
+	} {
+		if _, _, _, err := ParseASC(payload); !errors.Is(err, ErrInvalidASC) {
+			t.Errorf("ParseASC(%s) = %v, want ErrInvalidASC", name, err)
+		}
+	}
+}
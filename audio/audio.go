@@ -1,5 +1,11 @@
 package audio
 
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
 // As defined in the FLV spec: https://www.adobe.com/content/dam/acom/en/devnet/flv/video_file_format_spec_v10_1.pdf
 
 type Format uint8
@@ -14,12 +20,59 @@ const (
 	Nellymoser              Format = 6
 	G711AlawLogPCM          Format = 7
 	G711MulawLogPCM         Format = 8
+	ExHeader                Format = 9 // Enhanced RTMP extended header (see ParseHeader)
 	AAC                     Format = 10
 	Speex                   Format = 11
 	MP38KHz                 Format = 14
 	DeviceSpecificSound     Format = 15
 )
 
+// Formats that the FLV spec doesn't define, which are only carried by Enhanced RTMP extended headers and identified
+// by their FourCC. Their IDs are outside the 4 bits of the sound format of FLV headers, so that they're never mistaken
+// for one (12 and 13 are reserved).
+const (
+	Opus Format = 16
+)
+
+// Flags of the audioCodecs property of the connect command, which tells the codecs a player supports
+const (
+	SupportSndADPCM   uint16 = 0x0002
+	SupportSndMP3     uint16 = 0x0004
+	SupportSndNelly8  uint16 = 0x0020
+	SupportSndNelly   uint16 = 0x0040
+	SupportSndG711A   uint16 = 0x0080
+	SupportSndG711U   uint16 = 0x0100
+	SupportSndNelly16 uint16 = 0x0200
+	SupportSndAAC     uint16 = 0x0400
+	SupportSndSpeex   uint16 = 0x0800
+)
+
+// SupportFlag returns the audioCodecs flag of the format f, or 0 if it doesn't have one.
+func (f Format) SupportFlag() uint16 {
+	switch f {
+	case ADPCM:
+		return SupportSndADPCM
+	case MP3, MP38KHz:
+		return SupportSndMP3
+	case Nellymoser8KHzMono:
+		return SupportSndNelly8
+	case Nellymoser:
+		return SupportSndNelly
+	case G711AlawLogPCM:
+		return SupportSndG711A
+	case G711MulawLogPCM:
+		return SupportSndG711U
+	case Nellymoser16KHzMono:
+		return SupportSndNelly16
+	case AAC:
+		return SupportSndAAC
+	case Speex:
+		return SupportSndSpeex
+	default:
+		return 0
+	}
+}
+
 type SampleRate uint8
 
 const (
@@ -49,3 +102,199 @@ const (
 	AACSequenceHeader AACPacketType = 0
 	AACRaw            AACPacketType = 1
 )
+
+// PacketType is the packet type of an Enhanced RTMP (https://github.com/veovera/enhanced-rtmp) extended audio tag
+// header, which carries codecs that the FLV spec doesn't define. Its sound format is ExHeader, the low 4 bits of the
+// first byte are the packet type, and the FourCC of the codec follows.
+type PacketType uint8
+
+const (
+	PacketTypeSequenceStart      PacketType = 0
+	PacketTypeCodedFrames        PacketType = 1
+	PacketTypeSequenceEnd        PacketType = 2
+	PacketTypeMultichannelConfig PacketType = 4
+)
+
+// FourCC identifies the codec of an Enhanced RTMP extended audio tag header.
+type FourCC [4]byte
+
+var FourCCOpus = FourCC{'O', 'p', 'u', 's'}
+var FourCCAAC = FourCC{'m', 'p', '4', 'a'}
+var FourCCMP3 = FourCC{'.', 'm', 'p', '3'}
+
+// Format returns the format identified by the FourCC, or ExHeader if it isn't known.
+func (f FourCC) Format() Format {
+	switch f {
+	case FourCCOpus:
+		return Opus
+	case FourCCAAC:
+		return AAC
+	case FourCCMP3:
+		return MP3
+	default:
+		return ExHeader
+	}
+}
+
+// MetadataFormat returns the format identified by the audiocodecid property of onMetaData. Encoders write it either as
+// the sound format of the FLV audio tag header (eg: 10 for AAC, by FFmpeg and older versions of OBS), or as the FourCC
+// of the codec, itself written as a string (eg: "Opus", by OBS) or as a number (the FourCC read as a big endian
+// integer, by FFmpeg for Enhanced RTMP codecs). It returns false if the value doesn't identify a known format.
+func MetadataFormat(value any) (Format, bool) {
+	var fourCC FourCC
+	switch value := value.(type) {
+	case float64:
+		if value != math.Trunc(value) || value < 0 || value > math.MaxUint32 {
+			return 0, false
+		}
+		if value <= 0x0F {
+			switch format := Format(value); format {
+			case ExHeader, 12, 13:
+				// Not sound formats of the FLV spec (12 and 13 are reserved)
+				return 0, false
+			default:
+				return format, true
+			}
+		}
+		binary.BigEndian.PutUint32(fourCC[:], uint32(value))
+	case string:
+		if len(value) != len(fourCC) {
+			return 0, false
+		}
+		copy(fourCC[:], value)
+	default:
+		return 0, false
+	}
+	format := fourCC.Format()
+	return format, format != ExHeader
+}
+
+// Header is the audio tag header at the beginning of the payload of an audio message.
+type Header struct {
+	Format Format
+	// Only set for FLV headers, extended headers leave them to the codec's configuration
+	SampleRate SampleRate
+	SampleSize SampleSize
+	Channels   Channel
+	// Whether the header is an Enhanced RTMP extended header, in which case FourCC is set
+	Extended bool
+	FourCC   FourCC
+	// Packet type of extended headers, or the AACPacketType of AAC frames. Both have the same value for sequence
+	// headers.
+	PacketType PacketType
+}
+
+// ParseHeader parses the audio tag header at the beginning of payload, either the FLV header (sound format, rate, size
+// and type) or an Enhanced RTMP extended header. Fields the payload is too short to have are left unset.
+func ParseHeader(payload []byte) Header {
+	var header Header
+	if len(payload) == 0 {
+		return header
+	}
+	header.Format = Format((payload[0] >> 4) & 0x0F)
+	if header.Format != ExHeader {
+		header.SampleRate = SampleRate((payload[0] >> 2) & 0x03)
+		header.SampleSize = SampleSize((payload[0] >> 1) & 1)
+		header.Channels = Channel(payload[0] & 1)
+		if header.Format == AAC && len(payload) > 1 {
+			header.PacketType = PacketType(payload[1])
+		}
+		return header
+	}
+	header.Extended = true
+	header.PacketType = PacketType(payload[0] & 0x0F)
+	if len(payload) >= 5 {
+		copy(header.FourCC[:], payload[1:5])
+		header.Format = header.FourCC.Format()
+	}
+	return header
+}
+
+// IsSequenceHeader returns whether the header is the one of a sequence header: the AudioSpecificConfig of AAC, or the
+// configuration of a codec carried by an extended header (eg: the identification header of Opus).
+func (h Header) IsSequenceHeader() bool {
+	if h.Extended {
+		return h.PacketType == PacketTypeSequenceStart
+	}
+	return h.Format == AAC && h.PacketType == PacketTypeSequenceStart
+}
+
+// HasSequenceHeader returns whether frames of the format are decoded with a sequence header, which must be sent before
+// them.
+func (f Format) HasSequenceHeader() bool {
+	return f == AAC || f == Opus
+}
+
+func (f Format) String() string {
+	switch f {
+	case LinearPCMPlatformEndian:
+		return "LinearPCM"
+	case ADPCM:
+		return "ADPCM"
+	case MP3:
+		return "MP3"
+	case LinearPCMLittleEndian:
+		return "LinearPCMLittleEndian"
+	case Nellymoser16KHzMono:
+		return "Nellymoser16kHzMono"
+	case Nellymoser8KHzMono:
+		return "Nellymoser8kHzMono"
+	case Nellymoser:
+		return "Nellymoser"
+	case G711AlawLogPCM:
+		return "G711Alaw"
+	case G711MulawLogPCM:
+		return "G711Mulaw"
+	case ExHeader:
+		return "ExHeader"
+	case AAC:
+		return "AAC"
+	case Speex:
+		return "Speex"
+	case Opus:
+		return "Opus"
+	case MP38KHz:
+		return "MP38kHz"
+	case DeviceSpecificSound:
+		return "DeviceSpecific"
+	default:
+		return fmt.Sprintf("Format(%d)", uint8(f))
+	}
+}
+
+func (r SampleRate) String() string {
+	switch r {
+	case Rate5p5KHz:
+		return "5.5kHz"
+	case Rate11KHz:
+		return "11kHz"
+	case Rate22KHz:
+		return "22kHz"
+	case Rate44KHz:
+		return "44kHz"
+	default:
+		return fmt.Sprintf("SampleRate(%d)", uint8(r))
+	}
+}
+
+func (s SampleSize) String() string {
+	switch s {
+	case Size8Bit:
+		return "8bit"
+	case Size16Bit:
+		return "16bit"
+	default:
+		return fmt.Sprintf("SampleSize(%d)", uint8(s))
+	}
+}
+
+func (c Channel) String() string {
+	switch c {
+	case Mono:
+		return "mono"
+	case Stereo:
+		return "stereo"
+	default:
+		return fmt.Sprintf("Channel(%d)", uint8(c))
+	}
+}
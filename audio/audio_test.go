@@ -0,0 +1,119 @@
+package audio
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		name           string
+		payload        []byte
+		want           Header
+		sequenceHeader bool
+	}{
+		{
+			"AAC sequence header",
+			[]byte{0xaf, 0x00, 0x12, 0x10},
+			Header{Format: AAC, SampleRate: Rate44KHz, SampleSize: Size16Bit, Channels: Stereo, PacketType: PacketTypeSequenceStart},
+			true,
+		},
+		{
+			"AAC frame",
+			[]byte{0xaf, 0x01, 0x21},
+			Header{Format: AAC, SampleRate: Rate44KHz, SampleSize: Size16Bit, Channels: Stereo, PacketType: PacketTypeCodedFrames},
+			false,
+		},
+		{
+			"Opus sequence start",
+			[]byte{0x90, 'O', 'p', 'u', 's', 'O', 'p', 'u', 's', 'H', 'e', 'a', 'd'},
+			Header{Format: Opus, Extended: true, FourCC: FourCCOpus, PacketType: PacketTypeSequenceStart},
+			true,
+		},
+		{
+			"Opus coded frames",
+			[]byte{0x91, 'O', 'p', 'u', 's', 0xfc},
+			Header{Format: Opus, Extended: true, FourCC: FourCCOpus, PacketType: PacketTypeCodedFrames},
+			false,
+		},
+		{
+			"unknown FourCC",
+			[]byte{0x91, 'f', 'L', 'a', 'C'},
+			Header{Format: ExHeader, Extended: true, FourCC: FourCC{'f', 'L', 'a', 'C'}, PacketType: PacketTypeCodedFrames},
+			false,
+		},
+		{
+			"truncated extended header",
+			[]byte{0x90, 'O', 'p'},
+			Header{Format: ExHeader, Extended: true, PacketType: PacketTypeSequenceStart},
+			true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := ParseHeader(test.payload)
+			if header != test.want {
+				t.Errorf("ParseHeader() = %+v, want %+v", header, test.want)
+			}
+			if header.IsSequenceHeader() != test.sequenceHeader {
+				t.Errorf("IsSequenceHeader() = %t, want %t", header.IsSequenceHeader(), test.sequenceHeader)
+			}
+		})
+	}
+}
+
+func TestMetadataFormat(t *testing.T) {
+	tests := []struct {
+		value  any
+		want   Format
+		wantOK bool
+	}{
+		{10.0, AAC, true},
+		{2.0, MP3, true},
+		{"Opus", Opus, true},
+		// "Opus" read as a big endian integer
+		{float64(0x4f707573), Opus, true},
+		{"mp4a", AAC, true},
+		// The ID of Opus isn't a sound format of FLV headers, and 13 is reserved
+		{float64(Opus), 0, false},
+		{13.0, 0, false},
+		{9.0, 0, false},
+		{10.5, 0, false},
+		{"fLaC", 0, false},
+		{true, 0, false},
+	}
+	for _, test := range tests {
+		format, ok := MetadataFormat(test.value)
+		if ok != test.wantOK || (ok && format != test.want) {
+			t.Errorf("MetadataFormat(%v) = %v, %t, want %v, %t", test.value, format, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		value fmt.Stringer
+		want  string
+	}{
+		{AAC, "AAC"},
+		{MP3, "MP3"},
+		{Opus, "Opus"},
+		{MP38KHz, "MP38kHz"},
+		{Nellymoser8KHzMono, "Nellymoser8kHzMono"},
+		{Format(12), "Format(12)"},
+		{Rate5p5KHz, "5.5kHz"},
+		{Rate44KHz, "44kHz"},
+		{SampleRate(4), "SampleRate(4)"},
+		{Size8Bit, "8bit"},
+		{Size16Bit, "16bit"},
+		{SampleSize(2), "SampleSize(2)"},
+		{Mono, "mono"},
+		{Stereo, "stereo"},
+		{Channel(5), "Channel(5)"},
+	}
+	for _, test := range tests {
+		if got := test.value.String(); got != test.want {
+			t.Errorf("%T(%d).String() = %q, want %q", test.value, test.value, got, test.want)
+		}
+	}
+}
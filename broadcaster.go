@@ -1,8 +1,17 @@
 package rtmp
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+	"time"
+)
 
 // A subscriber gets sent audio, video and data messages that flow in a particular stream (identified with streamKey)
+//
+// The payloads passed to SendAudio and SendVideo are shared by every subscriber of the stream (and by the GOP cache),
+// they aren't copied for each of them. They're read-only: subscribers must not modify them, and must copy them if
+// they keep them after the call returns (eg: to queue them for another goroutine), since the payload is only
+// guaranteed to be left untouched by its owner for the duration of the call.
 type Subscriber interface {
 	SendAudio(audio []byte, timestamp uint32)
 	SendVideo(video []byte, timestamp uint32)
@@ -11,6 +20,28 @@ type Subscriber interface {
 	SendEndOfStream()
 }
 
+// BufferedSubscriber can optionally be implemented by a Subscriber that knows the length of the buffer of its player
+// (eg: set with the SetBufferLength user control message), or 0 if it doesn't. Players with a buffer shorter than the
+// frames cached for the stream (see GOPCacheBroadcaster) aren't sent any of them, since they would play them behind live. The
+// cached frames aren't trimmed to fit the buffer either: each of them depends on the ones before it, up to the keyframe
+// the cache starts with, so these players wait for the next keyframe instead.
+type BufferedSubscriber interface {
+	BufferLength() time.Duration
+}
+
+// StreamDrySubscriber can optionally be implemented by a Subscriber to be notified when the publisher of its stream
+// stops sending data without ending the stream (see Server.StreamDryTimeout).
+type StreamDrySubscriber interface {
+	SendStreamDry()
+}
+
+// StreamDryBroadcaster can optionally be implemented by a Broadcaster to notify the subscribers of a stream when its
+// publisher stops sending data without ending it (see Server.StreamDryTimeout). The broadcasters created with
+// NewBroadcaster implement it.
+type StreamDryBroadcaster interface {
+	BroadcastStreamDry(streamKey string)
+}
+
 type Broadcaster interface {
 	BroadcastAudio(streamKey string, audio []byte, timestamp uint32) error
 	BroadcastEndOfStream(streamKey string)
@@ -30,10 +61,79 @@ type Broadcaster interface {
 	AppName() string
 }
 
+// SinkBroadcaster can optionally be implemented by a Broadcaster to subscribe custom sinks (eg: recorders, or forwarders
+// to another protocol) to its streams besides players. The broadcasters created with NewBroadcaster implement it.
+type SinkBroadcaster interface {
+	AddSink(streamKey string, sink Subscriber) error
+	RemoveSink(streamKey string, id string) error
+}
+
+// StatsBroadcaster can optionally be implemented by a Broadcaster to report the activity of its streams. The
+// broadcasters created with NewBroadcaster implement it.
+type StatsBroadcaster interface {
+	StreamStats(streamKey string) (StreamStats, bool)
+}
+
+// GOPCacheBroadcaster can optionally be implemented by a Broadcaster that primes new subscribers with the frames of
+// their stream since its last keyframe, so they don't wait for the next one to start playing. The broadcasters created
+// with NewBroadcaster implement it.
+type GOPCacheBroadcaster interface {
+	SetGOPCache(maxFrames int)
+}
+
+// GOPCacheBudgetBroadcaster can optionally be implemented by a GOPCacheBroadcaster to cap the memory used by the GOP
+// caches of its streams with a GOPCacheBudget, which can be shared with other broadcasters to cap the memory used by
+// every stream of a server (Server.Stats reports its usage). The broadcasters created with NewBroadcaster implement it.
+type GOPCacheBudgetBroadcaster interface {
+	SetGOPCacheBudget(budget *GOPCacheBudget)
+	GetGOPCacheBudget() *GOPCacheBudget
+}
+
+// StreamListBroadcaster can optionally be implemented by a Broadcaster to list its streams and count their subscribers
+// (eg: for Server.Stats). The broadcasters created with NewBroadcaster implement it, listing the streams of their
+// context if it implements StreamLister.
+type StreamListBroadcaster interface {
+	GetStreamKeys() []string
+	GetSubscriberCount(streamKey string) int
+}
+
+// FilePlayer can optionally be implemented by a Broadcaster to publish recorded FLV files to its streams, as if they
+// were published live. The broadcasters created with NewBroadcaster implement it.
+type FilePlayer interface {
+	PlayFile(streamKey string, path string, loop bool) error
+}
+
+// ClockBroadcaster can optionally be implemented by a Broadcaster whose pacing of files played with PlayFile can be
+// controlled with a Clock (eg: in tests). The broadcasters created with NewBroadcaster implement it.
+type ClockBroadcaster interface {
+	SetClock(Clock)
+}
+
 type broadcaster struct {
 	appName      string
 	context      ContextStore
 	sessionGuard SessionGuard
+	resolver     StreamResolver
+	// Paces files published with PlayFile. If nil, SystemClock is used.
+	clock Clock
+	// Streams published through the broadcaster (*publishedStream), by stream key
+	streams sync.Map
+	// Maximum number of frames of the GOP cache of each stream, 0 if new subscribers aren't primed with a GOP cache
+	gopCacheFrames int
+	// Caps the memory used by the GOP caches of the streams, nil if it isn't capped
+	gopCacheBudget *GOPCacheBudget
+	// Held by AddSink between checking that the ID of a sink is unique and registering it
+	sinkMutex sync.Mutex
+}
+
+// publishedStream holds the stats of a stream while it's published.
+type publishedStream struct {
+	publishTime time.Time
+	traffic     mediaTraffic
+	// nil if the GOP cache is disabled
+	gop *gopCache
+	// Set if the stream is a recording played with PlayFile
+	recorded bool
 }
 
 func NewBroadcaster(appName string, context ContextStore) Broadcaster {
@@ -44,22 +144,102 @@ func NewBroadcaster(appName string, context ContextStore) Broadcaster {
 }
 
 func (b *broadcaster) RegisterPublisher(streamKey string) error {
-	return b.context.RegisterPublisher(streamKey)
+	return b.registerPublisher(streamKey, false)
+}
+
+func (b *broadcaster) registerPublisher(streamKey string, recorded bool) error {
+	stream := &publishedStream{publishTime: time.Now(), recorded: recorded}
+	if b.gopCacheFrames > 0 {
+		stream.gop = newGOPCache(b.gopCacheFrames)
+	}
+	// The stream of the publisher that already has the key (if any) is left untouched
+	if err := b.context.RegisterPublisher(streamKey); err != nil {
+		return err
+	}
+	if stream.gop != nil && b.gopCacheBudget != nil {
+		stream.gop.budget = b.gopCacheBudget
+		stream.gop.publishTime = stream.publishTime
+		stream.gop.subscribers = func() int { return b.GetSubscriberCount(streamKey) }
+		b.gopCacheBudget.add(stream.gop)
+	}
+	b.streams.Store(streamKey, stream)
+	return nil
+}
+
+// publishedStream returns the stream published with streamKey, or nil if it wasn't published through the broadcaster.
+func (b *broadcaster) publishedStream(streamKey string) *publishedStream {
+	if stream, ok := b.streams.Load(streamKey); ok {
+		return stream.(*publishedStream)
+	}
+	return nil
 }
 
 func (b *broadcaster) DestroyPublisher(streamKey string) error {
+	if stream := b.publishedStream(streamKey); stream != nil && stream.gop != nil && stream.gop.budget != nil {
+		stream.gop.mutex.Lock()
+		stream.gop.budget.remove(stream.gop)
+		stream.gop.mutex.Unlock()
+	}
+	b.streams.Delete(streamKey)
 	return b.context.DestroyPublisher(streamKey)
 }
 
+// RegisterSubscriber adds a subscriber to a stream. If the GOP cache is enabled, the subscriber is sent the cached
+// frames of the stream first (after the sequence headers, which the caller is expected to have sent).
 func (b *broadcaster) RegisterSubscriber(streamKey string, subscriber Subscriber) error {
+	if stream := b.publishedStream(streamKey); stream != nil && stream.gop != nil {
+		stream.gop.mutex.Lock()
+		defer stream.gop.mutex.Unlock()
+		if err := b.context.RegisterSubscriber(streamKey, subscriber); err != nil {
+			return err
+		}
+		stream.gop.prime(subscriber)
+		return nil
+	}
 	return b.context.RegisterSubscriber(streamKey, subscriber)
 }
 
+// StreamExists returns true if the stream is published locally. Otherwise, the stream resolver (if any) decides whether it exists.
 func (b *broadcaster) StreamExists(streamKey string) bool {
-	return b.context.StreamExists(streamKey)
+	if b.context.StreamExists(streamKey) {
+		return true
+	}
+	if b.resolver != nil {
+		return b.resolver.StreamExists(streamKey)
+	}
+	return false
+}
+
+// GetStreamKeys returns the stream keys of the streams of the underlying context, or nil if it doesn't implement
+// StreamLister.
+func (b *broadcaster) GetStreamKeys() []string {
+	if lister, ok := b.context.(StreamLister); ok {
+		return lister.GetStreamKeys()
+	}
+	return nil
+}
+
+// GetSubscriberCount returns the number of subscribers of a stream, or 0 if the stream doesn't exist.
+func (b *broadcaster) GetSubscriberCount(streamKey string) int {
+	subscribers, err := b.context.GetSubscribersForStream(streamKey)
+	if err != nil {
+		return 0
+	}
+	return len(subscribers)
 }
 
+// BroadcastAudio sends an audio message to the subscribers of a stream. The broadcaster takes ownership of the payload,
+// which is cached (as the sequence header or a frame of the GOP cache) and shared by the subscribers: the caller must
+// not modify or reuse it afterwards. The same goes for BroadcastVideo.
 func (b *broadcaster) BroadcastAudio(streamKey string, audio []byte, timestamp uint32) error {
+	if stream := b.publishedStream(streamKey); stream != nil {
+		stream.traffic.addAudio(len(audio))
+		if stream.gop != nil {
+			stream.gop.mutex.Lock()
+			defer stream.gop.mutex.Unlock()
+			stream.gop.addAudio(audio, timestamp)
+		}
+	}
 	subscribers, err := b.context.GetSubscribersForStream(streamKey)
 	if err != nil {
 		fmt.Println("broadcaster: BroadcastAudio: error getting subscribers for stream, " + err.Error())
@@ -72,6 +252,14 @@ func (b *broadcaster) BroadcastAudio(streamKey string, audio []byte, timestamp u
 }
 
 func (b *broadcaster) BroadcastVideo(streamKey string, video []byte, timestamp uint32) error {
+	if stream := b.publishedStream(streamKey); stream != nil {
+		stream.traffic.addVideo(len(video))
+		if stream.gop != nil {
+			stream.gop.mutex.Lock()
+			defer stream.gop.mutex.Unlock()
+			stream.gop.addVideo(video, timestamp)
+		}
+	}
 	subscribers, err := b.context.GetSubscribersForStream(streamKey)
 	if err != nil {
 		fmt.Println("broadcaster: BroadcastVideo: error getting subscribers for stream, " + err.Error())
@@ -88,6 +276,42 @@ func (b *broadcaster) DestroySubscriber(streamKey string, sessionID string) erro
 	return b.context.DestroySubscriber(streamKey, sessionID)
 }
 
+// AddSink subscribes a custom Subscriber (eg: a recorder or a forwarder to another protocol) to a stream. Like a player,
+// the sink is sent the metadata and the sequence headers of the stream first (and the GOP cache, if it's enabled), so
+// that it can decode the frames that follow. The sink is identified by its GetID, which must be unique among the
+// subscribers of the stream (ErrDuplicateSubscriber is returned otherwise), and is removed with RemoveSink.
+func (b *broadcaster) AddSink(streamKey string, sink Subscriber) error {
+	if !b.context.StreamExists(streamKey) {
+		return ErrStreamNotFound
+	}
+	b.sinkMutex.Lock()
+	defer b.sinkMutex.Unlock()
+	subscribers, err := b.context.GetSubscribersForStream(streamKey)
+	if err != nil {
+		return err
+	}
+	for _, sub := range subscribers {
+		if sub.GetID() == sink.GetID() {
+			return ErrDuplicateSubscriber
+		}
+	}
+	if metadata := b.GetMetadataForPublisher(streamKey); metadata != nil {
+		sink.SendMetadata(metadata)
+	}
+	if avcSeqHeader := b.GetAvcSequenceHeaderForPublisher(streamKey); avcSeqHeader != nil {
+		sink.SendVideo(avcSeqHeader, 0)
+	}
+	if aacSeqHeader := b.GetAacSequenceHeaderForPublisher(streamKey); aacSeqHeader != nil {
+		sink.SendAudio(aacSeqHeader, 0)
+	}
+	return b.RegisterSubscriber(streamKey, sink)
+}
+
+// RemoveSink unsubscribes the sink with the given ID from a stream. The sink isn't sent SendEndOfStream.
+func (b *broadcaster) RemoveSink(streamKey string, id string) error {
+	return b.DestroySubscriber(streamKey, id)
+}
+
 func (b *broadcaster) SetAvcSequenceHeaderForPublisher(streamKey string, payload []byte) {
 	b.context.SetAvcSequenceHeaderForPublisher(streamKey, payload)
 }
@@ -104,6 +328,22 @@ func (b *broadcaster) GetAacSequenceHeaderForPublisher(streamKey string) []byte
 	return b.context.GetAacSequenceHeaderForPublisher(streamKey)
 }
 
+// SetMetadataForPublisher caches the metadata of a stream in the underlying context, if it implements MetadataStore.
+func (b *broadcaster) SetMetadataForPublisher(streamKey string, metadata map[string]any) {
+	if store, ok := b.context.(MetadataStore); ok {
+		store.SetMetadataForPublisher(streamKey, metadata)
+	}
+}
+
+// GetMetadataForPublisher returns the metadata cached for a stream in the underlying context, or nil if the context
+// doesn't implement MetadataStore.
+func (b *broadcaster) GetMetadataForPublisher(streamKey string) map[string]any {
+	if store, ok := b.context.(MetadataStore); ok {
+		return store.GetMetadataForPublisher(streamKey)
+	}
+	return nil
+}
+
 func (b *broadcaster) BroadcastEndOfStream(streamKey string) {
 	subscribers, err := b.context.GetSubscribersForStream(streamKey)
 	if err != nil {
@@ -116,6 +356,20 @@ func (b *broadcaster) BroadcastEndOfStream(streamKey string) {
 	}
 }
 
+// BroadcastStreamDry notifies the subscribers of streamKey that implement StreamDrySubscriber that no data is flowing
+// on the stream.
+func (b *broadcaster) BroadcastStreamDry(streamKey string) {
+	subscribers, err := b.context.GetSubscribersForStream(streamKey)
+	if err != nil {
+		return
+	}
+	for _, sub := range subscribers {
+		if dry, ok := sub.(StreamDrySubscriber); ok {
+			dry.SendStreamDry()
+		}
+	}
+}
+
 func (b *broadcaster) BroadcastMetadata(streamKey string, metadata map[string]any) error {
 	subscribers, err := b.context.GetSubscribersForStream(streamKey)
 	if err != nil {
@@ -137,6 +391,56 @@ func (b *broadcaster) GetSessionGuard() SessionGuard {
 	return b.sessionGuard
 }
 
+// SetStreamResolver sets the resolver consulted by StreamExists for streams that aren't published locally.
+func (b *broadcaster) SetStreamResolver(resolver StreamResolver) {
+	b.resolver = resolver
+}
+
+func (b *broadcaster) GetStreamResolver() StreamResolver {
+	return b.resolver
+}
+
+func (b *broadcaster) SetClock(clock Clock) {
+	b.clock = clock
+}
+
+// SetGOPCache makes the broadcaster cache the frames of every stream published after the call since its last video
+// keyframe, up to maxFrames frames, so that new subscribers start playing from that keyframe instead of waiting for
+// the next one. Their audio starts at the first audio frame that isn't older than the keyframe, to keep lip-sync.
+// Streams whose keyframe interval spans more than maxFrames frames aren't cached, and subscribers whose buffer is
+// shorter than the cached frames aren't sent them (see BufferedSubscriber). If maxFrames is 0, there's no cache.
+func (b *broadcaster) SetGOPCache(maxFrames int) {
+	b.gopCacheFrames = maxFrames
+}
+
+// SetGOPCacheBudget caps the memory used by the GOP caches of the streams published after the call with budget (see
+// GOPCacheBudget). If budget is nil, their memory isn't capped, besides the frames limit of SetGOPCache.
+func (b *broadcaster) SetGOPCacheBudget(budget *GOPCacheBudget) {
+	b.gopCacheBudget = budget
+}
+
+func (b *broadcaster) GetGOPCacheBudget() *GOPCacheBudget {
+	return b.gopCacheBudget
+}
+
 func (b *broadcaster) AppName() string {
 	return b.appName
 }
+
+// Snapshot returns the recoverable state of the underlying context, if it implements Snapshotter.
+func (b *broadcaster) Snapshot() (*ContextSnapshot, error) {
+	snapshotter, ok := b.context.(Snapshotter)
+	if !ok {
+		return nil, ErrSnapshotNotSupported
+	}
+	return snapshotter.Snapshot()
+}
+
+// Restore loads a snapshot into the underlying context, if it implements Snapshotter.
+func (b *broadcaster) Restore(snapshot *ContextSnapshot) error {
+	snapshotter, ok := b.context.(Snapshotter)
+	if !ok {
+		return ErrSnapshotNotSupported
+	}
+	return snapshotter.Restore(snapshot)
+}
@@ -0,0 +1,88 @@
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// testSink records what it's sent, as "<kind>@<timestamp>".
+type testSink struct {
+	id       string
+	received []string
+}
+
+func (s *testSink) SendAudio(audio []byte, timestamp uint32) {
+	s.received = append(s.received, fmt.Sprintf("audio %x@%d", audio, timestamp))
+}
+
+func (s *testSink) SendVideo(video []byte, timestamp uint32) {
+	s.received = append(s.received, fmt.Sprintf("video %x@%d", video, timestamp))
+}
+
+func (s *testSink) SendMetadata(metadata map[string]any) {
+	s.received = append(s.received, fmt.Sprintf("metadata %v", metadata))
+}
+
+func (s *testSink) GetID() string    { return s.id }
+func (s *testSink) SendEndOfStream() { s.received = append(s.received, "end") }
+
+func TestAddSink(t *testing.T) {
+	b := NewBroadcaster("app", NewInMemoryContext()).(*broadcaster)
+	if err := b.AddSink("live", &testSink{id: "sink"}); !errors.Is(err, ErrStreamNotFound) {
+		t.Fatalf("AddSink() on an unpublished stream = %v, want ErrStreamNotFound", err)
+	}
+
+	if err := b.RegisterPublisher("live"); err != nil {
+		t.Fatal(err)
+	}
+	b.SetMetadataForPublisher("live", map[string]any{"width": 1280.0})
+	b.SetAvcSequenceHeaderForPublisher("live", []byte{0x17, 0x00})
+	b.SetAacSequenceHeaderForPublisher("live", []byte{0xaf, 0x00})
+
+	sink := &testSink{id: "sink"}
+	if err := b.AddSink("live", sink); err != nil {
+		t.Fatalf("AddSink() = %v", err)
+	}
+	if err := b.AddSink("live", &testSink{id: "sink"}); !errors.Is(err, ErrDuplicateSubscriber) {
+		t.Errorf("AddSink() with a duplicate ID = %v, want ErrDuplicateSubscriber", err)
+	}
+	b.BroadcastVideo("live", []byte{0x27, 0x01}, 40)
+	if err := b.RemoveSink("live", "sink"); err != nil {
+		t.Fatalf("RemoveSink() = %v", err)
+	}
+	b.BroadcastVideo("live", []byte{0x27, 0x01}, 80)
+
+	want := []string{"metadata map[width:1280]", "video 1700@0", "audio af00@0", "video 2701@40"}
+	if !reflect.DeepEqual(sink.received, want) {
+		t.Errorf("sink received %q, want %q", sink.received, want)
+	}
+}
+
+// clusterResolver answers whether streams exist as a cluster-wide registry would.
+type clusterResolver map[string]bool
+
+func (r clusterResolver) StreamExists(streamKey string) bool {
+	return r[streamKey]
+}
+
+func TestStreamResolver(t *testing.T) {
+	b := NewBroadcaster("app", NewInMemoryContext())
+	if err := b.RegisterPublisher("local"); err != nil {
+		t.Fatal(err)
+	}
+	if b.StreamExists("remote") {
+		t.Fatal("StreamExists(remote) = true without a resolver")
+	}
+	resolver := clusterResolver{"remote": true}
+	b.(ResolverBroadcaster).SetStreamResolver(resolver)
+	if got := b.(ResolverBroadcaster).GetStreamResolver(); !reflect.DeepEqual(got, resolver) {
+		t.Errorf("GetStreamResolver() = %v, want the resolver set", got)
+	}
+	for streamKey, want := range map[string]bool{"local": true, "remote": true, "unknown": false} {
+		if exists := b.StreamExists(streamKey); exists != want {
+			t.Errorf("StreamExists(%s) = %t, want %t", streamKey, exists, want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package rtmp
+
+import "github.com/codingpa-ws/rtmp/amf"
+
+// Flags of the videoFunction property of the connect command
+const (
+	// The client can perform frame-accurate seeks
+	SupportVidClientSeek uint16 = 0x0001
+)
+
+// ClientCapabilities are the capabilities a client advertised in its connect command. Fields the client didn't send
+// are 0.
+type ClientCapabilities struct {
+	// Capability flags of the client. Their meaning isn't documented by the spec (Flash Player sends 15).
+	Capabilities uint32
+	// Flags of the codecs the client supports (see audio.SupportSndAAC, video.SupportVidH264, etc.)
+	AudioCodecs uint16
+	VideoCodecs uint16
+	// Flags of the video functions the client supports (see SupportVidClientSeek)
+	VideoFunction uint16
+}
+
+// SupportsClientSeek returns true if the client advertised support for seeking with SupportVidClientSeek.
+func (c ClientCapabilities) SupportsClientSeek() bool {
+	return c.VideoFunction&SupportVidClientSeek != 0
+}
+
+// parseClientCapabilities reads the capabilities of a client from the command object of its connect command.
+func parseClientCapabilities(metadata amf.Metadata) ClientCapabilities {
+	var c ClientCapabilities
+	c.Capabilities = uint32(metadata.GetFloat64Default("capabilities", 0))
+	c.AudioCodecs = uint16(metadata.GetFloat64Default("audioCodecs", 0))
+	c.VideoCodecs = uint16(metadata.GetFloat64Default("videoCodecs", 0))
+	c.VideoFunction = uint16(metadata.GetFloat64Default("videoFunction", 0))
+	return c
+}
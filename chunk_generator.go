@@ -3,11 +3,13 @@ package rtmp
 import (
 	"encoding/binary"
 
+	"github.com/codingpa-ws/rtmp/amf"
 	"github.com/codingpa-ws/rtmp/amf/amf0"
 	"github.com/codingpa-ws/rtmp/constants"
 )
 
 const NetConnectionSucces = "NetConnection.Connect.Success"
+const NetConnectionRejected = "NetConnection.Connect.Rejected"
 
 func generateWindowAckSizeMessage(size uint32) []byte {
 	windowAckSizeMessage := make([]byte, 16)
@@ -116,6 +118,25 @@ func generateStreamBeginMessage(streamId uint32) []byte {
 	return streamBeginMessage
 }
 
+// generateUserControlMessage generates a user control message whose event data is 4 bytes long: the stream ID of
+// StreamEOF/StreamDry, or the timestamp of PingRequest/PingResponse (responses echo the timestamp of the request).
+func generateUserControlMessage(eventType uint16, eventData uint32) []byte {
+	userControlMessage := make([]byte, 18)
+	//---- HEADER ----//
+	// fmt = 0 and csid = 2 encoded in 1 byte, timestamp 0
+	userControlMessage[0] = 2
+	// Size of the body: 2 bytes for the event type, 4 bytes for the event data
+	userControlMessage[6] = 6
+	userControlMessage[7] = UserControlMessage
+	// Message stream ID 0, like every protocol control message
+
+	//---- BODY ----//
+	binary.BigEndian.PutUint16(userControlMessage[12:], eventType)
+	binary.BigEndian.PutUint32(userControlMessage[14:], eventData)
+
+	return userControlMessage
+}
+
 func generateSetChunkSizeMessage(chunkSize uint32) []byte {
 	setChunkSizeMessage := make([]byte, 16)
 	//---- HEADER ----//
@@ -148,36 +169,42 @@ func generateSetChunkSizeMessage(chunkSize uint32) []byte {
 	return setChunkSizeMessage
 }
 
-func generateConnectResponseSuccess(csID uint32) []byte {
+// generateConnectResponseSuccess generates the _result response to the connect command. fmsVer and capabilities identify
+// the server (eg: constants.FlashMediaServerVersion and constants.Capabilities), and objectEncoding is the AMF version
+// the client asked to use (0 or 3), which the response confirms.
+func generateConnectResponseSuccess(csID uint32, fmsVer string, capabilities int, objectEncoding float64) []byte {
 
 	// Body of our message
-	commandName, _ := amf0.Encode("_result")
-	// Transaction ID is 1 for connection responses
-	transactionId, _ := amf0.Encode(1)
-	properties, _ := amf0.Encode(map[string]any{
-		"fmsVer":       constants.FlashMediaServerVersion,
-		"capabilities": constants.Capabilities,
-		"mode":         constants.Mode,
-	})
-	information, _ := amf0.Encode(map[string]any{
-		"code":        NetConnectionSucces,
-		"level":       "status",
-		"description": "Connection accepted.",
-		"data": map[string]any{
-			"string": "3,5,7,7009",
+	body, _ := amf.Encode(
+		"_result",
+		// Transaction ID is 1 for connection responses
+		1,
+		// Properties
+		map[string]any{
+			"fmsVer":       fmsVer,
+			"capabilities": capabilities,
+			"mode":         constants.Mode,
 		},
-		"objectEncoding": 0, // AMFVersion0
-	})
+		// Information
+		map[string]any{
+			"code":        NetConnectionSucces,
+			"level":       "status",
+			"description": "Connection accepted.",
+			"data": map[string]any{
+				"string": "3,5,7,7009",
+			},
+			"objectEncoding": objectEncoding,
+		},
+	)
 
 	// Calculate the body length
-	bodyLength := len(commandName) + len(transactionId) + len(properties) + len(information)
+	bodyLength := len(body)
 
 	// 12 bytes for the header
 	connectResponseSuccessMessage := make([]byte, 12, 300)
 	//---- HEADER ----//
-	// fmt = 0 and csid = 3 encoded in 1 byte
+	// fmt = 0, and same csid as the connect request (set by withChunkStreamID)
 	// why does Twitch send csId = 3? is it because it is replying to the connect() request which sent csID = 3?
-	connectResponseSuccessMessage[0] = byte(csID)
 
 	// timestamp (3 bytes) is set to 0 so bytes 1-3 are unmodified (they're already zero-initialized)
 	//connectResponseSuccessMessage[1] = 0
@@ -201,94 +228,142 @@ func generateConnectResponseSuccess(csID uint32) []byte {
 
 	//---- BODY ----//
 	// Set the body
-	connectResponseSuccessMessage = append(connectResponseSuccessMessage, commandName...)
-	connectResponseSuccessMessage = append(connectResponseSuccessMessage, transactionId...)
-	connectResponseSuccessMessage = append(connectResponseSuccessMessage, properties...)
-	connectResponseSuccessMessage = append(connectResponseSuccessMessage, information...)
+	connectResponseSuccessMessage = append(connectResponseSuccessMessage, body...)
 
-	return connectResponseSuccessMessage
+	return withChunkStreamID(connectResponseSuccessMessage, csID)
 }
 
-func generateOnFCPublishMessage(csID uint32, transactionID float64, streamKey string) []byte {
-	onFCPublishString, _ := amf0.Encode("onFCPublish")
-	tId, _ := amf0.Encode(0)
-	commandObject, _ := amf0.Encode(nil)
-	information, _ := amf0.Encode(map[string]any{
-		"level":       "status",
-		"code":        "NetStream.Publish.Start",
-		"description": "FCPublish to stream " + streamKey,
-	})
-	bodyLength := len(onFCPublishString) + len(tId) + len(commandObject) + len(information)
-
-	onFCPublishMessage := make([]byte, 12, 180)
+// generateConnectResponseRejected generates the _error response to a connect command. ex holds the extended
+// information of the error (eg: the URL of a redirect), and can be nil.
+func generateConnectResponseRejected(csID uint32, transactionID float64, description string, ex map[string]any) []byte {
+	infoObject := map[string]any{
+		"code":        NetConnectionRejected,
+		"level":       "error",
+		"description": description,
+	}
+	if ex != nil {
+		infoObject["ex"] = ex
+	}
+	// No properties are sent when the connection is rejected
+	body, _ := amf.Encode("_error", transactionID, nil, infoObject)
+	bodyLength := len(body)
+
+	connectResponseRejectedMessage := make([]byte, 12, 12+bodyLength)
 	//---- HEADER ----//
-	// if csid = 3, does this mean these are not control messages/commands?
-	onFCPublishMessage[0] = byte(csID)
+	// fmt = 0, and same csid as the connect request (set by withChunkStreamID)
 
 	// Leave timestamp at 0 (bytes 1-3)
 
 	// Set body size (bytes 4-6) to bodyLength
-	onFCPublishMessage[4] = byte((bodyLength >> 16) & 0xFF)
-	onFCPublishMessage[5] = byte((bodyLength >> 8) & 0xFF)
-	onFCPublishMessage[6] = byte(bodyLength)
+	connectResponseRejectedMessage[4] = byte((bodyLength >> 16) & 0xFF)
+	connectResponseRejectedMessage[5] = byte((bodyLength >> 8) & 0xFF)
+	connectResponseRejectedMessage[6] = byte(bodyLength)
 
 	// Set type to AMF0 command (20)
-	onFCPublishMessage[7] = CommandMessageAMF0
+	connectResponseRejectedMessage[7] = CommandMessageAMF0
 
-	// Leave stream ID at 0 (bytes 8-11)
-	// NetConnection is the default communication channel, which has a stream ID 0. Protocol and a few command messages, including createStream, use the default communication channel.
+	// Stream ID (bytes 8-11) is 0, the connect command is sent on the NetConnection
 
 	//---- BODY ----//
-	onFCPublishMessage = append(onFCPublishMessage, onFCPublishString...)
-	onFCPublishMessage = append(onFCPublishMessage, tId...)
-	onFCPublishMessage = append(onFCPublishMessage, commandObject...)
-	onFCPublishMessage = append(onFCPublishMessage, information...)
+	connectResponseRejectedMessage = append(connectResponseRejectedMessage, body...)
 
-	return onFCPublishMessage
+	return withChunkStreamID(connectResponseRejectedMessage, csID)
 }
 
-func generateCreateStreamResponse(csID uint32, transactionID float64, commandObject map[string]any) []byte {
-	result, _ := amf0.Encode("_result")
-	tID, _ := amf0.Encode(transactionID)
-	commandObjectResponse, _ := amf0.Encode(nil)
-	// ID of the stream that was opened. We could also send an object with additional information if an error occurred, instead of a number.
-	// Subsequent chunks will be sent by the client on the stream ID specified here.
-	// TODO: is this a fixed value?
-	streamID, _ := amf0.Encode(constants.DefaultStreamID)
-	bodyLength := len(result) + len(tID) + len(commandObjectResponse) + len(streamID)
+// generateOnFCPublishMessage generates the onFCPublish command, which tells the client that it can publish streamKey.
+func generateOnFCPublishMessage(csID uint32, transactionID float64, streamKey string, objectEncoding float64) []byte {
+	body, _ := amf.Encode("onFCPublish", 0, nil, map[string]any{
+		"level":       "status",
+		"code":        "NetStream.Publish.Start",
+		"description": "FCPublish to stream " + streamKey,
+	})
+	return generateCommandMessage(csID, 0, objectEncoding, body)
+}
+
+// generateOnFCUnpublishMessage generates the onFCUnpublish command, which tells the client that it stopped publishing
+// streamKey.
+func generateOnFCUnpublishMessage(csID uint32, transactionID float64, streamKey string, objectEncoding float64) []byte {
+	body, _ := amf.Encode("onFCUnpublish", 0, nil, map[string]any{
+		"level":       "status",
+		"code":        "NetStream.Unpublish.Success",
+		"description": "FCUnpublish to stream " + streamKey,
+	})
+	return generateCommandMessage(csID, 0, objectEncoding, body)
+}
+
+// generateOnFCSubscribeMessage generates the onFCSubscribe command, which tells the client that it can play streamKey.
+func generateOnFCSubscribeMessage(csID uint32, transactionID float64, streamKey string, objectEncoding float64) []byte {
+	body, _ := amf.Encode("onFCSubscribe", 0, nil, map[string]any{
+		"level":       "status",
+		"code":        "NetStream.Play.Start",
+		"description": "FCSubscribe to stream " + streamKey,
+	})
+	return generateCommandMessage(csID, 0, objectEncoding, body)
+}
+
+// generateGetStreamLengthResponse generates the response to getStreamLength, whose value is the length of the stream
+// in seconds.
+func generateGetStreamLengthResponse(csID uint32, transactionID float64, length float64, objectEncoding float64) []byte {
+	body, _ := amf.Encode("_result", transactionID, nil, length)
+	return generateCommandMessage(csID, 0, objectEncoding, body)
+}
+
+// generateOnBWDoneMessage generates the onBWDone command, which tells clients that check the bandwidth of the
+// connection that the check is done.
+func generateOnBWDoneMessage(csID uint32, objectEncoding float64) []byte {
+	body, _ := amf.Encode("onBWDone", 0, nil)
+	return generateCommandMessage(csID, 0, objectEncoding, body)
+}
 
-	createStreamResponseMessage := make([]byte, 12, 50)
+// generateCheckBandwidthResponse generates the (empty) response to checkBandwidth.
+func generateCheckBandwidthResponse(csID uint32, transactionID float64, objectEncoding float64) []byte {
+	body, _ := amf.Encode("_result", transactionID, nil)
+	return generateCommandMessage(csID, 0, objectEncoding, body)
+}
+
+// generateCommandMessage generates a command message on the message stream streamID (0 for the NetConnection) with
+// the body, which is encoded in AMF0. If objectEncoding is 3 (the client negotiated AMF3 in its connect command), it's
+// an AMF3 command message: the body follows its format byte, and still switches to AMF3 with the AVM+ marker if it
+// needs to.
+func generateCommandMessage(csID uint32, streamID uint32, objectEncoding float64, body []byte) []byte {
+	messageType := byte(CommandMessageAMF0)
+	if objectEncoding == 3 {
+		messageType = CommandMessageAMF3
+		body = append([]byte{0}, body...)
+	}
+	bodyLength := len(body)
+
+	commandMessage := make([]byte, 12, 12+bodyLength)
 	//---- HEADER ----//
-	// if csid = 3, does this mean these are not control messages/commands?
-	createStreamResponseMessage[0] = byte(csID)
 
 	// Leave timestamp at 0 (bytes 1-3)
 
 	// Set body size (bytes 4-6) to bodyLength
-	createStreamResponseMessage[4] = byte((bodyLength >> 16) & 0xFF)
-	createStreamResponseMessage[5] = byte((bodyLength >> 8) & 0xFF)
-	createStreamResponseMessage[6] = byte(bodyLength)
+	commandMessage[4] = byte((bodyLength >> 16) & 0xFF)
+	commandMessage[5] = byte((bodyLength >> 8) & 0xFF)
+	commandMessage[6] = byte(bodyLength)
 
-	// Set type to AMF0 command (20)
-	createStreamResponseMessage[7] = CommandMessageAMF0
+	// Set type to AMF0 command (20) or AMF3 command (17)
+	commandMessage[7] = messageType
 
-	// Leave stream ID at 0 (bytes 8-11)
-	// NetConnection is the default communication channel, which has a stream ID 0. Protocol and a few command messages, including createStream, use the default communication channel.
+	// Set the stream ID (bytes 8-11), which is stored in LITTLE ENDIAN format
+	binary.LittleEndian.PutUint32(commandMessage[8:], streamID)
 
 	//---- BODY ----//
-	createStreamResponseMessage = append(createStreamResponseMessage, result...)
-	createStreamResponseMessage = append(createStreamResponseMessage, tID...)
-	createStreamResponseMessage = append(createStreamResponseMessage, commandObjectResponse...)
-	createStreamResponseMessage = append(createStreamResponseMessage, streamID...)
+	return withChunkStreamID(append(commandMessage, body...), csID)
+}
 
-	return createStreamResponseMessage
+func generateCreateStreamResponse(csID uint32, transactionID float64, streamID uint32, objectEncoding float64) []byte {
+	// The last value is the ID of the stream that was opened. We could also send an object with additional information if an error occurred, instead of a number.
+	// Subsequent chunks will be sent by the client on the stream ID specified here.
+	body, _ := amf.Encode("_result", transactionID, nil, streamID)
+	// NetConnection is the default communication channel, which has a stream ID 0. Protocol and a few command messages, including createStream, use the default communication channel.
+	return generateCommandMessage(csID, 0, objectEncoding, body)
 }
 
 func generateConnectRequest(csID int, transactionID int, info map[string]any) []byte {
-	connect, _ := amf0.Encode("connect")
-	tID, _ := amf0.Encode(transactionID)
-	cmdObj, _ := amf0.Encode(info)
-	bodyLength := len(connect) + len(tID) + len(cmdObj)
+	body, _ := amf.Encode("connect", transactionID, info)
+	bodyLength := len(body)
 
 	connectRequestMessage := make([]byte, 12, 12+bodyLength)
 	//---- HEADER ----//
@@ -309,23 +384,20 @@ func generateConnectRequest(csID int, transactionID int, info map[string]any) []
 	// NetConnection is the default communication channel, which has a stream ID 0. Protocol and a few command messages, including createStream, use the default communication channel.
 
 	//---- BODY ----//
-	connectRequestMessage = append(connectRequestMessage, connect...)
-	connectRequestMessage = append(connectRequestMessage, tID...)
-	connectRequestMessage = append(connectRequestMessage, cmdObj...)
+	connectRequestMessage = append(connectRequestMessage, body...)
 
 	return connectRequestMessage
 }
 
 func generateCreateStreamRequest(transactionID int) []byte {
-	createStream, _ := amf0.Encode("createStream")
-	tID, _ := amf0.Encode(transactionID)
-	cmdObj, _ := amf0.Encode(nil)
-	bodyLength := len(createStream) + len(tID) + len(cmdObj)
+	body, _ := amf.Encode("createStream", transactionID, nil)
+	bodyLength := len(body)
 	createStreamMessage := make([]byte, 8, 8+bodyLength)
 
 	//---- HEADER ----//
 	// if csid = 3, does this mean these are not control messages/commands?
-	createStreamMessage[0] = byte(3)
+	// Type 1 chunk header (no message stream ID), createStream is sent on the message stream of the connect request (0)
+	createStreamMessage[0] = ChunkType1<<6 | 3
 
 	// Leave timestamp delta at 0 (bytes 1-3)
 
@@ -338,18 +410,14 @@ func generateCreateStreamRequest(transactionID int) []byte {
 	createStreamMessage[7] = CommandMessageAMF0
 
 	//---- BODY ----//
-	createStreamMessage = append(createStreamMessage, createStream...)
-	createStreamMessage = append(createStreamMessage, tID...)
-	createStreamMessage = append(createStreamMessage, cmdObj...)
+	createStreamMessage = append(createStreamMessage, body...)
 
 	return createStreamMessage
 }
 
 func generateMetadataMessage(metadata map[string]any, streamID uint32) []byte {
-	setDataFrame, _ := amf0.Encode("@setDataFrame")
-	onMetadata, _ := amf0.Encode("onMetadata")
-	metadataObj, _ := amf0.Encode(amf0.ECMAArray(metadata))
-	bodyLength := len(setDataFrame) + len(onMetadata) + len(metadataObj)
+	body, _ := amf.Encode("@setDataFrame", "onMetadata", amf0.ECMAArray(metadata))
+	bodyLength := len(body)
 	metadataMessage := make([]byte, 12, 12+bodyLength)
 
 	//---- HEADER ----//
@@ -370,19 +438,14 @@ func generateMetadataMessage(metadata map[string]any, streamID uint32) []byte {
 	binary.LittleEndian.PutUint32(metadataMessage[8:], streamID)
 
 	//---- BODY ----//
-	metadataMessage = append(metadataMessage, setDataFrame...)
-	metadataMessage = append(metadataMessage, onMetadata...)
-	metadataMessage = append(metadataMessage, metadataObj...)
+	metadataMessage = append(metadataMessage, body...)
 	return metadataMessage
 }
 
 func generatePlayRequest(streamKey string, streamID uint32) []byte {
-	play, _ := amf0.Encode("play")
-	tID, _ := amf0.Encode(0)
-	cmdObj, _ := amf0.Encode(nil)
-	streamName, _ := amf0.Encode(streamKey)
-	start, _ := amf0.Encode(-2000)
-	bodyLength := len(play) + len(tID) + len(cmdObj) + len(streamName) + len(start)
+	// Start at -2000 plays the live stream if there's one, or the recorded one otherwise
+	body, _ := amf.Encode("play", 0, nil, streamKey, -2000)
+	bodyLength := len(body)
 	playMessage := make([]byte, 12, 12+bodyLength)
 
 	//---- HEADER ----//
@@ -403,49 +466,17 @@ func generatePlayRequest(streamKey string, streamID uint32) []byte {
 	binary.LittleEndian.PutUint32(playMessage[8:], streamID)
 
 	//---- BODY ----//
-	playMessage = append(playMessage, play...)
-	playMessage = append(playMessage, tID...)
-	playMessage = append(playMessage, cmdObj...)
-	playMessage = append(playMessage, streamName...)
-	playMessage = append(playMessage, start...)
+	playMessage = append(playMessage, body...)
 
 	return playMessage
 }
 
-func generateStatusMessage(transactionID float64, streamID uint32, infoObject map[string]any) []byte {
+func generateStatusMessage(transactionID float64, streamID uint32, infoObject map[string]any, objectEncoding float64) []byte {
 
-	commandName, _ := amf0.Encode("onStatus")
-	tID, _ := amf0.Encode(transactionID)
 	// Status messages don't have a command object, so encode nil
-	commandObject, _ := amf0.Encode(nil)
-	info, _ := amf0.Encode(infoObject)
-	bodyLength := len(commandName) + len(tID) + len(commandObject) + len(info)
-
-	createStreamResponseMessage := make([]byte, 12, 150)
-	//---- HEADER ----//
-	// if csid = 3, does this mean these are not control messages/commands?
-	createStreamResponseMessage[0] = 3 // Twitch sends 3
-
-	// Leave timestamp at 0 (bytes 1-3)
-
-	// Set body size (bytes 4-6) to bodyLength
-	createStreamResponseMessage[4] = byte((bodyLength >> 16) & 0xFF)
-	createStreamResponseMessage[5] = byte((bodyLength >> 8) & 0xFF)
-	createStreamResponseMessage[6] = byte(bodyLength)
-
-	// Set type to AMF0 command (20)
-	createStreamResponseMessage[7] = CommandMessageAMF0
-
-	// Set stream ID to whatever stream ID the request had (bytes 8-11). Stream ID is stored in LITTLE ENDIAN format.
-	binary.LittleEndian.PutUint32(createStreamResponseMessage[8:], streamID)
-
-	//---- BODY ----//
-	createStreamResponseMessage = append(createStreamResponseMessage, commandName...)
-	createStreamResponseMessage = append(createStreamResponseMessage, tID...)
-	createStreamResponseMessage = append(createStreamResponseMessage, commandObject...)
-	createStreamResponseMessage = append(createStreamResponseMessage, info...)
-
-	return createStreamResponseMessage
+	body, _ := amf.Encode("onStatus", transactionID, nil, infoObject)
+	// Twitch sends them on the chunk stream 3, and on the stream ID the request had
+	return generateCommandMessage(3, streamID, objectEncoding, body)
 }
 
 func generateAckMessage(sequenceNumber uint32) []byte {
@@ -3,14 +3,29 @@ package rtmp
 import (
 	"bufio"
 	"encoding/binary"
-	"fmt"
 	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/codingpa-ws/rtmp/constants"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 )
 
-var InvalidChunkType error = errors.New("chunk handler: unknown chunk type")
+var ErrUnknownChunkType error = errors.New("chunk handler: unknown chunk type")
+var ErrMessageTooLarge error = errors.New("chunk handler: message too large")
+var ErrMessageAssemblyTimeout error = errors.New("chunk handler: message assembly timed out")
+var ErrNoPreviousChunkHeader error = errors.New("chunk handler: chunk without a previous header on its chunk stream")
+var ErrTooManyPartialMessages error = errors.New("chunk handler: too many messages assembled at once")
+var ErrInvalidChunkStreamID error = errors.New("chunk handler: chunk stream ID can't be encoded in a basic header")
+
+// Maximum number of messages that can be assembled at once, on different chunk streams (see assembleMessage). Peers
+// interleave the chunks of a few chunk streams at most (eg: audio, video and commands).
+const maxPartialMessages = 8
+
+// Deprecated: use ErrUnknownChunkType.
+var InvalidChunkType = ErrUnknownChunkType
 
 // Chunk types
 const (
@@ -30,6 +45,12 @@ const (
 
 const DefaultMaximumChunkSize = 128
 
+// Largest chunk stream ID, encoded in a 3 bytes basic header
+const MaxChunkStreamID = 65535 + 64
+
+// Largest possible chunk header: 3 bytes basic header, 11 bytes type 0 message header and 4 bytes extended timestamp
+const MaxChunkHeaderSize = 3 + 11 + 4
+
 const (
 	LimitHard    uint8 = 0
 	LimitSoft    uint8 = 1
@@ -42,17 +63,84 @@ const (
 type ChunkHandler struct {
 	socketr *bufio.Reader
 	socketw *bufio.Writer
+	// Messages can be sent from other goroutines than the one reading from the connection (eg: a publisher broadcasting
+	// to this session), so every write to socketw must hold this lock.
+	writeMutex sync.Mutex
+	// Number of batches in progress (see beginBatch). While greater than 0, messages stay in socketw instead of being
+	// flushed one by one.
+	batches int
 	// The key is the chunk stream ID, and the value is the previous header of that chunk stream ID
 	prevChunkHeader map[uint32]ChunkHeader
 	inChunkSize     uint32
 	outChunkSize    uint32
-	windowAckSize   uint32
-	bytesReceived   uint32
-	outBandwidth    uint32
-	limit           uint8
+	// Window set by the peer with a Window Acknowledgement Size message: an acknowledgement is sent to the peer every
+	// time it has sent inWindowAckSize bytes since the last one
+	inWindowAckSize uint32
+	// Bytes received since the last acknowledgement sent
+	bytesReceived uint32
+	// Window sent to the peer with sendWindowAckSize: the peer is expected to acknowledge every outWindowAckSize bytes
+	// it receives from us
+	outWindowAckSize uint32
+	// Sequence number of the last acknowledgement received from the peer (number of bytes it received from us so far)
+	lastAckReceived atomic.Uint32
+	// Output bandwidth set by the peer with Set Peer Bandwidth, and its limit type
+	outBandwidth uint32
+	limit        uint8
+	// If true, media isn't sent while the peer has sendWindow bytes or more to acknowledge (see windowExceeded)
+	ackFlowControl bool
+	// Bytes that can be sent to the peer without being acknowledged: outBandwidth if the peer set it, twice
+	// outWindowAckSize otherwise. It's read by the goroutines sending media, hence atomic.
+	sendWindow atomic.Uint32
 
 	// False if no Acknowledgement message has been sent yet
 	ackSent bool
+
+	// Number of times a type 0 chunk header switched the message stream ID of a chunk stream that was already in use.
+	// It's read by the goroutines collecting stats, hence atomic.
+	streamIDChanges atomic.Uint32
+	// If true, the previous header of a chunk stream is discarded when its message stream ID changes unexpectedly
+	resetOnStreamIDChange bool
+	// Chunk streams switched to another message stream by their last type 0 header while resetOnStreamIDChange is set.
+	// Their previous header is discarded before the next type 1, 2 or 3 header that starts a message on them.
+	reusedChunkStreams map[uint32]bool
+	// If greater than the size of socketr, socketr grows (up to this size) when the peer sets a chunk size that doesn't fit in it
+	maxReadBufferSize int
+	// Reader socketr reads from (the connection), and the size of the reader that replaces socketr once it's drained,
+	// 0 if it doesn't need to grow (see growReadBuffer)
+	source             io.Reader
+	nextReadBufferSize int
+	// If greater than 0, messages longer than this are rejected with ErrMessageTooLarge before their payload is allocated
+	maxMessageSize uint32
+	// If greater than 0, messages split in multiple chunks must be fully received within this time after their first
+	// chunk, otherwise their assembly is aborted with ErrMessageAssemblyTimeout. This keeps peers from tying up a
+	// connection by trickling a message. The timeout is checked with clock once the message is assembled, and if conn
+	// is set, its read deadline (in wall-clock time, like every deadline) enforces it while a read is pending.
+	messageAssemblyTimeout time.Duration
+	conn                   interface{ SetReadDeadline(t time.Time) error }
+	clock                  Clock
+	// Read deadline of conn set with setReadDeadline, which is restored once a message is assembled
+	readDeadline time.Time
+
+	// Total number of bytes read/written since the chunk handler was created
+	totalBytesReceived atomic.Uint64
+	totalBytesSent     atomic.Uint64
+	metrics            Metrics
+	logger             *zap.Logger
+	// Messages of other chunk streams completed while assembling a message, see assembleMessage
+	interleaved []interleavedMessage
+	// Messages split in multiple chunks whose chunks are being read, by chunk stream ID
+	partialMessages map[uint32]*partialMessage
+}
+
+type interleavedMessage struct {
+	header  ChunkHeader
+	payload []byte
+}
+
+// partialMessage is a message split in multiple chunks, of which the first offset bytes were read.
+type partialMessage struct {
+	payload []byte
+	offset  uint32
 }
 
 type Chunk struct {
@@ -66,6 +154,8 @@ type ChunkHeader struct {
 	ExtendedTimestamp uint32
 	// Total elapsed time = timestamp + deltas
 	ElapsedTime uint32
+	// Timestamp delta of the chunk, which the type 3 chunks that follow it on its chunk stream reuse
+	timestampDelta uint32
 }
 
 type ChunkData struct {
@@ -88,22 +178,52 @@ type ChunkMessageHeader struct {
 
 func NewChunkHandler(reader *bufio.Reader, writer *bufio.Writer) *ChunkHandler {
 	return &ChunkHandler{
-		socketr:         reader,
-		socketw:         writer,
-		inChunkSize:     DefaultMaximumChunkSize,
-		outChunkSize:    DefaultMaximumChunkSize,
-		ackSent:         false,
-		prevChunkHeader: make(map[uint32]ChunkHeader),
+		socketr:            reader,
+		socketw:            writer,
+		inChunkSize:        DefaultMaximumChunkSize,
+		outChunkSize:       DefaultMaximumChunkSize,
+		ackSent:            false,
+		limit:              LimitNotSet,
+		prevChunkHeader:    make(map[uint32]ChunkHeader),
+		reusedChunkStreams: make(map[uint32]bool),
+		partialMessages:    make(map[uint32]*partialMessage),
+		metrics:            NopMetrics{},
+		logger:             zap.NewNop(),
+		clock:              SystemClock{},
 	}
 }
 
+// addBytesReceived counts n bytes that were read from the connection. It's called as soon as bytes are read (for every
+// chunk of a message split in multiple chunks), so that acknowledgements are sent on time even while a large message is
+// being received, and the peer doesn't stall waiting for them.
+func (chunkHandler *ChunkHandler) addBytesReceived(n int) {
+	if n == 0 {
+		return
+	}
+	chunkHandler.totalBytesReceived.Add(uint64(n))
+	chunkHandler.metrics.BytesReceived(n)
+	chunkHandler.updateBytesReceived(uint32(n))
+}
+
+// addBytesSent counts n bytes that were written to the connection
+func (chunkHandler *ChunkHandler) addBytesSent(n int) {
+	chunkHandler.totalBytesSent.Add(uint64(n))
+	chunkHandler.metrics.BytesSent(n)
+}
+
+// ReadChunkHeader reads the header of a chunk. The type 3 header of the next chunk of a message being assembled (see
+// assembleMessage) doesn't start a new message, so it doesn't add a delta to the timestamp.
 func (chunkHandler *ChunkHandler) ReadChunkHeader() (ch ChunkHeader, n int, err error) {
+	defer func() {
+		chunkHandler.addBytesReceived(n)
+	}()
 	ch = ChunkHeader{}
 	r, err := chunkHandler.readBasicHeader(&ch)
 	n += r
 	if err != nil {
 		return ch, n, err
 	}
+	chunkHandler.resetReusedChunkStream(ch.BasicHeader)
 	r, err = chunkHandler.readMessageHeader(&ch)
 	n += r
 	if err != nil {
@@ -123,29 +243,87 @@ func (chunkHandler *ChunkHandler) ReadChunkHeader() (ch ChunkHeader, n int, err
 
 	csid := ch.BasicHeader.ChunkStreamID
 
-	// If this is a type 0 chunk header, it contains an absolute timestamp. Set the elapsed time to that absolute timestamp.
-	// Otherwise add the delta to the elapsed time
+	// Buggy encoders sometimes reuse a chunk stream ID for a different message stream. Type 1, 2 and 3 headers inherit
+	// their fields from the previous header of the chunk stream, so flag these switches to help diagnose corrupted streams.
 	if ch.BasicHeader.FMT == ChunkType0 {
-		if isExtendedTimestamp {
-			ch.ElapsedTime = ch.ExtendedTimestamp
-		} else {
-			ch.ElapsedTime = ch.MessageHeader.Timestamp
-		}
-	} else {
-		if isExtendedTimestamp {
-			// Handling overflows is unnecessary because Go automatically wraps around
-			ch.ElapsedTime = chunkHandler.prevChunkHeader[csid].ElapsedTime + ch.ExtendedTimestamp
-		} else {
+		chunkHandler.checkStreamIDChange(csid, ch.MessageHeader.MessageStreamID)
+	}
+
+	timestamp := ch.MessageHeader.Timestamp
+	if isExtendedTimestamp {
+		timestamp = ch.ExtendedTimestamp
+	}
+	switch ch.BasicHeader.FMT {
+	case ChunkType0:
+		// If this is a type 0 chunk header, it contains an absolute timestamp. Set the elapsed time to that absolute timestamp.
+		ch.ElapsedTime = timestamp
+		// As per the specification, a type 3 chunk that follows a type 0 chunk uses its timestamp as delta
+		ch.timestampDelta = timestamp
+	case ChunkType3:
+		// Type 3 chunk headers don't have a timestamp delta. A type 3 chunk that starts a new message takes the same
+		// delta as the previous chunk, and the other ones are the continuation of the previous message.
+		prev := chunkHandler.prevChunkHeader[csid]
+		ch.timestampDelta = prev.timestampDelta
+		ch.ElapsedTime = prev.ElapsedTime
+		if chunkHandler.partialMessages[csid] == nil {
 			// Handling overflows is unnecessary because Go automatically wraps around
-			ch.ElapsedTime = chunkHandler.prevChunkHeader[csid].ElapsedTime + ch.MessageHeader.Timestamp
+			ch.ElapsedTime += ch.timestampDelta
 		}
+	default:
+		// Otherwise add the delta to the elapsed time
+		// Handling overflows is unnecessary because Go automatically wraps around
+		ch.ElapsedTime = chunkHandler.prevChunkHeader[csid].ElapsedTime + timestamp
+		ch.timestampDelta = timestamp
 	}
 
 	chunkHandler.prevChunkHeader[csid] = ch
 	return ch, n, err
 }
 
+// checkStreamIDChange flags a chunk stream whose message stream ID differs from the one in its previous header.
+// If resetOnStreamIDChange is set, the chunk stream is marked so that the headers that follow the message of the new
+// stream don't inherit its fields (see resetReusedChunkStream).
+func (chunkHandler *ChunkHandler) checkStreamIDChange(csid uint32, messageStreamID uint32) {
+	prev, exists := chunkHandler.prevChunkHeader[csid]
+	if !exists || prev.MessageHeader.MessageStreamID == messageStreamID {
+		return
+	}
+	chunkHandler.streamIDChanges.Add(1)
+	chunkHandler.logger.Debug("chunk handler: chunk stream switched message stream",
+		zap.Uint32("chunk_stream_id", csid),
+		zap.Uint32("from", prev.MessageHeader.MessageStreamID),
+		zap.Uint32("to", messageStreamID))
+	if chunkHandler.resetOnStreamIDChange {
+		chunkHandler.reusedChunkStreams[csid] = true
+	}
+}
+
+// resetReusedChunkStream discards the previous header of a chunk stream marked by checkStreamIDChange, before the
+// type 1, 2 or 3 header that starts the next message on it: these headers would otherwise carry over the fields of the
+// message that switched the chunk stream to another message stream. The type 3 headers of the chunks that complete that
+// message still use its header. A type 0 header clears the mark, since it doesn't inherit anything.
+func (chunkHandler *ChunkHandler) resetReusedChunkStream(basicHeader *ChunkBasicHeader) {
+	csid := basicHeader.ChunkStreamID
+	if !chunkHandler.reusedChunkStreams[csid] {
+		return
+	}
+	if basicHeader.FMT == ChunkType0 {
+		delete(chunkHandler.reusedChunkStreams, csid)
+		return
+	}
+	if chunkHandler.partialMessages[csid] == nil {
+		delete(chunkHandler.reusedChunkStreams, csid)
+		delete(chunkHandler.prevChunkHeader, csid)
+	}
+}
+
+// StreamIDChanges returns the number of times a chunk stream was reused for a different message stream.
+func (chunkHandler *ChunkHandler) StreamIDChanges() uint32 {
+	return chunkHandler.streamIDChanges.Load()
+}
+
 func (chunkHandler *ChunkHandler) readBasicHeader(header *ChunkHeader) (n int, err error) {
+	chunkHandler.resizeReadBuffer()
 	basicHeader := &ChunkBasicHeader{}
 
 	b, err := chunkHandler.socketr.ReadByte()
@@ -174,8 +352,8 @@ func (chunkHandler *ChunkHandler) readBasicHeader(header *ChunkHeader) (n int, e
 		if err != nil {
 			return n, err
 		}
-		basicHeader.ChunkStreamID = uint32(binary.BigEndian.Uint16(id)) + 64
-		chunkHandler.bytesReceived += 2
+		// The ID is (third byte) * 256 + (second byte) + 64, so up to MaxChunkStreamID
+		basicHeader.ChunkStreamID = uint32(binary.LittleEndian.Uint16(id)) + 64
 	} else {
 		// if csid is neither 0 or 1, that means we're dealing with chunk basic header 1 (uses 1 byte). We already read it.
 		basicHeader.ChunkStreamID = uint32(csid)
@@ -185,6 +363,49 @@ func (chunkHandler *ChunkHandler) readBasicHeader(header *ChunkHeader) (n int, e
 	return n, err
 }
 
+// encodeBasicHeader encodes a chunk basic header, using the 1, 2 or 3 bytes form depending on the chunk stream ID (which
+// must be between 2 and MaxChunkStreamID). It returns nil if the chunk stream ID is larger than MaxChunkStreamID.
+func encodeBasicHeader(fmt uint8, csid uint32) []byte {
+	switch {
+	case csid > MaxChunkStreamID:
+		return nil
+	case csid < 64:
+		return []byte{fmt<<6 | byte(csid)}
+	case csid < 64+256:
+		return []byte{fmt << 6, byte(csid - 64)}
+	default:
+		return []byte{fmt<<6 | 1, byte(csid - 64), byte((csid - 64) >> 8)}
+	}
+}
+
+// basicHeaderLength returns the length of the basic header that starts with the byte b.
+func basicHeaderLength(b byte) int {
+	switch b & 0x3F {
+	case 0:
+		return 2
+	case 1:
+		return 3
+	default:
+		return 1
+	}
+}
+
+// withChunkStreamID sets the chunk stream ID of a message generated with a 1 byte basic header (whose first byte only
+// holds the chunk type), growing the basic header if the ID doesn't fit in it. Replies to commands are sent on the chunk
+// stream of the command, which can be any chunk stream ID the client picked. It returns nil if the ID can't be encoded,
+// which send and sendBytes reject with ErrInvalidChunkStreamID.
+func withChunkStreamID(message []byte, csid uint32) []byte {
+	basicHeader := encodeBasicHeader(message[0]>>6, csid)
+	if basicHeader == nil {
+		return nil
+	}
+	if len(basicHeader) == 1 {
+		message[0] = basicHeader[0]
+		return message
+	}
+	return append(basicHeader, message[1:]...)
+}
+
 func (chunkHandler *ChunkHandler) readMessageHeader(header *ChunkHeader) (n int, err error) {
 	csid := header.BasicHeader.ChunkStreamID
 	_, prevChunkExists := chunkHandler.prevChunkHeader[csid]
@@ -266,99 +487,161 @@ func (chunkHandler *ChunkHandler) readMessageHeader(header *ChunkHeader) (n int,
 		}
 		// Since the timestamp delta field is 3 bytes long, to be able to interpret it as a 32-bit uint we have to add 1 byte at the beginning (3 + 1 byte = 4 bytes == 32-bits)
 		mh.Timestamp = binary.BigEndian.Uint32(append([]byte{0x00}, messageHeader[:3]...))
-		if prevChunkExists {
-			// Chunk type 2 message headers don't have a message length. This chunk takes the same message length as the previous chunk.
-			mh.MessageLength = chunkHandler.prevChunkHeader[csid].MessageHeader.MessageLength
-			// Chunk type 2 message headers don't have a message stream ID. This chunk takes the same message stream ID as the previous chunk.
-			mh.MessageStreamID = chunkHandler.prevChunkHeader[csid].MessageHeader.MessageStreamID
-			// Chunk type 2 message headers don't have a message type ID. This chunk takes the same message type ID as the previous chunk.
-			mh.MessageTypeID = chunkHandler.prevChunkHeader[csid].MessageHeader.MessageTypeID
+		// Without a previous header, the length of the message is unknown
+		if !prevChunkExists {
+			return n, errors.Wrapf(ErrNoPreviousChunkHeader, "chunk of type 2 on chunk stream %d", csid)
 		}
+		// Chunk type 2 message headers don't have a message length. This chunk takes the same message length as the previous chunk.
+		mh.MessageLength = chunkHandler.prevChunkHeader[csid].MessageHeader.MessageLength
+		// Chunk type 2 message headers don't have a message stream ID. This chunk takes the same message stream ID as the previous chunk.
+		mh.MessageStreamID = chunkHandler.prevChunkHeader[csid].MessageHeader.MessageStreamID
+		// Chunk type 2 message headers don't have a message type ID. This chunk takes the same message type ID as the previous chunk.
+		mh.MessageTypeID = chunkHandler.prevChunkHeader[csid].MessageHeader.MessageTypeID
 
 		header.MessageHeader = mh
 		return n, err
 	case ChunkType3:
 		// Chunk type 3 message headers don't have any data. All values are taken from the previous header.
-		if prevChunkExists {
-			mh.MessageLength = chunkHandler.prevChunkHeader[csid].MessageHeader.MessageLength
-			mh.MessageTypeID = chunkHandler.prevChunkHeader[csid].MessageHeader.MessageTypeID
-			mh.MessageStreamID = chunkHandler.prevChunkHeader[csid].MessageHeader.MessageStreamID
+		if !prevChunkExists {
+			return n, errors.Wrapf(ErrNoPreviousChunkHeader, "chunk of type 3 on chunk stream %d", csid)
 		}
+		mh.MessageLength = chunkHandler.prevChunkHeader[csid].MessageHeader.MessageLength
+		mh.MessageTypeID = chunkHandler.prevChunkHeader[csid].MessageHeader.MessageTypeID
+		mh.MessageStreamID = chunkHandler.prevChunkHeader[csid].MessageHeader.MessageStreamID
 		header.MessageHeader = mh
 		return n, err
 	default:
-		return n, InvalidChunkType
+		return n, ErrUnknownChunkType
 	}
 }
 
-// assembleMessage is called when the length of a message is greater than the currently set chunkSize.
-// It returns the final payload of the message assembled from multiple chunks.
-func (chunkHandler *ChunkHandler) assembleMessage(messageLength uint32) (payload []byte, n int, err error) {
-	//fmt.Println("assembling message...")
-	payload = make([]byte, messageLength)
-	// Read the initial chunk data that was sent with the first chunk header
-	n, err = io.ReadFull(chunkHandler.socketr, payload[:chunkHandler.inChunkSize])
-	offset := chunkHandler.inChunkSize
-	if err != nil {
-		return payload, n, err
+// assembleMessage reads chunks until the message of the chunk stream csid (started by the chunk just read) is complete,
+// and returns its payload. The chunks of the message can be interleaved with the chunks of other chunk streams (eg: a
+// Set Chunk Size message on the protocol channel, or the audio and video messages of a publisher that interleaves them),
+// whose messages are assembled at the same time. Those that complete first are kept for takeInterleavedMessages, the
+// others are completed by the chunks that follow.
+func (chunkHandler *ChunkHandler) assembleMessage(csid uint32) (payload []byte, n int, err error) {
+	if chunkHandler.messageAssemblyTimeout > 0 {
+		start := chunkHandler.clock.Now()
+		// The read deadline of the connection only enforces the timeout if it's earlier than the one already set
+		ownDeadline := false
+		defer func() {
+			if ownDeadline || !errors.Is(err, os.ErrDeadlineExceeded) {
+				err = chunkHandler.checkAssemblyDeadline(start, err)
+			}
+		}()
+		if chunkHandler.conn != nil {
+			deadline := time.Now().Add(chunkHandler.messageAssemblyTimeout)
+			if previous := chunkHandler.readDeadline; previous.IsZero() || deadline.Before(previous) {
+				chunkHandler.conn.SetReadDeadline(deadline)
+				ownDeadline = true
+				defer chunkHandler.conn.SetReadDeadline(previous)
+			}
+		}
 	}
-
-	// While there are still more bytes to read
-	for offset < messageLength {
-		// Read the next chunks (header + data) until we complete our message
-		_, r, err := chunkHandler.ReadChunkHeader()
-		//fmt.Printf("assembling message, encountered chunk type: %d, message type: %d\n", h.BasicHeader.FMT, h.MessageHeader.MessageTypeID)
+	for {
+		// ReadChunkHeader counts the header bytes
+		header, r, err := chunkHandler.ReadChunkHeader()
 		n += r
 		if err != nil {
-			return payload, n, err
+			return nil, n, err
 		}
-		// If this chunk is still not the end of the message, then read the whole chunk
-		if offset+chunkHandler.inChunkSize < messageLength {
-			r, err := io.ReadFull(chunkHandler.socketr, payload[offset:offset+chunkHandler.inChunkSize])
-			n += r
-			if err != nil {
-				return payload, n, err
-			}
-			offset += chunkHandler.inChunkSize
-		} else {
-			// If this is the last chunk of the message, just read the remaining bytes
-			remainingBytes := messageLength - offset
-			r, err := io.ReadFull(chunkHandler.socketr, payload[offset:offset+remainingBytes])
-			n += r
-			if err != nil {
-				return payload, n, err
+		payload, r, err := chunkHandler.readChunk(header)
+		n += r
+		if err != nil {
+			return nil, n, err
+		}
+		if payload == nil {
+			continue
+		}
+		if header.BasicHeader.ChunkStreamID == csid {
+			return payload, n, nil
+		}
+		// A Set Chunk Size message takes effect right away, since it applies to the chunks that follow it: the chunks
+		// of the messages being assembled that were already read keep the previous size
+		if header.MessageHeader.MessageTypeID == SetChunkSize && len(payload) >= 4 {
+			// Invalid sizes are left to the handler of the message to report
+			if size := binary.BigEndian.Uint32(payload) & 0x7FFFFFFF; size > 0 {
+				chunkHandler.SetChunkSize(size)
 			}
-			offset += remainingBytes
 		}
+		chunkHandler.interleaved = append(chunkHandler.interleaved, interleavedMessage{header: header, payload: payload})
 	}
-	return payload, n, err
 }
 
-func (chunkHandler *ChunkHandler) ReadChunkData(header ChunkHeader) (payload []byte, n int, err error) {
-	messageLength := header.MessageHeader.MessageLength
-	// Check if the length of the message is greater than the chunk size (default chunk size is 128 if no Set Chunk Size message has been received).
-	// If it is, we have to assemble the complete message from various chunks.
-	if messageLength > chunkHandler.inChunkSize {
-		//fmt.Println("assembling message, encountered chunk type:", header.BasicHeader.FMT)
-		payload, n, err = chunkHandler.assembleMessage(messageLength)
-		//if header.MessageHeader.MessageTypeID == VideoMessage {
-		//	fmt.Printf("assembled message of type: %d, message length: %d\n", header.MessageHeader.MessageTypeID, messageLength)
-		//}
-		if err != nil {
-			return payload, n, err
+// setReadDeadline sets the read deadline of conn (if it's set), which is kept track of so that the deadline enforcing
+// the message assembly timeout doesn't replace it for good.
+func (chunkHandler *ChunkHandler) setReadDeadline(t time.Time) error {
+	chunkHandler.readDeadline = t
+	if chunkHandler.conn == nil {
+		return nil
+	}
+	return chunkHandler.conn.SetReadDeadline(t)
+}
+
+// readChunk reads the data of a chunk, and returns the payload of its message if the chunk completes it, or nil if
+// the message is continued by the next chunks of its chunk stream.
+func (chunkHandler *ChunkHandler) readChunk(header ChunkHeader) (payload []byte, n int, err error) {
+	csid := header.BasicHeader.ChunkStreamID
+	message := chunkHandler.partialMessages[csid]
+	if message == nil || header.BasicHeader.FMT != ChunkType3 {
+		// The chunk starts a new message (abandoning the message of the chunk stream being assembled, if any)
+		messageLength := header.MessageHeader.MessageLength
+		if chunkHandler.maxMessageSize > 0 && messageLength > chunkHandler.maxMessageSize {
+			return nil, 0, errors.Wrapf(ErrMessageTooLarge, "message of type %d is %d bytes long, the maximum is %d", header.MessageHeader.MessageTypeID, messageLength, chunkHandler.maxMessageSize)
 		}
-	} else {
-		//if header.MessageHeader.MessageTypeID == VideoMessage {
-		//	fmt.Printf("read chunk data, no need to assemble message, type: %d, message length: %d\n", header.MessageHeader.MessageTypeID, messageLength)
-		//}
-		payload = make([]byte, messageLength)
-		n, err = io.ReadFull(chunkHandler.socketr, payload)
-		if err != nil {
-			return payload, n, err
+		if message == nil && len(chunkHandler.partialMessages) >= maxPartialMessages {
+			return nil, 0, errors.Wrapf(ErrTooManyPartialMessages, "message of type %d on chunk stream %d", header.MessageHeader.MessageTypeID, csid)
 		}
+		message = &partialMessage{payload: make([]byte, messageLength)}
+		chunkHandler.partialMessages[csid] = message
+	}
+
+	chunkLength := uint32(len(message.payload)) - message.offset
+	if chunkLength > chunkHandler.inChunkSize {
+		chunkLength = chunkHandler.inChunkSize
+	}
+	n, err = io.ReadFull(chunkHandler.socketr, message.payload[message.offset:message.offset+chunkLength])
+	chunkHandler.addBytesReceived(n)
+	if err != nil {
+		return nil, n, err
+	}
+	message.offset += chunkLength
+	if message.offset < uint32(len(message.payload)) {
+		return nil, n, nil
+	}
+
+	delete(chunkHandler.partialMessages, csid)
+	return message.payload, n, nil
+}
+
+// takeInterleavedMessages returns the messages completed while assembling the last message (see assembleMessage), in
+// the order they were read, and forgets them.
+func (chunkHandler *ChunkHandler) takeInterleavedMessages() []interleavedMessage {
+	messages := chunkHandler.interleaved
+	chunkHandler.interleaved = nil
+	return messages
+}
+
+// checkAssemblyDeadline returns the error the assembly of a message started at start ended with, or
+// ErrMessageAssemblyTimeout if it wasn't assembled within the timeout (even if it was received in full, eg: when the
+// read deadline can't be set).
+func (chunkHandler *ChunkHandler) checkAssemblyDeadline(start time.Time, err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) || chunkHandler.clock.Now().Sub(start) > chunkHandler.messageAssemblyTimeout {
+		return errors.Wrapf(ErrMessageAssemblyTimeout, "message not assembled within %s", chunkHandler.messageAssemblyTimeout)
 	}
+	return err
+}
 
-	return payload, n, err
+// ReadChunkData reads the data of the chunk whose header was just read. If the message of the chunk is split in multiple
+// chunks, the chunks that follow are read until it's complete (see assembleMessage).
+func (chunkHandler *ChunkHandler) ReadChunkData(header ChunkHeader) (payload []byte, n int, err error) {
+	payload, n, err = chunkHandler.readChunk(header)
+	if err != nil || payload != nil {
+		return payload, n, err
+	}
+	payload, r, err := chunkHandler.assembleMessage(header.BasicHeader.ChunkStreamID)
+	return payload, n + r, err
 }
 
 func (chunkHandler *ChunkHandler) readExtendedTimestamp(header *ChunkHeader) (n int, err error) {
@@ -371,10 +654,11 @@ func (chunkHandler *ChunkHandler) readExtendedTimestamp(header *ChunkHeader) (n
 	return n, err
 }
 
+// updateBytesReceived sends an acknowledgement every time the peer has sent inWindowAckSize bytes since the last one.
+// No acknowledgements are sent until the peer sets a window acknowledgement size.
 func (chunkHandler *ChunkHandler) updateBytesReceived(i uint32) {
 	chunkHandler.bytesReceived += i
-	// TODO: implement send ack
-	if chunkHandler.bytesReceived >= chunkHandler.windowAckSize {
+	if chunkHandler.inWindowAckSize > 0 && chunkHandler.bytesReceived >= chunkHandler.inWindowAckSize {
 		chunkHandler.sendAck()
 	}
 }
@@ -382,72 +666,172 @@ func (chunkHandler *ChunkHandler) updateBytesReceived(i uint32) {
 // TODO: handle errors for all of these functions
 func (chunkHandler *ChunkHandler) sendWindowAckSize(size uint32) {
 	message := generateWindowAckSizeMessage(size)
-	// TODO: wrap the socketr in a more user friendly struct that uses Write and Flush in one method
-	chunkHandler.socketw.Write(message)
-	chunkHandler.socketw.Flush()
+	chunkHandler.sendBytes(message)
+	chunkHandler.outWindowAckSize = size
+	// A peer acknowledging on time has up to a window to acknowledge, and its acknowledgement on the way
+	if chunkHandler.limit == LimitNotSet {
+		chunkHandler.sendWindow.Store(2 * size)
+	}
 }
 
 func (chunkHandler *ChunkHandler) sendSetPeerBandWidth(size uint32, limit uint8) {
 	message := generateSetPeerBandwidthMessage(size, limit)
-	chunkHandler.socketw.Write(message)
-	chunkHandler.socketw.Flush()
+	chunkHandler.sendBytes(message)
 }
 
 func (chunkHandler *ChunkHandler) sendBeginStream(streamID uint32) {
 	message := generateStreamBeginMessage(streamID)
-	chunkHandler.socketw.Write(message)
-	chunkHandler.socketw.Flush()
+	chunkHandler.sendBytes(message)
+}
+
+// sendUserControl sends a user control message with a 4 bytes event data (eg: the stream ID of StreamEOF, or the
+// timestamp of PingRequest).
+func (chunkHandler *ChunkHandler) sendUserControl(eventType uint16, eventData uint32) error {
+	message := generateUserControlMessage(eventType, eventData)
+	_, err := chunkHandler.sendBytes(message)
+	return err
 }
 
 func (chunkHandler *ChunkHandler) sendSetChunkSize(size uint32) {
 	message := generateSetChunkSizeMessage(size)
-	chunkHandler.socketw.Write(message)
-	chunkHandler.socketw.Flush()
+	// Hold the lock until the new chunk size is in effect, so no message is chunked with the old size after the peer was told about the new one
+	chunkHandler.writeMutex.Lock()
+	defer chunkHandler.writeMutex.Unlock()
+	n, _ := chunkHandler.socketw.Write(message)
+	chunkHandler.flush()
+	chunkHandler.addBytesSent(n)
 	chunkHandler.outChunkSize = size
 }
 
-func (chunkHandler *ChunkHandler) sendConnectSuccess(csID uint32) {
-	message := generateConnectResponseSuccess(csID)
-	chunkHandler.socketw.Write(message)
-	chunkHandler.socketw.Flush()
+func (chunkHandler *ChunkHandler) sendConnectSuccess(csID uint32, fmsVer string, capabilities int, objectEncoding float64) {
+	message := generateConnectResponseSuccess(csID, fmsVer, capabilities, objectEncoding)
+	chunkHandler.sendBytes(message)
 }
 
 func (chunkHandler *ChunkHandler) sendAck() {
-	message := generateAckMessage(chunkHandler.bytesReceived)
-	chunkHandler.socketw.Write(message)
-	chunkHandler.socketw.Flush()
-	// Reset the number of bytes received
+	// The sequence number is the number of bytes received so far (it wraps around after 4GiB)
+	message := generateAckMessage(uint32(chunkHandler.totalBytesReceived.Load()))
+	chunkHandler.sendBytes(message)
+	// Reset the number of bytes received since the last acknowledgement
 	chunkHandler.bytesReceived = 0
 	chunkHandler.ackSent = true
 }
 
 func (chunkHandler *ChunkHandler) SetChunkSize(size uint32) {
-	if constants.Debug {
-		fmt.Println("Set chunk size to", size)
-	}
+	chunkHandler.logger.Debug("chunk handler: set chunk size", zap.Uint32("size", size))
 	chunkHandler.inChunkSize = size
+	chunkHandler.growReadBuffer(size)
 }
 
-// Sets the window acknowledgement size to the new size
-func (chunkHandler *ChunkHandler) SetWindowAckSize(size uint32) {
-	if constants.Debug {
-		fmt.Println("Set window ack size to", size)
+// growReadBuffer makes socketr grow if a whole chunk (header + data) doesn't fit in it, so that high-bitrate streams
+// with large chunks can be read with fewer syscalls. The buffer never grows past maxReadBufferSize, and only grows if
+// the reader it reads from is known.
+func (chunkHandler *ChunkHandler) growReadBuffer(chunkSize uint32) {
+	current := chunkHandler.socketr.Size()
+	wanted := int(chunkSize) + MaxChunkHeaderSize
+	if chunkHandler.source == nil || wanted <= current || current >= chunkHandler.maxReadBufferSize {
+		return
+	}
+	size := current
+	for size < wanted {
+		size *= 2
+	}
+	if size > chunkHandler.maxReadBufferSize {
+		size = chunkHandler.maxReadBufferSize
+	}
+	chunkHandler.nextReadBufferSize = size
+	chunkHandler.resizeReadBuffer()
+}
+
+// resizeReadBuffer replaces socketr with a reader of nextReadBufferSize bytes reading from source, once the bytes
+// socketr already buffered have been read (so that none of them is lost or copied to the new reader). It's called
+// before every chunk, so the buffer grows at the first chunk boundary where it's drained.
+func (chunkHandler *ChunkHandler) resizeReadBuffer() {
+	if chunkHandler.nextReadBufferSize == 0 || chunkHandler.socketr.Buffered() > 0 {
+		return
 	}
+	chunkHandler.logger.Debug("chunk handler: growing read buffer", zap.Int("size", chunkHandler.nextReadBufferSize))
+	chunkHandler.socketr = bufio.NewReaderSize(chunkHandler.source, chunkHandler.nextReadBufferSize)
+	chunkHandler.nextReadBufferSize = 0
+}
+
+// Sets the window acknowledgement size set by the peer (the window of the bytes we receive) to the new size
+func (chunkHandler *ChunkHandler) SetWindowAckSize(size uint32) {
+	chunkHandler.logger.Debug("chunk handler: set window ack size", zap.Uint32("size", size))
 	// If no acknowledgement has been sent since the beginning of the session, send it
 	if !chunkHandler.ackSent {
 		chunkHandler.sendAck()
 	}
-	chunkHandler.windowAckSize = size
+	chunkHandler.inWindowAckSize = size
 }
 
+// SetBandwidth applies a Set Peer Bandwidth message, which limits the window of the bytes we send. As per the spec,
+// if the resulting window differs from the last one sent to the peer, a Window Acknowledgement Size message is sent.
 func (chunkHandler *ChunkHandler) SetBandwidth(size uint32, limitType uint8) {
-	// For now, ignore the limitType. Treat it as a hard limit (always set the window size)
-	// TODO: what is the purpose of set bandwidth?
-	//chunkHandler.SetWindowAckSize(size)
+	switch limitType {
+	case LimitHard:
+	case LimitSoft:
+		// The smaller of the new window and the one already in effect
+		if chunkHandler.limit != LimitNotSet && chunkHandler.outBandwidth < size {
+			size = chunkHandler.outBandwidth
+		}
+	case LimitDynamic:
+		// Treated as hard if the previous limit was hard, ignored otherwise
+		if chunkHandler.limit != LimitHard {
+			return
+		}
+		limitType = LimitHard
+	default:
+		chunkHandler.logger.Warn("chunk handler: ignoring Set Peer Bandwidth message with an unknown limit type", zap.Uint8("limit_type", limitType))
+		return
+	}
+	chunkHandler.logger.Debug("chunk handler: set peer bandwidth", zap.Uint32("size", size), zap.Uint8("limit_type", limitType))
+	chunkHandler.outBandwidth = size
+	chunkHandler.limit = limitType
+	chunkHandler.sendWindow.Store(size)
+	if size != chunkHandler.outWindowAckSize {
+		chunkHandler.sendWindowAckSize(size)
+	}
+}
+
+// onAck records an acknowledgement received from the peer.
+func (chunkHandler *ChunkHandler) onAck(sequenceNumber uint32) {
+	chunkHandler.lastAckReceived.Store(sequenceNumber)
+}
+
+// unacknowledgedBytes returns the number of bytes sent to the peer that it hasn't acknowledged yet. If it's greater
+// than outWindowAckSize, the peer is late acknowledging (or doesn't acknowledge at all).
+func (chunkHandler *ChunkHandler) unacknowledgedBytes() uint32 {
+	// Sequence numbers wrap around after 4GiB, like the number of bytes sent (which includes the bytes of the handshake,
+	// see MessageManager.Initialize) truncated to 32 bits
+	return uint32(chunkHandler.totalBytesSent.Load()) - chunkHandler.lastAckReceived.Load()
+}
+
+// windowExceeded returns true if flow control is enabled (see Server.AckFlowControl) and the peer has at least
+// sendWindow bytes to acknowledge, in which case media isn't sent to it until it acknowledges them.
+func (chunkHandler *ChunkHandler) windowExceeded() bool {
+	if !chunkHandler.ackFlowControl {
+		return false
+	}
+	window := chunkHandler.sendWindow.Load()
+	return window > 0 && chunkHandler.unacknowledgedBytes() >= window
 }
 
 func (chunkHandler *ChunkHandler) send(header []byte, payload []byte) error {
-	_, err := chunkHandler.socketw.Write(header)
+	if len(header) == 0 {
+		return ErrInvalidChunkStreamID
+	}
+	chunkHandler.writeMutex.Lock()
+	defer chunkHandler.writeMutex.Unlock()
+
+	// Bytes written to the connection (headers included)
+	bytesSent := 0
+	defer func() {
+		chunkHandler.addBytesSent(bytesSent)
+	}()
+
+	n, err := chunkHandler.socketw.Write(header)
+	bytesSent += n
 	if err != nil {
 		return err
 	}
@@ -455,8 +839,9 @@ func (chunkHandler *ChunkHandler) send(header []byte, payload []byte) error {
 	// Determine if we have to chunk our payload
 	if len(payload) > int(chunkHandler.outChunkSize) {
 		payloadLength := len(payload)
-		// take whatever csid came in the original header, and use it for future chunks. Also specify fmt = 3 (chunk header - type 3) for subsequent chunks
-		chunk3Header := (ChunkType3 << 6) | (header[0] & 0x3F)
+		// take whatever csid came in the original header (in a basic header of 1, 2 or 3 bytes), and use it for future chunks. Also specify fmt = 3 (chunk header - type 3) for subsequent chunks
+		chunk3Header := append([]byte(nil), header[:basicHeaderLength(header[0])]...)
+		chunk3Header[0] = (ChunkType3 << 6) | (header[0] & 0x3F)
 
 		chunkSize := int(chunkHandler.outChunkSize)
 		bytesWritten := 0 // bytes of the PAYLOAD we've written
@@ -465,7 +850,8 @@ func (chunkHandler *ChunkHandler) send(header []byte, payload []byte) error {
 		for bytesWritten < payloadLength {
 			if !firstPayloadChunk {
 				// We've already written payload data, so separate it with a chunk type 3 header
-				err = chunkHandler.socketw.WriteByte(chunk3Header)
+				n, err = chunkHandler.socketw.Write(chunk3Header)
+				bytesSent += n
 				if err != nil {
 					return err
 				}
@@ -474,7 +860,8 @@ func (chunkHandler *ChunkHandler) send(header []byte, payload []byte) error {
 			}
 			// if the next chunk is still not the end of the message, write chunk size bytes
 			if bytesWritten+chunkSize < payloadLength {
-				_, err = chunkHandler.socketw.Write(payload[bytesWritten : bytesWritten+chunkSize])
+				n, err = chunkHandler.socketw.Write(payload[bytesWritten : bytesWritten+chunkSize])
+				bytesSent += n
 				if err != nil {
 					return err
 				}
@@ -482,30 +869,79 @@ func (chunkHandler *ChunkHandler) send(header []byte, payload []byte) error {
 			} else {
 				// Write remaining data
 				remainingBytes := payloadLength - bytesWritten
-				_, err = chunkHandler.socketw.Write(payload[bytesWritten : bytesWritten+remainingBytes])
+				n, err = chunkHandler.socketw.Write(payload[bytesWritten : bytesWritten+remainingBytes])
+				bytesSent += n
 				bytesWritten += remainingBytes
 			}
 		}
 	} else {
 		// No chunking needed
-		_, err := chunkHandler.socketw.Write(payload)
+		n, err := chunkHandler.socketw.Write(payload)
+		bytesSent += n
 		if err != nil {
 			return err
 		}
 	}
 
-	err = chunkHandler.socketw.Flush()
-	if err != nil {
-		return err
+	return chunkHandler.flush()
+}
+
+// sendMessage sends a message generated with a type 0 header, split in chunks by send if it doesn't fit in one.
+func (chunkHandler *ChunkHandler) sendMessage(message []byte) error {
+	if len(message) == 0 {
+		return ErrInvalidChunkStreamID
 	}
-	return nil
+	headerLength := basicHeaderLength(message[0]) + 11
+	return chunkHandler.send(message[:headerLength], message[headerLength:])
 }
 
 func (chunkHandler *ChunkHandler) sendBytes(bytes []byte) (n int, err error) {
+	if len(bytes) == 0 {
+		return 0, ErrInvalidChunkStreamID
+	}
+	chunkHandler.writeMutex.Lock()
+	defer chunkHandler.writeMutex.Unlock()
+
 	n, err = chunkHandler.socketw.Write(bytes)
+	chunkHandler.addBytesSent(n)
 	if err != nil {
 		return
 	}
-	err = chunkHandler.socketw.Flush()
+	err = chunkHandler.flush()
 	return
 }
+
+// flush writes the messages buffered in socketw to the connection, unless a batch is in progress. The caller must hold
+// writeMutex.
+func (chunkHandler *ChunkHandler) flush() error {
+	if chunkHandler.batches > 0 {
+		return nil
+	}
+	return chunkHandler.socketw.Flush()
+}
+
+// Flush writes the messages buffered in socketw to the connection, even if a batch is in progress.
+func (chunkHandler *ChunkHandler) Flush() error {
+	chunkHandler.writeMutex.Lock()
+	defer chunkHandler.writeMutex.Unlock()
+	return chunkHandler.socketw.Flush()
+}
+
+// beginBatch starts a batch: the messages sent until the matching endBatch are buffered, and written to the connection
+// at once (in as few syscalls as the size of socketw allows) instead of being flushed one by one. Batches can be
+// nested, the messages are flushed when the outermost one ends. Messages sent by other goroutines in the meantime are
+// part of the batch too.
+func (chunkHandler *ChunkHandler) beginBatch() {
+	chunkHandler.writeMutex.Lock()
+	defer chunkHandler.writeMutex.Unlock()
+	chunkHandler.batches++
+}
+
+// endBatch ends a batch started with beginBatch, and flushes the messages sent during the batch if it's the outermost
+// one.
+func (chunkHandler *ChunkHandler) endBatch() error {
+	chunkHandler.writeMutex.Lock()
+	defer chunkHandler.writeMutex.Unlock()
+	chunkHandler.batches--
+	return chunkHandler.flush()
+}
@@ -0,0 +1,548 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codingpa-ws/rtmp/constants"
+)
+
+// chunkStream encodes messages in chunks of chunkSize bytes, like a peer would send them.
+func chunkStream(t testing.TB, chunkSize uint32, messages ...[]byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	chunkHandler := NewChunkHandler(nil, w)
+	chunkHandler.outChunkSize = chunkSize
+	for _, message := range messages {
+		if err := chunkHandler.send(message[:12], message[12:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b.Bytes()
+}
+
+// videoMessage returns a video message on the video channel (type 0 header followed by the payload).
+func videoMessage(streamID uint32, timestamp uint32, payload []byte) []byte {
+	message := make([]byte, 12, 12+len(payload))
+	message[0] = VideoChannel
+	putUint24(message[1:], timestamp)
+	putUint24(message[4:], uint32(len(payload)))
+	message[7] = VideoMessage
+	binary.LittleEndian.PutUint32(message[8:], streamID)
+	return append(message, payload...)
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
+
+// countingReader counts the reads made on the connection, each of which is a syscall on a socket.
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	c.reads++
+	return c.r.Read(b)
+}
+
+// readMessages reads every message of a chunk stream, and returns their payloads.
+func readMessages(chunkHandler *ChunkHandler) ([][]byte, error) {
+	var payloads [][]byte
+	for {
+		header, _, err := chunkHandler.ReadChunkHeader()
+		if errors.Is(err, io.EOF) {
+			return payloads, nil
+		}
+		if err != nil {
+			return payloads, err
+		}
+		payload, _, err := chunkHandler.ReadChunkData(header)
+		if err != nil {
+			return payloads, err
+		}
+		payloads = append(payloads, payload)
+	}
+}
+
+// TestUnknownChunkType checks that a basic header of no known chunk type is rejected with ErrUnknownChunkType (the
+// basic header only has 2 bits for it, which decode to a known type, so the header is made up).
+func TestUnknownChunkType(t *testing.T) {
+	chunkHandler := NewChunkHandler(bufio.NewReader(bytes.NewReader(make([]byte, 11))), nil)
+	header := ChunkHeader{BasicHeader: &ChunkBasicHeader{FMT: 4, ChunkStreamID: 4}}
+	if _, err := chunkHandler.readMessageHeader(&header); !errors.Is(err, ErrUnknownChunkType) {
+		t.Errorf("readMessageHeader() = %v, want ErrUnknownChunkType", err)
+	}
+}
+
+func TestReadChunkWithoutPreviousHeader(t *testing.T) {
+	// A type 0 chunk of a 3 byte message on chunk stream 4
+	type0 := []byte{0x04, 0, 0, 0, 0, 0, 3, VideoMessage, 1, 0, 0, 0, 1, 2, 3}
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"type 2 first", []byte{0x85, 0, 0, 40, 1, 2, 3}, ErrNoPreviousChunkHeader},
+		{"type 3 first", []byte{0xC5, 1, 2, 3}, ErrNoPreviousChunkHeader},
+		{"type 2 on another chunk stream", append(append([]byte(nil), type0...), 0x85, 0, 0, 40, 1, 2, 3), ErrNoPreviousChunkHeader},
+		{"type 3 on another chunk stream", append(append([]byte(nil), type0...), 0xC5, 1, 2, 3), ErrNoPreviousChunkHeader},
+		{"type 2 after type 0", append(append([]byte(nil), type0...), 0x84, 0, 0, 40, 1, 2, 3), nil},
+		{"type 3 after type 0", append(append([]byte(nil), type0...), 0xC4, 1, 2, 3), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunkHandler := NewChunkHandler(bufio.NewReader(bytes.NewReader(test.data)), nil)
+			if _, err := readMessages(chunkHandler); !errors.Is(err, test.want) {
+				t.Errorf("read error = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// TestReusedChunkStream reads a chunk stream that's switched to another message stream by a type 0 header (with a
+// message split in two chunks), then carries on with a type 1 header.
+func TestReusedChunkStream(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write([]byte{0x04, 0, 0, 0, 0, 0, 1, VideoMessage, 1, 0, 0, 0, 0})
+	second := pattern(200, 0)
+	stream.Write([]byte{0x04, 0, 0, 10, 0, 0, 200, VideoMessage, 2, 0, 0, 0})
+	stream.Write(second[:128])
+	stream.WriteByte(0xC4)
+	stream.Write(second[128:])
+	stream.Write([]byte{0x44, 0, 0, 5, 0, 0, 1, VideoMessage, 0})
+
+	type message struct {
+		streamID    uint32
+		elapsedTime uint32
+		length      int
+	}
+	tests := []struct {
+		name  string
+		reset bool
+		want  []message
+	}{
+		{"flagged", false, []message{{1, 0, 1}, {2, 10, 200}, {2, 15, 1}}},
+		{"reset", true, []message{{1, 0, 1}, {2, 10, 200}, {0, 5, 1}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunkHandler := NewChunkHandler(bufio.NewReader(bytes.NewReader(stream.Bytes())), nil)
+			chunkHandler.resetOnStreamIDChange = test.reset
+			var got []message
+			for range test.want {
+				header, _, err := chunkHandler.ReadChunkHeader()
+				if err != nil {
+					t.Fatal(err)
+				}
+				payload, _, err := chunkHandler.ReadChunkData(header)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, message{header.MessageHeader.MessageStreamID, header.ElapsedTime, len(payload)})
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("read %+v, want %+v", got, test.want)
+			}
+			if changes := chunkHandler.StreamIDChanges(); changes != 1 {
+				t.Errorf("StreamIDChanges() = %d, want 1", changes)
+			}
+		})
+	}
+}
+
+// TestType3Timestamps reads audio messages sent with type 3 chunk headers, and checks that each one that starts a new
+// message adds the previous delta to the timestamp (the timestamp of the type 0 chunk if it follows one), but not the
+// type 3 chunks that continue a message.
+func TestType3Timestamps(t *testing.T) {
+	frame := pattern(32, 0)
+	type0 := func(timestamp uint32, length int) []byte {
+		return []byte{0x00 | AudioChannel, 0, byte(timestamp >> 8), byte(timestamp), 0, 0, byte(length), AudioMessage, 1, 0, 0, 0}
+	}
+	type1 := func(delta uint32, length int) []byte {
+		return []byte{0x40 | AudioChannel, 0, byte(delta >> 8), byte(delta), 0, 0, byte(length), AudioMessage}
+	}
+	type2 := func(delta uint32) []byte {
+		return []byte{0x80 | AudioChannel, 0, byte(delta >> 8), byte(delta)}
+	}
+	type3 := []byte{0xC0 | AudioChannel}
+	stream := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	long := pattern(200, 0)
+
+	tests := []struct {
+		name   string
+		stream []byte
+		want   []uint32
+	}{
+		{"after a type 2 chunk", stream(type0(1000, 32), frame, type2(20), frame, type3, frame, type3, frame),
+			[]uint32{1000, 1020, 1040, 1060}},
+		{"after a type 0 chunk", stream(type0(20, 32), frame, type3, frame, type3, frame), []uint32{20, 40, 60}},
+		{"after a message of several chunks", stream(type0(1000, 200), long[:128], type3, long[128:], type1(23, 32), frame, type3,
+			frame, type3, frame), []uint32{1000, 1023, 1046, 1069}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunkHandler := NewChunkHandler(bufio.NewReader(bytes.NewReader(test.stream)), nil)
+			var got []uint32
+			for {
+				header, _, err := chunkHandler.ReadChunkHeader()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, _, err := chunkHandler.ReadChunkData(header); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, header.ElapsedTime)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("read audio messages at %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestChunkStreamID sends a command on chunk streams whose IDs take the 1, 2 and 3 bytes forms of the basic header, and
+// reads it back.
+func TestChunkStreamID(t *testing.T) {
+	body := pattern(200, 0)
+	for _, csid := range []uint32{3, 63, 64, 300, 319, 320, MaxChunkStreamID} {
+		t.Run(fmt.Sprint(csid), func(t *testing.T) {
+			var b bytes.Buffer
+			w := bufio.NewWriter(&b)
+			if err := NewChunkHandler(nil, w).sendMessage(generateCommandMessage(csid, 1, 0, body)); err != nil {
+				t.Fatalf("sendMessage() = %v", err)
+			}
+			chunkHandler := NewChunkHandler(bufio.NewReader(&b), nil)
+			header, _, err := chunkHandler.ReadChunkHeader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.BasicHeader.ChunkStreamID != csid {
+				t.Errorf("read chunk stream ID %d, want %d", header.BasicHeader.ChunkStreamID, csid)
+			}
+			// The type 3 chunk that completes the message repeats the chunk stream ID
+			payload, _, err := chunkHandler.ReadChunkData(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(payload, body) {
+				t.Errorf("read payload %x, want %x", payload, body)
+			}
+		})
+	}
+
+	t.Run("too large", func(t *testing.T) {
+		var b bytes.Buffer
+		chunkHandler := NewChunkHandler(nil, bufio.NewWriter(&b))
+		if err := chunkHandler.sendMessage(generateCommandMessage(70000, 1, 0, body)); !errors.Is(err, ErrInvalidChunkStreamID) {
+			t.Errorf("sendMessage() = %v, want ErrInvalidChunkStreamID", err)
+		}
+		if _, err := chunkHandler.sendBytes(generateCommandMessage(70000, 1, 0, body)); !errors.Is(err, ErrInvalidChunkStreamID) {
+			t.Errorf("sendBytes() = %v, want ErrInvalidChunkStreamID", err)
+		}
+		if b.Len() != 0 {
+			t.Errorf("sent %d bytes, want 0", b.Len())
+		}
+	})
+}
+
+// FuzzReadChunk reads arbitrary chunk streams, which must fail with an error rather than panic or allocate more than
+// the maximum message size. The seed corpus is in testdata/fuzz/FuzzReadChunk.
+func FuzzReadChunk(f *testing.F) {
+	f.Add(chunkStream(f, 128, videoMessage(1, 0, make([]byte, 300)), videoMessage(1, 40, make([]byte, 10))))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		chunkHandler := NewChunkHandler(bufio.NewReader(bytes.NewReader(data)), nil)
+		chunkHandler.maxMessageSize = 1 << 20
+		readMessages(chunkHandler)
+	})
+}
+
+// pattern returns n bytes that differ from one message to the other (with seed).
+func pattern(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = seed + byte(i)
+	}
+	return b
+}
+
+// TestAckDuringLargeMessage checks that acknowledgements are sent while the chunks of a large message are read, not
+// only once it's complete, so that the window of the peer doesn't stall in the middle of the message.
+func TestAckDuringLargeMessage(t *testing.T) {
+	video := pattern(20000, 0)
+	stream := chunkStream(t, 128, videoMessage(1, 0, video))
+	var sent bytes.Buffer
+	w := bufio.NewWriter(&sent)
+	chunkHandler := NewChunkHandler(bufio.NewReader(bytes.NewReader(stream)), w)
+	chunkHandler.SetWindowAckSize(5000)
+
+	header, _, err := chunkHandler.ReadChunkHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload, _, err := chunkHandler.ReadChunkData(header); err != nil || !bytes.Equal(payload, video) {
+		t.Fatalf("ReadChunkData() = %d bytes, %v, want the video message", len(payload), err)
+	}
+	w.Flush()
+
+	acks, err := readMessages(NewChunkHandler(bufio.NewReader(&sent), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sequenceNumbers []uint32
+	for _, ack := range acks {
+		sequenceNumbers = append(sequenceNumbers, binary.BigEndian.Uint32(ack))
+	}
+	// The first acknowledgement is sent when the window is set, and the others every 5000 bytes of the message
+	if len(sequenceNumbers) != 1+len(stream)/5000 {
+		t.Fatalf("sent acknowledgements %v for a message of %d bytes, want one every 5000 bytes", sequenceNumbers, len(stream))
+	}
+	// Each one is sent after the chunk that crossed the window, which is at most the chunk size plus the largest chunk
+	// header (18 bytes) past it
+	for i, sequenceNumber := range sequenceNumbers[1:] {
+		if sequenceNumber < uint32(5000*(i+1)) || sequenceNumber > uint32(5000*(i+1)+128+18) {
+			t.Errorf("acknowledgement %d sent after %d bytes, want it sent after %d", i+1, sequenceNumber, 5000*(i+1))
+		}
+	}
+}
+
+// TestWindowAckSizes sets a different window in each direction, and checks that acknowledgements are sent to the peer
+// by the window it set, while the flow control of the bytes sent to it uses the window sent to it.
+func TestWindowAckSizes(t *testing.T) {
+	stream := chunkStream(t, 128, videoMessage(1, 0, pattern(3000, 1)))
+	var sent bytes.Buffer
+	w := bufio.NewWriter(&sent)
+	chunkHandler := NewChunkHandler(bufio.NewReader(bytes.NewReader(stream)), w)
+	chunkHandler.ackFlowControl = true
+	chunkHandler.sendWindowAckSize(10000)
+	chunkHandler.SetWindowAckSize(1000)
+	if _, err := readMessages(chunkHandler); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+
+	reader := NewChunkHandler(bufio.NewReader(&sent), nil)
+	var windows, acks []uint32
+	for {
+		header, _, err := reader.ReadChunkHeader()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, _, err := reader.ReadChunkData(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch header.MessageHeader.MessageTypeID {
+		case WindowAckSize:
+			windows = append(windows, binary.BigEndian.Uint32(payload))
+		case Ack:
+			acks = append(acks, binary.BigEndian.Uint32(payload))
+		}
+	}
+	if !reflect.DeepEqual(windows, []uint32{10000}) {
+		t.Errorf("sent the windows %v, want [10000]", windows)
+	}
+	// The initial acknowledgement, and one after the chunk that crossed every 1000 bytes received since the last one
+	for i := 1; i < len(acks); i++ {
+		if received := acks[i] - acks[i-1]; received < 1000 || received > 1000+128+18 || (i == 1 && acks[0] != 0) {
+			t.Errorf("sent acknowledgements %v, want one every 1000 bytes", acks)
+			break
+		}
+	}
+	if len(acks) < 2 || uint32(len(stream))-acks[len(acks)-1] >= 1000 {
+		t.Errorf("sent acknowledgements %v for %d bytes received, want one every 1000 bytes", acks, len(stream))
+	}
+
+	// The peer can have twice the window sent to it to acknowledge, regardless of the window it set
+	chunkHandler.onAck(uint32(chunkHandler.totalBytesSent.Load()))
+	chunkHandler.addBytesSent(19999)
+	if chunkHandler.windowExceeded() {
+		t.Errorf("window exceeded with %d bytes to acknowledge, want 20000", chunkHandler.unacknowledgedBytes())
+	}
+	chunkHandler.addBytesSent(1)
+	if !chunkHandler.windowExceeded() {
+		t.Errorf("window not exceeded with %d bytes to acknowledge", chunkHandler.unacknowledgedBytes())
+	}
+}
+
+// TestAssembleInterleavedMessages reads a video message whose chunks are interleaved with the chunks of an audio
+// message, and with a Set Chunk Size message that changes the size of the chunks of both messages that follow it.
+func TestAssembleInterleavedMessages(t *testing.T) {
+	video, audio := pattern(600, 0), pattern(200, 100)
+	var stream bytes.Buffer
+	stream.Write([]byte{VideoChannel, 0, 0, 40, 0, 0x02, 0x58, VideoMessage, 1, 0, 0, 0})
+	stream.Write(video[:128])
+	stream.Write([]byte{AudioChannel, 0, 0, 20, 0, 0, 200, AudioMessage, 1, 0, 0, 0})
+	stream.Write(audio[:128])
+	stream.Write([]byte{0xC0 | VideoChannel})
+	stream.Write(video[128:256])
+	stream.Write([]byte{ProtocolChannel, 0, 0, 0, 0, 0, 4, SetChunkSize, 0, 0, 0, 0, 0, 0, 1, 0})
+	stream.Write([]byte{0xC0 | VideoChannel})
+	stream.Write(video[256:512])
+	stream.Write([]byte{0xC0 | AudioChannel})
+	stream.Write(audio[128:])
+	stream.Write([]byte{0xC0 | VideoChannel})
+	stream.Write(video[512:])
+
+	chunkHandler := NewChunkHandler(bufio.NewReader(&stream), nil)
+	header, _, err := chunkHandler.ReadChunkHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _, err := chunkHandler.ReadChunkData(header)
+	if err != nil {
+		t.Fatalf("ReadChunkData() = %v", err)
+	}
+	if !bytes.Equal(payload, video) || header.ElapsedTime != 40 {
+		t.Errorf("read a video message of %d bytes at %d, want %d bytes at 40", len(payload), header.ElapsedTime, len(video))
+	}
+	if chunkHandler.inChunkSize != 256 {
+		t.Errorf("chunk size = %d after the Set Chunk Size message, want 256", chunkHandler.inChunkSize)
+	}
+
+	interleaved := chunkHandler.takeInterleavedMessages()
+	if len(interleaved) != 2 {
+		t.Fatalf("%d interleaved messages, want 2", len(interleaved))
+	}
+	if typeID := interleaved[0].header.MessageHeader.MessageTypeID; typeID != SetChunkSize {
+		t.Errorf("first interleaved message is of type %d, want Set Chunk Size", typeID)
+	}
+	if message := interleaved[1]; !bytes.Equal(message.payload, audio) || message.header.ElapsedTime != 20 {
+		t.Errorf("second interleaved message is %d bytes at %d, want the audio message (%d bytes at 20)", len(message.payload), message.header.ElapsedTime, len(audio))
+	}
+	if len(chunkHandler.partialMessages) != 0 {
+		t.Errorf("%d messages still being assembled, want 0", len(chunkHandler.partialMessages))
+	}
+}
+
+func TestMessageAssemblyTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	stream := chunkStream(t, DefaultMaximumChunkSize, videoMessage(1, 0, make([]byte, 300)))
+	// The peer trickles the message: only its first chunk is sent
+	go client.Write(stream[:12+DefaultMaximumChunkSize])
+
+	chunkHandler := NewChunkHandler(bufio.NewReader(server), nil)
+	chunkHandler.messageAssemblyTimeout = 50 * time.Millisecond
+	chunkHandler.conn = server
+	// The read deadline is in wall-clock time, whatever the clock of the chunk handler tells
+	chunkHandler.clock = &fakeClock{now: time.Unix(1000, 0)}
+	done := make(chan error, 1)
+	go func() {
+		_, err := readMessages(chunkHandler)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrMessageAssemblyTimeout) {
+			t.Errorf("read error = %v, want ErrMessageAssemblyTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the assembly of the message didn't time out")
+	}
+}
+
+// deadlineRecorder records the read deadlines set on a connection.
+type deadlineRecorder struct {
+	deadlines []time.Time
+}
+
+func (d *deadlineRecorder) SetReadDeadline(t time.Time) error {
+	d.deadlines = append(d.deadlines, t)
+	return nil
+}
+
+func TestMessageAssemblyRestoresDeadline(t *testing.T) {
+	stream := chunkStream(t, DefaultMaximumChunkSize, videoMessage(1, 0, make([]byte, 300)))
+	tests := []struct {
+		name     string
+		previous time.Time
+		// Whether the assembly sets a deadline of its own, which is the case if it's earlier than the previous one
+		wantDeadline bool
+	}{
+		{"no previous deadline", time.Time{}, true},
+		{"later previous deadline", time.Now().Add(time.Hour), true},
+		{"earlier previous deadline", time.Now().Add(time.Millisecond), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &deadlineRecorder{}
+			chunkHandler := NewChunkHandler(bufio.NewReader(bytes.NewReader(stream)), nil)
+			chunkHandler.messageAssemblyTimeout = time.Minute
+			chunkHandler.conn = conn
+			chunkHandler.setReadDeadline(test.previous)
+			if _, err := readMessages(chunkHandler); err != nil {
+				t.Fatal(err)
+			}
+			// setReadDeadline, then the deadline of the assembly and the previous one again
+			wantCalls := 1
+			if test.wantDeadline {
+				wantCalls = 3
+			}
+			if len(conn.deadlines) != wantCalls {
+				t.Fatalf("read deadlines set: %v, want %d of them", conn.deadlines, wantCalls)
+			}
+			if last := conn.deadlines[len(conn.deadlines)-1]; !last.Equal(test.previous) {
+				t.Errorf("read deadline left at %v, want %v", last, test.previous)
+			}
+		})
+	}
+}
+
+// BenchmarkReadLargeChunks measures the reads a high-bitrate ingest (512KB keyframes in 256KB chunks) takes with the
+// default read buffer, and with a buffer that grows with the chunk size (see Server.MaxReadBufferSize).
+func BenchmarkReadLargeChunks(b *testing.B) {
+	const chunkSize = 256 * 1024
+	frame := make([]byte, 512*1024)
+	messages := make([][]byte, 16)
+	for i := range messages {
+		messages[i] = videoMessage(1, uint32(i*33), frame)
+	}
+	stream := chunkStream(b, chunkSize, messages...)
+
+	for _, bench := range []struct {
+		name              string
+		maxReadBufferSize int
+	}{
+		{"default", 0},
+		{"grown", 1024 * 1024},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.SetBytes(int64(len(stream)))
+			reads := 0
+			for i := 0; i < b.N; i++ {
+				conn := &countingReader{r: bytes.NewReader(stream)}
+				chunkHandler := NewChunkHandler(bufio.NewReaderSize(conn, constants.BuffioSize), nil)
+				chunkHandler.source = conn
+				chunkHandler.maxReadBufferSize = bench.maxReadBufferSize
+				chunkHandler.SetChunkSize(chunkSize)
+				if _, err := readMessages(chunkHandler); err != nil {
+					b.Fatal(err)
+				}
+				reads += conn.reads
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
@@ -2,81 +2,312 @@ package rtmp
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"net/url"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/codingpa-ws/rtmp/constants"
 )
 
 var ErrInvalidScheme error = errors.New("invalid scheme in URL")
+var ErrTooManyRedirects error = errors.New("client: too many redirects")
+
+// Maximum number of redirects Connect follows, so that misconfigured servers redirecting to each other don't make it loop forever
+const maxRedirects = 5
+
+// BackoffPolicy configures how ConnectWithRetry reconnects: the first retry waits BaseDelay, and every subsequent one
+// waits twice as long as the previous one, up to MaxDelay.
+type BackoffPolicy struct {
+	// Defaults to 1 second
+	BaseDelay time.Duration
+	// Defaults to 30 seconds
+	MaxDelay time.Duration
+	// Maximum number of consecutive failed attempts before giving up. If 0, ConnectWithRetry retries until its context
+	// is done.
+	MaxAttempts int
+}
+
+// delay returns how long to wait before the next attempt, after the given number of consecutive failed attempts.
+func (p BackoffPolicy) delay(failures int) time.Duration {
+	base, max := p.BaseDelay, p.MaxDelay
+	if base <= 0 {
+		base = time.Second
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	delay := base
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+type ClientState int
+
+const (
+	ClientConnecting ClientState = iota
+	// The server started playing the stream
+	ClientConnected
+	ClientDisconnected
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case ClientConnecting:
+		return "connecting"
+	case ClientConnected:
+		return "connected"
+	case ClientDisconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
 
 type Client struct {
 	// Address of the RTMP server this client is connected to
 	raddr      string
 	app        string
 	streamKey  string
-	url        *url.URL
+	url        *rtmpURL
 	OnAudio    AudioCallback
 	OnVideo    VideoCallback
 	OnMetadata MetadataCallback
+	// Called with the code and info object of every status sent by the server (eg: NetStream.Play.Start). Playback
+	// ends on NetStream.Play.Stop, NetStream.Play.UnpublishNotify and errors, after OnStatus is called.
+	OnStatus StatusCallback
+	// Called when the client starts connecting, when the server starts playing the stream, and when the connection
+	// ends (with the error it ended with, if any).
+	OnStateChange func(state ClientState, err error)
+	// Set once the server starts playing the stream
+	playing bool
+	// Optional TLS configuration used for rtmps:// URLs (eg: custom root CAs). If nil, the default configuration is used.
+	TLSConfig *tls.Config
+	// If true, OnAudio, OnVideo and OnMetadata are called on their own goroutines instead of the goroutine reading the
+	// connection, so that slow callbacks don't delay the messages that follow. Audio and video frames are delivered in
+	// order on one goroutine, and metadata on another one, so a metadata callback that blocks doesn't hold up frames.
+	// Otherwise, every callback is called synchronously while reading the connection.
+	AsyncCallbacks bool
+	// Optional function used to establish the connection to the server instead of net.Dialer (eg: to connect over an
+	// in-memory pipe in tests). For rtmps:// URLs, the connection it returns is secured with TLSConfig.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
+// Connect connects to the RTMP URL addr and plays the stream until it ends. If the server redirects the connection
+// (see Session.Redirect), Connect reconnects to the URL it was redirected to.
 func (c *Client) Connect(addr string) error {
-	u, err := url.Parse(addr)
-	if err != nil {
-		return err
+	return c.ConnectContext(context.Background(), addr)
+}
+
+// ConnectContext is like Connect, but gives up with ctx.Err() if ctx is done before the server starts playing the
+// stream, whether it's dialing, performing the handshake or exchanging the connect/createStream/play commands.
+// Once the stream is playing, ctx no longer applies, and ConnectContext returns when the stream ends.
+func (c *Client) ConnectContext(ctx context.Context, addr string) error {
+	return c.play(ctx, addr, false)
+}
+
+// play plays the stream at addr until it ends, following redirects. ctx applies until the server starts playing the
+// stream, or until it ends if untilDone is true.
+func (c *Client) play(ctx context.Context, addr string, untilDone bool) error {
+	for redirects := 0; redirects <= maxRedirects; redirects++ {
+		redirectURL, err := c.connect(ctx, addr, untilDone)
+		if redirectURL == "" {
+			return err
+		}
+		addr = redirectURL
 	}
-	// Always assign rtmp as the scheme
-	u.Scheme = "rtmp"
-	if u.Port() == "" {
-		u.Host += ":" + constants.DefaultPort
+	return ErrTooManyRedirects
+}
+
+// ConnectWithRetry plays the stream at addr like Connect, but reconnects whenever the connection ends or can't be
+// established (eg: the server restarted, or the publisher dropped and the stream isn't found until it comes back),
+// waiting as configured by policy between attempts. The callbacks of the client are kept across reconnections.
+// ConnectWithRetry returns after policy.MaxAttempts consecutive attempts failed, with the error of the last one. An
+// attempt counts as failed if the connection ended before the server started playing the stream.
+// It also returns ctx.Err() as soon as ctx is done, whether it's waiting to reconnect, connecting, or playing the
+// stream (the connection is then closed).
+func (c *Client) ConnectWithRetry(ctx context.Context, addr string, policy BackoffPolicy) error {
+	failures := 0
+	for {
+		c.setState(ClientConnecting, nil)
+		c.playing = false
+		err := c.play(ctx, addr, true)
+		c.setState(ClientDisconnected, err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if c.playing {
+			failures = 0
+		}
+		failures++
+		if policy.MaxAttempts > 0 && failures >= policy.MaxAttempts {
+			return err
+		}
+		timer := time.NewTimer(policy.delay(failures))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
 	}
-	c.url = u
-	c.raddr = u.Host
+}
+
+func (c *Client) setState(state ClientState, err error) {
+	if c.OnStateChange != nil {
+		c.OnStateChange(state, err)
+	}
+}
 
-	urlPath := u.Path
-	path := strings.Split(urlPath, "/")
-	// At the very least we need something in the path
-	if len(path) == 0 || (len(path) == 1 && path[0] == "") {
-		panic("invalid URL path")
+// tlsConfig returns the TLS configuration of connections dialed with DialContext, which (like tls.Dialer) verify the
+// host of the server unless TLSConfig sets another ServerName.
+func (c *Client) tlsConfig() *tls.Config {
+	config := &tls.Config{}
+	if c.TLSConfig != nil {
+		config = c.TLSConfig.Clone()
 	}
-	if path[0] == "" {
-		path = path[1:]
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(c.raddr)
 	}
+	return config
+}
 
-	elements := len(path)
-	// Treat the first part of the path as the app name
-	c.app = strings.Join(path[:elements-1], "/")
-	// The stream key is the last element of the path
-	c.streamKey = path[elements-1]
+// connect plays the stream at addr until it ends. If the server redirects the connection, it returns the URL it was
+// redirected to. ctx interrupts the connection until the server starts playing the stream, or until it ends if
+// untilDone is true.
+func (c *Client) connect(ctx context.Context, addr string, untilDone bool) (redirectURL string, err error) {
+	u, err := parseURL(addr)
+	if err != nil {
+		return "", err
+	}
+	if u.StreamKey == "" {
+		return "", ErrMissingStreamKey
+	}
+	// rtmps:// URLs are dialed over TLS
+	secure := u.Scheme == "rtmps"
+	c.url = u
+	c.raddr = u.Address()
+	c.app = u.App
+	c.streamKey = u.PlayName()
 
 	if constants.Debug {
 		fmt.Printf("app: \"%s\", streamKey: \"%s\"\n", c.app, c.streamKey)
 	}
-	conn, err := net.Dial("tcp", c.raddr)
+	var conn net.Conn
+	if c.DialContext != nil {
+		conn, err = c.DialContext(ctx, "tcp", c.raddr)
+		if err == nil && secure {
+			conn = tls.Client(conn, c.tlsConfig())
+		}
+	} else if secure {
+		dialer := &tls.Dialer{Config: c.TLSConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", c.raddr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", c.raddr)
+	}
 	if err != nil {
-		return err
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
 	}
 
 	defer conn.Close()
 
+	// Until the stream starts playing, ctx interrupts any pending read/write on the connection
+	watch := newConnectWatcher(ctx, conn)
+	defer watch.stop()
+
 	if constants.Debug {
 		fmt.Println("client: connected to", conn.RemoteAddr().String())
 	}
 
 	socketr := bufio.NewReaderSize(conn, constants.BuffioSize)
 	socketw := bufio.NewWriterSize(conn, constants.BuffioSize)
-	tcUrl := "rtmp://" + conn.RemoteAddr().String() + "/" + c.app
+	// The tcUrl names the server the way the URL does, not by the address it resolved to (which servers behind a proxy
+	// or virtual hosts can't match, and pipes set with DialContext don't have)
+	tcUrl := u.Scheme + "://" + c.raddr + "/" + c.app
 	client := NewClientSession(c.app, tcUrl, c.streamKey, c.OnAudio, c.OnVideo, c.OnMetadata)
+	client.OnStatus = func(code string, info map[string]any) {
+		if code == "NetStream.Play.Start" {
+			if !untilDone {
+				watch.stop()
+			}
+			c.playing = true
+			c.setState(ClientConnected, nil)
+		}
+		if c.OnStatus != nil {
+			c.OnStatus(code, info)
+		}
+	}
 	client.messageManager = NewMessageManager(client, NewHandshaker(socketr, socketw), NewChunkHandler(socketr, socketw))
+	client.asyncMedia = c.AsyncCallbacks
 	err = client.StartPlayback()
+	if errors.Is(err, ErrRedirected) {
+		return client.redirectURL, nil
+	}
+	if err != nil && watch.interrupted() {
+		return "", ctx.Err()
+	}
 	if err != nil && err != io.EOF {
-		return err
+		return "", err
 	}
 
-	return nil
+	return "", nil
+}
+
+// connectWatcher sets an expired deadline on a connection when its context is done, which makes any pending read or
+// write on it fail, until stop is called.
+type connectWatcher struct {
+	mutex   sync.Mutex
+	stopped bool
+	// Set if the deadline was set because the context was done
+	expired bool
+	done    chan struct{}
+}
+
+func newConnectWatcher(ctx context.Context, conn net.Conn) *connectWatcher {
+	w := &connectWatcher{done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.mutex.Lock()
+			if !w.stopped {
+				w.expired = true
+				conn.SetDeadline(time.Now())
+			}
+			w.mutex.Unlock()
+		case <-w.done:
+		}
+	}()
+	return w
+}
+
+// stop stops watching the context. If the context was already done, the connection stays unusable.
+func (w *connectWatcher) stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.stopped {
+		return
+	}
+	w.stopped = true
+	close(w.done)
+}
+
+// interrupted returns true if the context was done before stop was called.
+func (w *connectWatcher) interrupted() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.expired
 }
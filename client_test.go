@@ -0,0 +1,431 @@
+package rtmp_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codingpa-ws/rtmp"
+	"github.com/codingpa-ws/rtmp/audio"
+	"github.com/codingpa-ws/rtmp/rtmptest"
+	"github.com/codingpa-ws/rtmp/video"
+)
+
+// tcUrlGuard rejects every connection after recording the tcUrl it was sent.
+type tcUrlGuard struct {
+	tcUrl chan string
+}
+
+func (g tcUrlGuard) Check(*rtmp.Session) bool { return true }
+func (g tcUrlGuard) End(*rtmp.Session)        {}
+func (g tcUrlGuard) CheckConnect(sess *rtmp.Session) bool {
+	g.tcUrl <- sess.TcUrl()
+	return false
+}
+
+// selfSignedCertificate returns a certificate for host and the loopback address, and a pool of root CAs trusting it.
+func selfSignedCertificate(t *testing.T, host string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		DNSNames:              []string{host},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+// redirectGuard redirects every connection to url.
+type redirectGuard struct {
+	url string
+}
+
+func (g redirectGuard) Check(*rtmp.Session) bool { return true }
+func (g redirectGuard) End(*rtmp.Session)        {}
+func (g redirectGuard) CheckConnect(sess *rtmp.Session) bool {
+	sess.Redirect(g.url)
+	return false
+}
+
+func TestRedirect(t *testing.T) {
+	edge := newTestServer()
+	edge.Broadcaster.SetSessionGuard(redirectGuard{url: "rtmp://origin.example.com/app/live"})
+	origin := newTestServer()
+	guard := tcUrlGuard{tcUrl: make(chan string, 1)}
+	origin.Broadcaster.SetSessionGuard(guard)
+
+	t.Run("emit", func(t *testing.T) {
+		conn, err := rtmptest.Pipe(edge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.SendCommand(0, "connect", 1, map[string]any{"app": "app", "tcUrl": "rtmp://edge.example.com/app"})
+		command, _ := conn.ExpectResult()
+		if command == nil || command.Name != "_error" || command.Info()["code"] != rtmp.NetConnectionRejected {
+			t.Fatalf("connect answered with %v, want a rejection", command)
+		}
+		ex, _ := command.Info()["ex"].(map[string]any)
+		if ex["code"] != 302.0 || ex["redirect"] != "rtmp://origin.example.com/app/live" {
+			t.Errorf("ex = %v, want a 302 redirect to rtmp://origin.example.com/app/live", ex)
+		}
+		if _, err := conn.ReadMessage(); err == nil {
+			t.Error("connection still open after redirecting it")
+		}
+	})
+
+	t.Run("follow", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var dialed []string
+		client := &rtmp.Client{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialed = append(dialed, addr)
+				if addr == "origin.example.com:1935" {
+					return rtmptest.PipeDialer(origin)(ctx, network, addr)
+				}
+				return rtmptest.PipeDialer(edge)(ctx, network, addr)
+			},
+		}
+		// The connection ends once the origin rejects it
+		if err := client.ConnectContext(ctx, "rtmp://edge.example.com/app/live"); ctx.Err() != nil {
+			t.Fatalf("ConnectContext() = %v", err)
+		}
+		if !reflect.DeepEqual(dialed, []string{"edge.example.com:1935", "origin.example.com:1935"}) {
+			t.Errorf("dialed %v, want the edge and then the origin", dialed)
+		}
+		select {
+		case tcUrl := <-guard.tcUrl:
+			if tcUrl != "rtmp://origin.example.com:1935/app" {
+				t.Errorf("tcUrl = %q, want %q", tcUrl, "rtmp://origin.example.com:1935/app")
+			}
+		default:
+			t.Fatal("the origin didn't receive the connect command")
+		}
+	})
+
+	t.Run("loop", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// The edge redirects to the origin URL, which it serves too
+		client := &rtmp.Client{DialContext: rtmptest.PipeDialer(edge)}
+		if err := client.ConnectContext(ctx, "rtmp://edge.example.com/app/live"); !errors.Is(err, rtmp.ErrTooManyRedirects) {
+			t.Errorf("ConnectContext() = %v, want ErrTooManyRedirects", err)
+		}
+	})
+}
+
+// TestConnectTLS connects to an RTMPS server over an in-memory pipe, and checks that the tcUrl sent by the client
+// names the server by the host and port of the URL.
+func TestConnectTLS(t *testing.T) {
+	cert, roots := selfSignedCertificate(t, "rtmp.example.com")
+	s := newTestServer()
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	guard := tcUrlGuard{tcUrl: make(chan string, 1)}
+	s.Broadcaster.SetSessionGuard(guard)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := &rtmp.Client{
+		DialContext: rtmptest.PipeDialer(s),
+		TLSConfig:   &tls.Config{RootCAs: roots},
+	}
+	// The connection ends once the guard rejects it
+	if err := client.ConnectContext(ctx, "rtmps://rtmp.example.com:1936/app/live"); ctx.Err() != nil {
+		t.Fatalf("ConnectContext() = %v", err)
+	}
+	select {
+	case tcUrl := <-guard.tcUrl:
+		if tcUrl != "rtmps://rtmp.example.com:1936/app" {
+			t.Errorf("tcUrl = %q, want %q", tcUrl, "rtmps://rtmp.example.com:1936/app")
+		}
+	default:
+		t.Fatal("the server didn't receive the connect command")
+	}
+}
+
+// TestConnectRTMPS connects to an RTMPS server listening on the loopback interface, and to one without a port in its
+// URL, which is dialed on the default RTMPS port.
+func TestConnectRTMPS(t *testing.T) {
+	cert, roots := selfSignedCertificate(t, "rtmp.example.com")
+	s := newTestServer()
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	guard := tcUrlGuard{tcUrl: make(chan string, 1)}
+	s.Broadcaster.SetSessionGuard(guard)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	t.Run("loopback", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		client := &rtmp.Client{TLSConfig: &tls.Config{RootCAs: roots}}
+		if err := client.ConnectContext(ctx, "rtmps://"+l.Addr().String()+"/app/live"); ctx.Err() != nil {
+			t.Fatalf("ConnectContext() = %v", err)
+		}
+		select {
+		case tcUrl := <-guard.tcUrl:
+			if want := "rtmps://" + l.Addr().String() + "/app"; tcUrl != want {
+				t.Errorf("tcUrl = %q, want %q", tcUrl, want)
+			}
+		default:
+			t.Fatal("the server didn't receive the connect command")
+		}
+	})
+
+	t.Run("default port", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		dialed := make(chan string, 1)
+		client := &rtmp.Client{
+			TLSConfig: &tls.Config{RootCAs: roots},
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialed <- addr
+				return rtmptest.PipeDialer(s)(ctx, network, addr)
+			},
+		}
+		if err := client.ConnectContext(ctx, "rtmps://rtmp.example.com/app/live"); ctx.Err() != nil {
+			t.Fatalf("ConnectContext() = %v", err)
+		}
+		if addr := <-dialed; addr != "rtmp.example.com:443" {
+			t.Errorf("dialed %s, want rtmp.example.com:443", addr)
+		}
+		<-guard.tcUrl
+	})
+}
+
+// TestConnectStreamNotFound checks that playing a stream that isn't published fails with ErrStreamNotFound.
+func TestConnectStreamNotFound(t *testing.T) {
+	s := newTestServer()
+	client := &rtmp.Client{DialContext: rtmptest.PipeDialer(s)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.ConnectContext(ctx, "rtmp://localhost/app/live"); !errors.Is(err, rtmp.ErrStreamNotFound) {
+		t.Errorf("ConnectContext() = %v, want ErrStreamNotFound", err)
+	}
+}
+
+// TestConnectWithRetry checks that a client whose first connection fails reconnects and plays the stream, until its
+// context is canceled.
+func TestConnectWithRetry(t *testing.T) {
+	s := newTestServer()
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pipeDialer := rtmptest.PipeDialer(s)
+	dials := 0
+	var mutex sync.Mutex
+	var states []string
+	client := &rtmp.Client{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if dials++; dials == 1 {
+				return nil, errors.New("connection refused")
+			}
+			return pipeDialer(ctx, network, addr)
+		},
+		OnStateChange: func(state rtmp.ClientState, err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			states = append(states, state.String())
+			if state == rtmp.ClientConnected {
+				cancel()
+			}
+		},
+	}
+	err := client.ConnectWithRetry(ctx, "rtmp://localhost/app/live", rtmp.BackoffPolicy{BaseDelay: time.Millisecond, MaxAttempts: 3})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ConnectWithRetry() = %v, want context.Canceled", err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []string{"connecting", "disconnected", "connecting", "connected", "disconnected"}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("client states %v, want %v", states, want)
+	}
+}
+
+func TestConnectWithRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &rtmp.Client{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			cancel()
+			return nil, errors.New("connection refused")
+		},
+	}
+	done := make(chan error, 1)
+	// Without MaxAttempts, only the context stops the client from waiting to reconnect
+	go func() {
+		done <- client.ConnectWithRetry(ctx, "rtmp://localhost/app/live", rtmp.BackoffPolicy{BaseDelay: time.Hour})
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("ConnectWithRetry() = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ConnectWithRetry() didn't return once its context was canceled")
+	}
+}
+
+// TestClientOnStatus checks that OnStatus is called for every status of the stream, and that playback ends on
+// NetStream.Play.Stop although the connection stays open.
+func TestClientOnStatus(t *testing.T) {
+	s := newTestServer()
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var codes []string
+	client := &rtmp.Client{
+		DialContext: rtmptest.PipeDialer(s),
+		OnStatus: func(code string, info map[string]any) {
+			codes = append(codes, code)
+			if code == "NetStream.Play.Start" {
+				// The publisher deletes its stream without disconnecting
+				go publisher.SendCommand(0, "deleteStream", 0, nil, float64(publisher.StreamID))
+			}
+		},
+	}
+	if err := client.ConnectContext(ctx, "rtmp://localhost/app/live"); err != nil {
+		t.Fatalf("ConnectContext() = %v", err)
+	}
+	if want := []string{"NetStream.Play.Start", "NetStream.Play.Stop"}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("OnStatus called with %q, want %q", codes, want)
+	}
+}
+
+// TestAsyncCallbacks checks that a metadata callback that blocks doesn't stall the audio that follows, when the
+// callbacks are called asynchronously.
+func TestAsyncCallbacks(t *testing.T) {
+	s := newTestServer()
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	release := make(chan struct{})
+	timestamps := make(chan uint32, 3)
+	client := &rtmp.Client{
+		DialContext:    rtmptest.PipeDialer(s),
+		AsyncCallbacks: true,
+		OnMetadata: func(metadata map[string]any) {
+			<-release
+		},
+		OnAudio: func(format audio.Format, sampleRate audio.SampleRate, sampleSize audio.SampleSize, channels audio.Channel, payload []byte, timestamp uint32) {
+			timestamps <- timestamp
+		},
+		OnStatus: func(code string, info map[string]any) {
+			if code != "NetStream.Play.Start" {
+				return
+			}
+			go func() {
+				publisher.SendMetadata(map[string]any{"width": 1280.0})
+				for i := 0; i < cap(timestamps); i++ {
+					publisher.SendAudio([]byte{0x2f, 0x01, 0}, uint32(20*(i+1)))
+				}
+			}()
+		},
+	}
+	done := make(chan error, 1)
+	go func() { done <- client.ConnectContext(ctx, "rtmp://localhost/app/live") }()
+
+	for i := 0; i < cap(timestamps); i++ {
+		select {
+		case <-timestamps:
+		case <-ctx.Done():
+			t.Fatalf("received %d audio frames while the metadata callback was blocked, want %d", i, cap(timestamps))
+		}
+	}
+	close(release)
+	// The stream ends once its publisher disconnects
+	publisher.Close()
+	if err := <-done; err != nil {
+		t.Errorf("ConnectContext() = %v", err)
+	}
+}
+
+// TestClientEnhancedVideo checks that OnVideo is called with the codec and frame type of frames with Enhanced RTMP
+// extended headers, the AV1 sequence header first.
+func TestClientEnhancedVideo(t *testing.T) {
+	s := newTestServer()
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.SendVideo([]byte{0x90, 'a', 'v', '0', '1', 0x81, 0x08, 0x0c, 0x00}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var got []string
+	client := &rtmp.Client{
+		DialContext: rtmptest.PipeDialer(s),
+		OnVideo: func(frameType video.FrameType, codec video.Codec, payload []byte, timestamp uint32) {
+			got = append(got, fmt.Sprintf("%s %s %x", codec, frameType, payload))
+		},
+		OnStatus: func(code string, info map[string]any) {
+			if code != "NetStream.Play.Start" {
+				return
+			}
+			go func() {
+				publisher.SendVideo([]byte{0x91, 'a', 'v', '0', '1', 0x12, 0x00, 0x32, 0x10}, 40)
+				publisher.SendVideo([]byte{0xa1, 'a', 'v', '0', '1', 0x12, 0x00, 0x32, 0x08}, 80)
+				publisher.Close()
+			}()
+		},
+	}
+	if err := client.ConnectContext(ctx, "rtmp://localhost/app/live"); err != nil {
+		t.Fatalf("ConnectContext() = %v", err)
+	}
+	want := []string{
+		"AV1 keyframe 906176303181080c00",
+		"AV1 keyframe 916176303112003210",
+		"AV1 interframe a16176303112003208",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("OnVideo called with %q, want %q", got, want)
+	}
+}
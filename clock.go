@@ -0,0 +1,42 @@
+package rtmp
+
+import "time"
+
+// Clock is the source of time of the features that pace media to its timestamps (eg: FilePlayer.PlayFile), so that
+// they can be tested with a fake clock instead of waiting in real time.
+type Clock interface {
+	Now() time.Time
+	// Sleep pauses the calling goroutine for at least d.
+	Sleep(d time.Duration)
+}
+
+// SystemClock is the Clock used by default. It tells the wall-clock time.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// pacer releases media when its timestamps are due, relative to the time the first timestamp was released.
+type pacer struct {
+	clock   Clock
+	start   time.Time
+	started bool
+}
+
+// wait blocks until timestamp (in milliseconds) is due.
+func (p *pacer) wait(timestamp uint32) {
+	if !p.started {
+		p.start = p.clock.Now().Add(-time.Duration(timestamp) * time.Millisecond)
+		p.started = true
+		return
+	}
+	due := p.start.Add(time.Duration(timestamp) * time.Millisecond)
+	if d := due.Sub(p.clock.Now()); d > 0 {
+		p.clock.Sleep(d)
+	}
+}
@@ -1,6 +1,7 @@
 package constants
 
 const DefaultPort = "1935"
+const DefaultTLSPort = "443"
 const DefaultAddress = ":" + DefaultPort
 
 var Debug = false
@@ -13,6 +14,10 @@ const DefaultChunkSize uint32 = 4096
 
 const FlashMediaServerVersion string = "FMS/3,5,7,7009"
 
+// Version that can be sent in the S1 handshake message (see Server.HandshakeVersion), matching FlashMediaServerVersion.
+// The build number (7009) doesn't fit in a single byte, so only its lowest byte is sent.
+var FlashMediaServerHandshakeVersion = [4]byte{3, 5, 7, 7009 & 0xFF}
+
 const Capabilities int = 31
 
 const Mode int = 1
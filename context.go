@@ -21,6 +21,20 @@ type ContextStore interface {
 	GetAacSequenceHeaderForPublisher(streamKey string) []byte
 }
 
+// StreamLister can optionally be implemented by a ContextStore to list the stream keys of its registered publishers.
+// InMemoryContext implements it.
+type StreamLister interface {
+	GetStreamKeys() []string
+}
+
+// MetadataStore can optionally be implemented by a ContextStore to cache the metadata (@setDataFrame) of each stream,
+// so that it's sent to new sinks and kept in snapshots. InMemoryContext implements it, and so do the broadcasters
+// created with NewBroadcaster, which cache the metadata in their context if it implements it.
+type MetadataStore interface {
+	SetMetadataForPublisher(streamKey string, metadata map[string]any)
+	GetMetadataForPublisher(streamKey string) map[string]any
+}
+
 type InMemoryContext struct {
 	ContextStore
 	subMutex               sync.RWMutex
@@ -28,23 +42,47 @@ type InMemoryContext struct {
 	seqMutex               sync.RWMutex
 	avcSequenceHeaderCache map[string][]byte
 	aacSequenceHeaderCache map[string][]byte
-	numberOfSessions       uint32
+	metadataCache          map[string]map[string]any
+	// Stream keys registered by Restore whose publisher hasn't registered again yet
+	restored         map[string]bool
+	numberOfSessions uint32
 }
 
-var StreamNotFound error = errors.New("StreamNotFound")
+var ErrStreamNotFound error = errors.New("StreamNotFound")
+
+// Deprecated: use ErrStreamNotFound.
+var StreamNotFound = ErrStreamNotFound
+
+var ErrStreamAlreadyPublished error = errors.New("broadcaster: stream is already published")
+
+var ErrDuplicateSubscriber error = errors.New("broadcaster: a subscriber of the stream has the same ID")
 
 func NewInMemoryContext() *InMemoryContext {
 	return &InMemoryContext{
 		subscribers:            make(map[string][]Subscriber),
 		avcSequenceHeaderCache: make(map[string][]byte),
 		aacSequenceHeaderCache: make(map[string][]byte),
+		metadataCache:          make(map[string]map[string]any),
+		restored:               make(map[string]bool),
 	}
 }
 
-// Registers the session in the broadcaster to keep a reference to all open subscribers
+// Registers the session in the broadcaster to keep a reference to all open subscribers. It returns
+// ErrStreamAlreadyPublished if the stream key is already published, since the frames of two publishers would be
+// interleaved in the same stream. A stream key registered by Restore is claimed by its first publisher, along with the
+// subscribers that joined it in the meantime.
 func (c *InMemoryContext) RegisterPublisher(streamKey string) error {
 	// Assume there will be a small amount of subscribers (ie. a few instances of ffmpeg that transcode our audio/video)
 	c.subMutex.Lock()
+	if c.restored[streamKey] {
+		delete(c.restored, streamKey)
+		c.subMutex.Unlock()
+		return nil
+	}
+	if _, exists := c.subscribers[streamKey]; exists {
+		c.subMutex.Unlock()
+		return fmt.Errorf("%w: %s", ErrStreamAlreadyPublished, streamKey)
+	}
 	c.subscribers[streamKey] = make([]Subscriber, 0, 5)
 	if constants.Debug {
 		fmt.Println("context: registered publisher with stream key", streamKey)
@@ -59,6 +97,7 @@ func (c *InMemoryContext) DestroyPublisher(streamKey string) error {
 	defer c.subMutex.Unlock()
 	if _, exists := c.subscribers[streamKey]; exists {
 		delete(c.subscribers, streamKey)
+		delete(c.restored, streamKey)
 		c.numberOfSessions--
 	}
 	return nil
@@ -73,7 +112,7 @@ func (c *InMemoryContext) RegisterSubscriber(streamKey string, subscriber Subscr
 		return nil
 	}
 	// If no stream was found with that stream key, send an error
-	return StreamNotFound
+	return ErrStreamNotFound
 }
 
 func (c *InMemoryContext) StreamExists(streamKey string) bool {
@@ -83,6 +122,20 @@ func (c *InMemoryContext) StreamExists(streamKey string) bool {
 	return exists
 }
 
+// GetStreamKeys returns the stream keys of all the registered publishers
+func (c *InMemoryContext) GetStreamKeys() []string {
+	c.subMutex.RLock()
+	defer c.subMutex.RUnlock()
+	streamKeys := make([]string, 0, len(c.subscribers))
+	for streamKey := range c.subscribers {
+		streamKeys = append(streamKeys, streamKey)
+	}
+	return streamKeys
+}
+
+// GetSubscribersForStream returns the subscribers of a stream. The returned slice is never modified by the context
+// (subscribers are only ever appended past its length, or removed from a copy), so it can be iterated over after the
+// call without a lock, but it must not be modified by the caller.
 func (c *InMemoryContext) GetSubscribersForStream(streamKey string) ([]Subscriber, error) {
 	// We could add a cache check if this context got the subscribers from a DB rather than from memory
 	c.subMutex.RLock()
@@ -92,7 +145,7 @@ func (c *InMemoryContext) GetSubscribersForStream(streamKey string) ([]Subscribe
 		return subscribers, nil
 	}
 	// If no stream was found with that stream key, send an error
-	return nil, StreamNotFound
+	return nil, ErrStreamNotFound
 }
 
 func (c *InMemoryContext) DestroySubscriber(streamKey string, sessionID string) error {
@@ -102,14 +155,15 @@ func (c *InMemoryContext) DestroySubscriber(streamKey string, sessionID string)
 	if !exists {
 		return nil
 	}
-	numberOfSubs := len(subscribers)
-	for i, sub := range subscribers {
-		if sub.GetID() == sessionID {
-			// Swap the subscriber we're deleting with the last element, to avoid having to delete (more efficient)
-			subscribers[i] = subscribers[numberOfSubs-1]
-			c.subscribers[streamKey] = subscribers[:numberOfSubs-1]
+	// The subscribers are copied rather than removed in place: broadcasts iterate over the slices returned by
+	// GetSubscribersForStream without holding the lock
+	remaining := make([]Subscriber, 0, cap(subscribers))
+	for _, sub := range subscribers {
+		if sub.GetID() != sessionID {
+			remaining = append(remaining, sub)
 		}
 	}
+	c.subscribers[streamKey] = remaining
 	return nil
 }
 
@@ -136,3 +190,69 @@ func (c *InMemoryContext) GetAacSequenceHeaderForPublisher(streamKey string) []b
 	defer c.seqMutex.RUnlock()
 	return c.aacSequenceHeaderCache[streamKey]
 }
+
+func (c *InMemoryContext) SetMetadataForPublisher(streamKey string, metadata map[string]any) {
+	c.seqMutex.Lock()
+	c.metadataCache[streamKey] = metadata
+	c.seqMutex.Unlock()
+}
+
+func (c *InMemoryContext) GetMetadataForPublisher(streamKey string) map[string]any {
+	c.seqMutex.RLock()
+	defer c.seqMutex.RUnlock()
+	return c.metadataCache[streamKey]
+}
+
+// Snapshot returns the recoverable state of the context: the registered stream keys and the sequence headers and
+// metadata cached for each publisher. Subscribers are live connections, so they are not included.
+func (c *InMemoryContext) Snapshot() (*ContextSnapshot, error) {
+	snapshot := &ContextSnapshot{
+		AvcSequenceHeaders: make(map[string][]byte),
+		AacSequenceHeaders: make(map[string][]byte),
+		Metadata:           make(map[string]map[string]any),
+	}
+
+	snapshot.Streams = c.GetStreamKeys()
+
+	c.seqMutex.RLock()
+	defer c.seqMutex.RUnlock()
+	for streamKey, payload := range c.avcSequenceHeaderCache {
+		snapshot.AvcSequenceHeaders[streamKey] = append([]byte(nil), payload...)
+	}
+	for streamKey, payload := range c.aacSequenceHeaderCache {
+		snapshot.AacSequenceHeaders[streamKey] = append([]byte(nil), payload...)
+	}
+	for streamKey, metadata := range c.metadataCache {
+		snapshot.Metadata[streamKey] = metadata
+	}
+	return snapshot, nil
+}
+
+// Restore registers the streams of the snapshot (with no subscribers) and fills the caches with its sequence headers
+// and metadata. State that is already present in the context for the same stream keys is overwritten. The restored
+// streams have no publisher: players can subscribe to them until their publisher reconnects, and the first publisher
+// of each of them claims it with RegisterPublisher.
+func (c *InMemoryContext) Restore(snapshot *ContextSnapshot) error {
+	c.subMutex.Lock()
+	for _, streamKey := range snapshot.Streams {
+		if _, exists := c.subscribers[streamKey]; !exists {
+			c.subscribers[streamKey] = make([]Subscriber, 0, 5)
+			c.restored[streamKey] = true
+			c.numberOfSessions++
+		}
+	}
+	c.subMutex.Unlock()
+
+	c.seqMutex.Lock()
+	defer c.seqMutex.Unlock()
+	for streamKey, payload := range snapshot.AvcSequenceHeaders {
+		c.avcSequenceHeaderCache[streamKey] = payload
+	}
+	for streamKey, payload := range snapshot.AacSequenceHeaders {
+		c.aacSequenceHeaderCache[streamKey] = payload
+	}
+	for streamKey, metadata := range snapshot.Metadata {
+		c.metadataCache[streamKey] = metadata
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestContextSnapshotRestore(t *testing.T) {
+	c := NewInMemoryContext()
+	if err := c.RegisterPublisher("live"); err != nil {
+		t.Fatal(err)
+	}
+	c.SetAvcSequenceHeaderForPublisher("live", []byte{0x17, 0x00})
+	c.SetAacSequenceHeaderForPublisher("live", []byte{0xaf, 0x00})
+	c.SetMetadataForPublisher("live", map[string]any{"width": 1280.0})
+
+	snapshot, err := c.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() = %v", err)
+	}
+	// The snapshot is handed over to the new process serialized
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored ContextSnapshot
+	if err := json.Unmarshal(data, &restored); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewInMemoryContext()
+	if err := c.Restore(&restored); err != nil {
+		t.Fatalf("Restore() = %v", err)
+	}
+	if !c.StreamExists("live") {
+		t.Error("StreamExists() = false after Restore()")
+	}
+	if got := c.GetAvcSequenceHeaderForPublisher("live"); !reflect.DeepEqual(got, []byte{0x17, 0x00}) {
+		t.Errorf("GetAvcSequenceHeaderForPublisher() = %x", got)
+	}
+	if got := c.GetAacSequenceHeaderForPublisher("live"); !reflect.DeepEqual(got, []byte{0xaf, 0x00}) {
+		t.Errorf("GetAacSequenceHeaderForPublisher() = %x", got)
+	}
+	if got := c.GetMetadataForPublisher("live"); !reflect.DeepEqual(got, map[string]any{"width": 1280.0}) {
+		t.Errorf("GetMetadataForPublisher() = %v", got)
+	}
+
+	// A player reconnecting before the publisher keeps its subscription once the publisher claims the stream
+	if err := c.RegisterSubscriber("live", &testSink{id: "player"}); err != nil {
+		t.Fatalf("RegisterSubscriber() = %v", err)
+	}
+	if err := c.RegisterPublisher("live"); err != nil {
+		t.Fatalf("RegisterPublisher() on a restored stream = %v", err)
+	}
+	if subscribers, _ := c.GetSubscribersForStream("live"); len(subscribers) != 1 {
+		t.Errorf("got %d subscribers after the publisher claimed the stream, want 1", len(subscribers))
+	}
+	if err := c.RegisterPublisher("live"); !errors.Is(err, ErrStreamAlreadyPublished) {
+		t.Errorf("second RegisterPublisher() = %v, want ErrStreamAlreadyPublished", err)
+	}
+}
+
+// TestContextConcurrentSubscribers subscribes and unsubscribes players while their stream is broadcast, which must be
+// run with -race to be meaningful.
+func TestContextConcurrentSubscribers(t *testing.T) {
+	c := NewInMemoryContext()
+	if err := c.RegisterPublisher("live"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				id := fmt.Sprintf("player-%d-%d", i, j)
+				if err := c.RegisterSubscriber("live", &testSink{id: id}); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := c.DestroySubscriber("live", id); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			if subscribers, _ := c.GetSubscribersForStream("live"); len(subscribers) != 0 {
+				t.Errorf("got %d subscribers after they all unsubscribed, want 0", len(subscribers))
+			}
+			return
+		default:
+		}
+		subscribers, err := c.GetSubscribersForStream("live")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sub := range subscribers {
+			sub.GetID()
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package rtmp
+
+import "sync"
+
+// Number of media messages queued for asynchronous dispatch (see mediaDispatcher) before the message manager stops
+// reading the connection until their handlers catch up
+const mediaQueueSize = 256
+
+// mediaDispatcher handles the media messages received by a message manager on their own goroutines instead of the
+// goroutine reading the connection, so that slow handlers (eg: client callbacks, or broadcasting to many players)
+// don't delay the messages that follow. Messages are handled in the order they were received: audio and video on one
+// goroutine, and metadata on another one if splitMetadata was set (so that a handler blocking on metadata doesn't hold
+// up frames), or on the same one otherwise.
+type mediaDispatcher struct {
+	frames   chan func()
+	metadata chan func()
+	// Handlers dispatched that haven't returned yet (see wait)
+	pending sync.WaitGroup
+	// Goroutines running handlers
+	running sync.WaitGroup
+}
+
+func newMediaDispatcher(splitMetadata bool) *mediaDispatcher {
+	d := &mediaDispatcher{frames: make(chan func(), mediaQueueSize)}
+	d.metadata = d.frames
+	if splitMetadata {
+		d.metadata = make(chan func(), mediaQueueSize)
+		d.running.Add(1)
+		go d.run(d.metadata)
+	}
+	d.running.Add(1)
+	go d.run(d.frames)
+	return d
+}
+
+func (d *mediaDispatcher) run(handlers <-chan func()) {
+	defer d.running.Done()
+	for handle := range handlers {
+		handle()
+		d.pending.Done()
+	}
+}
+
+// frame queues the handler of an audio or video message, and data the handler of a data message (metadata). They're
+// only called from the goroutine reading the connection.
+func (d *mediaDispatcher) frame(handle func()) {
+	d.pending.Add(1)
+	d.frames <- handle
+}
+
+func (d *mediaDispatcher) data(handle func()) {
+	d.pending.Add(1)
+	d.metadata <- handle
+}
+
+// wait blocks until the handlers dispatched so far have returned.
+func (d *mediaDispatcher) wait() {
+	d.pending.Wait()
+}
+
+// stop waits for the handlers dispatched so far to return, and stops the goroutines of the dispatcher. No handler can
+// be dispatched afterwards.
+func (d *mediaDispatcher) stop() {
+	close(d.frames)
+	if d.metadata != d.frames {
+		close(d.metadata)
+	}
+	d.running.Wait()
+}
@@ -0,0 +1,63 @@
+package rtmp
+
+import (
+	"net"
+)
+
+// NewCIDRFilter returns a connection filter that can be used as Server.ConnFilter. Addresses within any of the deny
+// CIDRs are rejected. If allow is not empty, addresses that aren't within any of the allow CIDRs are rejected as well.
+// CIDRs are in the form "192.0.2.0/24" or "2001:db8::/32".
+func NewCIDRFilter(allow []string, deny []string) (func(net.Addr) bool, error) {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(addr net.Addr) bool {
+		ip := addrIP(addr)
+		if ip == nil {
+			return false
+		}
+		if containsIP(denyNets, ip) {
+			return false
+		}
+		return len(allowNets) == 0 || containsIP(allowNets, ip)
+	}, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP of addr, or nil if addr doesn't contain one
+func addrIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
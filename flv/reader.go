@@ -0,0 +1,102 @@
+// Package flv reads and writes FLV files, as defined in the FLV spec: https://www.adobe.com/content/dam/acom/en/devnet/flv/video_file_format_spec_v10_1.pdf
+// The payload of FLV audio, video and script data tags has the same format as the payload of the corresponding RTMP
+// messages, so tags can be published as is.
+package flv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrInvalidHeader error = errors.New("flv: invalid header")
+var ErrTruncatedTag error = errors.New("flv: truncated tag")
+
+type TagType uint8
+
+const (
+	TagAudio      TagType = 8
+	TagVideo      TagType = 9
+	TagScriptData TagType = 18
+)
+
+// Size of the FLV header (without the PreviousTagSize0 that follows it) and of the header of each tag
+const (
+	headerSize    = 9
+	tagHeaderSize = 11
+)
+
+type Header struct {
+	Version  uint8
+	HasAudio bool
+	HasVideo bool
+}
+
+type Tag struct {
+	Type TagType
+	// Timestamp of the tag, in milliseconds
+	Timestamp uint32
+	Data      []byte
+}
+
+// Reader is a demuxer that reads the tags of an FLV file, one at a time.
+type Reader struct {
+	r      io.Reader
+	Header Header
+}
+
+// NewReader reads the FLV header from r, returning a Reader positioned at the first tag.
+func NewReader(r io.Reader) (*Reader, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidHeader, err)
+	}
+	if string(header[:3]) != "FLV" {
+		return nil, fmt.Errorf("%w: missing FLV signature", ErrInvalidHeader)
+	}
+	dataOffset := binary.BigEndian.Uint32(header[5:])
+	if dataOffset < headerSize {
+		return nil, fmt.Errorf("%w: data offset %d is shorter than the header", ErrInvalidHeader, dataOffset)
+	}
+	// Skip the rest of the header (if any, for future versions) and PreviousTagSize0, which is always 0
+	if _, err := io.CopyN(io.Discard, r, int64(dataOffset-headerSize)+4); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidHeader, err)
+	}
+	return &Reader{
+		r: r,
+		Header: Header{
+			Version:  header[3],
+			HasAudio: header[4]&0x04 != 0,
+			HasVideo: header[4]&0x01 != 0,
+		},
+	}, nil
+}
+
+// ReadTag reads the next tag of the file. At the end of the file, it returns io.EOF.
+func (r *Reader) ReadTag() (*Tag, error) {
+	var header [tagHeaderSize]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("%w: %w", ErrTruncatedTag, err)
+	}
+	// The upper 3 bits are reserved for FMS (2 bits) and the filter (encryption) flag
+	tagType := TagType(header[0] & 0x1F)
+	dataSize := uint32(header[1])<<16 | uint32(header[2])<<8 | uint32(header[3])
+	// The 4th byte of the timestamp (TimestampExtended) holds its upper 8 bits
+	timestamp := uint32(header[7])<<24 | uint32(header[4])<<16 | uint32(header[5])<<8 | uint32(header[6])
+	// Bytes 8-10 are the stream ID, which is always 0
+
+	// The tag is followed by its size (PreviousTagSize), which isn't needed to read the file forward
+	data := make([]byte, dataSize+4)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTruncatedTag, err)
+	}
+	return &Tag{
+		Type:      tagType,
+		Timestamp: timestamp,
+		Data:      data[:dataSize],
+	}, nil
+}
@@ -0,0 +1,62 @@
+package flv
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Writer is a muxer that writes the tags of an FLV file, one at a time.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter writes the FLV header to w (with PreviousTagSize0), returning a Writer that writes the tags after it.
+func NewWriter(w io.Writer, header Header) (*Writer, error) {
+	b := [headerSize + 4]byte{'F', 'L', 'V', header.Version}
+	if b[3] == 0 {
+		b[3] = 1
+	}
+	if header.HasAudio {
+		b[4] |= 0x04
+	}
+	if header.HasVideo {
+		b[4] |= 0x01
+	}
+	binary.BigEndian.PutUint32(b[5:], headerSize)
+	if _, err := w.Write(b[:]); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// NewAppendWriter returns a Writer that writes tags to w without an FLV header, to append them to an FLV file that
+// already has one (and whose last tag is followed by its PreviousTagSize).
+func NewAppendWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteTag writes a tag, followed by its size (PreviousTagSize).
+func (w *Writer) WriteTag(tag *Tag) error {
+	dataSize := len(tag.Data)
+	var header [tagHeaderSize]byte
+	header[0] = byte(tag.Type)
+	header[1] = byte(dataSize >> 16)
+	header[2] = byte(dataSize >> 8)
+	header[3] = byte(dataSize)
+	// The 4th byte of the timestamp (TimestampExtended) holds its upper 8 bits
+	header[4] = byte(tag.Timestamp >> 16)
+	header[5] = byte(tag.Timestamp >> 8)
+	header[6] = byte(tag.Timestamp)
+	header[7] = byte(tag.Timestamp >> 24)
+	// Bytes 8-10 are the stream ID, which is always 0
+	if _, err := w.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(tag.Data); err != nil {
+		return err
+	}
+	var previousTagSize [4]byte
+	binary.BigEndian.PutUint32(previousTagSize[:], uint32(tagHeaderSize+dataSize))
+	_, err := w.w.Write(previousTagSize[:])
+	return err
+}
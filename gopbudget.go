@@ -0,0 +1,115 @@
+package rtmp
+
+import (
+	"sort"
+	"sync"
+)
+
+// GOPCacheBudget caps the memory used by the GOP caches (see GOPCacheBroadcaster) of the streams of one or more
+// broadcasters (see GOPCacheBudgetBroadcaster), which can be large across many streams. When caching a frame exceeds
+// the budget, the caches of other streams are evicted until it's met again, starting with the streams that have the
+// fewest subscribers and, among them, the ones published first. If that isn't enough, the cache of the stream the frame
+// belongs to is evicted too. Streams whose cache is evicted cache their frames again from their next keyframe, and
+// until then new subscribers wait for that keyframe to start playing.
+type GOPCacheBudget struct {
+	mutex     sync.Mutex
+	maxBytes  int
+	usedBytes int
+	evictions uint64
+	caches    map[*gopCache]struct{}
+}
+
+// GOPCacheBudgetStats is a snapshot of the memory used by the GOP caches of a budget.
+type GOPCacheBudgetStats struct {
+	// Maximum number of bytes of the cached frames
+	MaxBytes int
+	// Bytes of the frames currently cached
+	UsedBytes int
+	// Number of caches evicted to stay within the budget
+	Evictions uint64
+}
+
+// NewGOPCacheBudget returns a budget that caps the bytes of the frames cached by the GOP caches of the streams it's
+// assigned to at maxBytes.
+func NewGOPCacheBudget(maxBytes int) *GOPCacheBudget {
+	return &GOPCacheBudget{maxBytes: maxBytes, caches: make(map[*gopCache]struct{})}
+}
+
+// Stats returns the current usage of the budget. It's safe to call from any goroutine.
+func (b *GOPCacheBudget) Stats() GOPCacheBudgetStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return GOPCacheBudgetStats{MaxBytes: b.maxBytes, UsedBytes: b.usedBytes, Evictions: b.evictions}
+}
+
+// add accounts for the frames of a cache in the budget, until it's removed.
+func (b *GOPCacheBudget) add(cache *gopCache) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.caches[cache] = struct{}{}
+}
+
+// remove releases the frames of a cache (eg: once its stream is unpublished). The caller must hold the mutex of the
+// cache.
+func (b *GOPCacheBudget) remove(cache *gopCache) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.usedBytes -= cache.bytes
+	delete(b.caches, cache)
+	cache.drop()
+	cache.budget = nil
+}
+
+func (b *GOPCacheBudget) shrink(bytes int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.usedBytes -= bytes
+}
+
+// grow accounts for bytes added to a cache, and evicts caches if they exceed the budget. The caller must hold the
+// mutex of the cache. The caches of other streams are only evicted if their mutex is free: waiting for it could
+// deadlock with a stream evicting this one, and a stream holding its mutex is busy broadcasting anyway.
+func (b *GOPCacheBudget) grow(cache *gopCache, bytes int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.usedBytes += bytes
+	if b.usedBytes <= b.maxBytes {
+		return
+	}
+
+	type candidate struct {
+		cache       *gopCache
+		subscribers int
+	}
+	candidates := make([]candidate, 0, len(b.caches))
+	for other := range b.caches {
+		if other != cache {
+			candidates = append(candidates, candidate{cache: other, subscribers: other.subscribers()})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].subscribers != candidates[j].subscribers {
+			return candidates[i].subscribers < candidates[j].subscribers
+		}
+		return candidates[i].cache.publishTime.Before(candidates[j].cache.publishTime)
+	})
+	for _, candidate := range candidates {
+		if b.usedBytes <= b.maxBytes {
+			return
+		}
+		if !candidate.cache.mutex.TryLock() {
+			continue
+		}
+		if candidate.cache.bytes > 0 {
+			b.usedBytes -= candidate.cache.bytes
+			b.evictions++
+			candidate.cache.drop()
+		}
+		candidate.cache.mutex.Unlock()
+	}
+	if b.usedBytes > b.maxBytes {
+		b.usedBytes -= cache.bytes
+		b.evictions++
+		cache.drop()
+	}
+}
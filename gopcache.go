@@ -0,0 +1,130 @@
+package rtmp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/codingpa-ws/rtmp/audio"
+	"github.com/codingpa-ws/rtmp/video"
+)
+
+// gopCache keeps the frames of a stream since its last video keyframe (its current group of pictures), so that new
+// subscribers start rendering right away, from that keyframe, instead of waiting for the next one.
+type gopCache struct {
+	// Held while frames are cached and broadcast, and while a new subscriber is primed and registered, so that the
+	// subscriber doesn't miss or get twice a frame broadcast in between
+	mutex     sync.Mutex
+	maxFrames int
+	frames    []cachedFrame
+	// Bytes of the payloads of the cached frames
+	bytes int
+	// Budget the cache is accounted in, nil if its memory isn't capped (see GOPCacheBudget)
+	budget *GOPCacheBudget
+	// When the stream was published and how many subscribers it has, to choose the caches evicted by the budget
+	publishTime time.Time
+	subscribers func() int
+}
+
+type cachedFrame struct {
+	audio     bool
+	payload   []byte
+	timestamp uint32
+}
+
+func newGOPCache(maxFrames int) *gopCache {
+	return &gopCache{maxFrames: maxFrames}
+}
+
+// addVideo caches a video frame. Keyframes start a new group of pictures, and the frames that precede the first
+// keyframe aren't cached. Sequence headers are cached separately by the broadcaster.
+func (c *gopCache) addVideo(payload []byte, timestamp uint32) {
+	if len(payload) < 2 || isVideoSequenceHeader(payload) {
+		return
+	}
+	if video.ParseHeader(payload).FrameType == video.KeyFrame {
+		c.clear()
+	} else if len(c.frames) == 0 {
+		return
+	}
+	c.add(cachedFrame{payload: payload, timestamp: timestamp})
+}
+
+// addAudio caches an audio frame of the current group of pictures.
+func (c *gopCache) addAudio(payload []byte, timestamp uint32) {
+	if len(c.frames) == 0 || len(payload) < 2 || isAudioSequenceHeader(payload) {
+		return
+	}
+	c.add(cachedFrame{audio: true, payload: payload, timestamp: timestamp})
+}
+
+func (c *gopCache) add(frame cachedFrame) {
+	// Groups of pictures that don't fit are dropped until the next keyframe, subscribers then wait for it
+	if len(c.frames) >= c.maxFrames {
+		c.clear()
+		return
+	}
+	c.frames = append(c.frames, frame)
+	c.bytes += len(frame.payload)
+	if c.budget != nil {
+		c.budget.grow(c, len(frame.payload))
+	}
+}
+
+// clear drops the cached frames, releasing their bytes from the budget.
+func (c *gopCache) clear() {
+	if c.budget != nil && c.bytes > 0 {
+		c.budget.shrink(c.bytes)
+	}
+	c.drop()
+}
+
+// drop drops the cached frames without accounting for it in the budget. The payloads are no longer referenced, so the
+// memory of frames that were sent to every subscriber can be freed.
+func (c *gopCache) drop() {
+	for i := range c.frames {
+		c.frames[i] = cachedFrame{}
+	}
+	c.frames = c.frames[:0]
+	c.bytes = 0
+}
+
+// prime sends the cached frames to a new subscriber. Audio starts at the first frame that isn't older than the
+// keyframe: audio frames older than it (muxed late by the publisher) would play before the first picture, out of sync.
+// Subscribers whose buffer (see BufferedSubscriber) is shorter than the cached frames aren't sent any, and wait for
+// the next keyframe instead: the frames can't be trimmed, since they all depend on the keyframe.
+func (c *gopCache) prime(subscriber Subscriber) {
+	if len(c.frames) == 0 {
+		return
+	}
+	keyframeTimestamp := c.frames[0].timestamp
+	if buffered, ok := subscriber.(BufferedSubscriber); ok {
+		if bufferLength := buffered.BufferLength(); bufferLength > 0 && c.duration() > bufferLength {
+			return
+		}
+	}
+	for _, frame := range c.frames {
+		if !frame.audio {
+			subscriber.SendVideo(frame.payload, frame.timestamp)
+		} else if frame.timestamp >= keyframeTimestamp {
+			subscriber.SendAudio(frame.payload, frame.timestamp)
+		}
+	}
+}
+
+// duration returns the time between the keyframe and the last video frame cached.
+func (c *gopCache) duration() time.Duration {
+	for i := len(c.frames) - 1; i >= 0; i-- {
+		if !c.frames[i].audio {
+			return time.Duration(c.frames[i].timestamp-c.frames[0].timestamp) * time.Millisecond
+		}
+	}
+	return 0
+}
+
+func isVideoSequenceHeader(payload []byte) bool {
+	return video.ParseHeader(payload).IsSequenceHeader()
+}
+
+func isAudioSequenceHeader(payload []byte) bool {
+	return audio.ParseHeader(payload).IsSequenceHeader()
+}
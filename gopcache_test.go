@@ -0,0 +1,132 @@
+package rtmp
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// bufferedSink is a testSink whose player has a buffer of the given length.
+type bufferedSink struct {
+	testSink
+	bufferLength time.Duration
+}
+
+func (s *bufferedSink) BufferLength() time.Duration {
+	return s.bufferLength
+}
+
+func TestGOPCachePrime(t *testing.T) {
+	c := newGOPCache(10)
+	// Audio muxed late by the publisher, then a GOP spanning 80ms
+	c.addAudio([]byte{0xaf, 0x01, 0}, 0)
+	c.addVideo([]byte{0x17, 0x01, 1}, 20)
+	c.addAudio([]byte{0xaf, 0x01, 2}, 10)
+	c.addAudio([]byte{0xaf, 0x01, 3}, 30)
+	c.addVideo([]byte{0x27, 0x01, 4}, 60)
+	c.addVideo([]byte{0x27, 0x01, 5}, 100)
+	gop := []string{"video 170101@20", "audio af0103@30", "video 270104@60", "video 270105@100"}
+
+	tests := []struct {
+		name         string
+		bufferLength time.Duration
+		want         []string
+	}{
+		{"buffer unknown", 0, gop},
+		{"buffer longer than the GOP", time.Second, gop},
+		{"buffer as long as the GOP", 80 * time.Millisecond, gop},
+		{"buffer shorter than the GOP", 50 * time.Millisecond, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink := &bufferedSink{bufferLength: test.bufferLength}
+			c.prime(sink)
+			if !reflect.DeepEqual(sink.received, test.want) {
+				t.Errorf("primed with %q, want %q", sink.received, test.want)
+			}
+		})
+	}
+}
+
+// TestGOPCacheKeyframeAlignedAudio checks that a new subscriber isn't sent the audio the publisher muxed before the
+// keyframe its cached frames start with.
+func TestGOPCacheKeyframeAlignedAudio(t *testing.T) {
+	b := NewBroadcaster("app", NewInMemoryContext()).(*broadcaster)
+	b.SetGOPCache(30)
+	if err := b.RegisterPublisher("live"); err != nil {
+		t.Fatal(err)
+	}
+	b.BroadcastVideo("live", []byte{0x17, 0x01, 0}, 1000)
+	for _, timestamp := range []uint32{960, 980, 1000, 1020} {
+		b.BroadcastAudio("live", []byte{0xaf, 0x01, 0}, timestamp)
+	}
+	b.BroadcastVideo("live", []byte{0x27, 0x01, 0}, 1040)
+
+	sink := &testSink{id: "player"}
+	if err := b.RegisterSubscriber("live", sink); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"video 170100@1000", "audio af0100@1000", "audio af0100@1020", "video 270100@1040"}
+	if !reflect.DeepEqual(sink.received, want) {
+		t.Errorf("primed with %q, want %q", sink.received, want)
+	}
+}
+
+// TestGOPCacheBudget checks that the caches of the streams with the fewest subscribers are evicted first when caching
+// a frame exceeds the budget, and that the cache of the stream the frame belongs to is evicted if that isn't enough.
+func TestGOPCacheBudget(t *testing.T) {
+	b := NewBroadcaster("app", NewInMemoryContext()).(*broadcaster)
+	budget := NewGOPCacheBudget(1000)
+	b.SetGOPCache(30)
+	b.SetGOPCacheBudget(budget)
+	for _, streamKey := range []string{"watched", "unwatched"} {
+		if err := b.RegisterPublisher(streamKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.RegisterSubscriber("watched", &testSink{id: "player"}); err != nil {
+		t.Fatal(err)
+	}
+	keyframe := append([]byte{0x17, 0x01}, make([]byte, 398)...)
+	interframe := append([]byte{0x27, 0x01}, make([]byte, 398)...)
+	checkStats := func(want GOPCacheBudgetStats) {
+		t.Helper()
+		if stats := budget.Stats(); stats != want {
+			t.Errorf("budget stats = %+v, want %+v", stats, want)
+		}
+	}
+
+	b.BroadcastVideo("unwatched", keyframe, 0)
+	b.BroadcastVideo("watched", keyframe, 0)
+	checkStats(GOPCacheBudgetStats{MaxBytes: 1000, UsedBytes: 800})
+	b.BroadcastVideo("watched", interframe, 40)
+	checkStats(GOPCacheBudgetStats{MaxBytes: 1000, UsedBytes: 800, Evictions: 1})
+	for streamKey, want := range map[string]int{"watched": 2, "unwatched": 0} {
+		sink := &testSink{id: "new " + streamKey}
+		if err := b.RegisterSubscriber(streamKey, sink); err != nil {
+			t.Fatal(err)
+		}
+		if len(sink.received) != want {
+			t.Errorf("new subscriber of %s primed with %d frames, want %d", streamKey, len(sink.received), want)
+		}
+	}
+	s := &Server{Broadcaster: b}
+	if stats := s.Stats(); stats.GOPCache != budget.Stats() {
+		t.Errorf("server GOP cache stats = %+v, want %+v", stats.GOPCache, budget.Stats())
+	}
+
+	// Once no other stream has frames to evict, the stream exceeding the budget is evicted, until its next keyframe
+	b.BroadcastVideo("unwatched", interframe, 40)
+	b.BroadcastVideo("watched", interframe, 80)
+	checkStats(GOPCacheBudgetStats{MaxBytes: 1000, UsedBytes: 0, Evictions: 2})
+	b.BroadcastVideo("watched", interframe, 120)
+	checkStats(GOPCacheBudgetStats{MaxBytes: 1000, UsedBytes: 0, Evictions: 2})
+
+	// The frames of unpublished streams are released
+	b.BroadcastVideo("unwatched", keyframe, 80)
+	checkStats(GOPCacheBudgetStats{MaxBytes: 1000, UsedBytes: 400, Evictions: 2})
+	if err := b.DestroyPublisher("unwatched"); err != nil {
+		t.Fatal(err)
+	}
+	checkStats(GOPCacheBudgetStats{MaxBytes: 1000, UsedBytes: 0, Evictions: 2})
+}
@@ -0,0 +1,140 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: forward.proto
+
+package grpcforward
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Forwarder_Subscribe_FullMethodName = "/rtmp.forward.v1.Forwarder/Subscribe"
+)
+
+// ForwarderClient is the client API for Forwarder service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ForwarderClient interface {
+	// Subscribe streams the frames of a published stream, starting with its cached metadata and sequence headers,
+	// until the stream ends or the call is canceled. It fails with NOT_FOUND if the stream isn't published.
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Forwarder_SubscribeClient, error)
+}
+
+type forwarderClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewForwarderClient(cc grpc.ClientConnInterface) ForwarderClient {
+	return &forwarderClient{cc}
+}
+
+func (c *forwarderClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Forwarder_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Forwarder_ServiceDesc.Streams[0], Forwarder_Subscribe_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &forwarderSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Forwarder_SubscribeClient interface {
+	Recv() (*Frame, error)
+	grpc.ClientStream
+}
+
+type forwarderSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *forwarderSubscribeClient) Recv() (*Frame, error) {
+	m := new(Frame)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ForwarderServer is the server API for Forwarder service.
+// All implementations must embed UnimplementedForwarderServer
+// for forward compatibility
+type ForwarderServer interface {
+	// Subscribe streams the frames of a published stream, starting with its cached metadata and sequence headers,
+	// until the stream ends or the call is canceled. It fails with NOT_FOUND if the stream isn't published.
+	Subscribe(*SubscribeRequest, Forwarder_SubscribeServer) error
+	mustEmbedUnimplementedForwarderServer()
+}
+
+// UnimplementedForwarderServer must be embedded to have forward compatible implementations.
+type UnimplementedForwarderServer struct {
+}
+
+func (UnimplementedForwarderServer) Subscribe(*SubscribeRequest, Forwarder_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedForwarderServer) mustEmbedUnimplementedForwarderServer() {}
+
+// UnsafeForwarderServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ForwarderServer will
+// result in compilation errors.
+type UnsafeForwarderServer interface {
+	mustEmbedUnimplementedForwarderServer()
+}
+
+func RegisterForwarderServer(s grpc.ServiceRegistrar, srv ForwarderServer) {
+	s.RegisterService(&Forwarder_ServiceDesc, srv)
+}
+
+func _Forwarder_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ForwarderServer).Subscribe(m, &forwarderSubscribeServer{stream})
+}
+
+type Forwarder_SubscribeServer interface {
+	Send(*Frame) error
+	grpc.ServerStream
+}
+
+type forwarderSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *forwarderSubscribeServer) Send(m *Frame) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Forwarder_ServiceDesc is the grpc.ServiceDesc for Forwarder service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Forwarder_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "rtmp.forward.v1.Forwarder",
+	HandlerType: (*ForwarderServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Forwarder_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "forward.proto",
+}
@@ -0,0 +1,164 @@
+package grpcforward
+
+import (
+	"sync"
+
+	"github.com/codingpa-ws/rtmp/video"
+)
+
+// frameKind tells how a frame can be dropped from a queue without breaking the decoding of the frames that follow it.
+type frameKind uint8
+
+const (
+	// Metadata and sequence headers, which are never dropped to make room, since nothing decodes without them
+	kindConfig frameKind = iota
+	kindAudio
+	kindKeyframe
+	// Video frames that depend on the frames before them, up to the previous keyframe
+	kindInterFrame
+)
+
+func videoFrameKind(header video.Header) frameKind {
+	switch {
+	case header.IsSequenceHeader():
+		return kindConfig
+	case header.FrameType == video.KeyFrame:
+		return kindKeyframe
+	case header.FrameType == video.InterFrame || header.FrameType == video.DisposableInterFrame:
+		return kindInterFrame
+	default:
+		return kindConfig
+	}
+}
+
+type queuedFrame struct {
+	frame *Frame
+	kind  frameKind
+}
+
+// frameQueue buffers up to size frames of a consumer. When it's full, frames are dropped so that what's left still
+// decodes: audio frames first (they don't depend on each other), then the rest of the oldest group of pictures, then
+// the oldest keyframe. A video frame is never sent after a frame it depends on was dropped: once an inter frame or a
+// keyframe is dropped, every inter frame is dropped until the next keyframe.
+type frameQueue struct {
+	mutex  sync.Mutex
+	size   int
+	frames []queuedFrame
+	// Array of frames, reused every time the queue is emptied
+	buffer []queuedFrame
+	// Set when inter frames can't be decoded anymore until the next keyframe
+	waitKeyframe bool
+	// Frames dropped since the last frame popped
+	dropped, droppedKeyframes, droppedInterFrames uint64
+	// Receives a value (if it doesn't have one already) when a frame is pushed
+	ready chan struct{}
+}
+
+func newFrameQueue(size int) *frameQueue {
+	buffer := make([]queuedFrame, 0, size)
+	return &frameQueue{size: size, frames: buffer, buffer: buffer, ready: make(chan struct{}, 1)}
+}
+
+// push adds a frame to the queue, dropping frames if it's full. It never blocks.
+func (q *frameQueue) push(frame *Frame, kind frameKind) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if kind == kindInterFrame && q.waitKeyframe {
+		q.drop(kind)
+		return
+	}
+	if len(q.frames) >= q.size && !q.makeRoom(kind) {
+		q.drop(kind)
+		if kind == kindInterFrame || kind == kindKeyframe {
+			q.waitKeyframe = true
+		}
+		return
+	}
+	if kind == kindKeyframe {
+		q.waitKeyframe = false
+	}
+	q.frames = append(q.frames, queuedFrame{frame: frame, kind: kind})
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// makeRoom drops queued frames to make room for a frame of the given kind, and returns false if it can't.
+func (q *frameQueue) makeRoom(kind frameKind) bool {
+	// Audio frames, oldest first
+	for i, queued := range q.frames {
+		if queued.kind == kindAudio {
+			q.remove(i, i+1)
+			return true
+		}
+	}
+	// The inter frames of the oldest group of pictures, up to the next keyframe. They're the end of a group of
+	// pictures, so no frame left in the queue depends on them.
+	first := -1
+	for i, queued := range q.frames {
+		if queued.kind == kindInterFrame && first < 0 {
+			first = i
+		} else if queued.kind == kindKeyframe && first >= 0 {
+			q.remove(first, i)
+			return true
+		}
+	}
+	// Only a keyframe supersedes the inter frames of the newest group of pictures, and the oldest keyframe left
+	if kind != kindKeyframe {
+		return false
+	}
+	if first >= 0 {
+		q.remove(first, len(q.frames))
+		return true
+	}
+	for i, queued := range q.frames {
+		if queued.kind == kindKeyframe {
+			q.remove(i, i+1)
+			return true
+		}
+	}
+	return false
+}
+
+// remove drops the media frames queued between start and end (excluded). Metadata and sequence headers are kept.
+func (q *frameQueue) remove(start, end int) {
+	kept := q.frames[:start]
+	for _, queued := range q.frames[start:end] {
+		if queued.kind == kindConfig {
+			kept = append(kept, queued)
+		} else {
+			q.drop(queued.kind)
+		}
+	}
+	q.frames = append(kept, q.frames[end:]...)
+}
+
+func (q *frameQueue) drop(kind frameKind) {
+	q.dropped++
+	switch kind {
+	case kindKeyframe:
+		q.droppedKeyframes++
+	case kindInterFrame:
+		q.droppedInterFrames++
+	}
+}
+
+// pop removes the oldest frame of the queue, with the number of frames dropped before it, and returns nil if the queue
+// is empty.
+func (q *frameQueue) pop() *Frame {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.frames) == 0 {
+		return nil
+	}
+	frame := q.frames[0].frame
+	q.frames[0] = queuedFrame{}
+	q.frames = q.frames[1:]
+	if len(q.frames) == 0 {
+		q.frames = q.buffer[:0]
+	}
+	frame.DroppedFrames, frame.DroppedKeyframes, frame.DroppedInterFrames = q.dropped, q.droppedKeyframes, q.droppedInterFrames
+	q.dropped, q.droppedKeyframes, q.droppedInterFrames = 0, 0, 0
+	return frame
+}
@@ -0,0 +1,107 @@
+package grpcforward
+
+import "testing"
+
+// kindLetters represents a kind of frame with a letter: C for metadata and sequence headers, A for audio, K for
+// keyframes and I for inter frames.
+const kindLetters = "CAKI"
+
+// newTestQueue returns a queue holding frames of the kinds (see kindLetters), with room for as many frames.
+func newTestQueue(kinds string) *frameQueue {
+	q := newFrameQueue(len(kinds))
+	for i, letter := range kinds {
+		kind := frameKind(0)
+		for k, l := range kindLetters {
+			if l == letter {
+				kind = frameKind(k)
+			}
+		}
+		q.frames = append(q.frames, queuedFrame{frame: &Frame{Timestamp: uint32(i)}, kind: kind})
+	}
+	return q
+}
+
+// queuedKinds returns the kinds of the frames of q (see kindLetters).
+func queuedKinds(q *frameQueue) string {
+	kinds := make([]byte, len(q.frames))
+	for i, queued := range q.frames {
+		kinds[i] = kindLetters[queued.kind]
+	}
+	return string(kinds)
+}
+
+func TestFrameQueueMakeRoom(t *testing.T) {
+	tests := []struct {
+		name    string
+		queued  string
+		kind    frameKind
+		ok      bool
+		want    string
+		dropped uint64
+	}{
+		{"oldest audio first", "KIAIA", kindInterFrame, true, "KIIA", 1},
+		{"inter frames of the oldest group of pictures", "KIIKI", kindInterFrame, true, "KKI", 2},
+		{"no room for an inter frame in a single group of pictures", "KII", kindInterFrame, false, "KII", 0},
+		{"keyframe supersedes the inter frames of the newest group of pictures", "KII", kindKeyframe, true, "K", 2},
+		{"keyframe supersedes the oldest keyframe", "CKCK", kindKeyframe, true, "CCK", 1},
+		{"sequence headers are kept", "KICI", kindKeyframe, true, "KC", 2},
+		{"nothing to drop", "CC", kindKeyframe, false, "CC", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newTestQueue(test.queued)
+			if ok := q.makeRoom(test.kind); ok != test.ok {
+				t.Errorf("makeRoom() = %v, want %v", ok, test.ok)
+			}
+			if got := queuedKinds(q); got != test.want {
+				t.Errorf("queue holds %q, want %q", got, test.want)
+			}
+			if q.dropped != test.dropped {
+				t.Errorf("dropped %d frames, want %d", q.dropped, test.dropped)
+			}
+		})
+	}
+}
+
+func TestFrameQueueRemove(t *testing.T) {
+	tests := []struct {
+		name                                          string
+		queued                                        string
+		start, end                                    int
+		want                                          string
+		dropped, droppedKeyframes, droppedInterFrames uint64
+	}{
+		{"inter frames", "KIIK", 1, 3, "KK", 2, 0, 2},
+		{"everything but the sequence headers", "ACKI", 0, 4, "C", 3, 1, 1},
+		{"until the end", "KAKI", 2, 4, "KA", 2, 1, 1},
+		{"nothing", "KI", 2, 2, "KI", 0, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newTestQueue(test.queued)
+			q.remove(test.start, test.end)
+			if got := queuedKinds(q); got != test.want {
+				t.Errorf("queue holds %q, want %q", got, test.want)
+			}
+			if q.dropped != test.dropped || q.droppedKeyframes != test.droppedKeyframes || q.droppedInterFrames != test.droppedInterFrames {
+				t.Errorf("dropped %d frames (%d keyframes, %d inter frames), want %d (%d, %d)", q.dropped, q.droppedKeyframes,
+					q.droppedInterFrames, test.dropped, test.droppedKeyframes, test.droppedInterFrames)
+			}
+		})
+	}
+}
+
+func TestFrameQueuePush(t *testing.T) {
+	q := newFrameQueue(3)
+	for _, kind := range []frameKind{kindKeyframe, kindInterFrame, kindInterFrame, kindInterFrame, kindInterFrame, kindKeyframe, kindInterFrame} {
+		q.push(&Frame{}, kind)
+	}
+	// The inter frames that don't fit are dropped, and so are the ones that follow them until the next keyframe,
+	// which supersedes the inter frames queued
+	if got := queuedKinds(q); got != "KKI" {
+		t.Errorf("queue holds %q, want %q", got, "KKI")
+	}
+	if frame := q.pop(); frame.DroppedFrames != 4 || frame.DroppedInterFrames != 4 {
+		t.Errorf("popped frame reports %d dropped frames (%d inter frames), want 4 (4)", frame.DroppedFrames, frame.DroppedInterFrames)
+	}
+}
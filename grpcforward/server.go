@@ -0,0 +1,132 @@
+// Package grpcforward forwards the frames of the streams published to an RTMP server to gRPC consumers (eg: processing
+// pipelines), with the Forwarder service defined in forward.proto. It's a separate module, so that the rtmp package
+// doesn't depend on gRPC.
+package grpcforward
+
+//go:generate buf generate
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/codingpa-ws/rtmp"
+	"github.com/codingpa-ws/rtmp/amf/amf0"
+	"github.com/codingpa-ws/rtmp/audio"
+	"github.com/codingpa-ws/rtmp/rand"
+	"github.com/codingpa-ws/rtmp/video"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Default number of frames buffered for each consumer
+const DefaultBufferSize = 512
+
+// Server implements the Forwarder service for the streams of a broadcaster. The broadcaster must implement
+// rtmp.SinkBroadcaster, like the broadcasters created with rtmp.NewBroadcaster.
+type Server struct {
+	UnimplementedForwarderServer
+	Broadcaster rtmp.Broadcaster
+	// Number of frames buffered for each consumer. The frames of a consumer that doesn't keep up are dropped once its
+	// buffer is full, rather than slowing down the publisher (and every other subscriber): audio frames first, then
+	// whole groups of pictures, so that the consumer resumes on a keyframe. The number of frames dropped is reported in
+	// Frame.DroppedFrames. If not set, DefaultBufferSize is used.
+	BufferSize int
+}
+
+func NewServer(b rtmp.Broadcaster) *Server {
+	return &Server{Broadcaster: b}
+}
+
+// Subscribe forwards the frames of the stream req.StreamKey to the consumer until the stream ends (in which case it
+// returns nil) or the call is canceled.
+func (s *Server) Subscribe(req *SubscribeRequest, stream Forwarder_SubscribeServer) error {
+	streamKey := req.GetStreamKey()
+	broadcaster, ok := s.Broadcaster.(rtmp.SinkBroadcaster)
+	if !ok {
+		return status.Error(codes.Unimplemented, "the broadcaster doesn't support sinks")
+	}
+	bufferSize := s.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	sub := &subscriber{
+		id:     rand.GenerateUuid(),
+		frames: newFrameQueue(bufferSize),
+		ended:  make(chan struct{}),
+	}
+	// Like RTMP players, consumers need the metadata and sequence headers of the stream to decode it, which AddSink
+	// sends first
+	if err := broadcaster.AddSink(streamKey, sub); err != nil {
+		return status.Errorf(codes.NotFound, "stream %q is not published", streamKey)
+	}
+	defer broadcaster.RemoveSink(streamKey, sub.id)
+
+	for {
+		for frame := sub.frames.pop(); frame != nil; frame = sub.frames.pop() {
+			if err := stream.Send(frame); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-sub.frames.ready:
+		case <-sub.ended:
+			// Forward what's left in the buffer before ending the call
+			for frame := sub.frames.pop(); frame != nil; frame = sub.frames.pop() {
+				if err := stream.Send(frame); err != nil {
+					return err
+				}
+			}
+			return nil
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// subscriber buffers the frames broadcast to a consumer until Subscribe sends them. Its methods are called from the
+// goroutine of the publisher, so they never block. Payloads are copied before they're queued, since they're shared with
+// the other subscribers of the stream (see rtmp.Subscriber).
+type subscriber struct {
+	id      string
+	frames  *frameQueue
+	ended   chan struct{}
+	endOnce sync.Once
+}
+
+func (s *subscriber) SendAudio(payload []byte, timestamp uint32) {
+	if len(payload) == 0 {
+		return
+	}
+	header := audio.ParseHeader(payload)
+	kind := kindAudio
+	if header.IsSequenceHeader() {
+		kind = kindConfig
+	}
+	s.frames.push(&Frame{Type: Frame_TYPE_AUDIO, Timestamp: timestamp, Codec: uint32(header.Format), Payload: bytes.Clone(payload)}, kind)
+}
+
+func (s *subscriber) SendVideo(payload []byte, timestamp uint32) {
+	if len(payload) == 0 {
+		return
+	}
+	header := video.ParseHeader(payload)
+	s.frames.push(&Frame{Type: Frame_TYPE_VIDEO, Timestamp: timestamp, Codec: uint32(header.Codec), Payload: bytes.Clone(payload)}, videoFrameKind(header))
+}
+
+func (s *subscriber) SendMetadata(metadata map[string]any) {
+	payload, err := amf0.Encode(amf0.ECMAArray(metadata))
+	if err != nil {
+		return
+	}
+	s.frames.push(&Frame{Type: Frame_TYPE_METADATA, Payload: payload}, kindConfig)
+}
+
+func (s *subscriber) GetID() string {
+	return s.id
+}
+
+func (s *subscriber) SendEndOfStream() {
+	s.endOnce.Do(func() {
+		close(s.ended)
+	})
+}
@@ -0,0 +1,105 @@
+package grpcforward
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codingpa-ws/rtmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestClient serves the Forwarder service for b in memory, and returns a client connected to it.
+func newTestClient(t *testing.T, b rtmp.Broadcaster) ForwarderClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	RegisterForwarderServer(server, NewServer(b))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	dial := func(ctx context.Context, addr string) (net.Conn, error) { return listener.DialContext(ctx) }
+	conn, err := grpc.Dial("bufconn", grpc.WithContextDialer(dial), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewForwarderClient(conn)
+}
+
+func TestSubscribeNotPublished(t *testing.T) {
+	client := newTestClient(t, rtmp.NewBroadcaster("app", rtmp.NewInMemoryContext()))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Subscribe(ctx, &SubscribeRequest{StreamKey: "live"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.NotFound {
+		t.Errorf("Recv() = %v, want a NotFound error", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	b := rtmp.NewBroadcaster("app", rtmp.NewInMemoryContext())
+	client := newTestClient(t, b)
+	if err := b.RegisterPublisher("live"); err != nil {
+		t.Fatal(err)
+	}
+	b.(rtmp.MetadataStore).SetMetadataForPublisher("live", map[string]any{"width": 1280.0})
+	b.SetAvcSequenceHeaderForPublisher("live", []byte{0x17, 0x00, 0, 0, 0})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Subscribe(ctx, &SubscribeRequest{StreamKey: "live"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stream is subscribed to once the call reaches the server
+	for b.(rtmp.StreamListBroadcaster).GetSubscriberCount("live") == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("the consumer didn't subscribe to the stream")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.BroadcastVideo("live", []byte{0x17, 0x01, 0, 0, 0, 1}, 0)
+	b.BroadcastAudio("live", []byte{0xaf, 0x01, 2}, 20)
+	b.BroadcastVideo("live", []byte{0x27, 0x01, 0, 0, 0, 3}, 40)
+	b.BroadcastEndOfStream("live")
+
+	type frame struct {
+		Type      Frame_Type
+		Timestamp uint32
+	}
+	var got []frame
+	for {
+		f, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv() = %v", err)
+		}
+		got = append(got, frame{f.Type, f.Timestamp})
+	}
+	want := []frame{
+		{Frame_TYPE_METADATA, 0},
+		{Frame_TYPE_VIDEO, 0},
+		{Frame_TYPE_VIDEO, 0},
+		{Frame_TYPE_AUDIO, 20},
+		{Frame_TYPE_VIDEO, 40},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("received frames %v, want %v", got, want)
+	}
+	if n := b.(rtmp.StreamListBroadcaster).GetSubscriberCount("live"); n != 0 {
+		t.Errorf("GetSubscriberCount() = %d after the call ended, want 0", n)
+	}
+}
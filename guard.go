@@ -4,3 +4,16 @@ type SessionGuard interface {
 	Check(*Session) bool
 	End(*Session)
 }
+
+// PlayGuard can optionally be implemented by a SessionGuard to authorize playback too. CheckPlay is called when a
+// session requests to play a stream, before subscribing it. Sessions for which it returns false can't play the stream.
+type PlayGuard interface {
+	CheckPlay(*Session) bool
+}
+
+// ConnectGuard can optionally be implemented by a SessionGuard to accept or reject connections to the app, before
+// the session publishes or plays anything. Sessions for which CheckConnect returns false are rejected, unless
+// CheckConnect redirected them to another server with Session.Redirect.
+type ConnectGuard interface {
+	CheckConnect(*Session) bool
+}
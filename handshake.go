@@ -3,12 +3,16 @@ package rtmp
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"io"
+	"time"
 
 	"github.com/codingpa-ws/rtmp/rand"
+	"go.uber.org/zap"
 )
 
+var ErrHandshakeFailed error = errors.New("handshake failed")
 var ErrUnsupportedRTMPVersion error = errors.New("The version of RTMP is not supported")
 var ErrWrongC2Message error = errors.New("server handshake: s1 and c2 handshake messages do not match")
 var ErrWrongS2Message error = errors.New("client handshake: c1 and s2 handshake messages do not match")
@@ -21,13 +25,24 @@ type Handshaker struct {
 	reader             *bufio.Reader
 	writer             *bufio.Writer
 	handshakeCompleted bool
+	// Version the server sends in bytes 4-7 of the S1 message. Zero by default: clients check the S1 of servers that send
+	// a version for the digest of the FP9 handshake, which isn't implemented.
+	version [4]byte
+	// If true, the handshake doesn't fail when C2 doesn't echo S1, the mismatch is only reported with c2Mismatch.
+	lenient bool
+	// True if the C2 message received from the client didn't echo S1
+	c2Mismatch bool
+	// Number of bytes of the handshake sent (S0, S1 and S2, or C0, C1 and C2)
+	bytesSent int
+	logger    *zap.Logger
 }
 
 func NewHandshaker(reader *bufio.Reader, writer *bufio.Writer) *Handshaker {
 	return &Handshaker{
-		reader,
-		writer,
-		false,
+		reader:             reader,
+		writer:             writer,
+		handshakeCompleted: false,
+		logger:             zap.NewNop(),
 	}
 }
 
@@ -48,14 +63,24 @@ func (h *Handshaker) Handshake() error {
 		return err
 	}
 
-	if bytes.Compare(s1, c2) != 0 {
-		return ErrWrongC2Message
+	if !isEchoOf(c2, s1) {
+		h.c2Mismatch = true
+		if !h.lenient {
+			return ErrWrongC2Message
+		}
+		h.logger.Debug("server handshake: c2 doesn't echo s1, continuing anyway")
 	}
 
 	h.handshakeCompleted = true
 	return nil
 }
 
+// isEchoOf returns true if the C2/S2 message echo contains the time (bytes 0-3) and random data (bytes 8-1535) of
+// the C1/S1 message original. Bytes 4-7 (time2) hold the time at which the peer read the original, so they're ignored.
+func isEchoOf(echo []byte, original []byte) bool {
+	return bytes.Equal(echo[:4], original[:4]) && bytes.Equal(echo[8:], original[8:])
+}
+
 func (h *Handshaker) ClientHandshake() error {
 	if h.handshakeCompleted {
 		return ErrHandshakeAlreadyCompleted
@@ -160,7 +185,7 @@ func (h *Handshaker) sendS0S1S2(c1 []byte) ([]byte, error) {
 	// s0 message is stored in byte 0
 	s0s1s2[0] = RtmpVersion3
 	// s1 message is stored in bytes 1-1536
-	if err = h.generateRandomData(s0s1s2[1:1537]); err != nil {
+	if err = h.generateS1(s0s1s2[1:1537]); err != nil {
 		return nil, err
 	}
 	// s2 message is stored in bytes 1537-3073
@@ -174,9 +199,15 @@ func (h *Handshaker) sendS0S1S2(c1 []byte) ([]byte, error) {
 	return s0s1s2[1:1537], nil
 }
 
-// Generates an S1 message (random data)
+// Generates an S1 message: our time in milliseconds (bytes 0-3), our version (bytes 4-7) and random data (bytes 8-1535)
+func (h *Handshaker) generateS1(s1 []byte) error {
+	binary.BigEndian.PutUint32(s1[:4], uint32(time.Now().UnixMilli()))
+	copy(s1[4:8], h.version[:])
+	return h.generateRandomData(s1)
+}
+
+// Fills a C1/S1 message with random data, leaving the time and version fields (bytes 0-7) untouched
 func (h *Handshaker) generateRandomData(s1 []byte) error {
-	// the s1 byte array is zero-initialized, since we didn't modify it, we're sending our time as 0
 	err := rand.GenerateCryptoSafeRandomData(s1[8:])
 	if err != nil {
 		return err
@@ -190,7 +221,9 @@ func (h *Handshaker) generateEcho(target []byte, source []byte) error {
 }
 
 func (h *Handshaker) send(bytes []byte) error {
-	if _, err := h.writer.Write(bytes); err != nil {
+	n, err := h.writer.Write(bytes)
+	h.bytesSent += n
+	if err != nil {
 		return err
 	}
 	if err := h.writer.Flush(); err != nil {
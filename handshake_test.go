@@ -0,0 +1,118 @@
+package rtmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codingpa-ws/rtmp/constants"
+)
+
+// serverHandshake performs the server side of a handshake with a client that answers S1 with the C2 returned by c2. The
+// handshaker is configured with configure, if not nil.
+func serverHandshake(t *testing.T, configure func(h *Handshaker), c2 func(s1 []byte) []byte) error {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+
+	clientErr := make(chan error, 1)
+	go func() {
+		c0c1 := make([]byte, 1537)
+		c0c1[0] = RtmpVersion3
+		if _, err := client.Write(c0c1); err != nil {
+			clientErr <- err
+			return
+		}
+		s0s1s2 := make([]byte, 1+2*1536)
+		if _, err := io.ReadFull(client, s0s1s2); err != nil {
+			clientErr <- err
+			return
+		}
+		_, err := client.Write(c2(s0s1s2[1:1537]))
+		clientErr <- err
+	}()
+
+	h := NewHandshaker(bufio.NewReader(server), bufio.NewWriter(server))
+	if configure != nil {
+		configure(h)
+	}
+	err := h.Handshake()
+	if err := <-clientErr; err != nil {
+		t.Fatalf("client: %v", err)
+	}
+	return err
+}
+
+func TestHandshakeC2(t *testing.T) {
+	echo := func(s1 []byte) []byte {
+		c2 := append([]byte(nil), s1...)
+		// time2, which isn't part of the echo
+		copy(c2[4:8], []byte{1, 2, 3, 4})
+		return c2
+	}
+	corrupt := func(s1 []byte) []byte {
+		c2 := append([]byte(nil), s1...)
+		c2[100] ^= 0xFF
+		return c2
+	}
+	tests := []struct {
+		name    string
+		lenient bool
+		c2      func(s1 []byte) []byte
+		want    error
+	}{
+		{"echo", false, echo, nil},
+		{"mismatch", false, corrupt, ErrWrongC2Message},
+		{"mismatch lenient", true, corrupt, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configure := func(h *Handshaker) { h.lenient = test.lenient }
+			if err := serverHandshake(t, configure, test.c2); !errors.Is(err, test.want) {
+				t.Errorf("Handshake() = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestHandshakeS1(t *testing.T) {
+	tests := []struct {
+		name    string
+		version [4]byte
+	}{
+		{"default", [4]byte{}},
+		{"custom", constants.FlashMediaServerHandshakeVersion},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var s1 []byte
+			echo := func(s []byte) []byte {
+				s1 = append([]byte(nil), s...)
+				return s
+			}
+			before := uint32(time.Now().UnixMilli())
+			configure := func(h *Handshaker) {
+				if test.version != [4]byte{} {
+					h.version = test.version
+				}
+			}
+			if err := serverHandshake(t, configure, echo); err != nil {
+				t.Fatalf("Handshake() = %v", err)
+			}
+			after := uint32(time.Now().UnixMilli())
+			if got := binary.BigEndian.Uint32(s1[:4]); got-before > after-before {
+				t.Errorf("S1 time = %d, want between %d and %d", got, before, after)
+			}
+			if got := [4]byte(s1[4:8]); got != test.version {
+				t.Errorf("S1 version = %v, want %v", got, test.version)
+			}
+		})
+	}
+}
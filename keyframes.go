@@ -0,0 +1,68 @@
+package rtmp
+
+import (
+	"sync"
+	"time"
+)
+
+// KeyframeStats describes the keyframe cadence of a publisher, to diagnose encoder configurations. Long keyframe
+// intervals (GOPs) increase the time it takes for players to start rendering a stream.
+type KeyframeStats struct {
+	StreamKey string
+	// Time between the publish command and the first keyframe. 0 until the first keyframe is received.
+	TimeToFirstKeyframe time.Duration
+	// Interval between the last two keyframes, measured with the timestamps of the stream. 0 until the second
+	// keyframe is received.
+	KeyframeInterval time.Duration
+	// Number of keyframes received since the publish command
+	Keyframes uint64
+}
+
+// keyframeTracker measures the keyframe cadence of a publisher. It's updated by the session's read loop and can be
+// read from other goroutines (eg: Server.Stats).
+type keyframeTracker struct {
+	mutex         sync.Mutex
+	publishing    bool
+	publishTime   time.Time
+	lastTimestamp uint32
+	stats         KeyframeStats
+}
+
+// start resets the tracker when the session starts publishing streamKey at now.
+func (t *keyframeTracker) start(streamKey string, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.publishing = true
+	t.publishTime = now
+	t.lastTimestamp = 0
+	t.stats = KeyframeStats{StreamKey: streamKey}
+}
+
+// onKeyframe records a keyframe received at now with the given stream timestamp, and returns the updated stats.
+func (t *keyframeTracker) onKeyframe(now time.Time, timestamp uint32) KeyframeStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.stats.Keyframes == 0 {
+		t.stats.TimeToFirstKeyframe = now.Sub(t.publishTime)
+	} else {
+		// Unsigned subtraction, so the interval is still right when the timestamps wrap around
+		t.stats.KeyframeInterval = time.Duration(timestamp-t.lastTimestamp) * time.Millisecond
+	}
+	t.lastTimestamp = timestamp
+	t.stats.Keyframes++
+	return t.stats
+}
+
+// stop marks the session as no longer publishing. The stats of the last stream are kept.
+func (t *keyframeTracker) stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.publishing = false
+}
+
+// get returns the current stats, and false if the session isn't publishing.
+func (t *keyframeTracker) get() (KeyframeStats, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.stats, t.publishing
+}
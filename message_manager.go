@@ -1,17 +1,25 @@
 package rtmp
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"sync/atomic"
 
 	"github.com/codingpa-ws/rtmp/amf"
 	"github.com/codingpa-ws/rtmp/amf/amf0"
+	"github.com/codingpa-ws/rtmp/amf/amf3"
 	"github.com/codingpa-ws/rtmp/audio"
-	"github.com/codingpa-ws/rtmp/constants"
 	"github.com/codingpa-ws/rtmp/video"
+	"go.uber.org/zap"
 )
 
+var ErrMalformedCommand error = errors.New("message manager: malformed command")
+var ErrMalformedMessage error = errors.New("message manager: malformed message")
+
 // Control message types
 const (
 	// Control messages MUST have message stream ID 0 and be sent in chunk stream ID 2
@@ -41,7 +49,13 @@ const (
 )
 
 const (
-	EventStreamBegin uint16 = 0
+	EventStreamBegin      uint16 = 0
+	EventStreamEOF        uint16 = 1
+	EventStreamDry        uint16 = 2
+	EventSetBufferLength  uint16 = 3
+	EventStreamIsRecorded uint16 = 4
+	EventPingRequest      uint16 = 6
+	EventPingResponse     uint16 = 7
 )
 
 type MessageManager struct {
@@ -49,6 +63,21 @@ type MessageManager struct {
 	handshaker   *Handshaker
 	chunkHandler *ChunkHandler
 	streamID     uint32
+	logger       *zap.Logger
+	// Number of audio/video messages that couldn't be sent
+	droppedFrames atomic.Uint64
+	// Commands sent by a client that are waiting for a _result/_error response, by transaction ID, so that responses
+	// are matched to the command they answer even if the server interleaves them with other responses
+	pendingTransactions map[float64]string
+	lastTransactionID   float64
+	// If true, messages that can't be handled (eg: malformed commands or metadata) are logged and skipped instead of
+	// ending the session
+	skipMalformedMessages bool
+	// If true, the command messages sent are AMF3 command messages (see useAMF3Commands)
+	amf3Commands atomic.Bool
+	// Handles the media messages received on other goroutines (see dispatchMedia), nil if they're handled on the
+	// goroutine reading the connection
+	dispatcher *mediaDispatcher
 }
 
 func NewMessageManager(session MediaServer, handshaker *Handshaker, chunkHandler *ChunkHandler) *MessageManager {
@@ -56,6 +85,33 @@ func NewMessageManager(session MediaServer, handshaker *Handshaker, chunkHandler
 		session:      session,
 		handshaker:   handshaker,
 		chunkHandler: chunkHandler,
+		logger:       zap.NewNop(),
+
+		pendingTransactions: make(map[float64]string),
+	}
+}
+
+// setLogger sets the logger used by the message manager, its handshaker and its chunk handler.
+func (m *MessageManager) setLogger(logger *zap.Logger) {
+	m.logger = logger
+	m.handshaker.logger = logger
+	m.chunkHandler.logger = logger
+}
+
+// dispatchMedia makes the message manager handle the audio, video and data messages it receives on other goroutines
+// than the one reading the connection (see mediaDispatcher), until stopDispatch is called. Metadata is handled on its
+// own goroutine if splitMetadata is true. Commands are still handled while reading the connection, once the media
+// received before them has been handled, since they change the state the media handlers depend on (eg: the streams of
+// the session).
+func (m *MessageManager) dispatchMedia(splitMetadata bool) {
+	m.dispatcher = newMediaDispatcher(splitMetadata)
+}
+
+// stopDispatch waits for the media messages received so far to be handled, if they're dispatched asynchronously.
+func (m *MessageManager) stopDispatch() {
+	if m.dispatcher != nil {
+		m.dispatcher.stop()
+		m.dispatcher = nil
 	}
 }
 
@@ -64,7 +120,12 @@ func NewMessageManager(session MediaServer, handshaker *Handshaker, chunkHandler
 // in an error.
 // This method is used for servers only.
 func (m *MessageManager) Initialize() error {
-	return m.handshaker.Handshake()
+	if err := m.handshaker.Handshake(); err != nil {
+		return fmt.Errorf("%w: %w", ErrHandshakeFailed, err)
+	}
+	// Peers count the bytes of the handshake in the sequence numbers of their acknowledgements
+	m.chunkHandler.addBytesSent(m.handshaker.bytesSent)
+	return nil
 }
 
 // InitializeClient performs the handshake with the server. It returns an error if the handshake was not successful.
@@ -72,12 +133,18 @@ func (m *MessageManager) Initialize() error {
 // will result in an error.
 // This method is used for clients only.
 func (m *MessageManager) InitializeClient() error {
-	return m.handshaker.ClientHandshake()
+	if err := m.handshaker.ClientHandshake(); err != nil {
+		return fmt.Errorf("%w: %w", ErrHandshakeFailed, err)
+	}
+	m.chunkHandler.addBytesSent(m.handshaker.bytesSent)
+	return nil
 }
 
-// Reads the next chunk header + data
+// Reads the next chunk header + data.
+// Messages are interpreted synchronously, before the next chunk header is read. This guarantees that protocol control
+// messages such as Set Chunk Size are in effect for the messages that follow them, even if both arrive in the same read.
 func (m *MessageManager) nextMessage() error {
-	// TODO: every time a chunk is read, update the number of read bytes
+	// The chunk handler counts the bytes it reads, and sends acknowledgements when needed
 	var err error
 	chunkHeader, _, err := m.chunkHandler.ReadChunkHeader()
 	if err != nil {
@@ -89,7 +156,37 @@ func (m *MessageManager) nextMessage() error {
 		return err
 	}
 
-	return m.interpretMessage(chunkHeader, payload)
+	// The messages of other chunk streams interleaved with the chunks of the message were received in full before it
+	for _, message := range m.chunkHandler.takeInterleavedMessages() {
+		if err := m.handleMessage(message.header, message.payload); err != nil {
+			return err
+		}
+	}
+	return m.handleMessage(chunkHeader, payload)
+}
+
+func (m *MessageManager) handleMessage(chunkHeader ChunkHeader, payload []byte) error {
+	if !m.skipMalformedMessages {
+		return m.interpretMessage(chunkHeader, payload)
+	}
+	// The message has been read in full, so skipping it keeps the chunk stream in sync. Errors reading chunks (I/O
+	// errors, unknown chunk types, etc.) still end the session, since the next message can't be found after them.
+	if err := m.interpretMessageSafely(chunkHeader, payload); err != nil {
+		m.logger.Warn("message manager: skipping message that couldn't be handled",
+			zap.Uint8("message_type_id", chunkHeader.MessageHeader.MessageTypeID), zap.Uint32("message_length", chunkHeader.MessageHeader.MessageLength), zap.Error(err))
+	}
+	return nil
+}
+
+// interpretMessageSafely is like interpretMessage, but also returns an error if the message makes its handler panic
+// (eg: a payload too short for its type).
+func (m *MessageManager) interpretMessageSafely(header ChunkHeader, payload []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: panic handling message: %v", ErrMalformedMessage, r)
+		}
+	}()
+	return m.interpretMessage(header, payload)
 }
 
 func (m *MessageManager) interpretMessage(header ChunkHeader, payload []byte) error {
@@ -109,12 +206,18 @@ func (m *MessageManager) interpretMessage(header ChunkHeader, payload []byte) er
 		return m.handleControlMessage(&header, payload)
 	case UserControlMessage:
 		// First 2 bytes of payload contain event type
+		if len(payload) < 2 {
+			return fmt.Errorf("%w: user control message without an event type", ErrMalformedMessage)
+		}
 		eventType := binary.BigEndian.Uint16(payload[:2])
 		return m.handleUserControlMessage(&header, eventType, payload[2:])
 	case CommandMessageAMF0, CommandMessageAMF3:
+		if m.dispatcher != nil {
+			m.dispatcher.wait()
+		}
 		return m.handleCommandMessage(header.BasicHeader.ChunkStreamID, header.MessageHeader.MessageStreamID, header.MessageHeader.MessageTypeID, payload)
 	case DataMessageAMF0, DataMessageAMF3:
-		return m.handleDataMessage(header.MessageHeader.MessageTypeID, payload)
+		return m.handleDataMessage(header.MessageHeader.MessageStreamID, header.MessageHeader.MessageTypeID, payload)
 	case AudioMessage:
 		//fmt.Print(" audio\n")
 		//fmt.Printf("audio message: fmt %d, chunk stream id %d, message stream id %d, timestamp %d, elapsed time %d, message length %d\n", header.BasicHeader.FMT, header.BasicHeader.ChunkStreamID,
@@ -133,33 +236,51 @@ func (m *MessageManager) interpretMessage(header ChunkHeader, payload []byte) er
 func (m *MessageManager) handleControlMessage(header *ChunkHeader, payload []byte) error {
 	switch header.MessageHeader.MessageTypeID {
 	case SetChunkSize:
-		if constants.Debug {
-			fmt.Println("Received SetChunkSize control message")
-		}
+		m.logger.Debug("message manager: received SetChunkSize control message")
 		// The payload of a set chunk size message is the new chunk size
 		// The chunkHandler is the one affected by the chunk size, because it affects how it interprets messages.
 		// ie. the chunkHandler checks to see if the message length is greater than the chunk size, if it is, it has to assemble the message from various chunks.
-		newChunkSize := binary.BigEndian.Uint32(payload)
+		if len(payload) < 4 {
+			return errors.New("message manager: received Set Chunk Size message with a payload shorter than 4 bytes")
+		}
+		// The first bit of the payload must be zero, the chunk size is stored in the remaining 31 bits
+		newChunkSize := binary.BigEndian.Uint32(payload) & 0x7FFFFFFF
+		if newChunkSize == 0 {
+			return errors.New("message manager: received invalid chunk size 0 in Set Chunk Size message")
+		}
 		m.session.onSetChunkSize(newChunkSize)
 		return nil
 	case AbortMessage:
 		// The payload of an abort message is the chunk stream ID whose current message is to be discarded
+		if len(payload) < 4 {
+			return fmt.Errorf("%w: abort message without a chunk stream ID", ErrMalformedMessage)
+		}
 		chunkStreamId := binary.BigEndian.Uint32(payload)
 		m.session.onAbortMessage(chunkStreamId)
 		return nil
 	case Ack:
 		// The payload of an ack message is the sequence number (number of bytes received so far)
+		if len(payload) < 4 {
+			return fmt.Errorf("%w: acknowledgement without a sequence number", ErrMalformedMessage)
+		}
 		sequenceNumber := binary.BigEndian.Uint32(payload)
+		m.chunkHandler.onAck(sequenceNumber)
 		m.session.onAck(sequenceNumber)
 		return nil
 	case WindowAckSize:
 		// the ack window size is in the first 4 bytes
+		if len(payload) < 4 {
+			return fmt.Errorf("%w: window acknowledgement size message without a size", ErrMalformedMessage)
+		}
 		windowAckSize := binary.BigEndian.Uint32(payload[:4])
 		// Set the window ack size in the chunk handler, the chunk handler will call our onWindowAckSize function when the window ack size is reached
 		m.session.onSetWindowAckSize(windowAckSize)
 		return nil
 	case SetPeerBandwidth:
 		// window ack size is in the first 4 bytes: 0-3
+		if len(payload) < 5 {
+			return fmt.Errorf("%w: set peer bandwidth message without a window size and limit type", ErrMalformedMessage)
+		}
 		windowAckSize := binary.BigEndian.Uint32(payload[:4])
 		// limit is the 5th byte: 4
 		limitType := payload[4]
@@ -174,11 +295,33 @@ func (m *MessageManager) handleControlMessage(header *ChunkHeader, payload []byt
 func (m *MessageManager) handleUserControlMessage(header *ChunkHeader, eventType uint16, payload []byte) error {
 	switch eventType {
 	case EventStreamBegin:
-		m.streamID = binary.BigEndian.Uint32(payload)
-		m.session.onStreamBegin()
+		if len(payload) < 4 {
+			return fmt.Errorf("%w: stream begin without a stream ID", ErrMalformedMessage)
+		}
+		m.session.onStreamBegin(binary.BigEndian.Uint32(payload))
+		return nil
+	case EventSetBufferLength:
+		// Stream ID, and buffer length in milliseconds
+		if len(payload) < 8 {
+			return fmt.Errorf("%w: set buffer length without a stream ID and buffer length", ErrMalformedMessage)
+		}
+		m.session.onSetBufferLength(binary.BigEndian.Uint32(payload), binary.BigEndian.Uint32(payload[4:]))
+		return nil
+	case EventPingRequest:
+		// Answered right away with the timestamp of the request, as some peers disconnect if their pings go unanswered
+		if len(payload) < 4 {
+			return fmt.Errorf("%w: ping request without a timestamp", ErrMalformedMessage)
+		}
+		m.chunkHandler.sendUserControl(EventPingResponse, binary.BigEndian.Uint32(payload))
+		return nil
+	case EventPingResponse:
+		if len(payload) < 4 {
+			return fmt.Errorf("%w: ping response without a timestamp", ErrMalformedMessage)
+		}
+		m.session.onPingResponse(binary.BigEndian.Uint32(payload))
 		return nil
 	default:
-		fmt.Println("message manager: user control message not implemented, event type:", eventType)
+		m.logger.Warn("message manager: user control message not implemented", zap.Uint16("event_type", eventType))
 		return nil
 	}
 }
@@ -186,132 +329,324 @@ func (m *MessageManager) handleUserControlMessage(header *ChunkHeader, eventType
 func (m *MessageManager) handleCommandMessage(csID uint32, streamID uint32, commandType uint8, payload []byte) error {
 	switch commandType {
 	case CommandMessageAMF0:
-		commandName, err := amf0.Decode(payload) // Decode the command name (always the first string in the payload)
-		if err != nil {
-			return err
-		}
-		m.handleCommandAmf0(csID, streamID, commandName.(string), payload[amf0.Size(commandName.(string)):])
-		return nil
 	case CommandMessageAMF3:
-		// TODO: implement AMF3
-		fmt.Println("received AMF3 command but didn't process it because AMF3 encoding/decoding is not implemented yet")
-		return nil
+		payload = trimAmf3Format(payload)
+	default:
+		return errors.New(fmt.Sprintf("Command is not an AMF0 nor an AMF3 command, command message received was %d", commandType))
 	}
-	return errors.New(fmt.Sprintf("Command is not an AMF0 nor an AMF3 command, command message received was %d", commandType))
+	// Decode the command name (always the first string in the payload)
+	d := newPayloadDecoder(payload)
+	commandName, err := decodeNextString(d, "command name")
+	if err != nil {
+		return err
+	}
+	return m.handleCommandAmf0(csID, streamID, commandName, d)
 }
 
-func (m *MessageManager) handleCommandAmf0(csID uint32, streamID uint32, commandName string, payload []byte) {
-	if constants.Debug {
-		fmt.Println("received command", commandName)
+// trimAmf3Format removes the format byte at the beginning of the payload of AMF3 command and data messages. The values
+// that follow it are encoded in AMF0, and switch to AMF3 with the AVM+ marker (usually for objects), so they're then
+// handled like the values of AMF0 messages.
+func trimAmf3Format(payload []byte) []byte {
+	// The format byte is always 0, which can't be the marker of the name that follows (a string)
+	if len(payload) > 0 && payload[0] == 0 {
+		return payload[1:]
 	}
-	// Every command has a transaction ID and a command object (which can be null)
-	tId, _ := amf0.Decode(payload)
-	byteLength := amf0.Size(tId)
-	transactionId := tId.(float64)
-	// Update our payload to read the next property (commandObject)
-	payload = payload[byteLength:]
-	cmdObject, _ := amf0.Decode(payload)
-	var commandObject map[string]any
-	switch cmdObject.(type) {
-	case nil:
-		commandObject = nil
+	return payload
+}
+
+// newPayloadDecoder returns a decoder of the AMF0 values of the payload of a message, such as the name, transaction ID,
+// command object and arguments of a command.
+func newPayloadDecoder(payload []byte) *amf.Decoder {
+	// The payload is already in memory, so it's buffered at once
+	return amf.NewDecoder(bufio.NewReaderSize(bytes.NewReader(payload), len(payload)))
+}
+
+// decodeNextAmf0 decodes the next AMF0 value of the payload decoded by d.
+func decodeNextAmf0(d *amf.Decoder) (any, error) {
+	value, err := d.Decode()
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: missing value", ErrMalformedCommand)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformedCommand, err)
+	}
+	return value, nil
+}
+
+// decodeNextString decodes the next AMF0 value of the payload decoded by d, which must be a string.
+func decodeNextString(d *amf.Decoder, name string) (string, error) {
+	value, err := decodeNextAmf0(d)
+	if err != nil {
+		return "", err
+	}
+	str, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%w: %s is not a string", ErrMalformedCommand, name)
+	}
+	return str, nil
+}
+
+// decodeNextObject decodes the next AMF0 value of the payload decoded by d, which must be an object, an ECMA array or
+// null (or an AMF3 object).
+func decodeNextObject(d *amf.Decoder, name string) (map[string]any, error) {
+	value, err := decodeNextAmf0(d)
+	if err != nil {
+		return nil, err
+	}
+	switch object := value.(type) {
+	case nil, amf0.Undefined:
+		return nil, nil
 	case map[string]any:
-		commandObject = cmdObject.(map[string]any)
+		return object, nil
 	case amf0.ECMAArray:
-		commandObject = cmdObject.(amf0.ECMAArray)
+		return object, nil
+	case amf3.TypedObject:
+		return object.Properties, nil
+	default:
+		return nil, fmt.Errorf("%w: %s is not an object", ErrMalformedCommand, name)
+	}
+}
+
+// toFloat64 returns the value of a number, which is a float64 in AMF0 and can also be an int in AMF3.
+func toFloat64(value any) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case int:
+		return float64(number), true
+	default:
+		return 0, false
+	}
+}
+
+func (m *MessageManager) handleCommandAmf0(csID uint32, streamID uint32, commandName string, d *amf.Decoder) error {
+	m.logger.Debug("message manager: received command", zap.String("command", commandName))
+	// Every command has a transaction ID and a command object (which can be null)
+	tID, err := decodeNextAmf0(d)
+	if err != nil {
+		return err
+	}
+	transactionId, ok := toFloat64(tID)
+	if !ok {
+		return fmt.Errorf("%w: transaction ID of %s is not a number", ErrMalformedCommand, commandName)
+	}
+	var commandObject map[string]any
+	// Some clients omit the command object when it's null
+	if d.More() {
+		commandObject, err = decodeNextObject(d, "command object of "+commandName)
+		if err != nil {
+			return err
+		}
 	}
-	// Update our payload to read the next property
-	byteLength = amf0.Size(cmdObject)
-	payload = payload[byteLength:]
 
 	switch commandName {
 	case "connect":
 		m.session.onConnect(csID, transactionId, amf.Metadata(commandObject))
 	case "releaseStream":
-		streamKey, _ := amf0.Decode(payload)
-		m.session.onReleaseStream(csID, transactionId, commandObject, streamKey.(string))
+		streamKey, err := decodeNextString(d, "stream key")
+		if err != nil {
+			return err
+		}
+		m.session.onReleaseStream(csID, transactionId, commandObject, streamKey)
 	case "FCPublish":
-		streamKey, _ := amf0.Decode(payload)
-		m.session.onFCPublish(csID, transactionId, commandObject, streamKey.(string))
+		streamKey, err := decodeNextString(d, "stream key")
+		if err != nil {
+			return err
+		}
+		m.session.onFCPublish(csID, transactionId, commandObject, streamKey)
 	case "createStream":
 		m.session.onCreateStream(csID, transactionId, commandObject)
+	case "FCSubscribe":
+		streamKey, err := decodeNextString(d, "stream key")
+		if err != nil {
+			return err
+		}
+		m.session.onFCSubscribe(csID, transactionId, commandObject, streamKey)
+	case "checkBandwidth", "_checkbw":
+		m.session.onCheckBandwidth(csID, transactionId)
+	case "getStreamLength":
+		streamKey, err := decodeNextString(d, "stream key")
+		if err != nil {
+			return err
+		}
+		m.session.onGetStreamLength(csID, transactionId, streamKey)
 	case "publish":
 		// name with which the stream is published (basically the streamKey)
-		streamKey, _ := amf0.Decode(payload)
-		byteLength = amf0.Size(streamKey)
-		payload = payload[byteLength:]
+		streamKey, err := decodeNextString(d, "stream key")
+		if err != nil {
+			return err
+		}
 		// Publishing type: "live", "record", or "append"
 		// - record: The stream is published and the data is recorded to a new file. The file is stored on the server
 		// in a subdirectory within the directory that contains the server application. If the file already exists, it is overwritten.
 		// - append: The stream is published and the data is appended to a file. If no file is found, it is created.
 		// - live: Live data is published without recording it in a file.
-		publishingType, _ := amf0.Decode(payload)
-		m.session.onPublish(transactionId, commandObject, streamKey.(string), publishingType.(string))
+		// The spec makes it optional, and "live" is the default
+		publishingType := PublishingTypeLive
+		if d.More() {
+			if publishingType, err = decodeNextString(d, "publishing type"); err != nil {
+				return err
+			}
+		}
+		m.session.onPublish(streamID, transactionId, commandObject, streamKey, publishingType)
 	case "play":
-		streamKey, _ := amf0.Decode(payload)
-		byteLength = amf0.Size(streamKey)
-		payload = payload[byteLength:]
+		streamKey, err := decodeNextString(d, "stream key")
+		if err != nil {
+			return err
+		}
 
-		// Start time in seconds
-		startTime, _ := amf0.Decode(payload)
-		byteLength = amf0.Size(startTime)
-		payload = payload[byteLength:]
+		// Start time in seconds. The spec makes it optional, and -2 (live stream, or recorded stream if there's no live
+		// stream with that name) is the default
+		startTime := float64(-2)
+		if d.More() {
+			value, err := decodeNextAmf0(d)
+			if err != nil {
+				return err
+			}
+			// An undefined start time is an omitted one
+			if _, undefined := value.(amf0.Undefined); !undefined {
+				if startTime, ok = toFloat64(value); !ok {
+					return fmt.Errorf("%w: start time is not a number", ErrMalformedCommand)
+				}
+			}
+		}
 
 		// the spec specifies that, the next values should be duration (number), and reset (bool), but VLC doesn't send them
-		m.session.onPlay(streamKey.(string), startTime.(float64))
+		m.session.onPlay(streamID, streamKey, startTime)
+	case "seek":
+		// Number of milliseconds to seek into the playlist
+		value, err := decodeNextAmf0(d)
+		if err != nil {
+			return err
+		}
+		milliseconds, ok := toFloat64(value)
+		if !ok {
+			return fmt.Errorf("%w: seek position is not a number", ErrMalformedCommand)
+		}
+		m.session.onSeek(streamID, milliseconds)
+	case "play2":
+		options, err := decodeNextObject(d, "play options")
+		if err != nil {
+			return err
+		}
+		m.session.onPlay2(streamID, options)
 	case "FCUnpublish":
-		streamKey, _ := amf0.Decode(payload)
-		m.session.onFCUnpublish(commandObject, streamKey.(string))
+		streamKey, err := decodeNextString(d, "stream key")
+		if err != nil {
+			return err
+		}
+		m.session.onFCUnpublish(csID, transactionId, commandObject, streamKey)
 	case "closeStream":
-		m.session.onCloseStream(csID, transactionId, commandObject)
+		m.session.onCloseStream(streamID, transactionId, commandObject)
 	case "deleteStream":
-		streamID, _ := amf0.Decode(payload)
-		m.session.onDeleteStream(commandObject, streamID.(float64))
-	case "_result":
-		info, _ := amf0.Decode(payload)
-		m.session.onResult(info.(map[string]any))
+		value, err := decodeNextAmf0(d)
+		if err != nil {
+			return err
+		}
+		deletedStreamID, ok := toFloat64(value)
+		if !ok {
+			return fmt.Errorf("%w: stream ID is not a number", ErrMalformedCommand)
+		}
+		m.session.onDeleteStream(commandObject, deletedStreamID)
+	case "_result", "_error":
+		return m.handleResponse(commandName, transactionId, d)
 	case "onStatus":
-		info, _ := amf0.Decode(payload)
-		m.session.onStatus(info.(map[string]any))
+		info, err := decodeNextObject(d, "info object")
+		if err != nil {
+			return err
+		}
+		m.session.onStatus(info)
 	default:
-		fmt.Println("message manager: received command " + commandName + ", but couldn't handle it because no implementation is defined")
+		m.logger.Warn("message manager: received command, but couldn't handle it because no implementation is defined", zap.String("command", commandName))
+	}
+	return nil
+}
+
+// handleResponse handles the _result/_error response to a command sent by a client, matching it to the command by its
+// transaction ID. Responses to unknown transactions are ignored.
+func (m *MessageManager) handleResponse(commandName string, transactionID float64, d *amf.Decoder) error {
+	command, pending := m.pendingTransactions[transactionID]
+	if !pending {
+		m.logger.Warn("message manager: ignoring response to an unknown transaction", zap.String("command", commandName), zap.Float64("transaction_id", transactionID))
+		return nil
+	}
+	delete(m.pendingTransactions, transactionID)
+
+	if command == "createStream" && commandName == "_result" {
+		value, err := decodeNextAmf0(d)
+		if err != nil {
+			return err
+		}
+		streamID, ok := toFloat64(value)
+		if !ok {
+			return fmt.Errorf("%w: stream ID of the createStream response is not a number", ErrMalformedCommand)
+		}
+		m.session.onCreateStreamResult(uint32(streamID))
+		return nil
 	}
+	// The level of the info object tells if this is an error
+	info, err := decodeNextObject(d, "info object")
+	if err != nil {
+		return err
+	}
+	m.session.onResult(info)
+	return nil
 }
 
-func (m *MessageManager) handleDataMessage(dataType uint8, payload []byte) error {
+// newTransaction returns the transaction ID of a new command sent by a client, which expects a response.
+func (m *MessageManager) newTransaction(command string) float64 {
+	m.lastTransactionID++
+	m.pendingTransactions[m.lastTransactionID] = command
+	return m.lastTransactionID
+}
+
+func (m *MessageManager) handleDataMessage(streamID uint32, dataType uint8, payload []byte) error {
 	switch dataType {
-	case DataMessageAMF0:
-		dataName, err := amf0.Decode(payload) // Decode the command name (always the first string in the payload)
+	case DataMessageAMF0, DataMessageAMF3:
+		if dataType == DataMessageAMF3 {
+			payload = trimAmf3Format(payload)
+		}
+		// Decode the data message name (always the first string in the payload)
+		d := newPayloadDecoder(payload)
+		dataName, err := decodeNextString(d, "data message name")
 		if err != nil {
 			return err
 		}
 
-		return m.handleDataMessageAmf0(dataName.(string), payload[amf0.Size(dataName.(string)):])
-	case DataMessageAMF3:
-		// TODO: implement AMF3
-		fmt.Println("message manager: received AMF3 data message, but couldn't process it because AMF3 encoding/decoding is not implemented")
-		return nil
+		return m.handleDataMessageAmf0(streamID, dataName, d)
 	default:
 		return errors.New(fmt.Sprintf("message manager: received unknown data message type, type: %d", dataType))
 	}
 }
 
-func (m *MessageManager) handleDataMessageAmf0(dataName string, payload []byte) error {
+func (m *MessageManager) handleDataMessageAmf0(streamID uint32, dataName string, d *amf.Decoder) error {
 	switch dataName {
 	case "@setDataFrame":
 		// @setDataFrame message includes a string with value "onMetadata".
 		// Ignore it for now.
-		onMetadata, _ := amf0.Decode(payload)
-		payload = payload[amf0.Size(onMetadata):]
-		// Metadata is sent as an ECMAArray
-		metadata, _ := amf0.Decode(payload)
-		// Handle cases where the metadata comes as an object or as an ECMAArray
-		switch metadata.(type) {
-		case amf0.ECMAArray:
-			m.session.onMetadata(metadata.(amf0.ECMAArray))
-		case map[string]any:
-			m.session.onMetadata(metadata.(map[string]any))
+		_, err := decodeNextString(d, "data frame name")
+		if err != nil {
+			return err
+		}
+		// Metadata is sent as an ECMAArray, or as an object by some encoders
+		metadata, err := decodeNextObject(d, "metadata")
+		if err != nil {
+			return err
 		}
+		if metadata == nil {
+			m.logger.Debug("message manager: ignoring @setDataFrame with null metadata")
+			return nil
+		}
+		if m.dispatcher != nil {
+			m.dispatcher.data(func() { m.session.onMetadata(streamID, metadata) })
+			return nil
+		}
+		m.session.onMetadata(streamID, metadata)
+		return nil
+	case "|RtmpSampleAccess":
+		// Sent to players when they start playing, to allow them to access the raw audio and video data. There's
+		// nothing to restrict here.
+		m.logger.Debug("message manager: ignoring |RtmpSampleAccess")
 		return nil
 	default:
 		return errors.New(fmt.Sprintf("message manager: received unknown data message with name " + dataName))
@@ -325,13 +660,14 @@ func (m *MessageManager) handleAudioMessage(chunkStreamID uint32, messageStreamI
 	//sha256Hash.Write(payload)
 	//hash = sha256Hash.Sum(hash)
 	//fmt.Println("received audio, hash:", string(hash))
-	// Header contains sound format, rate, size, type
-	audioHeader := payload[0]
-	format := audio.Format((audioHeader >> 4) & 0x0F)
-	sampleRate := audio.SampleRate((audioHeader >> 2) & 0x03)
-	sampleSize := audio.SampleSize((audioHeader >> 1) & 1)
-	channels := audio.Channel((audioHeader) & 1)
-	m.session.onAudioMessage(format, sampleRate, sampleSize, channels, payload, timestamp)
+	// Header contains sound format, rate, size, type, or the FourCC of the codec (eg: Opus) if it's an Enhanced RTMP
+	// extended header
+	header := audio.ParseHeader(payload)
+	if m.dispatcher != nil {
+		m.dispatcher.frame(func() { m.session.onAudioMessage(messageStreamID, header, payload, timestamp) })
+		return nil
+	}
+	m.session.onAudioMessage(messageStreamID, header, payload, timestamp)
 	return nil
 }
 
@@ -342,12 +678,14 @@ func (m *MessageManager) handleVideoMessage(csID uint32, messageStreamID uint32,
 	//sha256Hash.Write(payload)
 	//hash = sha256Hash.Sum(hash)
 	//fmt.Println("received video, hash:", hash)
-	// Header contains frame type (key frame, i-frame, etc.) and format/codec (H264, etc.)
-	videoHeader := payload[0]
-	frameType := video.FrameType((videoHeader >> 4) & 0x0F)
-	codec := video.Codec(videoHeader & 0x0F)
-
-	m.session.onVideoMessage(frameType, codec, payload, timestamp)
+	// Header contains frame type (key frame, i-frame, etc.) and format/codec (H264, etc.), or the FourCC of the codec
+	// (eg: HEVC) if it's an Enhanced RTMP extended header
+	header := video.ParseHeader(payload)
+	if m.dispatcher != nil {
+		m.dispatcher.frame(func() { m.session.onVideoMessage(messageStreamID, header, payload, timestamp) })
+		return nil
+	}
+	m.session.onVideoMessage(messageStreamID, header, payload, timestamp)
 	return nil
 }
 
@@ -363,6 +701,21 @@ func (m *MessageManager) SetBandwidth(size uint32, limitType uint8) {
 	m.chunkHandler.SetBandwidth(size, limitType)
 }
 
+// Flush writes the messages that are still buffered to the connection, even if a batch is in progress.
+func (m *MessageManager) Flush() error {
+	return m.chunkHandler.Flush()
+}
+
+// beginBatch and endBatch delimit a burst of messages (eg: the sequence headers and the cached GOP sent when a stream
+// starts playing) that is flushed to the connection at once, see ChunkHandler.beginBatch.
+func (m *MessageManager) beginBatch() {
+	m.chunkHandler.beginBatch()
+}
+
+func (m *MessageManager) endBatch() error {
+	return m.chunkHandler.endBatch()
+}
+
 func (m *MessageManager) sendWindowAckSize(size uint32) {
 	m.chunkHandler.sendWindowAckSize(size)
 }
@@ -375,15 +728,67 @@ func (m *MessageManager) sendBeginStream(streamId uint32) {
 	m.chunkHandler.sendBeginStream(streamId)
 }
 
+func (m *MessageManager) sendPingRequest(timestamp uint32) error {
+	return m.chunkHandler.sendUserControl(EventPingRequest, timestamp)
+}
+
+func (m *MessageManager) sendStreamEOF(streamID uint32) {
+	m.chunkHandler.sendUserControl(EventStreamEOF, streamID)
+}
+
+func (m *MessageManager) sendStreamDry(streamID uint32) {
+	m.chunkHandler.sendUserControl(EventStreamDry, streamID)
+}
+
+func (m *MessageManager) sendStreamIsRecorded(streamID uint32) {
+	m.chunkHandler.sendUserControl(EventStreamIsRecorded, streamID)
+}
+
 func (m *MessageManager) sendSetChunkSize(size uint32) {
 	m.chunkHandler.sendSetChunkSize(size)
 }
 
-func (m *MessageManager) sendConnectSuccess(csID uint32) {
-	m.chunkHandler.sendConnectSuccess(csID)
+func (m *MessageManager) sendConnectSuccess(csID uint32, fmsVer string, capabilities int, objectEncoding float64) {
+	m.chunkHandler.sendConnectSuccess(csID, fmsVer, capabilities, objectEncoding)
 }
 
-func (m *MessageManager) sendAudio(audio []byte, timestamp uint32) {
+// useAMF3Commands makes the command messages sent from now on AMF3 command messages, for peers that negotiated AMF3 in
+// their connect command.
+func (m *MessageManager) useAMF3Commands() {
+	m.amf3Commands.Store(true)
+}
+
+// objectEncoding returns the AMF version of the command messages sent (see generateCommandMessage).
+func (m *MessageManager) objectEncoding() float64 {
+	if m.amf3Commands.Load() {
+		return 3
+	}
+	return 0
+}
+
+// sendConnectRejected replies to the connect command with an _error response
+func (m *MessageManager) sendConnectRejected(csID uint32, transactionID float64, description string) {
+	message := generateConnectResponseRejected(csID, transactionID, description, nil)
+	// The rejection can be sent before any Set Chunk Size message, so let send split it in chunks if it needs to
+	if err := m.chunkHandler.sendMessage(message); err != nil {
+		m.logger.Warn("message manager: error sending connect rejection", zap.Error(err))
+	}
+}
+
+// sendConnectRedirect replies to the connect command with an _error response that redirects the client to url.
+// The redirect is in the "ex" object of the response, with code 302 (like FMS/Wowza edges do).
+func (m *MessageManager) sendConnectRedirect(csID uint32, transactionID float64, url string) {
+	ex := map[string]any{
+		"code":     302,
+		"redirect": url,
+	}
+	message := generateConnectResponseRejected(csID, transactionID, "Connection redirected to "+url+".", ex)
+	if err := m.chunkHandler.sendMessage(message); err != nil {
+		m.logger.Warn("message manager: error sending connect redirect", zap.Error(err))
+	}
+}
+
+func (m *MessageManager) sendAudio(streamID uint32, audio []byte, timestamp uint32) {
 	var header []byte
 	isExtendedTimestamp := timestamp >= 0xFFFFFF
 	messageLength := len(audio)
@@ -410,7 +815,7 @@ func (m *MessageManager) sendAudio(audio []byte, timestamp uint32) {
 		// Extended timestamp
 		binary.BigEndian.PutUint32(header[8:], timestamp)
 
-		binary.LittleEndian.PutUint32(header[12:], 1)
+		binary.LittleEndian.PutUint32(header[12:], streamID)
 	} else {
 		header = make([]byte, 12)
 
@@ -430,19 +835,27 @@ func (m *MessageManager) sendAudio(audio []byte, timestamp uint32) {
 		// Type ID
 		header[7] = AudioMessage
 
-		binary.LittleEndian.PutUint32(header[8:], 1)
+		binary.LittleEndian.PutUint32(header[8:], streamID)
 	}
 	//fmt.Println("audio timestamp =", timestamp)
 	//fmt.Println("audio header:\n", hex.Dump(header))
 	// The chunk handler will divide these into more chunks if the payload is greater than the chunk size
-	m.chunkHandler.send(header, audio)
+	if err := m.chunkHandler.send(header, audio); err != nil {
+		m.dropFrame()
+	}
 	//if err != nil {
 	//	fmt.Println("error sending audio", err)
 	//}
 	//fmt.Println("bytes written:", n)
 }
 
-func (m *MessageManager) sendVideo(video []byte, timestamp uint32) {
+// dropFrame counts an audio or video frame that wasn't sent.
+func (m *MessageManager) dropFrame() {
+	m.droppedFrames.Add(1)
+	m.chunkHandler.metrics.FrameDropped()
+}
+
+func (m *MessageManager) sendVideo(streamID uint32, video []byte, timestamp uint32) {
 	//video = append([]byte{byte(0x27), 1, 0, 0, 0x50}, video...)
 	var header []byte
 	isExtendedTimestamp := timestamp >= 0xFFFFFF
@@ -470,7 +883,7 @@ func (m *MessageManager) sendVideo(video []byte, timestamp uint32) {
 		// Extended timestamp
 		binary.BigEndian.PutUint32(header[8:], timestamp)
 
-		binary.LittleEndian.PutUint32(header[12:], 1)
+		binary.LittleEndian.PutUint32(header[12:], streamID)
 	} else {
 		header = make([]byte, 12)
 		// fmt = 0 (chunk header - type 0) and chunk stream ID = 5 (video)
@@ -489,11 +902,12 @@ func (m *MessageManager) sendVideo(video []byte, timestamp uint32) {
 		// Type ID
 		header[7] = VideoMessage
 
-		binary.LittleEndian.PutUint32(header[8:], 1)
+		binary.LittleEndian.PutUint32(header[8:], streamID)
 	}
 	err := m.chunkHandler.send(header, video)
 	if err != nil {
-		fmt.Println("message manager received error in send:", err)
+		m.dropFrame()
+		m.logger.Warn("message manager: error sending video", zap.Error(err))
 	}
 	//if err != nil {
 	//	fmt.Println("error sending video", err)
@@ -501,39 +915,54 @@ func (m *MessageManager) sendVideo(video []byte, timestamp uint32) {
 	//fmt.Println("bytes written:", n)
 }
 
-func (m *MessageManager) sendMetadata(metadata map[string]any) {
-	message := generateMetadataMessage(metadata, m.streamID)
+func (m *MessageManager) sendMetadata(streamID uint32, metadata map[string]any) {
+	message := generateMetadataMessage(metadata, streamID)
 	m.chunkHandler.send(message[:12], message[12:])
 }
 
 func (m *MessageManager) sendPlayStart(info map[string]any) {
-	message := generateStatusMessage(4, 1, info)
+	message := generateStatusMessage(4, 1, info, m.objectEncoding())
 	m.chunkHandler.sendBytes(message)
 }
 
-func (m *MessageManager) sendRtmpSampleAccess(audio bool, video bool) {
-	message := generateDataMessageRtmpSampleAccess(audio, video)
+func (m *MessageManager) sendRtmpSampleAccess(streamID uint32, audio bool, video bool) {
+	message := generateDataMessageRtmpSampleAccess(streamID, audio, video)
 	m.chunkHandler.sendBytes(message)
 }
 
-func (m *MessageManager) sendStatusMessage(level string, code string, description string, optionalDetails ...string) {
+// sendStatusMessage sends an onStatus command on the message stream streamID. The properties of extra (eg: the
+// details property, see streamDetails) are added to the info object, except for level, code and description, which
+// are ignored so that they can't override the arguments.
+func (m *MessageManager) sendStatusMessage(streamID uint32, level, code, description string, extra map[string]any) {
 	infoObject := map[string]any{
 		"level":       level,
 		"code":        code,
 		"description": description,
 	}
-	if len(optionalDetails) > 0 && optionalDetails[0] != "" {
-		infoObject["details"] = optionalDetails[0]
+	for key, value := range extra {
+		if _, reserved := infoObject[key]; reserved {
+			continue
+		}
+		infoObject[key] = value
 	}
 
-	message := generateStatusMessage(0, 0, infoObject)
+	message := generateStatusMessage(0, streamID, infoObject, m.objectEncoding())
 	_, err := m.chunkHandler.sendBytes(message)
 	if err != nil {
-		fmt.Println("error sendingi status message:", err)
+		m.logger.Warn("message manager: error sending status message", zap.Error(err))
+	}
+}
+
+// streamDetails returns the extra properties of the status messages about the stream streamKey: its key, in the
+// details property, like other servers send it.
+func streamDetails(streamKey string) map[string]any {
+	if streamKey == "" {
+		return nil
 	}
+	return map[string]any{"details": streamKey}
 }
 
-func generateDataMessageRtmpSampleAccess(audio bool, video bool) []byte {
+func generateDataMessageRtmpSampleAccess(streamID uint32, audio bool, video bool) []byte {
 	message := make([]byte, 12)
 
 	// fmt & csid
@@ -553,43 +982,71 @@ func generateDataMessageRtmpSampleAccess(audio bool, video bool) []byte {
 	message[7] = DataMessageAMF0
 
 	// stream ID
-	binary.LittleEndian.PutUint32(message[8:], 1)
+	binary.LittleEndian.PutUint32(message[8:], streamID)
 
-	rtmpSampleAccess, _ := amf0.Encode("|RtmpSampleAccess")
-	message = append(message, rtmpSampleAccess...)
-	audioTrue, _ := amf0.Encode(audio)
-	message = append(message, audioTrue...)
-	videoTrue, _ := amf0.Encode(video)
-	message = append(message, videoTrue...)
+	body, _ := amf.Encode("|RtmpSampleAccess", audio, video)
+	message = append(message, body...)
 
 	return message
 }
 
 func (m *MessageManager) sendOnFCPublish(csID uint32, transactionID float64, streamKey string) {
-	message := generateOnFCPublishMessage(csID, transactionID, streamKey)
+	message := generateOnFCPublishMessage(csID, transactionID, streamKey, m.objectEncoding())
+	_, err := m.chunkHandler.sendBytes(message)
+	if err != nil {
+		m.logger.Warn("message manager: error sending onFCPublish", zap.Error(err))
+	}
+}
+
+func (m *MessageManager) sendOnFCUnpublish(csID uint32, transactionID float64, streamKey string) {
+	message := generateOnFCUnpublishMessage(csID, transactionID, streamKey, m.objectEncoding())
+	_, err := m.chunkHandler.sendBytes(message)
+	if err != nil {
+		m.logger.Warn("message manager: error sending onFCUnpublish", zap.Error(err))
+	}
+}
+
+func (m *MessageManager) sendOnFCSubscribe(csID uint32, transactionID float64, streamKey string) {
+	message := generateOnFCSubscribeMessage(csID, transactionID, streamKey, m.objectEncoding())
 	_, err := m.chunkHandler.sendBytes(message)
 	if err != nil {
-		fmt.Println("error sending onFCPublish", err)
+		m.logger.Warn("message manager: error sending onFCSubscribe", zap.Error(err))
 	}
 }
 
-func (m *MessageManager) sendCreateStreamResponse(csID uint32, transactionID float64, data map[string]any) {
-	message := generateCreateStreamResponse(csID, transactionID, data)
+func (m *MessageManager) sendGetStreamLengthResponse(csID uint32, transactionID float64, length float64) {
+	message := generateGetStreamLengthResponse(csID, transactionID, length, m.objectEncoding())
+	m.chunkHandler.sendBytes(message)
+}
+
+func (m *MessageManager) sendOnBWDone(csID uint32) {
+	message := generateOnBWDoneMessage(csID, m.objectEncoding())
+	m.chunkHandler.sendBytes(message)
+}
+
+func (m *MessageManager) sendCheckBandwidthResponse(csID uint32, transactionID float64) {
+	message := generateCheckBandwidthResponse(csID, transactionID, m.objectEncoding())
+	m.chunkHandler.sendBytes(message)
+}
+
+func (m *MessageManager) sendCreateStreamResponse(csID uint32, transactionID float64, streamID uint32) {
+	message := generateCreateStreamResponse(csID, transactionID, streamID, m.objectEncoding())
 	m.chunkHandler.sendBytes(message)
 }
 
 func (m *MessageManager) requestConnect(info map[string]any) error {
-	message := generateConnectRequest(3, 1, info)
+	message := generateConnectRequest(3, int(m.newTransaction("connect")), info)
 	err := m.chunkHandler.send(message[:12], message[12:])
 	return err
 }
 
-func (m *MessageManager) requestCreateStream(transactionID int) {
-	message := generateCreateStreamRequest(transactionID)
+func (m *MessageManager) requestCreateStream() {
+	message := generateCreateStreamRequest(int(m.newTransaction("createStream")))
 	m.chunkHandler.send(message[:8], message[8:])
 }
 
-func (m *MessageManager) requestPlay(streamKey string) {
+func (m *MessageManager) requestPlay(streamID uint32, streamKey string) {
+	m.streamID = streamID
 	message := generatePlayRequest(streamKey, m.streamID)
 	m.chunkHandler.send(message[:12], message[12:])
 }
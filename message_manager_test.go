@@ -0,0 +1,259 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/codingpa-ws/rtmp/amf"
+	"github.com/codingpa-ws/rtmp/constants"
+)
+
+// countingWriter counts the writes made on the connection, each of which is a syscall on a socket.
+type countingWriter struct {
+	w      io.Writer
+	writes int
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	c.writes++
+	return c.w.Write(b)
+}
+
+func TestSendStatusMessage(t *testing.T) {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	m := NewMessageManager(nil, nil, NewChunkHandler(nil, w))
+	// The reserved properties of extra don't override the level, code and description
+	extra := map[string]any{"details": "live", "code": "NetStream.Play.Start", "description": "overridden"}
+	m.sendStatusMessage(1, "error", "NetStream.Play.StreamNotFound", "Stream live not found.", extra)
+
+	chunkHandler := NewChunkHandler(bufio.NewReader(&b), nil)
+	// Commands are sent in a single chunk, after the Set Chunk Size message that follows connect
+	chunkHandler.SetChunkSize(constants.DefaultChunkSize)
+	header, _, err := chunkHandler.ReadChunkHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _, err := chunkHandler.ReadChunkData(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamID := header.MessageHeader.MessageStreamID; streamID != 1 {
+		t.Errorf("onStatus sent on the stream %d, want 1", streamID)
+	}
+	var values []any
+	decoder := amf.NewDecoder(bytes.NewReader(payload))
+	for {
+		value, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+	want := []any{"onStatus", 0.0, nil, map[string]any{
+		"level":       "error",
+		"code":        "NetStream.Play.StreamNotFound",
+		"description": "Stream live not found.",
+		"details":     "live",
+	}}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("sent %v, want %v", values, want)
+	}
+}
+
+// TestCreateStreamTransaction answers the commands of a client with an unrelated _result before the one to createStream,
+// and checks that the stream is played on the stream ID of the createStream response.
+func TestCreateStreamTransaction(t *testing.T) {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	session := NewClientSession("app", "rtmp://localhost/app", "live", nil, nil, nil)
+	m := NewMessageManager(session, nil, NewChunkHandler(nil, w))
+	session.messageManager = m
+	if err := m.requestConnect(map[string]any{"app": "app"}); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := [][]any{
+		{"_result", 1.0, nil, map[string]any{"level": "status", "code": NetConnectionSucces}},
+		// Responses to transactions the client didn't start, one of which looks like a createStream response
+		{"_result", 7.0, nil, 9.0},
+		{"_error", 8.0, nil, map[string]any{"level": "error", "code": "NetConnection.Call.Failed"}},
+		{"_result", 2.0, nil, 3.0},
+	}
+	for _, response := range responses {
+		payload, err := amf.Encode(response...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.handleCommandMessage(3, 0, CommandMessageAMF0, payload); err != nil {
+			t.Fatalf("handling %v: %v", response, err)
+		}
+	}
+	if !session.active {
+		t.Fatalf("session ended by the responses to unknown transactions: %v", session.err)
+	}
+	w.Flush()
+
+	chunkHandler := NewChunkHandler(bufio.NewReader(&b), nil)
+	var commands []string
+	for {
+		header, _, err := chunkHandler.ReadChunkHeader()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, _, err := chunkHandler.ReadChunkData(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, err := amf.DecodeOrdered(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commands = append(commands, fmt.Sprintf("%v %v on stream %d", values[0], values[1], header.MessageHeader.MessageStreamID))
+	}
+	want := []string{"connect 1 on stream 0", "createStream 2 on stream 0", "play 0 on stream 3"}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("client sent %q, want %q", commands, want)
+	}
+}
+
+// TestUnacknowledgedBytes checks that the bytes sent, starting with those of the handshake, are unacknowledged until the
+// peer acknowledges them.
+func TestUnacknowledgedBytes(t *testing.T) {
+	// C0, C1 and a C2 that doesn't echo S1, which the lenient handshake accepts
+	c0c1c2 := make([]byte, 1+2*1536)
+	c0c1c2[0] = RtmpVersion3
+	handshaker := NewHandshaker(bufio.NewReader(bytes.NewReader(c0c1c2)), bufio.NewWriter(io.Discard))
+	handshaker.lenient = true
+	chunkHandler := NewChunkHandler(nil, bufio.NewWriter(io.Discard))
+	m := NewMessageManager(nil, handshaker, chunkHandler)
+	if err := m.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	const handshakeLength = 1 + 2*1536
+	if n := chunkHandler.unacknowledgedBytes(); n != handshakeLength {
+		t.Errorf("%d bytes unacknowledged after the handshake, want %d", n, handshakeLength)
+	}
+
+	m.sendStatusMessage(1, "status", "NetStream.Play.Start", "Playing stream", nil)
+	sent := uint32(chunkHandler.totalBytesSent.Load())
+	if n := chunkHandler.unacknowledgedBytes(); n != sent || sent <= handshakeLength {
+		t.Errorf("%d bytes unacknowledged after sending a message, want %d", n, sent)
+	}
+	chunkHandler.onAck(handshakeLength)
+	if n, want := chunkHandler.unacknowledgedBytes(), sent-handshakeLength; n != want {
+		t.Errorf("%d bytes unacknowledged after the handshake is acknowledged, want %d", n, want)
+	}
+	chunkHandler.onAck(sent)
+	if n := chunkHandler.unacknowledgedBytes(); n != 0 {
+		t.Errorf("%d bytes unacknowledged after every byte is acknowledged, want 0", n)
+	}
+}
+
+// TestMalformedControlMessages checks that control and user control messages too short for their type are rejected
+// with ErrMalformedMessage, instead of making their handler read past the payload.
+func TestMalformedControlMessages(t *testing.T) {
+	tests := []struct {
+		name          string
+		messageTypeID uint8
+		payload       []byte
+	}{
+		{"abort", AbortMessage, []byte{0, 0, 3}},
+		{"acknowledgement", Ack, []byte{0, 1}},
+		{"window acknowledgement size", WindowAckSize, nil},
+		{"set peer bandwidth", SetPeerBandwidth, []byte{0, 0x26, 0x25, 0xa0}},
+		{"user control", UserControlMessage, []byte{0}},
+		{"stream begin", UserControlMessage, []byte{0, byte(EventStreamBegin), 0, 0, 1}},
+		{"set buffer length", UserControlMessage, []byte{0, byte(EventSetBufferLength), 0, 0, 0, 1, 0, 0}},
+		{"ping request", UserControlMessage, []byte{0, byte(EventPingRequest)}},
+		{"ping response", UserControlMessage, []byte{0, byte(EventPingResponse), 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMessageManager(nil, nil, NewChunkHandler(nil, bufio.NewWriter(io.Discard)))
+			header := ChunkHeader{
+				BasicHeader:   &ChunkBasicHeader{ChunkStreamID: 2},
+				MessageHeader: &ChunkMessageHeader{MessageTypeID: tt.messageTypeID, MessageLength: uint32(len(tt.payload))},
+			}
+			if err := m.interpretMessage(header, tt.payload); !errors.Is(err, ErrMalformedMessage) {
+				t.Errorf("interpretMessage(%x) = %v, want ErrMalformedMessage", tt.payload, err)
+			}
+		})
+	}
+}
+
+// sendPlayBurst sends what a player is sent when it starts playing a stream: the status messages, the metadata, the
+// sequence headers and a cached GOP of frames.
+func sendPlayBurst(m *MessageManager, frames [][]byte) {
+	m.sendStatusMessage(1, "status", "NetStream.Play.Reset", "Playing and resetting stream", nil)
+	m.sendStatusMessage(1, "status", "NetStream.Play.Start", "Playing stream", nil)
+	m.sendRtmpSampleAccess(1, true, true)
+	m.sendMetadata(1, map[string]any{"width": 1280.0, "height": 720.0, "framerate": 30.0})
+	m.sendVideo(1, []byte{0x17, 0x00, 0, 0, 0, 0x01, 0x64, 0x00, 0x1f}, 0)
+	m.sendAudio(1, []byte{0xaf, 0x00, 0x12, 0x10}, 0)
+	for i, frame := range frames {
+		if frame[0] == 0xaf {
+			m.sendAudio(1, frame, uint32(i*16))
+		} else {
+			m.sendVideo(1, frame, uint32(i*16))
+		}
+	}
+}
+
+// BenchmarkSendMedia measures the writes the burst sent to a new player takes when its messages are flushed one by
+// one, and when they're sent in a batch (see beginBatch).
+func BenchmarkSendMedia(b *testing.B) {
+	// A GOP of 30 video frames (a keyframe, then inter frames) with 2 audio frames each
+	var frames [][]byte
+	for i := 0; i < 30; i++ {
+		video := make([]byte, 1500)
+		video[0] = 0x27
+		if i == 0 {
+			video = make([]byte, 20000)
+			video[0] = 0x17
+		}
+		video[1] = 0x01
+		frames = append(frames, video)
+		for j := 0; j < 2; j++ {
+			audio := make([]byte, 200)
+			audio[0], audio[1] = 0xaf, 0x01
+			frames = append(frames, audio)
+		}
+	}
+
+	for _, bench := range []struct {
+		name    string
+		batched bool
+	}{
+		{"unbatched", false},
+		{"batched", true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			writes := 0
+			for i := 0; i < b.N; i++ {
+				conn := &countingWriter{w: io.Discard}
+				m := NewMessageManager(nil, nil, NewChunkHandler(nil, bufio.NewWriterSize(conn, constants.BuffioSize)))
+				if bench.batched {
+					m.beginBatch()
+				}
+				sendPlayBurst(m, frames)
+				if bench.batched {
+					m.endBatch()
+				}
+				writes += conn.writes
+			}
+			b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+		})
+	}
+}
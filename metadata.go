@@ -0,0 +1,50 @@
+package rtmp
+
+import (
+	"github.com/codingpa-ws/rtmp/amf"
+	"github.com/codingpa-ws/rtmp/audio"
+	"github.com/codingpa-ws/rtmp/video"
+)
+
+// parseClientMetadata reads the onMetaData message of a publisher. The codec IDs are kept as the encoder wrote them (a
+// string or a number), and normalized to the codec they identify.
+func parseClientMetadata(metadata amf.Metadata) clientMetadata {
+	var m clientMetadata
+	m.duration = metadata.GetFloat64Default("duration", 0)
+	m.fileSize = metadata.GetFloat64Default("filesize", 0)
+	m.width = metadata.GetFloat64Default("width", 0)
+	m.height = metadata.GetFloat64Default("height", 0)
+	m.videoDataRate = metadata.GetFloat64Default("videodatarate", 0)
+	m.frameRate = metadata.GetFloat64Default("framerate", 0)
+	m.audioDataRate = metadata.GetFloat64Default("audiodatarate", 0)
+	m.audioSampleRate = metadata.GetFloat64Default("audiosamplerate", 0)
+	m.audioSampleSize = metadata.GetFloat64Default("audiosamplesize", 0)
+	m.audioChannels = metadata.GetFloat64Default("audiochannels", 0)
+	m.encoder, _ = metadata.GetString("encoder")
+
+	videoCodecID := metadata.Get("videocodecid")
+	switch id := videoCodecID.(type) {
+	case string:
+		m.videoCodecID = id
+	case float64:
+		m.nVideoCodecID = id
+	}
+	m.videoCodec, m.hasVideoCodec = video.MetadataCodec(videoCodecID)
+	audioCodecID := metadata.Get("audiocodecid")
+	switch id := audioCodecID.(type) {
+	case string:
+		m.audioCodecID = id
+	case float64:
+		m.nAudioCodecID = id
+	}
+	m.audioFormat, m.hasAudioFormat = audio.MetadataFormat(audioCodecID)
+
+	m.sound.stereoSound, _ = metadata.GetBool("stereo")
+	m.sound.twoPointOneSound, _ = metadata.GetBool("2.1")
+	m.sound.threePointOneSound, _ = metadata.GetBool("3.1")
+	m.sound.fourPointZeroSound, _ = metadata.GetBool("4.0")
+	m.sound.fourPointOneSound, _ = metadata.GetBool("4.1")
+	m.sound.fivePointOneSound, _ = metadata.GetBool("5.1")
+	m.sound.sevenPointOneSound, _ = metadata.GetBool("7.1")
+	return m
+}
@@ -0,0 +1,65 @@
+package rtmp
+
+import (
+	"testing"
+
+	"github.com/codingpa-ws/rtmp/audio"
+	"github.com/codingpa-ws/rtmp/video"
+)
+
+// TestParseClientMetadata checks that the codec IDs of FFmpeg (numbers) and OBS (FourCCs as strings) are normalized to
+// the same codecs, while the raw values are kept as they were sent.
+func TestParseClientMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]any
+		video    video.Codec
+		audio    audio.Format
+	}{
+		{"FFmpeg H264", map[string]any{"videocodecid": 7.0, "audiocodecid": 10.0, "encoder": "Lavf58.76.100"}, video.H264, audio.AAC},
+		{"OBS H264", map[string]any{"videocodecid": "avc1", "audiocodecid": "mp4a", "encoder": "obs-output module (libobs version 30.0.0)"}, video.H264, audio.AAC},
+		// FFmpeg writes the FourCCs of Enhanced RTMP codecs as big endian integers
+		{"FFmpeg HEVC", map[string]any{"videocodecid": float64(0x68766331), "audiocodecid": float64(0x4f707573)}, video.HEVC, audio.Opus},
+		{"OBS HEVC", map[string]any{"videocodecid": "hvc1", "audiocodecid": "Opus"}, video.HEVC, audio.Opus},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := parseClientMetadata(test.metadata)
+			if !m.hasVideoCodec || m.videoCodec != test.video {
+				t.Errorf("video codec = %v, %t, want %v", m.videoCodec, m.hasVideoCodec, test.video)
+			}
+			if !m.hasAudioFormat || m.audioFormat != test.audio {
+				t.Errorf("audio format = %v, %t, want %v", m.audioFormat, m.hasAudioFormat, test.audio)
+			}
+
+			// The raw values are kept in the field of their type
+			switch id := test.metadata["videocodecid"].(type) {
+			case string:
+				if m.videoCodecID != id || m.nVideoCodecID != 0 {
+					t.Errorf("raw video codec ID = %q, %v, want %q", m.videoCodecID, m.nVideoCodecID, id)
+				}
+			case float64:
+				if m.nVideoCodecID != id || m.videoCodecID != "" {
+					t.Errorf("raw video codec ID = %q, %v, want %v", m.videoCodecID, m.nVideoCodecID, id)
+				}
+			}
+			switch id := test.metadata["audiocodecid"].(type) {
+			case string:
+				if m.audioCodecID != id || m.nAudioCodecID != 0 {
+					t.Errorf("raw audio codec ID = %q, %v, want %q", m.audioCodecID, m.nAudioCodecID, id)
+				}
+			case float64:
+				if m.nAudioCodecID != id || m.audioCodecID != "" {
+					t.Errorf("raw audio codec ID = %q, %v, want %v", m.audioCodecID, m.nAudioCodecID, id)
+				}
+			}
+		})
+	}
+
+	// Without codec IDs, or with unknown ones, no codec is declared
+	for _, metadata := range []map[string]any{{}, {"videocodecid": "vp09", "audiocodecid": "fLaC"}} {
+		if m := parseClientMetadata(metadata); m.hasVideoCodec || m.hasAudioFormat {
+			t.Errorf("parseClientMetadata(%v) declared %v (%t) and %v (%t), want no codecs", metadata, m.videoCodec, m.hasVideoCodec, m.audioFormat, m.hasAudioFormat)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package rtmp
+
+// Metrics receives the events of a server that are relevant for monitoring (see the metrics package for a Prometheus
+// adapter). Its methods are called from the goroutines of the sessions, so implementations must be safe for concurrent use.
+type Metrics interface {
+	ConnectionOpened()
+	ConnectionClosed()
+	PublisherStarted()
+	PublisherStopped()
+	SubscriberAdded()
+	SubscriberRemoved()
+	// BytesReceived is called with the number of bytes read from a connection, after each message is read
+	BytesReceived(n int)
+	// BytesSent is called with the number of bytes written to a connection, after each message is sent
+	BytesSent(n int)
+	HandshakeFailed()
+	// ConnectRejected is called when a connect command is rejected because it's invalid (eg: unknown or missing app)
+	ConnectRejected()
+	// AuthFailed is called when the SessionGuard of the broadcaster doesn't allow a session to connect, publish or play
+	AuthFailed()
+	// FrameDropped is called when an audio or video frame couldn't be sent to a subscriber
+	FrameDropped()
+}
+
+// NopMetrics is the Metrics implementation used when a server has no Metrics. It discards every event.
+type NopMetrics struct{}
+
+func (NopMetrics) ConnectionOpened()   {}
+func (NopMetrics) ConnectionClosed()   {}
+func (NopMetrics) PublisherStarted()   {}
+func (NopMetrics) PublisherStopped()   {}
+func (NopMetrics) SubscriberAdded()    {}
+func (NopMetrics) SubscriberRemoved()  {}
+func (NopMetrics) BytesReceived(n int) {}
+func (NopMetrics) BytesSent(n int)     {}
+func (NopMetrics) HandshakeFailed()    {}
+func (NopMetrics) ConnectRejected()    {}
+func (NopMetrics) AuthFailed()         {}
+func (NopMetrics) FrameDropped()       {}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Prometheus keeps the metrics of an RTMP server (it implements rtmp.Metrics) and serves them over HTTP in the
+// Prometheus text exposition format, without depending on the Prometheus client library:
+//
+//	m := &metrics.Prometheus{}
+//	server := &rtmp.Server{Metrics: m, ...}
+//	http.Handle("/metrics", m)
+type Prometheus struct {
+	activeConnections atomic.Int64
+	activePublishers  atomic.Int64
+	activeSubscribers atomic.Int64
+	bytesReceived     atomic.Uint64
+	bytesSent         atomic.Uint64
+	handshakeFailures atomic.Uint64
+	connectRejections atomic.Uint64
+	authFailures      atomic.Uint64
+	droppedFrames     atomic.Uint64
+}
+
+func (p *Prometheus) ConnectionOpened()   { p.activeConnections.Add(1) }
+func (p *Prometheus) ConnectionClosed()   { p.activeConnections.Add(-1) }
+func (p *Prometheus) PublisherStarted()   { p.activePublishers.Add(1) }
+func (p *Prometheus) PublisherStopped()   { p.activePublishers.Add(-1) }
+func (p *Prometheus) SubscriberAdded()    { p.activeSubscribers.Add(1) }
+func (p *Prometheus) SubscriberRemoved()  { p.activeSubscribers.Add(-1) }
+func (p *Prometheus) BytesReceived(n int) { p.bytesReceived.Add(uint64(n)) }
+func (p *Prometheus) BytesSent(n int)     { p.bytesSent.Add(uint64(n)) }
+func (p *Prometheus) HandshakeFailed()    { p.handshakeFailures.Add(1) }
+func (p *Prometheus) ConnectRejected()    { p.connectRejections.Add(1) }
+func (p *Prometheus) AuthFailed()         { p.authFailures.Add(1) }
+func (p *Prometheus) FrameDropped()       { p.droppedFrames.Add(1) }
+
+// ServeHTTP writes the current value of every metric in the Prometheus text exposition format.
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "rtmp_active_connections", "gauge", "Number of active connections.", p.activeConnections.Load())
+	writeMetric(w, "rtmp_active_publishers", "gauge", "Number of active publishers.", p.activePublishers.Load())
+	writeMetric(w, "rtmp_active_subscribers", "gauge", "Number of active subscribers.", p.activeSubscribers.Load())
+	writeMetric(w, "rtmp_received_bytes_total", "counter", "Total number of bytes received.", p.bytesReceived.Load())
+	writeMetric(w, "rtmp_sent_bytes_total", "counter", "Total number of bytes sent.", p.bytesSent.Load())
+	writeMetric(w, "rtmp_handshake_failures_total", "counter", "Total number of failed handshakes.", p.handshakeFailures.Load())
+	writeMetric(w, "rtmp_connect_rejections_total", "counter", "Total number of rejected connect commands.", p.connectRejections.Load())
+	writeMetric(w, "rtmp_auth_failures_total", "counter", "Total number of sessions the session guard didn't allow to connect, publish or play.", p.authFailures.Load())
+	writeMetric(w, "rtmp_dropped_frames_total", "counter", "Total number of audio/video frames that couldn't be sent to a subscriber.", p.droppedFrames.Load())
+}
+
+func writeMetric[T int64 | uint64](w http.ResponseWriter, name string, metricType string, help string, value T) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, metricType, name, value)
+}
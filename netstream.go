@@ -0,0 +1,230 @@
+package rtmp
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codingpa-ws/rtmp/audio"
+	"github.com/codingpa-ws/rtmp/constants"
+	"github.com/codingpa-ws/rtmp/video"
+)
+
+// netStream is a logical stream (a NetStream) of a session, created by the client with createStream and identified by
+// the message stream ID of the messages sent on it. Clients that multiplex can publish or play a different stream on
+// each of their net streams.
+type netStream struct {
+	session *Session
+	// Message stream ID
+	id         uint32
+	streamKey  string
+	publishing bool
+	playing    bool
+	// Recording of the media published on the net stream, if it's published with the record or append publishing type
+	recorder *recorder
+	// Set while the recording waits for the metadata of the stream to be named (see Server.RecordNameMetadata). It's
+	// started by the metadata or the first frame, whichever comes first, appending to its file if appendRecording is set.
+	pendingRecording bool
+	appendRecording  bool
+	// Length of the buffer of the player (a time.Duration), set with SetBufferLength
+	bufferLength atomic.Int64
+
+	// The timestamps of the media sent to the player are rebased on the first frame it's sent (see rebase), so that a
+	// player that joins a stream mid-way doesn't see a gap between the sequence headers (sent at 0) and the frames.
+	timestampMutex sync.Mutex
+	rebased        bool
+	timestampBase  uint32
+	// Rebased timestamps of the first frame, and of the last message sent
+	firstTimestamp uint32
+	lastTimestamp  uint32
+	// Set when a video frame was dropped because the window of the player was exceeded (see throttleVideo)
+	waitKeyframe atomic.Bool
+
+	// While the player starts playing (see holdMedia), the media it's sent is held until it was sent Play.Start and the
+	// sequence headers of the stream
+	holdMutex sync.Mutex
+	holding   bool
+	held      []heldMessage
+}
+
+// heldMessage is a message held while a player starts playing, see holdMedia.
+type heldMessage struct {
+	typeID    uint8
+	payload   []byte
+	metadata  map[string]any
+	timestamp uint32
+}
+
+// SendAudio, SendVideo, SendMetadata and SendEndOfStream implement Subscriber, so that a player receives the media of
+// a stream on the message stream ID it played it on.
+func (s *netStream) SendAudio(payload []byte, timestamp uint32) {
+	if s.hold(heldMessage{typeID: AudioMessage, payload: payload, timestamp: timestamp}) {
+		return
+	}
+	s.sendAudio(payload, timestamp)
+}
+
+func (s *netStream) sendAudio(payload []byte, timestamp uint32) {
+	sequenceHeader := audio.ParseHeader(payload).IsSequenceHeader()
+	if !sequenceHeader && s.session.messageManager.chunkHandler.windowExceeded() {
+		s.session.messageManager.dropFrame()
+		return
+	}
+	s.session.traffic.addAudio(len(payload))
+	timestamp = s.rebase(timestamp, sequenceHeader)
+	s.session.messageManager.sendAudio(s.id, payload, timestamp)
+}
+
+func (s *netStream) SendVideo(payload []byte, timestamp uint32) {
+	if s.hold(heldMessage{typeID: VideoMessage, payload: payload, timestamp: timestamp}) {
+		return
+	}
+	s.sendVideo(payload, timestamp)
+}
+
+func (s *netStream) sendVideo(payload []byte, timestamp uint32) {
+	header := video.ParseHeader(payload)
+	if s.throttleVideo(header) {
+		s.session.messageManager.dropFrame()
+		return
+	}
+	s.session.traffic.addVideo(len(payload))
+	timestamp = s.rebase(timestamp, header.IsSequenceHeader())
+	s.session.messageManager.sendVideo(s.id, payload, timestamp)
+}
+
+// throttleVideo returns true if a video frame mustn't be sent, because the player hasn't acknowledged enough of what it
+// was sent (see Server.AckFlowControl). Once a frame is dropped, the frames that follow are dropped until the next
+// keyframe, since they depend on it. Sequence headers are always sent.
+func (s *netStream) throttleVideo(header video.Header) bool {
+	if header.IsSequenceHeader() {
+		return false
+	}
+	if s.session.messageManager.chunkHandler.windowExceeded() {
+		s.waitKeyframe.Store(true)
+		return true
+	}
+	if s.waitKeyframe.Load() {
+		if header.FrameType != video.KeyFrame {
+			return true
+		}
+		s.waitKeyframe.Store(false)
+	}
+	return false
+}
+
+// rebase returns the timestamp of a message sent to the player, relative to the first frame it was sent since it
+// started playing. Sequence headers don't start the timeline, since they're sent at 0 before the first frame (when the
+// stream starts playing, or when the player seeks). Messages older than the first frame (eg: audio muxed late by the
+// publisher) are sent at the timestamp of the first frame.
+func (s *netStream) rebase(timestamp uint32, sequenceHeader bool) uint32 {
+	s.timestampMutex.Lock()
+	defer s.timestampMutex.Unlock()
+	if !s.rebased {
+		if sequenceHeader {
+			return s.lastTimestamp
+		}
+		// The timeline carries on from the last message sent, if the player played another stream before (eg: play2)
+		s.timestampBase = timestamp - s.lastTimestamp
+		s.firstTimestamp = s.lastTimestamp
+		s.rebased = true
+	}
+	rebased := timestamp - s.timestampBase
+	// Timestamps are compared with serial number arithmetic, since they wrap around after 2^32 milliseconds
+	if int32(rebased-s.firstTimestamp) < 0 {
+		return s.firstTimestamp
+	}
+	s.lastTimestamp = rebased
+	return rebased
+}
+
+// restartTimestamps makes the next frame sent start the timeline of the player again (see rebase), when it starts
+// playing a stream.
+func (s *netStream) restartTimestamps() {
+	s.timestampMutex.Lock()
+	defer s.timestampMutex.Unlock()
+	s.rebased = false
+}
+
+func (s *netStream) SendMetadata(metadata map[string]any) {
+	if s.hold(heldMessage{typeID: DataMessageAMF0, metadata: metadata}) {
+		return
+	}
+	s.session.messageManager.sendMetadata(s.id, metadata)
+}
+
+// holdMedia holds the media sent to the net stream (eg: the GOP cache it's primed with when it's registered, or the
+// frames broadcast meanwhile) until releaseMedia is called, so that a player that starts playing is sent Play.Start and
+// the sequence headers first, even though it's registered as a subscriber before.
+func (s *netStream) holdMedia() {
+	s.holdMutex.Lock()
+	defer s.holdMutex.Unlock()
+	s.holding = true
+}
+
+// hold holds message if the net stream is holding media, and returns false otherwise. The payload is copied, since it
+// is only guaranteed to be left untouched for the duration of the call (see Subscriber).
+func (s *netStream) hold(message heldMessage) bool {
+	s.holdMutex.Lock()
+	defer s.holdMutex.Unlock()
+	if !s.holding {
+		return false
+	}
+	message.payload = append([]byte(nil), message.payload...)
+	s.held = append(s.held, message)
+	return true
+}
+
+// releaseMedia sends the media held since holdMedia in order (unless send is false, if the player didn't start
+// playing), and stops holding media.
+func (s *netStream) releaseMedia(send bool) {
+	for {
+		s.holdMutex.Lock()
+		held := s.held
+		s.held = nil
+		if len(held) == 0 || !send {
+			s.holding = false
+			s.holdMutex.Unlock()
+			return
+		}
+		s.holdMutex.Unlock()
+		// The media sent meanwhile is held too, and sent on the next iteration
+		for _, message := range held {
+			switch message.typeID {
+			case AudioMessage:
+				s.sendAudio(message.payload, message.timestamp)
+			case VideoMessage:
+				s.sendVideo(message.payload, message.timestamp)
+			default:
+				s.session.messageManager.sendMetadata(s.id, message.metadata)
+			}
+		}
+	}
+}
+
+func (s *netStream) SendEndOfStream() {
+	s.session.messageManager.beginBatch()
+	defer s.session.messageManager.endBatch()
+	s.session.messageManager.sendStatusMessage(s.id, "status", "NetStream.Play.Stop", "Stopped playing stream.", nil)
+	s.session.messageManager.sendStreamEOF(s.id)
+}
+
+// BufferLength implements BufferedSubscriber.
+func (s *netStream) BufferLength() time.Duration {
+	return time.Duration(s.bufferLength.Load())
+}
+
+// SendStreamDry implements StreamDrySubscriber.
+func (s *netStream) SendStreamDry() {
+	s.session.messageManager.sendStreamDry(s.id)
+}
+
+// GetID returns the ID of the session. For net streams other than the first one, the stream ID is appended, since a
+// session can play the same stream more than once.
+func (s *netStream) GetID() string {
+	if s.id == uint32(constants.DefaultStreamID) {
+		return s.session.id
+	}
+	return fmt.Sprintf("%s/%d", s.session.id, s.id)
+}
@@ -0,0 +1,149 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/codingpa-ws/rtmp/audio"
+	"github.com/codingpa-ws/rtmp/flv"
+	"github.com/codingpa-ws/rtmp/video"
+)
+
+// PlayFile publishes the FLV file at path to streamKey, as if it was published live: its tags are broadcast when their
+// timestamps are due, and its sequence headers and metadata are cached for new subscribers. If loop is true, the file
+// is played again from the beginning every time it ends. Its players are told that the stream is recorded.
+// PlayFile blocks until the file ends (never if loop is true, unless it can't be read), or the stream is unpublished
+// (eg: with DestroyPublisher), so it's usually run in its own goroutine.
+func (b *broadcaster) PlayFile(streamKey string, path string, loop bool) error {
+	if b.context.StreamExists(streamKey) {
+		return fmt.Errorf("%w: %s", ErrStreamAlreadyPublished, streamKey)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := b.registerPublisher(streamKey, true); err != nil {
+		return err
+	}
+	unpublished := false
+	defer func() {
+		// If the stream was unpublished from outside, the key may already be published by someone else
+		if !unpublished {
+			b.BroadcastEndOfStream(streamKey)
+			b.DestroyPublisher(streamKey)
+		}
+	}()
+
+	clock := b.clock
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	mediaPacer := &pacer{clock: clock}
+	// Every play of the file after the first one starts one frame interval after the previous one ended, so that
+	// timestamps keep increasing across loops
+	var offset uint32
+	for {
+		reader, err := flv.NewReader(file)
+		if err != nil {
+			return err
+		}
+		loopTimeline := fileTimeline{offset: offset}
+		for {
+			tag, err := reader.ReadTag()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			timestamp := loopTimeline.timestamp(tag.Timestamp)
+			mediaPacer.wait(timestamp)
+			if !b.context.StreamExists(streamKey) {
+				unpublished = true
+				return nil
+			}
+			b.publishTag(streamKey, tag, timestamp)
+		}
+		if !loop {
+			return nil
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		offset = loopTimeline.end()
+	}
+}
+
+// fileTimeline maps the timestamps of a play of a file to the timestamps of the stream it's published to.
+type fileTimeline struct {
+	// Stream timestamp of the first tag of the file
+	offset uint32
+	// File timestamps of the first and last tags, and the last interval between two tags
+	first, last, interval uint32
+	started               bool
+}
+
+func (t *fileTimeline) timestamp(fileTimestamp uint32) uint32 {
+	if !t.started {
+		t.first, t.last = fileTimestamp, fileTimestamp
+		t.started = true
+	}
+	// Files don't always start at 0, and timestamps that go backwards (eg: a broken muxer) are clamped
+	if fileTimestamp < t.last {
+		fileTimestamp = t.last
+	}
+	if fileTimestamp > t.last {
+		t.interval = fileTimestamp - t.last
+	}
+	t.last = fileTimestamp
+	return t.offset + fileTimestamp - t.first
+}
+
+// end returns the stream timestamp the next play of the file starts at: one interval after its last tag.
+func (t *fileTimeline) end() uint32 {
+	return t.offset + t.last - t.first + t.interval
+}
+
+// publishTag broadcasts an FLV tag to the subscribers of streamKey, caching it if it's a sequence header or metadata.
+func (b *broadcaster) publishTag(streamKey string, tag *flv.Tag, timestamp uint32) {
+	switch tag.Type {
+	case flv.TagAudio:
+		if len(tag.Data) < 2 {
+			return
+		}
+		if audio.ParseHeader(tag.Data).IsSequenceHeader() {
+			b.SetAacSequenceHeaderForPublisher(streamKey, tag.Data)
+		}
+		b.BroadcastAudio(streamKey, tag.Data, timestamp)
+	case flv.TagVideo:
+		if len(tag.Data) < 2 {
+			return
+		}
+		if video.ParseHeader(tag.Data).IsSequenceHeader() {
+			b.SetAvcSequenceHeaderForPublisher(streamKey, tag.Data)
+		}
+		b.BroadcastVideo(streamKey, tag.Data, timestamp)
+	case flv.TagScriptData:
+		if metadata := decodeOnMetaData(tag.Data); metadata != nil {
+			b.SetMetadataForPublisher(streamKey, metadata)
+			b.BroadcastMetadata(streamKey, metadata)
+		}
+	}
+}
+
+// decodeOnMetaData returns the metadata of an onMetaData script data tag, or nil if data is another script data tag.
+func decodeOnMetaData(data []byte) map[string]any {
+	d := newPayloadDecoder(data)
+	name, err := decodeNextString(d, "script data name")
+	if err != nil || name != "onMetaData" {
+		return nil
+	}
+	metadata, err := decodeNextObject(d, "metadata")
+	if err != nil {
+		return nil
+	}
+	return metadata
+}
@@ -0,0 +1,153 @@
+package rtmp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/codingpa-ws/rtmp/flv"
+)
+
+// writeFLV writes tags to a new FLV file, returning its path.
+func writeFLV(t *testing.T, tags ...*flv.Tag) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file.flv")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w, err := flv.NewWriter(file, flv.Header{HasVideo: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range tags {
+		if err := w.WriteTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// timedSink records when it receives each frame.
+type timedSink struct {
+	testSink
+	times []time.Time
+}
+
+func (s *timedSink) SendVideo(video []byte, timestamp uint32) {
+	s.testSink.SendVideo(video, timestamp)
+	s.times = append(s.times, time.Now())
+}
+
+func TestPlayFile(t *testing.T) {
+	path := writeFLV(t,
+		&flv.Tag{Type: flv.TagVideo, Timestamp: 0, Data: []byte{0x17, 0x00, 0, 0, 0}},
+		&flv.Tag{Type: flv.TagVideo, Timestamp: 0, Data: []byte{0x17, 0x01, 0, 0, 0}},
+		&flv.Tag{Type: flv.TagVideo, Timestamp: 100, Data: []byte{0x27, 0x01, 0, 0, 1}},
+		&flv.Tag{Type: flv.TagVideo, Timestamp: 200, Data: []byte{0x27, 0x01, 0, 0, 2}},
+		&flv.Tag{Type: flv.TagVideo, Timestamp: 300, Data: []byte{0x27, 0x01, 0, 0, 3}},
+	)
+	b := NewBroadcaster("app", NewInMemoryContext()).(*broadcaster)
+	played := make(chan error, 1)
+	start := time.Now()
+	go func() { played <- b.PlayFile("live", path, false) }()
+
+	// The player subscribes once the file is published, before its frame at 100ms is due (it may miss the frames at 0)
+	for !b.StreamExists("live") {
+		time.Sleep(time.Millisecond)
+	}
+	sink := &timedSink{testSink: testSink{id: "player"}}
+	if err := b.RegisterSubscriber("live", sink); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-played; err != nil {
+		t.Fatalf("PlayFile() = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("played a file of 300ms in %s", elapsed)
+	}
+	if b.StreamExists("live") {
+		t.Error("the stream is still published after the file ended")
+	}
+
+	want := []string{"video 2701000001@100", "video 2701000002@200", "video 2701000003@300", "end"}
+	if len(sink.received) < len(want) || !reflect.DeepEqual(sink.received[len(sink.received)-len(want):], want) {
+		t.Fatalf("subscriber received %q, want it to end with %q", sink.received, want)
+	}
+	// The frames aren't released before their timestamps are due (the pacer catches up with frames released late, so
+	// they're compared with the first one rather than with the previous one)
+	times := sink.times[len(sink.times)-3:]
+	for i := 1; i < len(times); i++ {
+		if elapsed := times[i].Sub(times[0]); elapsed < time.Duration(100*i-10)*time.Millisecond {
+			t.Errorf("frame at %dms released %s after the frame at 100ms", 100*(i+1), elapsed)
+		}
+	}
+}
+
+// sleepHookClock is a fakeClock that calls onSleep every time it's slept on, after moving forward.
+type sleepHookClock struct {
+	fakeClock
+	onSleep func()
+}
+
+func (c *sleepHookClock) Sleep(d time.Duration) {
+	c.fakeClock.Sleep(d)
+	c.onSleep()
+}
+
+// clockSink records the simulated time at which it receives each frame.
+type clockSink struct {
+	testSink
+	clock *sleepHookClock
+	start time.Time
+}
+
+func (s *clockSink) SendVideo(video []byte, timestamp uint32) {
+	s.testSink.SendVideo(video, timestamp)
+	s.received = append(s.received, fmt.Sprintf("released at %dms", s.clock.now.Sub(s.start).Milliseconds()))
+}
+
+// TestPlayFilePacing loops a file with a fake clock, and checks that each frame is released when its timestamp is due,
+// with the timestamps of every loop following those of the previous one.
+func TestPlayFilePacing(t *testing.T) {
+	// The file doesn't start at 0, and its frames are 40ms apart
+	path := writeFLV(t,
+		&flv.Tag{Type: flv.TagVideo, Timestamp: 1000, Data: []byte{0x17, 0x01, 0, 0, 0}},
+		&flv.Tag{Type: flv.TagVideo, Timestamp: 1040, Data: []byte{0x27, 0x01, 0, 0, 1}},
+		&flv.Tag{Type: flv.TagVideo, Timestamp: 1080, Data: []byte{0x27, 0x01, 0, 0, 2}},
+	)
+	b := NewBroadcaster("app", NewInMemoryContext()).(*broadcaster)
+	clock := &sleepHookClock{fakeClock: fakeClock{now: time.Unix(1000, 0)}}
+	b.SetClock(clock)
+	sink := &clockSink{testSink: testSink{id: "player"}, clock: clock, start: clock.now}
+	clock.onSleep = func() {
+		// The player subscribes while the first frame is played, and the file is unpublished in its third loop
+		if len(sink.received) == 0 {
+			if err := b.RegisterSubscriber("live", sink); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if clock.now.Sub(sink.start) >= 280*time.Millisecond {
+			b.DestroyPublisher("live")
+		}
+	}
+	if err := b.PlayFile("live", path, true); err != nil {
+		t.Fatalf("PlayFile() = %v", err)
+	}
+
+	want := []string{
+		"video 2701000001@40", "released at 40ms",
+		"video 2701000002@80", "released at 80ms",
+		"video 1701000000@120", "released at 120ms",
+		"video 2701000001@160", "released at 160ms",
+		"video 2701000002@200", "released at 200ms",
+		"video 1701000000@240", "released at 240ms",
+	}
+	if !reflect.DeepEqual(sink.received, want) {
+		t.Errorf("subscriber received %q, want %q", sink.received, want)
+	}
+}
@@ -0,0 +1,145 @@
+package rtmp
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// tokenBucket allows events at rate per second on average, and up to burst events at once.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from the bucket if it has one, after refilling it for the time since it was last used.
+func (b *tokenBucket) allow(now time.Time, rate float64, burst int) bool {
+	b.refill(now, rate, burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) refill(now time.Time, rate float64, burst int) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * rate
+	}
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+}
+
+// connRateLimiter limits the rate of new connections, globally and by remote IP (see Server.ConnectionRate).
+type connRateLimiter struct {
+	mutex     sync.Mutex
+	clock     Clock
+	rate      float64
+	burst     int
+	rateByIP  float64
+	burstByIP int
+	global    tokenBucket
+	byIP      map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// sweepInterval is how often the buckets of the IPs that haven't connected for long enough to refill them are
+// forgotten, so that the limiter doesn't keep one for every address that ever connected.
+const sweepInterval = time.Minute
+
+func newConnRateLimiter(clock Clock, rate float64, burst int, rateByIP float64, burstByIP int) *connRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	if burstByIP < 1 {
+		burstByIP = 1
+	}
+	now := clock.Now()
+	return &connRateLimiter{
+		clock:     clock,
+		rate:      rate,
+		burst:     burst,
+		rateByIP:  rateByIP,
+		burstByIP: burstByIP,
+		global:    tokenBucket{tokens: float64(burst), last: now},
+		byIP:      make(map[string]*tokenBucket),
+		lastSweep: now,
+	}
+}
+
+// allow returns false if a new connection from addr exceeds the global rate or the rate of its IP.
+func (l *connRateLimiter) allow(addr net.Addr) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.clock.Now()
+
+	var bucket *tokenBucket
+	if l.rateByIP > 0 {
+		if ip := addrIP(addr); ip != nil {
+			l.sweep(now)
+			bucket = l.byIP[string(ip.To16())]
+			if bucket == nil {
+				bucket = &tokenBucket{tokens: float64(l.burstByIP), last: now}
+				l.byIP[string(ip.To16())] = bucket
+			}
+			if !bucket.allow(now, l.rateByIP, l.burstByIP) {
+				return false
+			}
+		}
+	}
+	if l.rate > 0 && !l.global.allow(now, l.rate, l.burst) {
+		// The connection is refused anyway, so it doesn't count against the rate of its IP
+		if bucket != nil {
+			bucket.tokens++
+		}
+		return false
+	}
+	return true
+}
+
+func (l *connRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for ip, bucket := range l.byIP {
+		if bucket.refill(now, l.rateByIP, l.burstByIP); bucket.tokens >= float64(l.burstByIP) {
+			delete(l.byIP, ip)
+		}
+	}
+}
+
+// maxDelayedCloses is the maximum number of connections refused by the rate limits that wait to be closed at a time
+// (see Server.RateLimitDelay).
+const maxDelayedCloses = 1024
+
+// rateLimitWarnInterval is the minimum time between two warnings about connections refused by the rate limits, so that
+// a reconnect storm doesn't flood the logs as well.
+const rateLimitWarnInterval = time.Second
+
+// rejectRateLimited closes a connection refused by the rate limits, after RateLimitDelay if it's set and there aren't
+// maxDelayedCloses connections waiting to be closed already. Refused connections are logged at most once every
+// rateLimitWarnInterval, with the number of connections refused since the last warning.
+func (s *Server) rejectRateLimited(conn net.Conn) {
+	s.rateLimitRejected++
+	if now := s.rateLimiter.clock.Now(); now.Sub(s.rateLimitWarned) >= rateLimitWarnInterval {
+		s.Logger.Warn("[server] Rejected incoming connection, connection rate limit exceeded",
+			zap.String("remote_addr", conn.RemoteAddr().String()), zap.Int("rejected", s.rateLimitRejected))
+		s.rateLimitRejected = 0
+		s.rateLimitWarned = now
+	}
+
+	if s.RateLimitDelay <= 0 || s.delayedCloses.Load() >= maxDelayedCloses {
+		conn.Close()
+		return
+	}
+	s.delayedCloses.Add(1)
+	time.AfterFunc(s.RateLimitDelay, func() {
+		conn.Close()
+		s.delayedCloses.Add(-1)
+	})
+}
@@ -0,0 +1,110 @@
+package rtmp
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fakeClock is a Clock that only moves forward when it's told to (or when it's slept on).
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time        { return c.now }
+func (c *fakeClock) Sleep(d time.Duration) { c.now = c.now.Add(d) }
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1935}
+}
+
+func TestConnRateLimiter(t *testing.T) {
+	type connection struct {
+		after time.Duration
+		ip    string
+		want  bool
+	}
+	tests := []struct {
+		name        string
+		rate        float64
+		burst       int
+		rateByIP    float64
+		burstByIP   int
+		connections []connection
+	}{
+		{"global burst", 1, 2, 0, 0, []connection{
+			{0, "10.0.0.1", true}, {0, "10.0.0.2", true}, {0, "10.0.0.3", false},
+			{time.Second, "10.0.0.3", true}, {0, "10.0.0.3", false},
+		}},
+		{"by IP", 0, 0, 1, 1, []connection{
+			{0, "10.0.0.1", true}, {0, "10.0.0.1", false}, {0, "10.0.0.2", true},
+			{500 * time.Millisecond, "10.0.0.1", false}, {500 * time.Millisecond, "10.0.0.1", true},
+		}},
+		// A connection refused by the global rate doesn't count against the rate of its IP
+		{"global and by IP", 1, 1, 1, 1, []connection{
+			{0, "10.0.0.1", true}, {0, "10.0.0.2", false}, {time.Second, "10.0.0.2", true},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(1000, 0)}
+			l := newConnRateLimiter(clock, test.rate, test.burst, test.rateByIP, test.burstByIP)
+			for i, c := range test.connections {
+				clock.Sleep(c.after)
+				if got := l.allow(tcpAddr(c.ip)); got != c.want {
+					t.Errorf("connection %d from %s: allow() = %v, want %v", i, c.ip, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+// closeRecorder is a connection that records whether it was closed.
+type closeRecorder struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func (c *closeRecorder) RemoteAddr() net.Addr {
+	return tcpAddr("10.0.0.1")
+}
+
+func TestRejectRateLimited(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	s := &Server{Logger: zap.New(core), RateLimitDelay: time.Hour, rateLimiter: newConnRateLimiter(clock, 1, 1, 0, 0)}
+
+	conns := make([]*closeRecorder, maxDelayedCloses+5)
+	for i := range conns {
+		conns[i] = &closeRecorder{}
+		s.rejectRateLimited(conns[i])
+	}
+	for i, conn := range conns {
+		// The connections beyond maxDelayedCloses are closed right away
+		if want := i >= maxDelayedCloses; conn.closed.Load() != want {
+			t.Fatalf("connection %d closed = %v, want %v", i, conn.closed.Load(), want)
+		}
+	}
+	if n := s.delayedCloses.Load(); n != maxDelayedCloses {
+		t.Errorf("%d connections wait to be closed, want %d", n, maxDelayedCloses)
+	}
+
+	clock.Sleep(rateLimitWarnInterval)
+	s.rejectRateLimited(&closeRecorder{})
+	warnings := logs.All()
+	if len(warnings) != 2 {
+		t.Fatalf("logged %d warnings, want 2", len(warnings))
+	}
+	if rejected := warnings[1].ContextMap()["rejected"]; rejected != int64(len(conns)) {
+		t.Errorf("second warning reports %v connections rejected, want %d", rejected, len(conns))
+	}
+}
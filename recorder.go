@@ -0,0 +1,200 @@
+package rtmp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/codingpa-ws/rtmp/amf"
+	"github.com/codingpa-ws/rtmp/amf/amf0"
+	"github.com/codingpa-ws/rtmp/flv"
+)
+
+var ErrAlreadyRecording error = errors.New("recorder: the file is already being recorded")
+
+// Publishing types of the publish command
+const (
+	PublishingTypeLive   = "live"
+	PublishingTypeRecord = "record"
+	PublishingTypeAppend = "append"
+)
+
+// recordingPaths holds the paths of the recordings in progress. Stream keys that only differ by their query share a
+// recording path (see recordingPath), so they must not be recorded at the same time.
+var recordingPaths = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// recorder records the media published on a net stream to an FLV file (see Server.RecordDir).
+type recorder struct {
+	path   string
+	file   *os.File
+	buffer *bufio.Writer
+	writer *flv.Writer
+	// Tags are written relative to the first message recorded, starting at offset (after the last tag of the file, if
+	// the recording is appended to it)
+	offset, first, last uint32
+	started             bool
+}
+
+// recordingPath returns the path of the recording of streamKey in dir. The stream key (without its query) is escaped,
+// so that it can't name a file outside of dir.
+func recordingPath(dir string, streamKey string) string {
+	streamKey, _, _ = strings.Cut(streamKey, "?")
+	return filepath.Join(dir, url.PathEscape(streamKey)+".flv")
+}
+
+// metadataRecordingPath returns the path of the recording named name in dir (eg: a name set by the publisher in the
+// metadata of its stream, see Server.RecordNameMetadata), and false if name is empty. Like stream keys, the name is
+// escaped, so that it can't name a file outside of dir.
+func metadataRecordingPath(dir string, name string) (string, bool) {
+	name = strings.TrimSuffix(name, ".flv")
+	if name == "" {
+		return "", false
+	}
+	path := filepath.Join(dir, url.PathEscape(name)+".flv")
+	if filepath.Dir(path) != filepath.Clean(dir) {
+		return "", false
+	}
+	return path, true
+}
+
+// newRecorder creates the recording at path, overwriting the file if it exists. If appendTo is true, the recording is
+// appended to the file instead (it's created if it doesn't exist), and its timestamps carry on after the last tag of
+// the file. It returns ErrAlreadyRecording if another recording of path is in progress.
+func newRecorder(path string, appendTo bool) (*recorder, error) {
+	if !lockRecordingPath(path) {
+		return nil, ErrAlreadyRecording
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendTo {
+		flags = os.O_RDWR | os.O_CREATE
+	}
+	file, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		unlockRecordingPath(path)
+		return nil, err
+	}
+	r := &recorder{path: path, file: file, buffer: bufio.NewWriter(file)}
+	if appendTo {
+		err = r.seekEnd()
+	} else {
+		r.writer, err = flv.NewWriter(r.buffer, flv.Header{Version: 1, HasAudio: true, HasVideo: true})
+	}
+	if err != nil {
+		file.Close()
+		unlockRecordingPath(path)
+		return nil, err
+	}
+	return r, nil
+}
+
+// lockRecordingPath marks path as being recorded. It returns false if it already is.
+func lockRecordingPath(path string) bool {
+	path = filepath.Clean(path)
+	recordingPaths.Lock()
+	defer recordingPaths.Unlock()
+	if recordingPaths.paths[path] {
+		return false
+	}
+	recordingPaths.paths[path] = true
+	return true
+}
+
+// unlockRecordingPath marks path as no longer being recorded.
+func unlockRecordingPath(path string) {
+	recordingPaths.Lock()
+	defer recordingPaths.Unlock()
+	delete(recordingPaths.paths, filepath.Clean(path))
+}
+
+// seekEnd positions the recorder after the last complete tag of its file, to append to it. A tag truncated at the end
+// of the file (eg: by a crash of the previous recording) is overwritten. Empty files are written from the start.
+func (r *recorder) seekEnd() error {
+	info, err := r.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		r.writer, err = flv.NewWriter(r.buffer, flv.Header{Version: 1, HasAudio: true, HasVideo: true})
+		return err
+	}
+	reader, err := flv.NewReader(r.file)
+	if err != nil {
+		return err
+	}
+	end, err := r.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	tags := 0
+	for {
+		tag, err := reader.ReadTag()
+		if errors.Is(err, io.EOF) || errors.Is(err, flv.ErrTruncatedTag) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if end, err = r.file.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+		r.last = tag.Timestamp
+		tags++
+	}
+	if err := r.file.Truncate(end); err != nil {
+		return err
+	}
+	if _, err := r.file.Seek(end, io.SeekStart); err != nil {
+		return err
+	}
+	if tags > 0 {
+		r.offset = r.last + 1
+	}
+	r.writer = flv.NewAppendWriter(r.buffer)
+	return nil
+}
+
+// write records an audio or video message.
+func (r *recorder) write(tagType flv.TagType, data []byte, timestamp uint32) error {
+	if !r.started {
+		r.first = timestamp
+		r.started = true
+	}
+	// Messages older than the first one recorded (eg: audio muxed late by the publisher) are recorded at its time
+	elapsed := timestamp - r.first
+	if int32(elapsed) < 0 {
+		elapsed = 0
+	}
+	r.last = r.offset + elapsed
+	return r.writer.WriteTag(&flv.Tag{Type: tagType, Timestamp: r.last, Data: data})
+}
+
+// writeMetadata records the metadata of the stream, as an onMetaData tag at the time of the last message recorded.
+func (r *recorder) writeMetadata(metadata map[string]any) error {
+	data, err := amf.Encode("onMetaData", amf0.ECMAArray(metadata))
+	if err != nil {
+		return err
+	}
+	timestamp := r.offset
+	if r.started {
+		timestamp = r.last
+	}
+	return r.writer.WriteTag(&flv.Tag{Type: flv.TagScriptData, Timestamp: timestamp, Data: data})
+}
+
+// close writes what's left of the recording to its file, and closes it. Its path can then be recorded again.
+func (r *recorder) close() error {
+	defer unlockRecordingPath(r.path)
+	err := r.buffer.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,167 @@
+package rtmp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/codingpa-ws/rtmp/amf"
+	"github.com/codingpa-ws/rtmp/amf/amf0"
+	"github.com/codingpa-ws/rtmp/flv"
+)
+
+// TestRecorderPathInProgress checks that streams sharing a recording path (their stream keys only differ by their
+// query) aren't recorded at the same time, and that the path can be recorded again once the recording is closed.
+func TestRecorderPathInProgress(t *testing.T) {
+	dir := t.TempDir()
+	path := recordingPath(dir, "live?token=a")
+	if other := recordingPath(dir, "live?token=b"); other != path {
+		t.Fatalf("recording paths %s and %s, want the same path", path, other)
+	}
+	r, err := newRecorder(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, appendTo := range []bool{false, true} {
+		if _, err := newRecorder(path, appendTo); !errors.Is(err, ErrAlreadyRecording) {
+			t.Errorf("newRecorder(appendTo: %t) while recording = %v, want ErrAlreadyRecording", appendTo, err)
+		}
+	}
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err = newRecorder(path, true)
+	if err != nil {
+		t.Fatalf("newRecorder() after the recording is closed = %v", err)
+	}
+	r.close()
+}
+
+// readRecording returns the header and tags of the recording at path.
+func readRecording(t *testing.T, path string) (flv.Header, []*flv.Tag) {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := flv.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags []*flv.Tag
+	for {
+		tag, err := reader.ReadTag()
+		if err == io.EOF {
+			return reader.Header, tags
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, tag)
+	}
+}
+
+// TestRecorderTags records the audio, video and metadata messages of a stream, and checks that each one is recorded
+// as a tag of its type with its payload unchanged, at its time since the first message recorded.
+func TestRecorderTags(t *testing.T) {
+	metadata, _ := amf.Encode("onMetaData", amf0.ECMAArray{"audiocodecid": 10.0, "videocodecid": 7.0})
+	want := []*flv.Tag{
+		// AVC sequence header and keyframe
+		{Type: flv.TagVideo, Timestamp: 0, Data: []byte{0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x64, 0x00, 0x1f}},
+		{Type: flv.TagVideo, Timestamp: 0, Data: []byte{0x17, 0x01, 0x00, 0x00, 0x00, 0x65, 0x88}},
+		// AAC sequence header and raw frame
+		{Type: flv.TagAudio, Timestamp: 0, Data: []byte{0xaf, 0x00, 0x12, 0x10}},
+		{Type: flv.TagAudio, Timestamp: 23, Data: []byte{0xaf, 0x01, 0x21, 0x1a}},
+		// MP3 frame
+		{Type: flv.TagAudio, Timestamp: 46, Data: []byte{0x2f, 0xff, 0xfb}},
+		{Type: flv.TagScriptData, Timestamp: 46, Data: metadata},
+		// AVC inter frame, after the 24 bits of the tag timestamp wrap (into its extended byte)
+		{Type: flv.TagVideo, Timestamp: 0x1000010, Data: []byte{0x27, 0x01, 0x00, 0x00, 0x00, 0x41, 0x9a}},
+	}
+
+	path := filepath.Join(t.TempDir(), "live.flv")
+	r, err := newRecorder(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const first = 5000
+	for _, tag := range want {
+		if tag.Type == flv.TagScriptData {
+			err = r.writeMetadata(map[string]any{"audiocodecid": 10.0, "videocodecid": 7.0})
+		} else {
+			err = r.write(tag.Type, tag.Data, first+tag.Timestamp)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header, got := readRecording(t, path)
+	if header != (flv.Header{Version: 1, HasAudio: true, HasVideo: true}) {
+		t.Errorf("header = %+v, want version 1 with audio and video", header)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("recorded %d tags, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("tag %d = %d at %d with %x, want %d at %d with %x", i, got[i].Type, got[i].Timestamp, got[i].Data,
+				want[i].Type, want[i].Timestamp, want[i].Data)
+		}
+	}
+}
+
+// TestMetadataRecordingPath checks that the names publishers give their recordings can't name a file outside of the
+// recording directory.
+func TestMetadataRecordingPath(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"show", "show.flv", "..", "../show", "/etc/show", `..\show`, "a/../../show", "show?x=1"} {
+		path, ok := metadataRecordingPath(dir, name)
+		if !ok {
+			t.Errorf("metadataRecordingPath(%q) = false, want a path", name)
+			continue
+		}
+		if filepath.Dir(path) != dir || filepath.Ext(path) != ".flv" {
+			t.Errorf("metadataRecordingPath(%q) = %s, want an FLV file in %s", name, path, dir)
+		}
+	}
+	for _, name := range []string{"", ".flv"} {
+		if path, ok := metadataRecordingPath(dir, name); ok {
+			t.Errorf("metadataRecordingPath(%q) = %s, want false", name, path)
+		}
+	}
+}
+
+func TestRecorderMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "live.flv")
+	r, err := newRecorder(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.write(flv.TagVideo, []byte{0x17, 0x01}, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.writeMetadata(map[string]any{"width": 1280.0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, tags := readRecording(t, path)
+	if len(tags) != 2 {
+		t.Fatalf("recorded %d tags, want 2", len(tags))
+	}
+	tag := tags[1]
+	want, _ := amf.Encode("onMetaData", amf0.ECMAArray{"width": 1280.0})
+	if tag.Type != flv.TagScriptData || tag.Timestamp != 0 || !reflect.DeepEqual(tag.Data, want) {
+		t.Errorf("recorded %d tag at %d with %x, want an onMetaData script data tag at 0 with %x", tag.Type, tag.Timestamp, tag.Data, want)
+	}
+}
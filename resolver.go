@@ -0,0 +1,14 @@
+package rtmp
+
+// StreamResolver is consulted by the broadcaster to decide whether a stream that isn't published locally exists,
+// eg: by looking it up in a cluster-wide registry when using edge servers or external origins.
+type StreamResolver interface {
+	StreamExists(streamKey string) bool
+}
+
+// ResolverBroadcaster can optionally be implemented by a Broadcaster that consults a StreamResolver for the streams
+// that aren't published locally. The broadcasters created with NewBroadcaster implement it.
+type ResolverBroadcaster interface {
+	SetStreamResolver(StreamResolver)
+	GetStreamResolver() StreamResolver
+}
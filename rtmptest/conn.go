@@ -0,0 +1,408 @@
+// Package rtmptest provides a minimal, scriptable RTMP client to test RTMP servers end to end.
+// Unlike rtmp.Client, it exposes the low-level operations of the protocol (sending raw commands and media, reading
+// every message sent by the server), so tests can assert on exactly what goes over the wire.
+package rtmptest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/codingpa-ws/rtmp"
+	"github.com/codingpa-ws/rtmp/amf"
+	"github.com/codingpa-ws/rtmp/amf/amf0"
+	"github.com/codingpa-ws/rtmp/constants"
+)
+
+// Chunk stream IDs used by Conn
+const (
+	CommandChannel uint32 = 3
+	AudioChannel   uint32 = uint32(rtmp.AudioChannel)
+	VideoChannel   uint32 = uint32(rtmp.VideoChannel)
+	DataChannel    uint32 = 5
+)
+
+// Message is a complete RTMP message (assembled from its chunks) received from the server.
+type Message struct {
+	ChunkStreamID uint32
+	TypeID        uint8
+	StreamID      uint32
+	Timestamp     uint32
+	Payload       []byte
+}
+
+// Command is a decoded AMF0 command message.
+type Command struct {
+	Name          string
+	TransactionID float64
+	// Command object, nil if the command object is null
+	Object map[string]any
+	// Values that follow the command object
+	Args    []any
+	Message *Message
+}
+
+// Conn is a connection to an RTMP server that already performed the handshake.
+type Conn struct {
+	conn          net.Conn
+	writer        *bufio.Writer
+	chunkHandler  *rtmp.ChunkHandler
+	outChunkSize  uint32
+	transactionID float64
+
+	// Stream ID returned by the last call to CreateStream
+	StreamID uint32
+}
+
+// Dial connects to the RTMP server at addr (host:port) and performs the handshake.
+func Dial(addr string) (*Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewConn performs the handshake over an already established connection (eg: one end of a pipe created with NewPipe).
+func NewConn(conn net.Conn) (*Conn, error) {
+	reader := bufio.NewReaderSize(conn, constants.BuffioSize)
+	writer := bufio.NewWriterSize(conn, constants.BuffioSize)
+	if err := rtmp.NewHandshaker(reader, writer).ClientHandshake(); err != nil {
+		return nil, err
+	}
+	return &Conn{
+		conn:         conn,
+		writer:       writer,
+		chunkHandler: rtmp.NewChunkHandler(reader, writer),
+		outChunkSize: rtmp.DefaultMaximumChunkSize,
+	}, nil
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// SetDeadline sets the read and write deadline of the underlying connection, so a test doesn't block forever
+// waiting for a message that never arrives.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetChunkSize tells the server that the following messages are sent with the given chunk size.
+func (c *Conn) SetChunkSize(size uint32) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, size)
+	if err := c.WriteMessage(uint32(rtmp.ProtocolChannel), rtmp.SetChunkSize, 0, 0, payload); err != nil {
+		return err
+	}
+	c.outChunkSize = size
+	return nil
+}
+
+// WriteMessage sends a message with a type 0 chunk header, split in as many chunks as the current chunk size requires.
+func (c *Conn) WriteMessage(csID uint32, typeID uint8, streamID uint32, timestamp uint32, payload []byte) error {
+	header := encodeBasicHeader(rtmp.ChunkType0, csID)
+	basicHeaderLength := len(header)
+	header = append(header, make([]byte, 11)...)
+	messageHeader := header[basicHeaderLength:]
+	if timestamp >= 0xFFFFFF {
+		putUint24(messageHeader[:3], 0xFFFFFF)
+	} else {
+		putUint24(messageHeader[:3], timestamp)
+	}
+	putUint24(messageHeader[3:6], uint32(len(payload)))
+	messageHeader[6] = typeID
+	binary.LittleEndian.PutUint32(messageHeader[7:], streamID)
+	if timestamp >= 0xFFFFFF {
+		header = binary.BigEndian.AppendUint32(header, timestamp)
+	}
+
+	if _, err := c.writer.Write(header); err != nil {
+		return err
+	}
+	continuationHeader := encodeBasicHeader(rtmp.ChunkType3, csID)
+	for offset := 0; offset < len(payload); offset += int(c.outChunkSize) {
+		if offset > 0 {
+			if _, err := c.writer.Write(continuationHeader); err != nil {
+				return err
+			}
+		}
+		end := offset + int(c.outChunkSize)
+		if end > len(payload) {
+			end = len(payload)
+		}
+		if _, err := c.writer.Write(payload[offset:end]); err != nil {
+			return err
+		}
+	}
+	return c.writer.Flush()
+}
+
+// SendCommand sends an AMF0 command message. The command object and the rest of the arguments are passed in args.
+func (c *Conn) SendCommand(streamID uint32, name string, transactionID float64, args ...any) error {
+	payload, err := encodeValues(append([]any{name, transactionID}, args...)...)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(CommandChannel, rtmp.CommandMessageAMF0, streamID, 0, payload)
+}
+
+// SendAudio sends an audio message (FLV audio tag data, headers included) on the stream returned by CreateStream.
+func (c *Conn) SendAudio(payload []byte, timestamp uint32) error {
+	return c.WriteMessage(AudioChannel, rtmp.AudioMessage, c.StreamID, timestamp, payload)
+}
+
+// SendVideo sends a video message (FLV video tag data, headers included) on the stream returned by CreateStream.
+func (c *Conn) SendVideo(payload []byte, timestamp uint32) error {
+	return c.WriteMessage(VideoChannel, rtmp.VideoMessage, c.StreamID, timestamp, payload)
+}
+
+// SendMetadata sends a @setDataFrame data message with the given metadata on the stream returned by CreateStream.
+func (c *Conn) SendMetadata(metadata map[string]any) error {
+	payload, err := encodeValues("@setDataFrame", "onMetaData", amf0.ECMAArray(metadata))
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(DataChannel, rtmp.DataMessageAMF0, c.StreamID, 0, payload)
+}
+
+// ReadMessage reads the next message sent by the server. Set Chunk Size messages are applied before being returned.
+func (c *Conn) ReadMessage() (*Message, error) {
+	header, _, err := c.chunkHandler.ReadChunkHeader()
+	if err != nil {
+		return nil, err
+	}
+	payload, _, err := c.chunkHandler.ReadChunkData(header)
+	if err != nil {
+		return nil, err
+	}
+	message := &Message{
+		ChunkStreamID: header.BasicHeader.ChunkStreamID,
+		TypeID:        header.MessageHeader.MessageTypeID,
+		StreamID:      header.MessageHeader.MessageStreamID,
+		Timestamp:     header.ElapsedTime,
+		Payload:       payload,
+	}
+	if message.TypeID == rtmp.SetChunkSize && len(payload) >= 4 {
+		c.chunkHandler.SetChunkSize(binary.BigEndian.Uint32(payload) & 0x7FFFFFFF)
+	}
+	return message, nil
+}
+
+// ReadCommand reads messages until an AMF0 or AMF3 command message arrives, and returns it decoded. Other messages are
+// skipped.
+func (c *Conn) ReadCommand() (*Command, error) {
+	for {
+		message, err := c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if message.TypeID != rtmp.CommandMessageAMF0 && message.TypeID != rtmp.CommandMessageAMF3 {
+			continue
+		}
+		return DecodeCommand(message)
+	}
+}
+
+// ExpectCommand reads messages until a command with the given name arrives. Other messages and commands are skipped.
+func (c *Conn) ExpectCommand(name string) (*Command, error) {
+	for {
+		command, err := c.ReadCommand()
+		if err != nil {
+			return nil, err
+		}
+		if command.Name == name {
+			return command, nil
+		}
+	}
+}
+
+// ExpectStatus reads messages until an onStatus command arrives, and returns its info object.
+// It returns an error if the status code of the onStatus command isn't code.
+func (c *Conn) ExpectStatus(code string) (map[string]any, error) {
+	command, err := c.ExpectCommand("onStatus")
+	if err != nil {
+		return nil, err
+	}
+	info := command.Info()
+	if info["code"] != code {
+		return info, fmt.Errorf("rtmptest: expected status %s, got %v", code, info["code"])
+	}
+	return info, nil
+}
+
+// Connect sends a connect command for the given app and waits for the server to accept it.
+func (c *Conn) Connect(app string) error {
+	return c.ConnectWith(map[string]any{
+		"app":      app,
+		"flashVer": "LNX 9,0,124,2",
+		"tcUrl":    "rtmp://" + c.conn.RemoteAddr().String() + "/" + app,
+	})
+}
+
+// ConnectWith sends a connect command with the given command object and waits for the server to accept it.
+func (c *Conn) ConnectWith(commandObject map[string]any) error {
+	if err := c.SendCommand(0, "connect", c.nextTransactionID(), commandObject); err != nil {
+		return err
+	}
+	command, err := c.ExpectResult()
+	if err != nil {
+		return err
+	}
+	if code := command.Info()["code"]; code != rtmp.NetConnectionSucces {
+		return fmt.Errorf("rtmptest: connect failed with code %v", code)
+	}
+	return nil
+}
+
+// ExpectResult reads messages until a _result or _error command arrives. It returns an error (and the command) if
+// the command is _error.
+func (c *Conn) ExpectResult() (*Command, error) {
+	for {
+		command, err := c.ReadCommand()
+		if err != nil {
+			return nil, err
+		}
+		switch command.Name {
+		case "_result":
+			return command, nil
+		case "_error":
+			return command, fmt.Errorf("rtmptest: received _error: %v", command.Info())
+		}
+	}
+}
+
+// CreateStream sends a createStream command and returns the ID of the stream created by the server, which is
+// used by the following calls to Publish, Play, SendAudio, SendVideo and SendMetadata.
+func (c *Conn) CreateStream() (uint32, error) {
+	if err := c.SendCommand(0, "createStream", c.nextTransactionID(), nil); err != nil {
+		return 0, err
+	}
+	command, err := c.ExpectResult()
+	if err != nil {
+		return 0, err
+	}
+	if len(command.Args) == 0 {
+		return 0, errors.New("rtmptest: createStream result has no stream ID")
+	}
+	streamID, ok := command.Args[0].(float64)
+	if !ok {
+		return 0, fmt.Errorf("rtmptest: createStream result has an invalid stream ID %v", command.Args[0])
+	}
+	c.StreamID = uint32(streamID)
+	return c.StreamID, nil
+}
+
+// Publish sends a live publish command for streamKey and waits for NetStream.Publish.Start.
+func (c *Conn) Publish(streamKey string) error {
+	if err := c.SendCommand(c.StreamID, "publish", 0, nil, streamKey, "live"); err != nil {
+		return err
+	}
+	_, err := c.ExpectStatus("NetStream.Publish.Start")
+	return err
+}
+
+// Play sends a play command for streamKey and waits for NetStream.Play.Start.
+func (c *Conn) Play(streamKey string) error {
+	if err := c.SendCommand(c.StreamID, "play", 0, nil, streamKey, float64(-2000)); err != nil {
+		return err
+	}
+	_, err := c.ExpectStatus("NetStream.Play.Start")
+	return err
+}
+
+func (c *Conn) nextTransactionID() float64 {
+	c.transactionID++
+	return c.transactionID
+}
+
+// Info returns the info object of a _result, _error or onStatus command (the first object in its arguments), or nil.
+func (command *Command) Info() map[string]any {
+	for _, arg := range command.Args {
+		switch info := arg.(type) {
+		case map[string]any:
+			return info
+		case amf0.ECMAArray:
+			return info
+		}
+	}
+	return nil
+}
+
+// DecodeCommand decodes the payload of an AMF0 command message, or of an AMF3 command message (whose values follow a
+// format byte).
+func DecodeCommand(message *Message) (*Command, error) {
+	payload := message.Payload
+	if message.TypeID == rtmp.CommandMessageAMF3 && len(payload) > 0 && payload[0] == 0 {
+		payload = payload[1:]
+	}
+	values, err := DecodeValues(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) < 2 {
+		return nil, errors.New("rtmptest: command message has no transaction ID")
+	}
+	command := &Command{Message: message}
+	var ok bool
+	if command.Name, ok = values[0].(string); !ok {
+		return nil, fmt.Errorf("rtmptest: invalid command name %v", values[0])
+	}
+	if command.TransactionID, ok = values[1].(float64); !ok {
+		return nil, fmt.Errorf("rtmptest: invalid transaction ID %v", values[1])
+	}
+	if len(values) > 2 {
+		switch object := values[2].(type) {
+		case map[string]any:
+			command.Object = object
+		case amf0.ECMAArray:
+			command.Object = object
+		}
+		command.Args = values[3:]
+	}
+	return command, nil
+}
+
+// DecodeValues decodes all the AMF0 values in payload.
+func DecodeValues(payload []byte) ([]any, error) {
+	var values []any
+	for len(payload) > 0 {
+		value, size, err := amf0.DecodeNext(payload)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, value)
+		payload = payload[size:]
+	}
+	return values, nil
+}
+
+func encodeValues(values ...any) ([]byte, error) {
+	return amf.Encode(values...)
+}
+
+// encodeBasicHeader encodes a chunk basic header, using the 1, 2 or 3 bytes form depending on the chunk stream ID
+func encodeBasicHeader(fmt uint8, csID uint32) []byte {
+	switch {
+	case csID < 64:
+		return []byte{fmt<<6 | byte(csID)}
+	case csID < 64+256:
+		return []byte{fmt << 6, byte(csID - 64)}
+	default:
+		return []byte{fmt<<6 | 1, byte((csID - 64) & 0xFF), byte((csID - 64) >> 8)}
+	}
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
@@ -0,0 +1,177 @@
+package rtmptest
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/codingpa-ws/rtmp"
+)
+
+// NewPipe returns the two ends of an in-memory, full duplex connection. Unlike net.Pipe, writes never block: what's
+// written is buffered until the other end reads it, like on a socket (with an unlimited buffer). Otherwise, a server
+// would block sending a message the test doesn't read (eg: a user control message), while the test blocks sending the
+// next one. Both ends support deadlines.
+func NewPipe() (net.Conn, net.Conn) {
+	a, b := newPipeBuffer(), newPipeBuffer()
+	return &pipeConn{in: a, out: b}, &pipeConn{in: b, out: a}
+}
+
+// Pipe connects to server over an in-memory pipe instead of a socket (see NewPipe), and performs the handshake. The
+// server end of the pipe is served with Server.ServeConn, so the server doesn't need to listen.
+func Pipe(server *rtmp.Server) (*Conn, error) {
+	conn, _ := PipeDialer(server)(context.Background(), "pipe", "")
+	c, err := NewConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// PipeDialer returns a dial function for rtmp.Client.DialContext that connects to server over an in-memory pipe
+// (see Pipe), whatever the address dialed. It allows testing a server and a client end to end without opening sockets.
+func PipeDialer(server *rtmp.Server) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		clientConn, serverConn := NewPipe()
+		go server.ServeConn(serverConn)
+		return clientConn, nil
+	}
+}
+
+// pipeBuffer holds the bytes written to one end of a pipe until the other end reads them.
+type pipeBuffer struct {
+	mutex sync.Mutex
+	data  []byte
+	// Set when the writing end is closed (reads return io.EOF once data is drained), and when the reading end is closed
+	writeClosed, readClosed bool
+	readDeadline            time.Time
+	// Closed (and replaced) every time the state of the buffer changes, to wake up a pending read
+	changed chan struct{}
+}
+
+func newPipeBuffer() *pipeBuffer {
+	return &pipeBuffer{changed: make(chan struct{})}
+}
+
+// update changes the state of the buffer, and wakes up the pending read (if any).
+func (p *pipeBuffer) update(change func()) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	change()
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *pipeBuffer) read(b []byte) (int, error) {
+	for {
+		p.mutex.Lock()
+		switch {
+		case p.readClosed:
+			p.mutex.Unlock()
+			return 0, net.ErrClosed
+		case len(p.data) > 0:
+			n := copy(b, p.data)
+			p.data = p.data[n:]
+			p.mutex.Unlock()
+			return n, nil
+		case p.writeClosed:
+			p.mutex.Unlock()
+			return 0, io.EOF
+		case !p.readDeadline.IsZero() && !time.Now().Before(p.readDeadline):
+			p.mutex.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		changed, deadline := p.changed, p.readDeadline
+		p.mutex.Unlock()
+
+		if deadline.IsZero() {
+			<-changed
+			continue
+		}
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (p *pipeBuffer) write(b []byte) (int, error) {
+	p.mutex.Lock()
+	closed := p.writeClosed || p.readClosed
+	p.mutex.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	p.update(func() { p.data = append(p.data, b...) })
+	return len(b), nil
+}
+
+// pipeConn is an end of a pipe created with NewPipe.
+type pipeConn struct {
+	in, out       *pipeBuffer
+	mutex         sync.Mutex
+	writeDeadline time.Time
+	closed        bool
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	return c.in.read(b)
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	closed, deadline := c.closed, c.writeDeadline
+	c.mutex.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+	// Writes never block, so the deadline only matters if it has already passed
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.out.write(b)
+}
+
+func (c *pipeConn) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.mutex.Unlock()
+	c.in.update(func() { c.in.readClosed = true })
+	c.out.update(func() { c.out.writeClosed = true })
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return pipeAddr{} }
+func (c *pipeConn) RemoteAddr() net.Addr { return pipeAddr{} }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.in.update(func() { c.in.readDeadline = t })
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
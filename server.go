@@ -2,9 +2,13 @@ package rtmp
 
 import (
 	"bufio"
-	"fmt"
+	"context"
+	"crypto/tls"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/codingpa-ws/rtmp/constants"
 	"github.com/pkg/errors"
@@ -17,9 +21,160 @@ type Server struct {
 	Addr        string
 	Logger      *zap.Logger
 	Broadcaster Broadcaster
+	// Broadcasters of the apps hosted by the server besides the app of Broadcaster, by app name (eg: "live" and "vod"),
+	// like the applications of nginx-rtmp. Clients are routed by the app of their connect command, so that each app has
+	// its own streams and session guard. Clients connecting to an app that isn't hosted by the server are rejected.
+	Apps map[string]Broadcaster
+	// If true, the chunk handler forgets the previous header of a chunk stream when a client reuses it for a different
+	// message stream, instead of only flagging it: the type 1, 2 and 3 headers that start the messages that follow on
+	// the chunk stream don't inherit the fields of the message that switched it.
+	ResetReusedChunkStreams bool
+	// Version sent in the S1 handshake message (eg: constants.FlashMediaServerHandshakeVersion). If not set, zero is
+	// sent, since clients (eg: FFmpeg) expect the S1 of a server that sends a version to carry the HMAC digest of the
+	// FP9 handshake, which the server doesn't send, and fail to play.
+	HandshakeVersion [4]byte
+	// Clients whose C2 handshake message doesn't echo the time and random data of S1 are rejected with
+	// ErrWrongC2Message. If LenientHandshake is true, the mismatch is tolerated instead, for the sake of
+	// interoperability with broken clients.
+	LenientHandshake bool
+	// If set, the server accepts RTMPS (RTMP over TLS) connections instead of plain RTMP connections.
+	TLSConfig *tls.Config
+	// If greater than 0, publishers that don't send an AVC/AAC sequence header within this time after they start
+	// publishing are disconnected, since players wouldn't be able to decode their stream.
+	SequenceHeaderTimeout time.Duration
+	// If greater than 0, publishers that don't send any audio/video message for this long are disconnected, and their
+	// subscribers receive NetStream.Play.Stop.
+	PublisherIdleTimeout time.Duration
+	// If greater than 0, the subscribers of a stream receive a StreamDry user control message when its publisher doesn't
+	// send any audio/video message for this long, which tells players that no data is flowing although the stream
+	// hasn't ended (if the broadcaster implements StreamDryBroadcaster). It should be shorter than PublisherIdleTimeout.
+	StreamDryTimeout time.Duration
+	// Size of the read buffer of each connection. If not set, constants.BuffioSize is used.
+	ReadBufferSize int
+	// If greater than ReadBufferSize, the read buffer of a connection grows up to this size when the client sets a
+	// chunk size that doesn't fit in it (eg: high-bitrate 4K ingests with large chunks).
+	MaxReadBufferSize int
+	// Size of the write buffer of each connection. If not set, constants.BuffioSize is used. Messages larger than the
+	// buffer are written in several writes to the connection.
+	WriteBufferSize int
+	// If greater than 0, sessions that receive a message longer than this many bytes end with ErrMessageTooLarge. Since
+	// peers can interleave the chunks of messages of different chunk streams, a session can hold up to 8 messages
+	// being received at once (more end the session with ErrTooManyPartialMessages).
+	MaxMessageSize uint32
+	// If greater than 0, sessions that take longer than this to receive all the chunks of a message (measured from its
+	// first chunk) end with ErrMessageAssemblyTimeout, so that a peer trickling a message can't tie up a connection.
+	MessageAssemblyTimeout time.Duration
+	// If true, messages that can't be handled (eg: malformed commands or metadata) are logged and skipped, instead of
+	// ending the session of the client that sent them. Errors reading the chunks of a message still end the session.
+	SkipMalformedMessages bool
+	// Source of time of the server sessions (eg: for MessageAssemblyTimeout). If not set, SystemClock is used.
+	Clock Clock
+	// If true, players that advertise the codecs they support in their connect command (audioCodecs/videoCodecs) receive
+	// NetStream.Play.Failed when they play a stream encoded with another codec, instead of frames they can't decode.
+	// Codecs that don't have a flag in the RTMP spec (eg: HEVC) are never considered supported.
+	CheckPlayerCodecs bool
+	// If true, seek and play2 requests of clients that advertise support for seeking (see SupportVidClientSeek) are
+	// honored: seeking jumps to the live edge of the stream, and play2 switches the stream played on a net stream.
+	// Otherwise, they fail.
+	LiveSeek bool
+	// If true, the audio, video and data messages received from publishers are handled (eg: broadcast to players and
+	// recorded) on a goroutine of their own instead of the goroutine reading the connection, so that slow subscribers
+	// don't delay reading the connection and acknowledging it. Messages are still handled in the order they were
+	// received, and commands are handled after the media received before them. If false, everything is handled while
+	// reading the connection.
+	AsyncMediaDispatch bool
+	// If true, the server sends onBWDone after the connect sequence, and answers the checkBandwidth command, for clients
+	// that stall at connect until their bandwidth check completes. It's off by default, since other clients log
+	// onBWDone as an unknown command. The bandwidth isn't actually measured.
+	BandwidthCheck bool
+	// If true, media isn't sent to players that haven't acknowledged more bytes than their window allows: the window
+	// they set with Set Peer Bandwidth, or twice the acknowledgement window the server sent them if they didn't set one.
+	// This keeps slow players from piling up data in the connection. Their audio and video frames are dropped until they
+	// acknowledge, and video resumes at the next keyframe. Players that don't send acknowledgements at all stop
+	// receiving media after their first window, so this is off by default.
+	AckFlowControl bool
+	// Acknowledgement window sent to clients when they connect: they acknowledge every WindowAckSize bytes they receive,
+	// which bounds the media sent to them ahead of their acknowledgements with AckFlowControl. It's also the output
+	// bandwidth of the clients (see Set Peer Bandwidth). If not set, constants.DefaultClientWindowSize is used.
+	WindowAckSize uint32
+	// fmsVer and capabilities sent in the response to the connect command, to mimic the identity of another server for
+	// clients that expect a specific one. If not set, constants.FlashMediaServerVersion and constants.Capabilities are
+	// used.
+	ServerVersion      string
+	ServerCapabilities int
+	// If true, the connect response confirms AMF0 (objectEncoding 0) even to clients that ask for AMF3, for clients
+	// that mishandle AMF3. Commands the clients send in AMF3 are still understood.
+	DisableAMF3 bool
+	// Directory where the streams published with the record or append publishing type are recorded, in an FLV file
+	// named after their stream key (eg: mystream.flv, see RecordNameMetadata): record overwrites the file, and append
+	// adds to it. If empty, they're published live, without being recorded. The query of the stream key isn't part of the name of the file,
+	// so a stream published while another stream records the same file is published without being recorded.
+	RecordDir string
+	// Name of a metadata property (eg: "recordName") with which publishers name the recording of their stream in
+	// RecordDir instead of their stream key, in the metadata they send before their first frame. The name is escaped
+	// like stream keys are, so that it can't name a file outside of RecordDir, and the .flv extension is added if it's
+	// missing. Streams whose metadata doesn't have the property (or that send a frame first) are named after their
+	// stream key. If empty, recordings are always named after their stream key.
+	RecordNameMetadata string
+	// If true, the time between the publish command and the first keyframe, and the keyframe interval of every
+	// publisher are logged. Keyframe intervals longer than LongKeyframeInterval (if set) are logged as warnings.
+	// Keyframe stats are also available in ServerStats regardless of this setting.
+	KeyframeDiagnostics  bool
+	LongKeyframeInterval time.Duration
+	// If greater than 0, connections accepted while this many connections are active are closed immediately.
+	MaxConnections int
+	// If greater than 0, connections accepted faster than ConnectionRate per second on average (with bursts of up to
+	// ConnectionBurst connections) are closed before their handshake, to resist reconnect storms. ConnectionRatePerIP and
+	// ConnectionBurstPerIP limit the connections of each remote IP the same way. Bursts default to a single connection.
+	ConnectionRate       float64
+	ConnectionBurst      int
+	ConnectionRatePerIP  float64
+	ConnectionBurstPerIP int
+	// If greater than 0, connections refused by the rate limits are closed after this delay instead of immediately,
+	// which slows down clients that reconnect as soon as their connection is closed. Up to 1024 refused connections
+	// wait to be closed at a time: beyond, they're closed immediately, so that a reconnect storm can't exhaust the file
+	// descriptors of the server.
+	RateLimitDelay time.Duration
+	// If set, ConnFilter is called with the remote address of every accepted connection before starting its session.
+	// Connections for which it returns false are closed immediately. See NewCIDRFilter for allow/deny lists.
+	ConnFilter func(addr net.Addr) bool
+	// Receives connection, stream and traffic events (eg: metrics.Prometheus). If not set, events are discarded.
+	Metrics Metrics
+	// If StatsInterval is greater than 0 and OnStats is set, OnStats is called with a snapshot of the server's stats
+	// (see Server.Stats) every StatsInterval, eg: to push them to a dashboard.
+	StatsInterval time.Duration
+	OnStats       func(stats ServerStats)
+
+	mutex        sync.Mutex
+	listener     net.Listener
+	shuttingDown atomic.Bool
+	// Active sessions, by session ID
+	sessions   sync.Map
+	sessionsWG sync.WaitGroup
+	// Number of active connections
+	connections atomic.Int64
+	// Semaphore enforcing MaxConnections, nil if there's no limit. It's created by the first connection served (by
+	// Serve or ServeConn), see slots.
+	connectionSlots     chan struct{}
+	connectionSlotsOnce sync.Once
+	// Enforces ConnectionRate and ConnectionRatePerIP, nil if there's no limit
+	rateLimiter *connRateLimiter
+	// Connections refused by the rate limits that wait to be closed (see RateLimitDelay)
+	delayedCloses atomic.Int64
+	// Connections refused by the rate limits since the last warning logged, and the time it was logged (see
+	// rejectRateLimited). Only used by the accept loop.
+	rateLimitRejected int
+	rateLimitWarned   time.Time
+	// Closed when the server shuts down
+	done chan struct{}
 }
 
+var ErrServerClosed error = errors.New("rtmp: server closed")
+var ErrTooManyConnections error = errors.New("rtmp: maximum number of connections reached")
+
 // Listen starts the server and listens for any incoming connections. If no Addr (host:port) has been assigned to the server, ":1935" is used.
+// If a TLSConfig has been assigned to the server, every accepted connection is wrapped in a TLS server connection (RTMPS).
+// After Shutdown is called, Listen returns ErrServerClosed.
 func (s *Server) Listen() error {
 	if s.Addr == "" {
 		s.Addr = constants.DefaultAddress
@@ -37,38 +192,321 @@ func (s *Server) Listen() error {
 		return err
 	}
 
-	s.Logger.Info(fmt.Sprint("[server] Listening on ", s.Addr))
+	return s.Serve(listener)
+}
+
+// Serve accepts incoming connections on the listener l, starting a new session for each of them. This allows using
+// listeners that weren't created by the server (eg: systemd socket activation, in-memory listeners, or wrapped listeners).
+// Serve always closes l before returning. After Shutdown is called, Serve returns ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mutex.Lock()
+	if s.shuttingDown.Load() {
+		s.mutex.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listener = l
+	if s.ConnectionRate > 0 || s.ConnectionRatePerIP > 0 {
+		var clock Clock = SystemClock{}
+		if s.Clock != nil {
+			clock = s.Clock
+		}
+		s.rateLimiter = newConnRateLimiter(clock, s.ConnectionRate, s.ConnectionBurst, s.ConnectionRatePerIP, s.ConnectionBurstPerIP)
+	}
+	s.done = make(chan struct{})
+	s.mutex.Unlock()
+	defer l.Close()
+
+	if s.StatsInterval > 0 && s.OnStats != nil {
+		go s.reportStats(s.done)
+	}
+
+	s.Logger.Info("[server] Listening", zap.String("addr", l.Addr().String()))
 
 	for {
-		conn, err := listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			s.Logger.Error(fmt.Sprint("[server] Error accepting incoming connection ", err))
+			if s.shuttingDown.Load() {
+				return ErrServerClosed
+			}
+			// The listener can't accept any more connections (eg: it was closed by its owner)
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			s.Logger.Error("[server] Error accepting incoming connection", zap.Error(err))
 			continue
 		}
 
-		s.Logger.Info(fmt.Sprint("[server] Accepted incoming connection from ", conn.RemoteAddr().String()))
+		if s.ConnFilter != nil && !s.ConnFilter(conn.RemoteAddr()) {
+			s.Logger.Warn("[server] Rejected incoming connection, address not allowed", zap.String("remote_addr", conn.RemoteAddr().String()))
+			conn.Close()
+			continue
+		}
 
-		go func(conn net.Conn) {
-			defer conn.Close()
+		if s.rateLimiter != nil && !s.rateLimiter.allow(conn.RemoteAddr()) {
+			s.rejectRateLimited(conn)
+			continue
+		}
 
-			socketr := bufio.NewReaderSize(conn, constants.BuffioSize)
-			socketw := bufio.NewWriterSize(conn, constants.BuffioSize)
-			sess := NewSession(s.Logger, s.Broadcaster)
+		if !s.acquireConnectionSlot() {
+			s.Logger.Warn("[server] Rejected incoming connection, maximum number of connections reached", zap.String("remote_addr", conn.RemoteAddr().String()))
+			conn.Close()
+			continue
+		}
 
-			sess.messageManager = NewMessageManager(sess,
-				NewHandshaker(socketr, socketw),
-				NewChunkHandler(socketr, socketw),
-			)
+		s.Logger.Info("[server] Accepted incoming connection", zap.String("remote_addr", conn.RemoteAddr().String()))
 
-			s.Logger.Info(fmt.Sprint("[server] Starting server session with sessionId ", sess.id))
-			err := sess.Start()
-			if err != io.EOF {
-				s.Logger.Error(fmt.Sprint("[server] Server session with sessionId ", sess.id, " ended with an error: ", err))
-			} else {
-				s.Logger.Info(fmt.Sprint("[server] Server session with sessionId ", sess.id, " ended."))
-			}
-		}(conn)
+		// The TLS handshake is performed on the first read/write, so it happens in the session's goroutine and doesn't block the accept loop
+		if s.TLSConfig != nil {
+			conn = tls.Server(conn, s.TLSConfig)
+		}
+
+		sess := s.newSession(conn)
+		if !s.trackSession(sess) {
+			s.releaseConnectionSlot()
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.serveSession(conn, sess)
+	}
+}
 
+// ServeConn runs a session on conn, a connection established outside of the server (eg: one end of a net.Pipe, to test
+// the server end to end without opening sockets), and returns once the session ends. ConnFilter and the connection
+// rate limits don't apply to it, but it counts as an active connection (ErrTooManyConnections is returned if there
+// are MaxConnections already), and is secured with TLSConfig if it's set.
+// ServeConn always closes conn. After Shutdown is called, ServeConn returns ErrServerClosed.
+func (s *Server) ServeConn(conn net.Conn) error {
+	if s.shuttingDown.Load() {
+		conn.Close()
+		return ErrServerClosed
 	}
+	if !s.acquireConnectionSlot() {
+		conn.Close()
+		return ErrTooManyConnections
+	}
+	if s.TLSConfig != nil {
+		conn = tls.Server(conn, s.TLSConfig)
+	}
+	sess := s.newSession(conn)
+	if !s.trackSession(sess) {
+		s.releaseConnectionSlot()
+		conn.Close()
+		return ErrServerClosed
+	}
+	s.serveSession(conn, sess)
+	return nil
+}
 
+// trackSession adds a session to the active sessions of the server, which Shutdown closes and waits for, and returns
+// false if the server is shutting down. It's called before the session's goroutine is started: otherwise, a Shutdown
+// happening before the goroutine adds the session would wait for it without closing it.
+func (s *Server) trackSession(sess *Session) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.shuttingDown.Load() {
+		return false
+	}
+	s.sessions.Store(sess.id, sess)
+	s.sessionsWG.Add(1)
+	return true
+}
+
+// serveSession runs the session of conn (tracked with trackSession) until the session ends.
+func (s *Server) serveSession(conn net.Conn, sess *Session) {
+	defer s.sessionsWG.Done()
+	defer func() {
+		// A message that makes the session panic (eg: malformed AMF0) must only end that session, not the whole server
+		if r := recover(); r != nil {
+			s.Logger.Error("[server] Recovered from a panic in a server session",
+				zap.String("remote_addr", conn.RemoteAddr().String()), zap.Any("panic", r), zap.Stack("stack"))
+		}
+	}()
+	defer s.releaseConnectionSlot()
+	defer conn.Close()
+	defer s.sessions.Delete(sess.id)
+
+	sess.metrics.ConnectionOpened()
+	defer sess.metrics.ConnectionClosed()
+
+	sess.logger.Info("[server] Starting server session")
+	err := sess.Start()
+	if err == nil || errors.Is(err, io.EOF) {
+		sess.logger.Info("[server] Server session ended")
+	} else {
+		sess.logger.Error("[server] Server session ended with an error", zap.String("cause", sessionEndCause(err)), zap.Error(err))
+	}
+}
+
+// newSession creates the server session of conn, configured with the settings of the server.
+func (s *Server) newSession(conn net.Conn) *Session {
+	metrics := s.Metrics
+	if metrics == nil {
+		metrics = NopMetrics{}
+	}
+
+	readBufferSize := s.ReadBufferSize
+	if readBufferSize <= 0 {
+		readBufferSize = constants.BuffioSize
+	}
+	socketr := bufio.NewReaderSize(conn, readBufferSize)
+	writeBufferSize := s.WriteBufferSize
+	if writeBufferSize <= 0 {
+		writeBufferSize = constants.BuffioSize
+	}
+	socketw := bufio.NewWriterSize(conn, writeBufferSize)
+	sess := NewSession(s.Logger, s.Broadcaster)
+	sess.conn = conn
+	sess.apps = s.Apps
+	sess.metrics = metrics
+	sess.sequenceHeaderTimeout = s.SequenceHeaderTimeout
+	sess.idleTimeout = s.PublisherIdleTimeout
+	sess.streamDryTimeout = s.StreamDryTimeout
+	sess.keyframeDiagnostics = s.KeyframeDiagnostics
+	sess.longKeyframeInterval = s.LongKeyframeInterval
+	sess.checkPlayerCodecs = s.CheckPlayerCodecs
+	sess.liveSeek = s.LiveSeek
+	sess.asyncMedia = s.AsyncMediaDispatch
+	sess.bandwidthCheck = s.BandwidthCheck
+	sess.recordDir = s.RecordDir
+	sess.recordNameMetadata = s.RecordNameMetadata
+	if s.ServerVersion != "" {
+		sess.serverVersion = s.ServerVersion
+	}
+	if s.ServerCapabilities != 0 {
+		sess.serverCapabilities = s.ServerCapabilities
+	}
+	sess.disableAMF3 = s.DisableAMF3
+	if s.WindowAckSize > 0 {
+		sess.windowAckSize = s.WindowAckSize
+	}
+
+	chunkHandler := NewChunkHandler(socketr, socketw)
+	chunkHandler.resetOnStreamIDChange = s.ResetReusedChunkStreams
+	chunkHandler.maxReadBufferSize = s.MaxReadBufferSize
+	chunkHandler.source = conn
+	chunkHandler.maxMessageSize = s.MaxMessageSize
+	chunkHandler.messageAssemblyTimeout = s.MessageAssemblyTimeout
+	chunkHandler.ackFlowControl = s.AckFlowControl
+	chunkHandler.conn = conn
+	if s.Clock != nil {
+		chunkHandler.clock = s.Clock
+	}
+	chunkHandler.metrics = metrics
+	handshaker := NewHandshaker(socketr, socketw)
+	if s.HandshakeVersion != [4]byte{} {
+		handshaker.version = s.HandshakeVersion
+	}
+	handshaker.lenient = s.LenientHandshake
+	sess.messageManager = NewMessageManager(sess,
+		handshaker,
+		chunkHandler,
+	)
+	sess.messageManager.skipMalformedMessages = s.SkipMalformedMessages
+	sess.addLogFields(zap.String("remote_addr", conn.RemoteAddr().String()))
+	return sess
+}
+
+// sessionEndCause classifies the error a session ended with, for logging.
+func sessionEndCause(err error) string {
+	switch {
+	case errors.Is(err, ErrHandshakeFailed):
+		return "handshake_failed"
+	case errors.Is(err, ErrUnknownApp):
+		return "unknown_app"
+	case errors.Is(err, ErrMalformedCommand):
+		return "malformed_command"
+	case errors.Is(err, ErrUnknownChunkType):
+		return "unknown_chunk_type"
+	case errors.Is(err, ErrMessageTooLarge):
+		return "message_too_large"
+	case errors.Is(err, ErrMessageAssemblyTimeout):
+		return "message_assembly_timeout"
+	case errors.Is(err, net.ErrClosed):
+		return "connection_closed"
+	default:
+		return "protocol_error"
+	}
+}
+
+// acquireConnectionSlot returns false if the server already has MaxConnections active connections.
+// Otherwise, it counts a new active connection, which must be released with releaseConnectionSlot once it's closed.
+func (s *Server) acquireConnectionSlot() bool {
+	if slots := s.slots(); slots != nil {
+		select {
+		case slots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	s.connections.Add(1)
+	return true
+}
+
+func (s *Server) releaseConnectionSlot() {
+	s.connections.Add(-1)
+	if slots := s.slots(); slots != nil {
+		<-slots
+	}
+}
+
+// slots returns the semaphore enforcing MaxConnections, or nil if there's no limit. It's created on first use, so that
+// the connections served with ServeConn are limited too, even if Serve isn't called.
+func (s *Server) slots() chan struct{} {
+	s.connectionSlotsOnce.Do(func() {
+		if s.MaxConnections > 0 {
+			s.connectionSlots = make(chan struct{}, s.MaxConnections)
+		}
+	})
+	return s.connectionSlots
+}
+
+// ConnectionCount returns the number of active connections.
+func (s *Server) ConnectionCount() int {
+	return int(s.connections.Load())
+}
+
+// broadcasters returns the broadcasters of the apps hosted by the server (see Apps).
+func (s *Server) broadcasters() []Broadcaster {
+	broadcasters := make([]Broadcaster, 0, len(s.Apps)+1)
+	if s.Broadcaster != nil {
+		broadcasters = append(broadcasters, s.Broadcaster)
+	}
+	for _, broadcaster := range s.Apps {
+		if broadcaster != s.Broadcaster {
+			broadcasters = append(broadcasters, broadcaster)
+		}
+	}
+	return broadcasters
+}
+
+// Shutdown stops the server from accepting new connections, closes all active sessions, and waits for them to end.
+// If ctx is done before all sessions have ended, Shutdown returns the context's error.
+// Once Shutdown has been called, the server can't be started again.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	var err error
+	if !s.shuttingDown.Swap(true) && s.listener != nil {
+		err = s.listener.Close()
+		close(s.done)
+	}
+	s.mutex.Unlock()
+
+	s.sessions.Range(func(_, sess any) bool {
+		sess.(*Session).Close()
+		return true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.sessionsWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
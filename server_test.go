@@ -0,0 +1,633 @@
+package rtmp_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codingpa-ws/rtmp"
+	"github.com/codingpa-ws/rtmp/constants"
+	"github.com/codingpa-ws/rtmp/rtmptest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func newTestServer() *rtmp.Server {
+	return &rtmp.Server{Logger: zap.NewNop(), Broadcaster: rtmp.NewBroadcaster("app", rtmp.NewInMemoryContext())}
+}
+
+func TestShutdown(t *testing.T) {
+	s := newTestServer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+
+	conn, err := rtmptest.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.Connect("app"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := <-served; !errors.Is(err, rtmp.ErrServerClosed) {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+	if _, err := conn.ReadMessage(); err == nil {
+		t.Error("session still open after Shutdown")
+	}
+	if n := s.ConnectionCount(); n != 0 {
+		t.Errorf("ConnectionCount() = %d after Shutdown, want 0", n)
+	}
+}
+
+// TestOnStats checks that OnStats is called every StatsInterval while the server is serving, with the stats of the
+// session publishing a stream.
+func TestOnStats(t *testing.T) {
+	s := newTestServer()
+	s.StatsInterval = 20 * time.Millisecond
+	snapshots := make(chan rtmp.ServerStats, 100)
+	s.OnStats = func(stats rtmp.ServerStats) { snapshots <- stats }
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	publisher, err := rtmptest.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	publisher.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := publisher.Connect("app"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := publisher.CreateStream(); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	var previous time.Time
+	for reports := 0; reports < 3; {
+		select {
+		case stats := <-snapshots:
+			if stats.Streams != 1 {
+				// Reported before the stream was published
+				continue
+			}
+			if stats.Connections != 1 || len(stats.Sessions) != 1 || len(stats.Keyframes) != 1 {
+				t.Errorf("stats = %+v, want 1 connection, session and publisher", stats)
+			}
+			if !previous.IsZero() {
+				if interval := stats.Time.Sub(previous); interval < s.StatsInterval/2 {
+					t.Errorf("stats reported %s after the previous ones, want every %s", interval, s.StatsInterval)
+				}
+			}
+			previous = stats.Time
+			reports++
+		case <-timeout:
+			t.Fatal("OnStats wasn't called with the published stream")
+		}
+	}
+}
+
+// pipeListener is a listener accepting in-memory pipes (see rtmptest.NewPipe), so that Server.Serve runs without
+// opening sockets.
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// addrConn is the server end of a pipe, dialed from addr.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1935}
+}
+
+// dial connects to the listener from addr, and performs the handshake.
+func (l *pipeListener) dial(addr string) (*rtmptest.Conn, error) {
+	clientConn, serverConn := rtmptest.NewPipe()
+	l.conns <- addrConn{Conn: serverConn, addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 50000}}
+	conn, err := rtmptest.NewConn(clientConn)
+	if err != nil {
+		clientConn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, nil
+}
+
+// TestConnFilter checks that the connections ConnFilter rejects are closed before their handshake.
+func TestConnFilter(t *testing.T) {
+	s := newTestServer()
+	s.ConnFilter = func(addr net.Addr) bool {
+		return addr.(*net.TCPAddr).IP.Equal(net.ParseIP("203.0.113.10"))
+	}
+	l := newPipeListener()
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	allowed, err := l.dial("203.0.113.10")
+	if err != nil {
+		t.Fatalf("handshake from an allowed address: %v", err)
+	}
+	defer allowed.Close()
+	if err := allowed.Connect("app"); err != nil {
+		t.Errorf("connect from an allowed address: %v", err)
+	}
+	if denied, err := l.dial("198.51.100.20"); err == nil {
+		denied.Close()
+		t.Error("handshake from a denied address succeeded")
+	}
+}
+
+// TestServeListener runs the server on a listener of in-memory pipes, and plays a stream published through it.
+func TestServeListener(t *testing.T) {
+	s := newTestServer()
+	l := newPipeListener()
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+
+	var conns []*rtmptest.Conn
+	for _, addr := range []string{"203.0.113.10", "203.0.113.11"} {
+		conn, err := l.dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := conn.Connect("app"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.CreateStream(); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	publisher, player := conns[0], conns[1]
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	if err := player.Play("live"); err != nil {
+		t.Fatal(err)
+	}
+	publisher.SendVideo([]byte{0x17, 0x01, 0}, 0)
+	for {
+		message, err := player.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.TypeID == rtmp.VideoMessage {
+			break
+		}
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; !errors.Is(err, rtmp.ErrServerClosed) {
+		t.Errorf("Serve() = %v, want ErrServerClosed", err)
+	}
+}
+
+// TestSessionEndCause checks that the errors sessions end with wrap the sentinel error of their cause, by which the
+// server classifies them when it logs them.
+func TestSessionEndCause(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(conn net.Conn)
+		want string
+	}{
+		{"handshake failed", func(conn net.Conn) {
+			// RTMP version 9 doesn't exist
+			conn.Write(append([]byte{9}, make([]byte, 1536)...))
+		}, "handshake_failed"},
+		{"unknown app", func(conn net.Conn) {
+			if c, err := rtmptest.NewConn(conn); err == nil {
+				c.Connect("unknown")
+			}
+		}, "unknown_app"},
+		{"message too large", func(conn net.Conn) {
+			if c, err := rtmptest.NewConn(conn); err == nil {
+				c.Connect("app")
+				c.CreateStream()
+				c.Publish("live")
+				c.SendVideo(make([]byte, 5000), 0)
+			}
+		}, "message_too_large"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			core, logs := observer.New(zap.ErrorLevel)
+			s := newTestServer()
+			s.Logger = zap.New(core)
+			s.MaxMessageSize = 1000
+			clientConn, serverConn := rtmptest.NewPipe()
+			defer clientConn.Close()
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			served := make(chan error, 1)
+			go func() { served <- s.ServeConn(serverConn) }()
+			test.run(clientConn)
+			<-served
+
+			ended := logs.FilterMessage("[server] Server session ended with an error").All()
+			if len(ended) != 1 {
+				t.Fatalf("logged %d session errors, want 1", len(ended))
+			}
+			if cause := ended[0].ContextMap()["cause"]; cause != test.want {
+				t.Errorf("session ended with %v (%s), want %s", cause, ended[0].ContextMap()["error"], test.want)
+			}
+		})
+	}
+}
+
+// failureMetrics counts the failures reported to the Metrics of a server.
+type failureMetrics struct {
+	rtmp.NopMetrics
+	mutex                                       sync.Mutex
+	handshakes, connectRejections, authFailures int
+}
+
+func (m *failureMetrics) HandshakeFailed() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.handshakes++
+}
+
+func (m *failureMetrics) ConnectRejected() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.connectRejections++
+}
+
+func (m *failureMetrics) AuthFailed() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.authFailures++
+}
+
+func TestFailureMetrics(t *testing.T) {
+	tests := []struct {
+		name  string
+		guard rtmp.SessionGuard
+		run   func(conn net.Conn)
+		// Handshake failures, connect rejections and auth failures
+		want [3]int
+	}{
+		{"handshake failed", nil, func(conn net.Conn) {
+			conn.Write(append([]byte{9}, make([]byte, 1536)...))
+		}, [3]int{1, 0, 0}},
+		{"unknown app", nil, func(conn net.Conn) {
+			if c, err := rtmptest.NewConn(conn); err == nil {
+				c.Connect("unknown")
+			}
+		}, [3]int{0, 1, 0}},
+		{"missing app", nil, func(conn net.Conn) {
+			if c, err := rtmptest.NewConn(conn); err == nil {
+				c.ConnectWith(map[string]any{"tcUrl": "rtmp://localhost/app"})
+			}
+		}, [3]int{0, 1, 0}},
+		{"connect denied", tcUrlGuard{tcUrl: make(chan string, 1)}, func(conn net.Conn) {
+			if c, err := rtmptest.NewConn(conn); err == nil {
+				c.Connect("app")
+			}
+		}, [3]int{0, 0, 1}},
+		{"publish denied", roleGuard{play: true}, func(conn net.Conn) {
+			if c, err := rtmptest.NewConn(conn); err == nil {
+				c.Connect("app")
+				c.CreateStream()
+				c.Publish("live")
+			}
+		}, [3]int{0, 0, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metrics := &failureMetrics{}
+			s := newTestServer()
+			s.Metrics = metrics
+			if test.guard != nil {
+				s.Broadcaster.SetSessionGuard(test.guard)
+			}
+			clientConn, serverConn := rtmptest.NewPipe()
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			served := make(chan error, 1)
+			go func() { served <- s.ServeConn(serverConn) }()
+			test.run(clientConn)
+			// The server ends the session of failures, but it may be waiting for the next message of the others
+			clientConn.Close()
+			<-served
+
+			metrics.mutex.Lock()
+			defer metrics.mutex.Unlock()
+			if got := [3]int{metrics.handshakes, metrics.connectRejections, metrics.authFailures}; got != test.want {
+				t.Errorf("counted %d handshake failures, %d connect rejections and %d auth failures, want %v", got[0], got[1], got[2], test.want)
+			}
+		})
+	}
+}
+
+// pipeStream connects to the app of s over a pipe (see rtmptest.Pipe), and creates a stream. The connection is closed
+// when the test ends.
+func pipeStream(t *testing.T, s *rtmp.Server) *rtmptest.Conn {
+	t.Helper()
+	conn, err := rtmptest.Pipe(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.Connect("app"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.CreateStream(); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// TestServeConn publishes a stream and plays it over in-memory pipes, without opening sockets.
+func TestServeConn(t *testing.T) {
+	s := newTestServer()
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	player := pipeStream(t, s)
+	if err := player.Play("live"); err != nil {
+		t.Fatal(err)
+	}
+
+	var want []uint32
+	for i := uint32(0); i < 3; i++ {
+		if err := publisher.SendVideo([]byte{0x27, 0x01, 0, 0, 0, byte(i)}, i*40); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, i*40)
+	}
+	var got []uint32
+	for len(got) < len(want) {
+		message, err := player.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading the frames played: %v", err)
+		}
+		if message.TypeID == rtmp.VideoMessage {
+			got = append(got, message.Timestamp)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("played frames at %v, want %v", got, want)
+	}
+}
+
+func TestServeConnMaxConnections(t *testing.T) {
+	s := newTestServer()
+	s.MaxConnections = 1
+	conn, err := rtmptest.Pipe(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, server := rtmptest.NewPipe()
+	defer client.Close()
+	if err := s.ServeConn(server); !errors.Is(err, rtmp.ErrTooManyConnections) {
+		t.Errorf("ServeConn() over MaxConnections = %v, want ErrTooManyConnections", err)
+	}
+}
+
+// TestApps hosts two apps on a server, and checks that connections are routed to the broadcaster of the app they
+// connect to.
+func TestApps(t *testing.T) {
+	live := rtmp.NewBroadcaster("live", rtmp.NewInMemoryContext())
+	vod := rtmp.NewBroadcaster("vod", rtmp.NewInMemoryContext())
+	s := &rtmp.Server{Logger: zap.NewNop(), Apps: map[string]rtmp.Broadcaster{"live": live, "vod": vod}}
+	connect := func(app string) *rtmptest.Conn {
+		t.Helper()
+		conn, err := rtmptest.Pipe(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.Connect(app); err != nil {
+			t.Fatalf("Connect(%q) = %v", app, err)
+		}
+		if _, err := conn.CreateStream(); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	if err := connect("live").Publish("key"); err != nil {
+		t.Fatal(err)
+	}
+	if !live.StreamExists("key") || vod.StreamExists("key") {
+		t.Fatal("stream published to live isn't published to the live broadcaster only")
+	}
+	// The same stream key is another stream in the other app
+	if err := connect("vod?token=abc").Play("key"); err == nil {
+		t.Error("played a stream of live from vod")
+	}
+	if err := connect("vod").Publish("key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect("live").Play("key"); err != nil {
+		t.Error(err)
+	}
+	if streams := s.Stats().Streams; streams != 2 {
+		t.Errorf("Stats().Streams = %d, want the streams of both apps", streams)
+	}
+
+	conn, err := rtmptest.Pipe(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.Connect("other"); err == nil {
+		t.Error("connected to an app that isn't hosted")
+	}
+}
+
+// countingConn records the size of the reads and writes of the server end of a connection.
+type countingConn struct {
+	net.Conn
+	mutex  sync.Mutex
+	reads  []int
+	writes []int
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	c.mutex.Lock()
+	c.reads = append(c.reads, len(p))
+	c.mutex.Unlock()
+	return c.Conn.Read(p)
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	c.writes = append(c.writes, len(p))
+	c.mutex.Unlock()
+	return c.Conn.Write(p)
+}
+
+// TestBufferSizes checks that the connection of a player is read into a buffer of ReadBufferSize bytes, and that a
+// message larger than WriteBufferSize is written to it in several writes.
+func TestBufferSizes(t *testing.T) {
+	tests := []struct {
+		name            string
+		readBufferSize  int
+		writeBufferSize int
+		readSize        int
+		severalWrites   bool
+	}{
+		{"default", 0, 0, constants.BuffioSize, false},
+		{"custom", 512, 256, 512, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer()
+			s.ReadBufferSize = test.readBufferSize
+			s.WriteBufferSize = test.writeBufferSize
+			publisher := pipeStream(t, s)
+			if err := publisher.Publish("live"); err != nil {
+				t.Fatal(err)
+			}
+			client, server := rtmptest.NewPipe()
+			conn := &countingConn{Conn: server}
+			go s.ServeConn(conn)
+			player, err := rtmptest.NewConn(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer player.Close()
+			player.SetDeadline(time.Now().Add(5 * time.Second))
+			if err := player.Connect("app"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := player.CreateStream(); err != nil {
+				t.Fatal(err)
+			}
+			if err := player.Play("live"); err != nil {
+				t.Fatal(err)
+			}
+
+			// The handshake is read in full messages, the commands that follow are read into the buffer
+			conn.mutex.Lock()
+			for _, size := range conn.reads[2:] {
+				if size != test.readSize {
+					t.Errorf("read %d bytes from the connection, want reads of %d bytes", size, test.readSize)
+				}
+			}
+			writes := len(conn.writes)
+			conn.mutex.Unlock()
+
+			frame := make([]byte, 20000)
+			frame[0], frame[1] = 0x17, 0x01
+			if err := publisher.SendVideo(frame, 40); err != nil {
+				t.Fatal(err)
+			}
+			for {
+				message, err := player.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if message.TypeID == rtmp.VideoMessage {
+					break
+				}
+			}
+			conn.mutex.Lock()
+			frameWrites := len(conn.writes) - writes
+			conn.mutex.Unlock()
+			if (frameWrites > 1) != test.severalWrites {
+				t.Errorf("frame written to the player in %d writes", frameWrites)
+			}
+		})
+	}
+}
+
+// TestConnectResponseIdentity checks the fmsVer, capabilities and objectEncoding of the connect response sent to a
+// client that asks for AMF3, by default and with the server configured to mimic another server.
+func TestConnectResponseIdentity(t *testing.T) {
+	tests := []struct {
+		name           string
+		configure      func(s *rtmp.Server)
+		fmsVer         string
+		capabilities   float64
+		objectEncoding float64
+	}{
+		{"default", func(*rtmp.Server) {}, constants.FlashMediaServerVersion, float64(constants.Capabilities), 3},
+		{"custom", func(s *rtmp.Server) {
+			s.ServerVersion = "FMS/5,0,15,5004"
+			s.ServerCapabilities = 255
+			s.DisableAMF3 = true
+		}, "FMS/5,0,15,5004", 255, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer()
+			test.configure(s)
+			conn, err := rtmptest.Pipe(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			conn.SendCommand(0, "connect", 1, map[string]any{"app": "app", "tcUrl": "rtmp://localhost/app", "objectEncoding": 3.0})
+			result, err := conn.ExpectResult()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmsVer, capabilities := result.Object["fmsVer"], result.Object["capabilities"]; fmsVer != test.fmsVer || capabilities != test.capabilities {
+				t.Errorf("connect response fmsVer, capabilities = %v, %v, want %v, %v", fmsVer, capabilities, test.fmsVer,
+					test.capabilities)
+			}
+			if objectEncoding := result.Info()["objectEncoding"]; objectEncoding != test.objectEncoding {
+				t.Errorf("connect response objectEncoding = %v, want %v", objectEncoding, test.objectEncoding)
+			}
+		})
+	}
+}
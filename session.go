@@ -1,19 +1,38 @@
 package rtmp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/codingpa-ws/rtmp/amf"
 	"github.com/codingpa-ws/rtmp/audio"
 	"github.com/codingpa-ws/rtmp/constants"
+	"github.com/codingpa-ws/rtmp/flv"
 	"github.com/codingpa-ws/rtmp/rand"
 	"github.com/codingpa-ws/rtmp/video"
 	"go.uber.org/zap"
 )
 
+var ErrUnknownApp error = errors.New("session: unknown app")
+var ErrConnectRejected error = errors.New("session: connection rejected")
+var ErrRedirected error = errors.New("session: connection redirected")
+
+// Maximum number of stream IDs that media received on without being created is logged for (see mediaStream), so that a
+// client that sends media on random stream IDs can't grow the session without bound
+const maxUnknownMediaStreams = 16
+
 type AudioCallback func(format audio.Format, sampleRate audio.SampleRate, sampleSize audio.SampleSize, channels audio.Channel, payload []byte, timestamp uint32)
 type VideoCallback func(frameType video.FrameType, codec video.Codec, payload []byte, timestamp uint32)
 type MetadataCallback func(metadata map[string]any)
+type StatusCallback func(code string, info map[string]any)
 
 type surroundSound struct {
 	stereoSound        bool
@@ -31,7 +50,7 @@ type clientMetadata struct {
 	width        float64
 	height       float64
 	videoCodecID string
-	// number representation of videoCodecID (ffmpeg sends audioCodecID as a number rather than a string (like obs))
+	// number representation of videoCodecID (ffmpeg sends videoCodecID as a number rather than a string (like obs))
 	nVideoCodecID float64
 	videoDataRate float64
 	frameRate     float64
@@ -44,6 +63,11 @@ type clientMetadata struct {
 	audioChannels   float64
 	sound           surroundSound
 	encoder         string
+	// Codecs identified by the codec IDs above, whichever way the encoder wrote them. hasVideoCodec and hasAudioFormat
+	// are false if the encoder didn't declare a known codec.
+	videoCodec                    video.Codec
+	audioFormat                   audio.Format
+	hasVideoCodec, hasAudioFormat bool
 }
 
 // Media Server interface defines the callbacks that are called when a message is received by the server
@@ -58,20 +82,31 @@ type MediaServer interface {
 	onReleaseStream(csID uint32, transactionId float64, args map[string]any, streamKey string)
 	onFCPublish(csID uint32, transactionId float64, args map[string]any, streamKey string)
 	onCreateStream(csID uint32, transactionId float64, data map[string]any)
-	onPublish(transactionId float64, args map[string]any, streamKey string, publishingType string)
-	onFCUnpublish(args map[string]any, streamKey string)
+	onFCSubscribe(csID uint32, transactionId float64, args map[string]any, streamKey string)
+	onGetStreamLength(csID uint32, transactionId float64, streamKey string)
+	onCheckBandwidth(csID uint32, transactionId float64)
+	onPublish(streamID uint32, transactionId float64, args map[string]any, streamKey string, publishingType string)
+	onFCUnpublish(csID uint32, transactionId float64, args map[string]any, streamKey string)
 	onDeleteStream(args map[string]any, streamID float64)
-	onCloseStream(csID uint32, transactionId float64, args map[string]any)
-	onAudioMessage(format audio.Format, sampleRate audio.SampleRate, sampleSize audio.SampleSize, channels audio.Channel, payload []byte, timestamp uint32)
-	onVideoMessage(frameType video.FrameType, codec video.Codec, payload []byte, timestamp uint32)
-	onMetadata(metadata map[string]any)
-	onPlay(streamKey string, startTime float64)
+	onCloseStream(streamID uint32, transactionId float64, args map[string]any)
+	onAudioMessage(streamID uint32, header audio.Header, payload []byte, timestamp uint32)
+	onVideoMessage(streamID uint32, header video.Header, payload []byte, timestamp uint32)
+	onMetadata(streamID uint32, metadata map[string]any)
+	onPlay(streamID uint32, streamKey string, startTime float64)
+	onSeek(streamID uint32, milliseconds float64)
+	onPlay2(streamID uint32, options map[string]any)
 
 	// TODO: separate into two distinct interfaces: client, server (maybe 3 for common functions like onAck, onSetWindowAckSize, onSetChunkSize, etc.)
 	// Client callbacks
 	onResult(info map[string]any)
+	onCreateStreamResult(streamID uint32)
 	onStatus(info map[string]any)
-	onStreamBegin()
+	onStreamBegin(streamID uint32)
+
+	onSetBufferLength(streamID uint32, milliseconds uint32)
+
+	// Common callbacks
+	onPingResponse(timestamp uint32)
 }
 
 // Represents a connection made with the RTMP server where messages are exchanged between client/server.
@@ -81,38 +116,123 @@ type Session struct {
 	id             string
 	clientMetadata clientMetadata
 	broadcaster    Broadcaster
-	active         bool
+	// Broadcasters of the other apps the session can connect to, by app name (see Server.Apps)
+	apps   map[string]Broadcaster
+	active bool
+	// Connection the session runs on, closed to end the session from outside its read loop
+	conn    io.Closer
+	metrics Metrics
+	// Error that made the session stop (eg: the client connected to an unknown app), returned by Start/StartPlayback
+	err error
+	// Time the session was created at, and the audio/video traffic of its streams (see Stats)
+	startTime time.Time
+	traffic   mediaTraffic
 
 	// Callbacks (for RTMP clients)
 	OnAudio    AudioCallback
 	OnVideo    VideoCallback
 	OnMetadata MetadataCallback
+	// Called with every onStatus command received, before the session handles it
+	OnStatus StatusCallback
 
 	// Interprets messages, calling the appropriate callback on the session. Also in charge of sending messages.
 	messageManager *MessageManager
 
 	// app data
-	app            string
-	flashVer       string
-	swfUrl         string
-	tcUrl          string
+	app      string
+	flashVer string
+	swfUrl   string
+	tcUrl    string
+	// Query parameters of the tcUrl, app and stream key
+	connectParams  map[string]string
 	amfType        string
+	objectEncoding float64 // AMF version the client asked to use for its commands (0 or 3)
+	connectObject  amf.Metadata
+	capabilities   ClientCapabilities
 	streamKey      string // used to identify user
 	publishingType string
-	isPublisher    bool
-	isPlayer       bool
 	isClient       bool
 	serverAddress  string
+
+	// Net streams of the session, by message stream ID. A client can publish or play a different stream on each of them.
+	streams map[uint32]*netStream
+	// Message stream ID of the last net stream created with createStream
+	lastStreamID uint32
+	// Message stream IDs that media was received on without being created, logged once each (up to
+	// maxUnknownMediaStreams, see mediaStream)
+	unknownMediaStreams map[uint32]struct{}
+
+	// Chunk stream and transaction IDs of the connect command, to reply to it
+	connectCsID          uint32
+	connectTransactionID float64
+	// URL the server redirected this (client) session to
+	redirectURL string
+
+	// If true, players can't play streams encoded with codecs they didn't advertise in their connect command
+	checkPlayerCodecs bool
+	// If true, seek and play2 requests of clients that advertise support for seeking are honored
+	liveSeek bool
+	// If true, the media received is handled on other goroutines than the read loop (see startDispatch)
+	asyncMedia bool
+	// If true, onBWDone is sent after the connect sequence and checkBandwidth commands are answered
+	bandwidthCheck bool
+	// Directory where streams published with the record and append publishing types are recorded, if not empty
+	recordDir string
+	// Metadata property naming recordings, if not empty (see Server.RecordNameMetadata)
+	recordNameMetadata string
+	// fmsVer and capabilities sent in the response to the connect command
+	serverVersion      string
+	serverCapabilities int
+	// If true, the connect response confirms AMF0 even to clients that ask for AMF3
+	disableAMF3 bool
+	// Window sent to the client after it connects, with Window Acknowledgement Size and Set Peer Bandwidth
+	windowAckSize uint32
+
+	// If greater than 0, a publisher that doesn't send a sequence header within this time after publishing is disconnected
+	sequenceHeaderTimeout time.Duration
+	sequenceHeaderTimer   *time.Timer
+	// Set by the read loop, read by sequenceHeaderTimer
+	receivedSequenceHeader atomic.Bool
+
+	// If greater than 0, a publisher that doesn't send any audio/video message for this long is disconnected
+	idleTimeout time.Duration
+	// Time (in unix nanoseconds) of the last audio/video message of the publisher. Set by the read loop, read by watchIdle.
+	lastMediaTime atomic.Int64
+	// Closed when the session ends, to stop watchIdle
+	idleDone chan struct{}
+	// If greater than 0, the subscribers of the stream receive StreamDry when the publisher doesn't send any audio/video
+	// message for this long
+	streamDryTimeout time.Duration
+
+	keyframes keyframeTracker
+	// If true, the time to the first keyframe and the keyframe intervals of the publisher are logged
+	keyframeDiagnostics bool
+	// If greater than 0 (and keyframeDiagnostics is set), keyframe intervals longer than this are logged as warnings
+	longKeyframeInterval time.Duration
+
+	// Pings sent by Ping that are waiting for their response, by timestamp. Closed by the read loop when the response
+	// arrives.
+	pingMutex sync.Mutex
+	pings     map[uint32]chan struct{}
 }
 
 func NewSession(logger *zap.Logger, b Broadcaster) *Session {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
 	session := &Session{
-		logger:      logger,
 		id:          rand.GenerateUuid(),
 		broadcaster: b,
 		active:      true,
+		startTime:   time.Now(),
 		isClient:    false,
+		metrics:     NopMetrics{},
+
+		serverVersion:      constants.FlashMediaServerVersion,
+		serverCapabilities: constants.Capabilities,
+		windowAckSize:      constants.DefaultClientWindowSize,
 	}
+	session.logger = logger.With(zap.String("session_id", session.id))
 
 	return session
 }
@@ -120,6 +240,7 @@ func NewSession(logger *zap.Logger, b Broadcaster) *Session {
 func NewClientSession(app string, tcUrl string, streamKey string, audioCallback AudioCallback, videoCallback VideoCallback, metadataCallback MetadataCallback) *Session {
 	session := &Session{
 		id:         rand.GenerateUuid(),
+		startTime:  time.Now(),
 		isClient:   true,
 		app:        app,
 		tcUrl:      tcUrl,
@@ -128,42 +249,44 @@ func NewClientSession(app string, tcUrl string, streamKey string, audioCallback
 		OnVideo:    videoCallback,
 		OnMetadata: metadataCallback,
 		active:     true,
+		metrics:    NopMetrics{},
 	}
+	session.logger = zap.NewNop().With(zap.String("session_id", session.id))
 	return session
 }
 
+// addLogFields adds fields to the logger of the session and to the loggers of the components it runs on, so that every
+// log of the session carries them from now on.
+func (session *Session) addLogFields(fields ...zap.Field) {
+	session.logger = session.logger.With(fields...)
+	if session.messageManager != nil {
+		session.messageManager.setLogger(session.logger)
+	}
+}
+
 // Start performs the initial handshake and starts receiving streams of data. This is used for servers only. For clients, use StartPlayback().
 func (session *Session) Start() error {
 	// Perform handshake
 	err := session.messageManager.Initialize()
 	if err != nil {
+		session.metrics.HandshakeFailed()
 		return err
 	}
 
+	if session.asyncMedia {
+		session.startDispatch()
+	}
 	defer func() {
+		// The media received is handled before the streams it's published on are closed
+		session.messageManager.stopDispatch()
 		// Remove the session from the context
-		if session.isPlayer {
-			if constants.Debug {
-				fmt.Println("session: destroying subscriber")
-			}
-			session.broadcaster.DestroySubscriber(session.streamKey, session.id)
-		}
-		if session.isPublisher {
-			if constants.Debug {
-				fmt.Println("session: destroying publisher")
-			}
-			// Broadcast end of stream
-			session.broadcaster.BroadcastEndOfStream(session.streamKey)
-			session.broadcaster.DestroyPublisher(session.streamKey)
-			if guard := session.broadcaster.GetSessionGuard(); guard != nil {
-				guard.End(session)
-			}
+		for _, stream := range session.streams {
+			session.closeStream(stream)
 		}
+		session.stopPublisherTimers()
 	}()
 
-	if constants.Debug {
-		fmt.Println("Handshake completed successfully")
-	}
+	session.logger.Debug("session: handshake completed successfully")
 
 	for session.active {
 		if err = session.messageManager.nextMessage(); err != nil {
@@ -171,7 +294,15 @@ func (session *Session) Start() error {
 		}
 	}
 
-	return nil
+	return session.err
+}
+
+// startDispatch makes the message manager handle the media received on other goroutines than the one reading the
+// connection (see Server.AsyncMediaDispatch and Client.AsyncCallbacks). The callbacks of client sessions are
+// independent, so metadata is dispatched on its own goroutine. The handlers of server sessions share the state of the
+// published streams (eg: their recordings), so they're called on the same goroutine.
+func (session *Session) startDispatch() {
+	session.messageManager.dispatchMedia(session.isClient)
 }
 
 func (session *Session) StartPlayback() error {
@@ -181,8 +312,11 @@ func (session *Session) StartPlayback() error {
 		return err
 	}
 
-	if constants.Debug {
-		fmt.Println("client handshake completed successfully")
+	session.logger.Debug("session: client handshake completed successfully")
+	if session.asyncMedia {
+		session.startDispatch()
+		// Playback ends once the callbacks of the media received have returned
+		defer session.messageManager.stopDispatch()
 	}
 
 	info := map[string]any{
@@ -210,7 +344,7 @@ func (session *Session) StartPlayback() error {
 				return err
 			}
 		} else {
-			return nil
+			return session.err
 		}
 	}
 }
@@ -218,61 +352,168 @@ func (session *Session) StartPlayback() error {
 func (session *Session) onResult(info map[string]any) {
 	level, exists := info["level"]
 	if !exists {
-		fmt.Println("session: onResult: no 'level' in info object")
+		session.logger.Warn("session: onResult: no 'level' in info object")
 		return
 	}
 	code, exists := info["code"]
 	if !exists {
-		fmt.Println("session: onResult: no 'code' in info object")
+		session.logger.Warn("session: onResult: no 'code' in info object")
 		return
 	}
 
 	if level == "error" {
-		fmt.Printf("session: onResult error: %+v\n", info)
+		if redirectURL := getRedirectURL(info); redirectURL != "" {
+			session.logger.Info("session: redirected", zap.String("url", redirectURL))
+			session.redirectURL = redirectURL
+			session.err = fmt.Errorf("%w to %s", ErrRedirected, redirectURL)
+			session.active = false
+			return
+		}
+		session.logger.Error("session: onResult error", zap.Any("info", info))
 		session.active = false
 		return
 	}
 	if level == "warning" {
-		fmt.Printf("session: onResult warning: %+v\n", info)
+		session.logger.Warn("session: onResult warning", zap.Any("info", info))
 	}
 
 	switch code {
 	case "NetConnection.Connect.Success":
-		session.messageManager.requestCreateStream(2)
+		session.messageManager.requestCreateStream()
+	}
+}
+
+// onCreateStreamResult plays the stream of the client on the net stream created by the server.
+func (session *Session) onCreateStreamResult(streamID uint32) {
+	session.logger.Debug("session: stream created", zap.Uint32("stream_id", streamID))
+	session.messageManager.requestPlay(streamID, session.streamKey)
+}
+
+// getRedirectURL returns the URL a connect _error response redirects to, or "" if it isn't a redirect.
+func getRedirectURL(info map[string]any) string {
+	if info["code"] != NetConnectionRejected {
+		return ""
 	}
+	ex, _ := amf.Metadata(info).GetMap("ex")
+	redirectURL, _ := ex.GetString("redirect")
+	return redirectURL
+}
+
+// Redirect rejects the connection of the session, redirecting the client to url (eg: another edge server). Clients
+// only follow redirects in the response to their connect command, so Redirect is meant to be called by a ConnectGuard.
+func (session *Session) Redirect(url string) {
+	session.logger.Info("session: redirecting connection", zap.String("url", url))
+	session.messageManager.sendConnectRedirect(session.connectCsID, session.connectTransactionID, url)
+	session.err = fmt.Errorf("%w to %s", ErrRedirected, url)
+	session.active = false
 }
 
-func (session *Session) onStreamBegin() {
-	session.messageManager.requestPlay(session.streamKey)
+// onSetBufferLength is sent by players (usually before playing, and again when they change it) with the length of
+// the buffer of a stream.
+func (session *Session) onSetBufferLength(streamID uint32, milliseconds uint32) {
+	session.logger.Debug("session: set buffer length", zap.Uint32("stream_id", streamID), zap.Uint32("buffer_length_ms", milliseconds))
+	// The message doesn't create a stream: players send it for the streams they created (or are about to play), and
+	// for stream 0 (the connection), whose buffer length doesn't matter
+	stream, exists := session.streams[streamID]
+	if !exists {
+		return
+	}
+	stream.bufferLength.Store(int64(time.Duration(milliseconds) * time.Millisecond))
+}
+
+func (session *Session) onStreamBegin(streamID uint32) {
+	session.logger.Debug("session: stream begin", zap.Uint32("stream_id", streamID))
+}
+
+// Ping sends a PingRequest user control message to the peer, and returns the round-trip time once the peer answers
+// it with a PingResponse, or the error of ctx if it's done first.
+func (session *Session) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	// The timestamp (the time since the session started, in milliseconds) identifies the request, since the response
+	// echoes it
+	timestamp := uint32(start.Sub(session.startTime).Milliseconds())
+	response := make(chan struct{})
+	session.pingMutex.Lock()
+	if session.pings == nil {
+		session.pings = make(map[uint32]chan struct{})
+	}
+	for session.pings[timestamp] != nil {
+		timestamp++
+	}
+	session.pings[timestamp] = response
+	session.pingMutex.Unlock()
+	defer func() {
+		session.pingMutex.Lock()
+		delete(session.pings, timestamp)
+		session.pingMutex.Unlock()
+	}()
+
+	if err := session.messageManager.sendPingRequest(timestamp); err != nil {
+		return 0, err
+	}
+	select {
+	case <-response:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (session *Session) onPingResponse(timestamp uint32) {
+	session.pingMutex.Lock()
+	response := session.pings[timestamp]
+	delete(session.pings, timestamp)
+	session.pingMutex.Unlock()
+	if response == nil {
+		session.logger.Debug("session: ignoring ping response that doesn't match any ping request", zap.Uint32("timestamp", timestamp))
+		return
+	}
+	close(response)
 }
 
 func (session *Session) onStatus(info map[string]any) {
 	level, exists := info["level"]
 	if !exists {
-		fmt.Println("session: onStatus: no 'level' in info object")
+		session.logger.Warn("session: onStatus: no 'level' in info object")
 		return
 	}
 	code, exists := info["code"]
 	if !exists {
-		fmt.Println("session: onStatus: no 'code' in info object")
+		session.logger.Warn("session: onStatus: no 'code' in info object")
+		return
+	}
+	if session.OnStatus != nil {
+		codeString, _ := code.(string)
+		session.OnStatus(codeString, info)
+	}
+	if code == "NetStream.Play.StreamNotFound" {
+		session.logger.Info("session: stream not found", zap.String("stream_key", session.streamKey))
+		session.err = fmt.Errorf("%w: %s", ErrStreamNotFound, session.streamKey)
+		session.active = false
 		return
 	}
 	if level == "error" {
-		fmt.Printf("session: onStatus error: %s, %+v\n", code, info)
+		session.logger.Error("session: onStatus error", zap.Any("code", code), zap.Any("info", info))
 		session.active = false
 		return
 	}
 
 	if level == "warning" {
-		fmt.Printf("session: onStatus warning: %s, %+v\n", code, info)
+		session.logger.Warn("session: onStatus warning", zap.Any("code", code), zap.Any("info", info))
 	}
 
 	switch code {
 	case "NetStream.Play.Start":
-		fmt.Println("received NetStream.Play.Start")
+		session.logger.Debug("session: received NetStream.Play.Start")
 		// TODO: set up transcoders
+	case "NetStream.Play.Stop", "NetStream.Play.UnpublishNotify":
+		// The stream ended, so there's nothing left to play
+		session.logger.Debug("session: stream ended, ending playback", zap.Any("code", code))
+		session.active = false
+	case "NetStream.Play.Reset", "NetStream.Play.PublishNotify", "NetStream.Data.Start":
+		// Informational statuses, only relevant to OnStatus
 	default:
-		fmt.Println("session: onStatus: received unknown code:", code)
+		session.logger.Warn("session: onStatus: received unknown code", zap.Any("code", code))
 	}
 }
 
@@ -280,27 +521,77 @@ func (session *Session) GetID() string {
 	return session.id
 }
 
+// Close ends the session by closing its connection, which makes the read loop of the session return.
+func (session *Session) Close() error {
+	if session.conn == nil {
+		return nil
+	}
+	return session.conn.Close()
+}
+
 func (session *Session) onWindowAckSizeReached(sequenceNumber uint32) {
 }
 
 func (session *Session) onConnect(csID uint32, transactionID float64, data amf.Metadata) {
+	if _, err := data.GetString("app"); err != nil {
+		session.logger.Warn("session: rejecting connect command with a missing or invalid app", zap.Error(err))
+		session.messageManager.sendConnectRejected(csID, transactionID, "The connect command object has a missing or invalid app.")
+		session.metrics.ConnectRejected()
+		session.err = fmt.Errorf("%w: %w", ErrMalformedCommand, err)
+		session.active = false
+		return
+	}
 	session.storeMetadata(data)
+	session.connectCsID = csID
+	session.connectTransactionID = transactionID
+
+	// Route the session to the broadcaster of its app
+	knownApp := session.broadcaster != nil && session.app == session.broadcaster.AppName()
+	if broadcaster, ok := session.apps[session.app]; ok {
+		session.broadcaster = broadcaster
+		knownApp = true
+	}
+
+	// Without a default broadcaster (see Server.Apps), there's no guard to check connections to unknown apps with
+	if session.broadcaster != nil {
+		if guard, ok := session.broadcaster.GetSessionGuard().(ConnectGuard); ok && !guard.CheckConnect(session) {
+			// If the guard redirected the session, the response was already sent
+			if session.active {
+				session.logger.Info("session: connection rejected by guard")
+				session.messageManager.sendConnectRejected(csID, transactionID, "Connection rejected.")
+				session.metrics.AuthFailed()
+				session.err = ErrConnectRejected
+				session.active = false
+			}
+			return
+		}
+	}
 
-	if session.app == session.broadcaster.AppName() {
+	if knownApp {
 		// Initiate connect sequence
 		// As per the specification, after the connect command, the server sends the protocol message Window Acknowledgment Size
-		session.messageManager.sendWindowAckSize(constants.DefaultClientWindowSize)
+		session.messageManager.sendWindowAckSize(session.windowAckSize)
 		// After sending the window ack size message, the server sends the set peer bandwidth message
-		session.messageManager.sendSetPeerBandWidth(constants.DefaultClientWindowSize, LimitDynamic)
+		session.messageManager.sendSetPeerBandWidth(session.windowAckSize, LimitDynamic)
 		// Send the User Control Message to begin stream with stream ID = DefaultPublishStream (which is 0)
 		// Subsequent messages sent by the client will have stream ID = DefaultPublishStream, until another sendBeginStream message is sent
 		session.messageManager.sendBeginStream(constants.DefaultPublishStream)
 		// Send Set Chunk Size message
 		session.messageManager.sendSetChunkSize(constants.DefaultChunkSize)
 		// Send Connect Success response
-		session.messageManager.sendConnectSuccess(csID)
+		session.messageManager.sendConnectSuccess(csID, session.serverVersion, session.serverCapabilities, session.objectEncoding)
+		// The response to connect confirms the AMF version, which the commands that follow are sent with
+		if session.objectEncoding == 3 {
+			session.messageManager.useAMF3Commands()
+		}
+		if session.bandwidthCheck {
+			session.messageManager.sendOnBWDone(csID)
+		}
 	} else {
-		fmt.Println("session: user trying to connect to app \"" + session.app + "\", but the app doesn't exist. Closing connection.")
+		session.logger.Warn("session: user trying to connect to an app that doesn't exist, closing connection", zap.String("app", session.app))
+		session.messageManager.sendConnectRejected(csID, transactionID, "Application \""+session.app+"\" doesn't exist.")
+		session.metrics.ConnectRejected()
+		session.err = fmt.Errorf("%w %q", ErrUnknownApp, session.app)
 		session.active = false
 	}
 }
@@ -309,12 +600,81 @@ func (session *Session) storeMetadata(metadata amf.Metadata) {
 	// Playback clients send other properties in the command object, such as what audio/video codecs the client supports
 	// We skip client metadata for now
 
-	session.app, _ = metadata.GetString("app")
+	session.connectObject = metadata
+	app, _ := metadata.GetString("app")
+	// Clients connecting to rtmp://host/app?token=... usually send the query string in the app name as well
+	session.app = session.addConnectParams(app)
 
 	session.flashVer, _ = metadata.GetString("flashVer")
 	session.swfUrl, _ = metadata.GetString("swfUrl")
 	session.tcUrl, _ = metadata.GetString("tcUrl")
 	session.amfType, _ = metadata.GetString("type")
+	if metadata.GetFloat64Default("objectEncoding", 0) == 3 && !session.disableAMF3 {
+		session.objectEncoding = 3
+	}
+	session.capabilities = parseClientCapabilities(metadata)
+	session.addConnectParams(session.tcUrl)
+}
+
+// addConnectParams adds the query parameters of s (a URL, an app name or a stream key) to the connect params of the
+// session, and returns s without its query string. If a parameter is set more than once, the first value is kept.
+func (session *Session) addConnectParams(s string) string {
+	path, rawQuery, found := strings.Cut(s, "?")
+	if !found {
+		return s
+	}
+	query, _ := url.ParseQuery(rawQuery)
+	if session.connectParams == nil {
+		session.connectParams = make(map[string]string, len(query))
+	}
+	for key, values := range query {
+		if _, exists := session.connectParams[key]; !exists && len(values) > 0 {
+			session.connectParams[key] = values[0]
+		}
+	}
+	return path
+}
+
+// ConnectParams returns the query parameters of the tcUrl, app and stream key sent by the client (eg: the token of
+// rtmp://host/app?token=...), so that a SessionGuard can authenticate the session. The stream key returned by
+// GetStreamKey doesn't include its query string.
+func (session *Session) ConnectParams() map[string]string {
+	params := make(map[string]string, len(session.connectParams))
+	for key, value := range session.connectParams {
+		params[key] = value
+	}
+	return params
+}
+
+// ConnectObject returns the command object of the connect command sent by the client (eg: its flashVer and tcUrl),
+// which can be decoded into a struct with Metadata.Unmarshal.
+func (session *Session) ConnectObject() amf.Metadata {
+	return session.connectObject
+}
+
+// FlashVer, TcUrl and SwfUrl return the properties of the same name of the connect command object sent by the client
+// (eg: "FMLE/3.0 (compatible; FMSc/1.0)" for the flashVer of an encoder), or "" if it didn't send them.
+func (session *Session) FlashVer() string {
+	return session.flashVer
+}
+
+func (session *Session) TcUrl() string {
+	return session.tcUrl
+}
+
+func (session *Session) SwfUrl() string {
+	return session.swfUrl
+}
+
+// App returns the app the client connected to, without its query string (see ConnectParams).
+func (session *Session) App() string {
+	return session.app
+}
+
+// ObjectEncoding returns the AMF version negotiated for the commands of the session: 3 if the client asked for AMF3 in
+// its connect command (unless Server.DisableAMF3 is set), 0 otherwise.
+func (session *Session) ObjectEncoding() float64 {
+	return session.objectEncoding
 }
 
 func (session *Session) onSetChunkSize(size uint32) {
@@ -335,7 +695,7 @@ func (session *Session) onSetBandwidth(windowAckSize uint32, limitType uint8) {
 	session.messageManager.SetBandwidth(windowAckSize, limitType)
 }
 
-func (session *Session) onMetadata(metadata map[string]any) {
+func (session *Session) onMetadata(streamID uint32, metadata map[string]any) {
 	// This is not for the RTMP server. RTMP servers don't have the option to specify callback. Only RTMP clients use this for now
 	if session.OnMetadata != nil {
 		session.OnMetadata(metadata)
@@ -346,68 +706,451 @@ func (session *Session) onMetadata(metadata map[string]any) {
 	if session.isClient {
 		return
 	}
+	stream := session.mediaStream(streamID, "metadata")
+	if stream == nil {
+		return
+	}
 
+	session.clientMetadata = parseClientMetadata(metadata)
+	// Cache the metadata so it can be restored along with the sequence headers (see Snapshotter)
+	if store, ok := session.broadcaster.(MetadataStore); ok {
+		store.SetMetadataForPublisher(stream.streamKey, metadata)
+	}
 	// TODO: broadcast metadata to client
-	session.broadcaster.BroadcastMetadata(session.streamKey, metadata)
+	session.broadcaster.BroadcastMetadata(stream.streamKey, metadata)
+	if stream.pendingRecording {
+		session.startPendingRecording(stream, metadata)
+	}
+	if stream.recorder != nil {
+		session.checkRecording(stream, stream.recorder.writeMetadata(metadata))
+	}
 	//if constants.Debug {
 	//	fmt.Printf("clientMetadata %+v", session.clientMetadata)
 	//}
 }
 
+// onReleaseStream is sent by publishers (eg: OBS, FFmpeg) before publishing streamKey, to release it if it's still
+// published from a previous attempt. If this session publishes it, it's unpublished. If nobody publishes it, the
+// sequence headers and metadata cached for its last publisher are cleared, so that they aren't sent to players of the
+// new one.
 func (session *Session) onReleaseStream(csID uint32, transactionID float64, args map[string]any, streamKey string) {
+	streamKey, _, _ = strings.Cut(streamKey, "?")
+	if stream := session.publishedStream(streamKey); stream != nil {
+		session.closeStream(stream)
+	}
+	if !session.broadcaster.StreamExists(streamKey) {
+		session.broadcaster.SetAvcSequenceHeaderForPublisher(streamKey, nil)
+		session.broadcaster.SetAacSequenceHeaderForPublisher(streamKey, nil)
+		if store, ok := session.broadcaster.(MetadataStore); ok {
+			store.SetMetadataForPublisher(streamKey, nil)
+		}
+	}
+}
+
+// publishedStream returns the net stream of the session that publishes streamKey, or nil if there's none.
+func (session *Session) publishedStream(streamKey string) *netStream {
+	for _, stream := range session.streams {
+		if stream.publishing && stream.streamKey == streamKey {
+			return stream
+		}
+	}
+	return nil
 }
 
 func (session *Session) onFCPublish(csID uint32, transactionID float64, args map[string]any, streamKey string) {
 	session.messageManager.sendOnFCPublish(csID, transactionID, streamKey)
 }
 
+// onFCSubscribe is sent by some players (eg: for CDNs that pull the stream on demand) before playing streamKey. The
+// stream is played with play, so FCSubscribe is only acknowledged.
+func (session *Session) onFCSubscribe(csID uint32, transactionID float64, args map[string]any, streamKey string) {
+	session.messageManager.sendOnFCSubscribe(csID, transactionID, streamKey)
+}
+
+// onCheckBandwidth is sent by clients that check the bandwidth of the connection. The bandwidth isn't actually
+// measured: the check completes right away with onBWDone, which is all that these clients wait for.
+func (session *Session) onCheckBandwidth(csID uint32, transactionID float64) {
+	if !session.bandwidthCheck {
+		session.logger.Debug("session: ignoring checkBandwidth, the bandwidth check is disabled")
+		return
+	}
+	session.messageManager.sendCheckBandwidthResponse(csID, transactionID)
+	session.messageManager.sendOnBWDone(csID)
+}
+
+// streamRecorded returns true if streamKey is a recording played with PlayFile, if the broadcaster reports it (see
+// StatsBroadcaster).
+func (session *Session) streamRecorded(streamKey string) bool {
+	b, ok := session.broadcaster.(StatsBroadcaster)
+	if !ok {
+		return false
+	}
+	stats, ok := b.StreamStats(streamKey)
+	return ok && stats.Recorded
+}
+
+// onGetStreamLength is sent by some players before playing streamKey, to know its length in seconds: 0 for live
+// streams, or the duration of the file of recorded ones (from their metadata).
+func (session *Session) onGetStreamLength(csID uint32, transactionID float64, streamKey string) {
+	streamKey, _, _ = strings.Cut(streamKey, "?")
+	var length float64
+	if store, ok := session.broadcaster.(MetadataStore); ok && session.streamRecorded(streamKey) {
+		length, _ = amf.Metadata(store.GetMetadataForPublisher(streamKey)).GetFloat64("duration")
+	}
+	session.messageManager.sendGetStreamLengthResponse(csID, transactionID, length)
+}
+
 func (session *Session) onCreateStream(csID uint32, transactionID float64, data map[string]any) {
-	// data object could be nil
-	session.messageManager.sendCreateStreamResponse(csID, transactionID, data)
-	session.messageManager.sendBeginStream(uint32(constants.DefaultStreamID))
+	// Allocate the next unused message stream ID, starting at 1 (DefaultStreamID)
+	for {
+		session.lastStreamID++
+		if _, exists := session.streams[session.lastStreamID]; !exists {
+			break
+		}
+	}
+	stream := session.stream(session.lastStreamID)
+	session.messageManager.sendCreateStreamResponse(csID, transactionID, stream.id)
+	session.messageManager.sendBeginStream(stream.id)
+}
+
+// stream returns the net stream with the message stream ID id. Some clients publish or play without sending
+// createStream first, so the stream is created if it doesn't exist yet.
+func (session *Session) stream(id uint32) *netStream {
+	stream, exists := session.streams[id]
+	if !exists {
+		if session.streams == nil {
+			session.streams = make(map[uint32]*netStream)
+		}
+		stream = &netStream{session: session, id: id}
+		session.streams[id] = stream
+	}
+	return stream
+}
+
+// mediaStream returns the net stream that publishes the media received on the message stream ID streamID, or nil if
+// the media must be dropped rather than broadcast: media sent on a message stream that wasn't created (eg: stream 0,
+// the NetConnection) or that isn't publishing (eg: before the publish command) doesn't belong to any stream. Media on
+// streams that weren't created is logged as a warning once per stream ID, since it's usually sent by a client that
+// publishes on the wrong stream ID, for the first maxUnknownMediaStreams stream IDs. Beyond, it's only logged at debug
+// level.
+func (session *Session) mediaStream(streamID uint32, kind string) *netStream {
+	stream := session.streams[streamID]
+	if stream == nil {
+		_, logged := session.unknownMediaStreams[streamID]
+		switch {
+		case logged:
+		case len(session.unknownMediaStreams) < maxUnknownMediaStreams:
+			session.logger.Warn("session: dropping "+kind+" received on a stream that wasn't created", zap.Uint32("stream_id", streamID))
+			if session.unknownMediaStreams == nil {
+				session.unknownMediaStreams = make(map[uint32]struct{})
+			}
+			session.unknownMediaStreams[streamID] = struct{}{}
+		default:
+			session.logger.Debug("session: dropping "+kind+" received on a stream that wasn't created", zap.Uint32("stream_id", streamID))
+		}
+		return nil
+	}
+	if !stream.publishing {
+		session.logger.Debug("session: dropping "+kind+" received before publish", zap.Uint32("stream_id", streamID))
+		return nil
+	}
+	return stream
+}
+
+// closeStream stops publishing or playing on stream, removing it from the broadcaster.
+func (session *Session) closeStream(stream *netStream) {
+	if stream.playing {
+		session.logger.Debug("session: destroying subscriber", zap.Uint32("stream_id", stream.id))
+		session.broadcaster.DestroySubscriber(stream.streamKey, stream.GetID())
+		session.metrics.SubscriberRemoved()
+		stream.playing = false
+	}
+	if stream.publishing {
+		session.logger.Debug("session: destroying publisher", zap.Uint32("stream_id", stream.id))
+		stream.pendingRecording = false
+		session.stopRecording(stream)
+		// Broadcast end of stream
+		session.broadcaster.BroadcastEndOfStream(stream.streamKey)
+		session.broadcaster.DestroyPublisher(stream.streamKey)
+		session.metrics.PublisherStopped()
+		if guard := session.broadcaster.GetSessionGuard(); guard != nil {
+			// Guards identify the stream by the stream key of the session
+			session.streamKey = stream.streamKey
+			guard.End(session)
+		}
+		stream.publishing = false
+		// The connection stays open for its other net streams, so the publisher timeouts must not end it once none of
+		// them publishes anymore
+		if !session.isPublishing() {
+			session.stopPublisherTimers()
+			session.keyframes.stop()
+		}
+	}
 }
 
-func (session *Session) onPublish(transactionId float64, args map[string]any, streamKey string, publishingType string) {
+// startRecording starts recording the media published on stream to the file at path, appending to it if appendTo is
+// true. If the file can't be opened, the stream is still published, without being recorded.
+func (session *Session) startRecording(stream *netStream, path string, appendTo bool) {
+	r, err := newRecorder(path, appendTo)
+	if err != nil {
+		session.logger.Warn("session: error opening recording", zap.String("path", path), zap.Error(err))
+		session.messageManager.sendStatusMessage(stream.id, "error", "NetStream.Record.NoAccess", "Could not record stream: "+err.Error()+".", streamDetails(stream.streamKey))
+		return
+	}
+	session.logger.Info("session: recording stream", zap.String("path", path), zap.Bool("append", appendTo))
+	stream.recorder = r
+	session.messageManager.sendStatusMessage(stream.id, "status", "NetStream.Record.Start", "Recording stream.", streamDetails(stream.streamKey))
+}
+
+// startPendingRecording starts the recording of stream that waited for its metadata, in the file named by the
+// recordNameMetadata property of metadata if it has one, or after the stream key otherwise (eg: if metadata is nil,
+// because a frame was published first).
+func (session *Session) startPendingRecording(stream *netStream, metadata map[string]any) {
+	stream.pendingRecording = false
+	path := recordingPath(session.recordDir, stream.streamKey)
+	if name, ok := metadata[session.recordNameMetadata].(string); ok {
+		if namedPath, ok := metadataRecordingPath(session.recordDir, name); ok {
+			path = namedPath
+		} else {
+			session.logger.Warn("session: ignoring invalid recording name", zap.String("name", name))
+		}
+	}
+	session.startRecording(stream, path, stream.appendRecording)
+}
+
+// record writes an audio or video message published on stream to its recording, if it's recorded.
+func (session *Session) record(stream *netStream, tagType flv.TagType, data []byte, timestamp uint32) {
+	if stream.pendingRecording {
+		session.startPendingRecording(stream, nil)
+	}
+	if stream.recorder != nil {
+		session.checkRecording(stream, stream.recorder.write(tagType, data, timestamp))
+	}
+}
+
+// checkRecording stops recording stream if err (returned while writing its recording) isn't nil.
+func (session *Session) checkRecording(stream *netStream, err error) {
+	if err != nil {
+		session.logger.Warn("session: error recording stream", zap.Error(err))
+		session.stopRecording(stream)
+	}
+}
+
+// stopRecording closes the recording of stream, if it's recorded.
+func (session *Session) stopRecording(stream *netStream) {
+	if stream.recorder == nil {
+		return
+	}
+	if err := stream.recorder.close(); err != nil {
+		session.logger.Warn("session: error closing recording", zap.Error(err))
+	}
+	stream.recorder = nil
+	session.messageManager.sendStatusMessage(stream.id, "status", "NetStream.Record.Stop", "Stopped recording stream.", streamDetails(stream.streamKey))
+}
+
+// isPublishing returns true if any net stream of the session is publishing.
+func (session *Session) isPublishing() bool {
+	for _, stream := range session.streams {
+		if stream.publishing {
+			return true
+		}
+	}
+	return false
+}
+
+// stopPublisherTimers stops the sequence header timer and the idle watcher, so that they can be started again by the
+// next publish command.
+func (session *Session) stopPublisherTimers() {
+	if session.sequenceHeaderTimer != nil {
+		session.sequenceHeaderTimer.Stop()
+		session.sequenceHeaderTimer = nil
+	}
+	if session.idleDone != nil {
+		close(session.idleDone)
+		session.idleDone = nil
+	}
+}
+
+func (session *Session) onPublish(streamID uint32, transactionId float64, args map[string]any, streamKey string, publishingType string) {
 	// TODO: Handle things like look up the user's stream key, check if it's valid.
 	// TODO: For example: twitch returns "Publishing live_user_<username>" in the description.
-	// TODO: Handle things like recording into a file if publishingType = "record" or "append". Or always record?
 
+	stream := session.stream(streamID)
+	streamKey = session.addConnectParams(streamKey)
+	if session.streamKey == "" {
+		session.addLogFields(zap.String("stream_key", streamKey))
+	}
 	session.streamKey = streamKey
 	session.publishingType = publishingType
 
+	switch publishingType {
+	case PublishingTypeLive, PublishingTypeRecord, PublishingTypeAppend:
+	default:
+		session.logger.Info("session: rejecting publisher with an unknown publishing type", zap.String("publishing_type", publishingType))
+		session.messageManager.sendStatusMessage(stream.id, "error", "NetStream.Publish.Denied", "Unknown publishing type "+publishingType+".", streamDetails(streamKey))
+		session.active = false
+		return
+	}
+
 	if guard := session.broadcaster.GetSessionGuard(); guard != nil {
 		if !guard.Check(session) {
-			session.SendEndOfStream()
+			session.metrics.AuthFailed()
+			stream.SendEndOfStream()
 			session.active = false
 			return
 		}
 	}
 
-	session.messageManager.sendStatusMessage("status", "NetStream.Publish.Start", "Publishing live_user_<x>")
-	session.isPublisher = true
-	session.broadcaster.RegisterPublisher(streamKey)
+	// The publisher is only told it's publishing once the stream is registered: otherwise, it would start sending media
+	// that's discarded
+	if err := session.broadcaster.RegisterPublisher(streamKey); err != nil {
+		session.logger.Info("session: rejecting publisher", zap.Error(err))
+		code, description := "NetStream.Publish.Denied", "Could not publish stream: "+err.Error()+"."
+		if errors.Is(err, ErrStreamAlreadyPublished) {
+			code, description = "NetStream.Publish.BadName", "Stream "+streamKey+" is already being published."
+		}
+		session.messageManager.sendStatusMessage(stream.id, "error", code, description, streamDetails(streamKey))
+		session.active = false
+		return
+	}
+	session.messageManager.sendStatusMessage(stream.id, "status", "NetStream.Publish.Start", "Publishing live_user_<x>", nil)
+	stream.streamKey = streamKey
+	stream.publishing = true
+	session.keyframes.start(streamKey, time.Now())
+	session.metrics.PublisherStarted()
+	if publishingType != PublishingTypeLive && session.recordDir != "" {
+		if session.recordNameMetadata != "" {
+			stream.pendingRecording = true
+			stream.appendRecording = publishingType == PublishingTypeAppend
+		} else {
+			session.startRecording(stream, recordingPath(session.recordDir, streamKey), publishingType == PublishingTypeAppend)
+		}
+	}
+
+	// The timeouts are enforced on the connection, so they're only started by the first stream it publishes
+	if session.sequenceHeaderTimeout > 0 && session.sequenceHeaderTimer == nil {
+		session.receivedSequenceHeader.Store(false)
+		session.sequenceHeaderTimer = time.AfterFunc(session.sequenceHeaderTimeout, func() {
+			session.onSequenceHeaderTimeout(stream.id)
+		})
+	}
+	if (session.idleTimeout > 0 || session.streamDryTimeout > 0) && session.idleDone == nil {
+		session.lastMediaTime.Store(time.Now().UnixNano())
+		session.idleDone = make(chan struct{})
+		go session.watchIdle(session.idleDone, streamKey)
+	}
+}
+
+// onSequenceHeaderTimeout is called (from the timer's goroutine) when sequenceHeaderTimeout has elapsed since the
+// session started publishing. Without a sequence header, players aren't able to decode the stream, so end it.
+func (session *Session) onSequenceHeaderTimeout(streamID uint32) {
+	if session.receivedSequenceHeader.Load() {
+		return
+	}
+	session.logger.Debug("session: no sequence header received from publisher, closing connection")
+	session.messageManager.sendStatusMessage(streamID, "error", "NetStream.Failed", "No sequence header received within "+session.sequenceHeaderTimeout.String()+".", nil)
+	session.Close()
 }
 
-func (session *Session) onFCUnpublish(args map[string]any, streamKey string) {
+// watchIdle closes the session when the publisher hasn't sent any audio/video message for idleTimeout, until done is
+// closed. Otherwise, the stream would stay live (with stale sequence headers) as long as the connection stays open.
+// Closing the session makes its read loop return, which broadcasts the end of the stream to its subscribers.
+// Before that, the subscribers of streamKey receive StreamDry once the publisher has been idle for streamDryTimeout,
+// and again every time it stops sending data after resuming.
+func (session *Session) watchIdle(done <-chan struct{}, streamKey string) {
+	timer := time.NewTimer(session.nextIdleCheck(0, false))
+	defer timer.Stop()
+	// Time of the last media message when StreamDry was sent, which is only sent again once the publisher sent another
+	var dryMediaTime int64
+	for {
+		select {
+		case <-timer.C:
+			lastMediaTime := session.lastMediaTime.Load()
+			idle := time.Since(time.Unix(0, lastMediaTime))
+			if session.idleTimeout > 0 && idle >= session.idleTimeout {
+				session.logger.Info("session: publisher idle, closing connection", zap.Duration("idle", idle))
+				session.Close()
+				return
+			}
+			if session.streamDryTimeout > 0 && idle >= session.streamDryTimeout && lastMediaTime != dryMediaTime {
+				dryMediaTime = lastMediaTime
+				session.logger.Debug("session: stream dry", zap.Duration("idle", idle))
+				if dry, ok := session.broadcaster.(StreamDryBroadcaster); ok {
+					dry.BroadcastStreamDry(streamKey)
+				}
+			}
+			timer.Reset(session.nextIdleCheck(idle, lastMediaTime == dryMediaTime))
+		case <-done:
+			return
+		}
+	}
+}
+
+// nextIdleCheck returns how long watchIdle waits for the next timeout, given how long the publisher has been idle, and
+// whether StreamDry was already sent since its last media message.
+func (session *Session) nextIdleCheck(idle time.Duration, dry bool) time.Duration {
+	wait := time.Duration(math.MaxInt64)
+	if session.idleTimeout > 0 {
+		wait = session.idleTimeout - idle
+	}
+	if session.streamDryTimeout > 0 {
+		dryWait := session.streamDryTimeout - idle
+		if dry {
+			// Check again later whether the publisher resumed sending data
+			dryWait = session.streamDryTimeout
+		}
+		if dryWait < wait {
+			wait = dryWait
+		}
+	}
+	return wait
+}
+
+// onFCUnpublish is sent by publishers when they stop publishing streamKey, usually before deleteStream (or instead of
+// it). The stream ends right away, instead of when the connection closes.
+func (session *Session) onFCUnpublish(csID uint32, transactionID float64, args map[string]any, streamKey string) {
+	streamKey, _, _ = strings.Cut(streamKey, "?")
+	stream := session.publishedStream(streamKey)
+	if stream == nil {
+		session.logger.Debug("session: FCUnpublish of a stream that isn't published", zap.String("unpublished_stream_key", streamKey))
+		return
+	}
+	session.closeStream(stream)
+	session.messageManager.sendOnFCUnpublish(csID, transactionID, streamKey)
+	session.messageManager.sendStatusMessage(stream.id, "status", "NetStream.Unpublish.Success", streamKey+" is now unpublished.", nil)
 }
 
 func (session *Session) onDeleteStream(args map[string]any, streamID float64) {
+	id := uint32(streamID)
+	if stream, exists := session.streams[id]; exists {
+		session.closeStream(stream)
+		delete(session.streams, id)
+	}
 }
 
 func (session *Session) SendEndOfStream() {
-	session.messageManager.sendStatusMessage("status", "NetStream.Play.Stop", "Stopped playing stream.")
+	session.messageManager.beginBatch()
+	defer session.messageManager.endBatch()
+	session.messageManager.sendStatusMessage(uint32(constants.DefaultStreamID), "status", "NetStream.Play.Stop", "Stopped playing stream.", nil)
+	session.messageManager.sendStreamEOF(uint32(constants.DefaultStreamID))
 }
 
-func (session *Session) onCloseStream(csID uint32, transactionId float64, args map[string]any) {
+func (session *Session) SendStreamDry() {
+	session.messageManager.sendStreamDry(uint32(constants.DefaultStreamID))
+}
 
+func (session *Session) onCloseStream(streamID uint32, transactionId float64, args map[string]any) {
+	if stream, exists := session.streams[streamID]; exists {
+		session.closeStream(stream)
+	}
 }
 
 // audioData is the full payload (it has the audio headers at the beginning of the payload), for easy forwarding
 // If format == audio.AAC, audioData will contain AACPacketType at index 1
-func (session *Session) onAudioMessage(format audio.Format, sampleRate audio.SampleRate, sampleSize audio.SampleSize, channels audio.Channel, payload []byte, timestamp uint32) {
+func (session *Session) onAudioMessage(streamID uint32, header audio.Header, payload []byte, timestamp uint32) {
 	// This is not for the RTMP server. RTMP servers don't have the option to specify callback. Only RTMP clients use this for now
 	if session.OnAudio != nil {
-		session.OnAudio(format, sampleRate, sampleSize, channels, payload, timestamp)
+		session.OnAudio(header.Format, header.SampleRate, header.SampleSize, header.Channels, payload, timestamp)
 		return
 	}
 
@@ -416,19 +1159,31 @@ func (session *Session) onAudioMessage(format audio.Format, sampleRate audio.Sam
 	if session.isClient {
 		return
 	}
-
-	// Cache aac sequence header to send to play back clients when they connect
-	if format == audio.AAC && audio.AACPacketType(payload[1]) == audio.AACSequenceHeader {
-		session.broadcaster.SetAacSequenceHeaderForPublisher(session.streamKey, payload)
+	stream := session.mediaStream(streamID, "audio")
+	if stream == nil {
+		return
 	}
-	session.broadcaster.BroadcastAudio(session.streamKey, payload, timestamp)
+	session.lastMediaTime.Store(time.Now().UnixNano())
+	session.traffic.addAudio(len(payload))
+
+	// Cache aac sequence header to send to play back clients when they connect (the configuration of codecs carried by
+	// extended headers, eg: Opus, is cached the same way)
+	if header.IsSequenceHeader() {
+		session.broadcaster.SetAacSequenceHeaderForPublisher(stream.streamKey, payload)
+		session.receivedSequenceHeader.Store(true)
+	} else if !header.Format.HasSequenceHeader() {
+		// Other formats don't have a sequence header
+		session.receivedSequenceHeader.Store(true)
+	}
+	session.broadcaster.BroadcastAudio(stream.streamKey, payload, timestamp)
+	session.record(stream, flv.TagAudio, payload, timestamp)
 }
 
 // videoData is the full payload (it has the video headers at the beginning of the payload), for easy forwarding
-func (session *Session) onVideoMessage(frameType video.FrameType, codec video.Codec, payload []byte, timestamp uint32) {
+func (session *Session) onVideoMessage(streamID uint32, header video.Header, payload []byte, timestamp uint32) {
 	// This is not for the RTMP server. RTMP servers don't have the option to specify callback. Only RTMP clients use this for now
 	if session.OnVideo != nil {
-		session.OnVideo(frameType, codec, payload, timestamp)
+		session.OnVideo(header.FrameType, header.Codec, payload, timestamp)
 		return
 	}
 
@@ -437,55 +1192,217 @@ func (session *Session) onVideoMessage(frameType video.FrameType, codec video.Co
 	if session.isClient {
 		return
 	}
+	stream := session.mediaStream(streamID, "video")
+	if stream == nil {
+		return
+	}
+	session.lastMediaTime.Store(time.Now().UnixNano())
+	session.traffic.addVideo(len(payload))
+
+	// cache avc sequence header to send to playback clients when they connect (HEVC and AV1 sequence headers, with or
+	// without an extended header, are cached the same way)
+	if header.IsSequenceHeader() {
+		session.broadcaster.SetAvcSequenceHeaderForPublisher(stream.streamKey, payload)
+		session.receivedSequenceHeader.Store(true)
+	} else {
+		if !header.Codec.HasSequenceHeader() {
+			// Other codecs don't have a sequence header
+			session.receivedSequenceHeader.Store(true)
+		}
+		if header.FrameType == video.KeyFrame {
+			session.onKeyframe(timestamp)
+		}
+	}
+	session.broadcaster.BroadcastVideo(stream.streamKey, payload, timestamp)
+	session.record(stream, flv.TagVideo, payload, timestamp)
+}
 
-	// cache avc sequence header to send to playback clients when they connect
-	if codec == video.H264 && video.AVCPacketType(payload[1]) == video.AVCSequenceHeader {
-		session.broadcaster.SetAvcSequenceHeaderForPublisher(session.streamKey, payload)
+// onKeyframe updates the keyframe stats of the publisher, logging them if keyframe diagnostics are enabled.
+func (session *Session) onKeyframe(timestamp uint32) {
+	stats := session.keyframes.onKeyframe(time.Now(), timestamp)
+	if !session.keyframeDiagnostics {
+		return
+	}
+	switch {
+	case stats.Keyframes == 1:
+		session.logger.Info("session: received first keyframe", zap.Duration("time_to_first_keyframe", stats.TimeToFirstKeyframe))
+	case session.longKeyframeInterval > 0 && stats.KeyframeInterval > session.longKeyframeInterval:
+		session.logger.Warn("session: long keyframe interval", zap.Duration("keyframe_interval", stats.KeyframeInterval))
+	default:
+		session.logger.Debug("session: received keyframe", zap.Duration("keyframe_interval", stats.KeyframeInterval))
 	}
-	session.broadcaster.BroadcastVideo(session.streamKey, payload, timestamp)
 }
 
-func (session *Session) onPlay(streamKey string, startTime float64) {
+// KeyframeStats returns the keyframe stats of the session, and false if the session isn't publishing.
+func (session *Session) KeyframeStats() (KeyframeStats, bool) {
+	return session.keyframes.get()
+}
+
+func (session *Session) onPlay(streamID uint32, streamKey string, startTime float64) {
+	stream := session.stream(streamID)
+	streamKey = session.addConnectParams(streamKey)
+	if session.streamKey == "" {
+		session.addLogFields(zap.String("stream_key", streamKey))
+	}
 	session.streamKey = streamKey
 
+	if guard, ok := session.broadcaster.GetSessionGuard().(PlayGuard); ok && !guard.CheckPlay(session) {
+		session.messageManager.sendStatusMessage(stream.id, "error", "NetStream.Play.Failed", "Not authorized to play this stream.", streamDetails(streamKey))
+		session.metrics.AuthFailed()
+		return
+	}
+
 	if !session.broadcaster.StreamExists(streamKey) {
-		session.messageManager.sendStatusMessage("error", "NetStream.Play.StreamNotFound", "not_found", streamKey)
+		session.messageManager.sendStatusMessage(stream.id, "error", "NetStream.Play.StreamNotFound", "Stream "+streamKey+" not found.", streamDetails(streamKey))
 		return
 	}
-	session.messageManager.sendStatusMessage("status", "NetStream.Play.Start", "Playing stream for live_user_<x>")
 	avcSeqHeader := session.broadcaster.GetAvcSequenceHeaderForPublisher(streamKey)
-	if avcSeqHeader != nil {
-		if constants.Debug {
-			fmt.Printf("sending video onPlay, sequence header with timestamp: 0, body size: %d\n", len(avcSeqHeader))
+	aacSeqHeader := session.broadcaster.GetAacSequenceHeaderForPublisher(streamKey)
+	if session.checkPlayerCodecs {
+		if description := session.unsupportedCodec(avcSeqHeader, aacSeqHeader); description != "" {
+			session.logger.Info("session: player doesn't support the codecs of the stream", zap.String("description", description))
+			session.messageManager.sendStatusMessage(stream.id, "error", "NetStream.Play.Failed", description, streamDetails(streamKey))
+			return
 		}
-		session.messageManager.sendVideo(avcSeqHeader, 0)
 	}
 
-	aacSeqHeader := session.broadcaster.GetAacSequenceHeaderForPublisher(streamKey)
+	stream.restartTimestamps()
+	// The net stream is the subscriber, so that the media is sent on the message stream ID it was played on. It's
+	// registered first, so that the player isn't sent Play.Start if it can't play the stream, and the media it's sent
+	// meanwhile (eg: the cached GOP) is held until it was sent Play.Start and the sequence headers.
+	stream.holdMedia()
+	if err := session.broadcaster.RegisterSubscriber(streamKey, stream); err != nil {
+		stream.releaseMedia(false)
+		session.logger.Warn("session: error registering subscriber", zap.Error(err))
+		session.messageManager.sendStatusMessage(stream.id, "error", "NetStream.Play.Failed", "Could not play stream: "+err.Error()+".", streamDetails(streamKey))
+		return
+	}
+	stream.streamKey = streamKey
+	stream.playing = true
+	session.metrics.SubscriberAdded()
+
+	// The status, the sequence headers and the cached GOP are flushed at once
+	session.messageManager.beginBatch()
+	defer session.messageManager.endBatch()
+
+	// Recordings are announced before they start playing, so that players enable seeking
+	if session.streamRecorded(streamKey) {
+		session.messageManager.sendStreamIsRecorded(stream.id)
+	}
+	session.messageManager.sendStatusMessage(stream.id, "status", "NetStream.Play.Start", "Playing stream for live_user_<x>", nil)
+	session.messageManager.sendRtmpSampleAccess(stream.id, true, true)
+	if avcSeqHeader != nil {
+		session.logger.Debug("session: sending video sequence header on play", zap.Int("size", len(avcSeqHeader)))
+		stream.sendVideo(avcSeqHeader, 0)
+	}
+
 	if aacSeqHeader != nil {
-		if constants.Debug {
-			fmt.Printf("sending audio onPlay, sequence header with timestamp: 0, body size: %d\n", len(aacSeqHeader))
+		session.logger.Debug("session: sending audio sequence header on play", zap.Int("size", len(aacSeqHeader)))
+		stream.sendAudio(aacSeqHeader, 0)
+	}
+	stream.releaseMedia(true)
+}
+
+// unsupportedCodec returns a description of the codec of the stream (known from its sequence headers) that the player
+// didn't advertise in its connect command, or "" if it supports them. Players that didn't advertise any codec are
+// assumed to support all of them.
+func (session *Session) unsupportedCodec(avcSeqHeader []byte, aacSeqHeader []byte) string {
+	if session.capabilities.VideoCodecs != 0 && len(avcSeqHeader) > 0 {
+		codec := video.ParseHeader(avcSeqHeader).Codec
+		if session.capabilities.VideoCodecs&codec.SupportFlag() == 0 {
+			return fmt.Sprintf("The stream is encoded with a video codec (%s) the player doesn't support.", codec)
 		}
-		session.messageManager.sendAudio(aacSeqHeader, 0)
 	}
+	if session.capabilities.AudioCodecs != 0 && len(aacSeqHeader) > 0 {
+		format := audio.ParseHeader(aacSeqHeader).Format
+		if session.capabilities.AudioCodecs&format.SupportFlag() == 0 {
+			return fmt.Sprintf("The stream is encoded with an audio codec (%s) the player doesn't support.", format)
+		}
+	}
+	return ""
+}
 
-	session.isPlayer = true
-	err := session.broadcaster.RegisterSubscriber(streamKey, session)
-	if err != nil {
-		// TODO: send failure response to client
+// ClientCapabilities returns the capabilities the client advertised in its connect command.
+func (session *Session) ClientCapabilities() ClientCapabilities {
+	return session.capabilities
+}
+
+// VideoCodec returns the video codec the publisher declared in the metadata of its stream, whether its encoder identified
+// it with a codec ID (like FFmpeg) or a FourCC (like OBS). It returns false if the publisher didn't declare a known
+// codec. The metadata itself is kept as the publisher sent it (see MetadataStore).
+func (session *Session) VideoCodec() (video.Codec, bool) {
+	return session.clientMetadata.videoCodec, session.clientMetadata.hasVideoCodec
+}
+
+// AudioFormat is like VideoCodec, for the audio format of the stream.
+func (session *Session) AudioFormat() (audio.Format, bool) {
+	return session.clientMetadata.audioFormat, session.clientMetadata.hasAudioFormat
+}
+
+// honorsSeek returns true if seek and play2 requests of the client are honored: the server allows it (liveSeek) and the
+// client advertised support for seeking.
+func (session *Session) honorsSeek() bool {
+	return session.liveSeek && session.capabilities.SupportsClientSeek()
+}
+
+// onSeek is called when a player seeks within the stream it's playing. Only live streams are served, and they aren't
+// buffered (there's no DVR window to seek in), so the seek can at most be honored by jumping to the live edge of the
+// stream. Otherwise, it fails.
+func (session *Session) onSeek(streamID uint32, milliseconds float64) {
+	stream, exists := session.streams[streamID]
+	if !exists || !stream.playing || !session.honorsSeek() {
+		session.logger.Debug("session: rejecting seek in a live stream", zap.Float64("milliseconds", milliseconds))
+		var streamKey string
+		if exists {
+			streamKey = stream.streamKey
+		}
+		session.messageManager.sendStatusMessage(streamID, "error", "NetStream.Seek.Failed", "Seeking is not supported on live streams.", streamDetails(streamKey))
+		return
+	}
+	session.logger.Debug("session: seeking to the live edge", zap.Float64("milliseconds", milliseconds))
+	session.messageManager.beginBatch()
+	defer session.messageManager.endBatch()
+	// Like FMS, the player is told that its playlist is reset before the seek is notified
+	session.messageManager.sendStatusMessage(streamID, "status", "NetStream.Play.Reset", "Playing and resetting "+stream.streamKey+".", streamDetails(stream.streamKey))
+	session.messageManager.sendStatusMessage(streamID, "status", "NetStream.Seek.Notify", "Seeking to the live edge of the stream.", streamDetails(stream.streamKey))
+	// The player flushes its buffers on seek, so it needs the sequence headers again to decode what comes next. They're
+	// sent the same way as on play (see onPlay).
+	if avcSeqHeader := session.broadcaster.GetAvcSequenceHeaderForPublisher(stream.streamKey); avcSeqHeader != nil {
+		stream.sendVideo(avcSeqHeader, 0)
+	}
+	if aacSeqHeader := session.broadcaster.GetAacSequenceHeaderForPublisher(stream.streamKey); aacSeqHeader != nil {
+		stream.sendAudio(aacSeqHeader, 0)
+	}
+}
+
+// onPlay2 is called when a player switches the stream it's playing on a net stream (eg: to another bitrate of the same
+// content), with the NetStreamPlayOptions object of the play2 command. Switching is only honored for clients that can
+// seek, since they can handle the discontinuity.
+func (session *Session) onPlay2(streamID uint32, options map[string]any) {
+	streamKey, err := amf.Metadata(options).GetString("streamName")
+	stream, exists := session.streams[streamID]
+	if err != nil || !exists || stream.publishing || !session.honorsSeek() {
+		session.logger.Debug("session: rejecting play2", zap.Any("options", options))
+		session.messageManager.sendStatusMessage(streamID, "error", "NetStream.Play.Failed", "Switching streams is not supported for this client.", nil)
+		return
 	}
+	session.closeStream(stream)
+	session.onPlay(streamID, streamKey, -1)
 }
 
+// SendAudio, SendVideo and SendMetadata send media on the first net stream of the session (DefaultStreamID).
 func (session *Session) SendAudio(audio []byte, timestamp uint32) {
-	session.messageManager.sendAudio(audio, timestamp)
+	session.traffic.addAudio(len(audio))
+	session.messageManager.sendAudio(uint32(constants.DefaultStreamID), audio, timestamp)
 }
 
 func (session *Session) SendVideo(video []byte, timestamp uint32) {
-	session.messageManager.sendVideo(video, timestamp)
+	session.traffic.addVideo(len(video))
+	session.messageManager.sendVideo(uint32(constants.DefaultStreamID), video, timestamp)
 }
 
 func (session *Session) SendMetadata(metadata map[string]any) {
-	session.messageManager.sendMetadata(metadata)
+	session.messageManager.sendMetadata(uint32(constants.DefaultStreamID), metadata)
 }
 
 func (session *Session) GetStreamKey() string {
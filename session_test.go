@@ -0,0 +1,1833 @@
+package rtmp_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codingpa-ws/rtmp"
+	"github.com/codingpa-ws/rtmp/amf"
+	"github.com/codingpa-ws/rtmp/amf/amf0"
+	"github.com/codingpa-ws/rtmp/flv"
+	"github.com/codingpa-ws/rtmp/rtmptest"
+	"github.com/codingpa-ws/rtmp/video"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// rejectingContext is a context store that doesn't accept subscribers.
+type rejectingContext struct {
+	*rtmp.InMemoryContext
+}
+
+func (rejectingContext) RegisterSubscriber(streamKey string, subscriber rtmp.Subscriber) error {
+	return errors.New("no subscribers allowed")
+}
+
+// TestPlayRegisterFailed checks that a player that can't be registered as a subscriber is sent Play.Failed, rather than
+// Play.Start.
+func TestPlayRegisterFailed(t *testing.T) {
+	b := rtmp.NewBroadcaster("app", rejectingContext{rtmp.NewInMemoryContext()})
+	s := &rtmp.Server{Logger: zap.NewNop(), Broadcaster: b}
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+
+	player := pipeStream(t, s)
+	if err := player.SendCommand(player.StreamID, "play", 0, nil, "live", float64(-2000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := player.ExpectStatus("NetStream.Play.Failed"); err != nil {
+		t.Errorf("player wasn't told that it can't play the stream: %v", err)
+	}
+}
+
+// publisherRejectingContext is a context store that doesn't accept publishers.
+type publisherRejectingContext struct {
+	*rtmp.InMemoryContext
+}
+
+func (publisherRejectingContext) RegisterPublisher(streamKey string) error {
+	return errors.New("no publishers allowed")
+}
+
+// TestPublishRegisterFailed checks that a publisher that can't be registered is sent Publish.Denied, and never
+// Publish.Start.
+func TestPublishRegisterFailed(t *testing.T) {
+	b := rtmp.NewBroadcaster("app", publisherRejectingContext{rtmp.NewInMemoryContext()})
+	s := &rtmp.Server{Logger: zap.NewNop(), Broadcaster: b}
+	publisher := pipeStream(t, s)
+	if err := publisher.SendCommand(publisher.StreamID, "publish", 0, nil, "live", "live"); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		command, err := publisher.ReadCommand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if command.Name != "onStatus" {
+			continue
+		}
+		if info := command.Info(); info["code"] != "NetStream.Publish.Denied" || info["level"] != "error" {
+			t.Errorf("publisher was sent %v, want NetStream.Publish.Denied", info)
+		}
+		break
+	}
+	if b.StreamExists("live") {
+		t.Error("the stream of the rejected publisher exists")
+	}
+}
+
+// TestPlayBurst checks what a player is sent when it starts playing a stream, in order: Play.Start, |RtmpSampleAccess,
+// the sequence headers, then the cached GOP.
+func TestPlayBurst(t *testing.T) {
+	s := newTestServer()
+	s.Broadcaster.(rtmp.GOPCacheBroadcaster).SetGOPCache(30)
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	avcSeqHeader := []byte{0x17, 0x00, 0, 0, 0, 0x01, 0x64}
+	keyframe := []byte{0x17, 0x01, 0, 0, 0, 0x65}
+	for _, frame := range [][]byte{avcSeqHeader, keyframe} {
+		if err := publisher.SendVideo(frame, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The publisher is sent nothing back, so a round trip guarantees the frames were broadcast
+	if _, err := publisher.CreateStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	player := pipeStream(t, s)
+	if err := player.SendCommand(player.StreamID, "play", 0, nil, "live", float64(-2000)); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for len(got) < 4 {
+		message, err := player.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch message.TypeID {
+		case rtmp.CommandMessageAMF0:
+			command, err := rtmptest.DecodeCommand(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if command.Name == "onStatus" {
+				got = append(got, command.Info()["code"].(string))
+			}
+		case rtmp.DataMessageAMF0:
+			values, err := rtmptest.DecodeValues(message.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, values[0].(string))
+		case rtmp.VideoMessage:
+			if reflect.DeepEqual(message.Payload, avcSeqHeader) {
+				got = append(got, "video sequence header")
+			} else {
+				got = append(got, "keyframe")
+			}
+		}
+	}
+	want := []string{"NetStream.Play.Start", "|RtmpSampleAccess", "video sequence header", "keyframe"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("player was sent %q, want %q", got, want)
+	}
+}
+
+// TestSetBufferLength checks that the GOP a player is sent when it starts playing is skipped if it's longer than the
+// buffer the player set for its stream.
+func TestSetBufferLength(t *testing.T) {
+	s := newTestServer()
+	s.Broadcaster.(rtmp.GOPCacheBroadcaster).SetGOPCache(30)
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	// A GOP spanning 1s
+	for timestamp := uint32(0); timestamp <= 1000; timestamp += 100 {
+		frame := []byte{0x27, 0x01, 0}
+		if timestamp == 0 {
+			frame[0] = 0x17
+		}
+		if err := publisher.SendVideo(frame, timestamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	streamID := publisher.StreamID
+	if _, err := publisher.CreateStream(); err != nil {
+		t.Fatal(err)
+	}
+	publisher.StreamID = streamID
+
+	tests := []struct {
+		name         string
+		bufferStream int
+		bufferLength uint32
+		gop          bool
+	}{
+		{"buffer unknown", -1, 0, true},
+		{"buffer longer than the GOP", 0, 2000, true},
+		{"buffer shorter than the GOP", 0, 500, false},
+		{"buffer of another stream", 7, 500, true},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			player := pipeStream(t, s)
+			if test.bufferStream >= 0 {
+				target := uint32(test.bufferStream)
+				if target == 0 {
+					target = player.StreamID
+				}
+				payload := binary.BigEndian.AppendUint16(nil, rtmp.EventSetBufferLength)
+				payload = binary.BigEndian.AppendUint32(payload, target)
+				payload = binary.BigEndian.AppendUint32(payload, test.bufferLength)
+				if err := player.WriteMessage(2, rtmp.UserControlMessage, 0, 0, payload); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := player.Play("live"); err != nil {
+				t.Fatal(err)
+			}
+			// The next frame marks the end of the burst
+			marker := []byte{0x27, 0x01, byte(i + 1)}
+			if err := publisher.SendVideo(marker, uint32(1100+100*i)); err != nil {
+				t.Fatal(err)
+			}
+			burst := 0
+			for {
+				message, err := player.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if message.TypeID != rtmp.VideoMessage {
+					continue
+				}
+				if bytes.Equal(message.Payload, marker) {
+					break
+				}
+				// The cached GOP also has the markers of the previous players
+				if message.Payload[2] == 0 {
+					burst++
+				}
+			}
+			if want := map[bool]int{true: 11, false: 0}[test.gop]; burst != want {
+				t.Errorf("player was sent %d frames before the live ones, want %d", burst, want)
+			}
+		})
+	}
+}
+
+// playFile loops a file of the tags on streamKey with PlayFile, until the end of the test.
+func playFile(t *testing.T, s *rtmp.Server, streamKey string, tags ...*flv.Tag) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), streamKey+".flv")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := flv.NewWriter(file, flv.Header{HasVideo: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range tags {
+		if err := w.WriteTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+
+	played := make(chan error, 1)
+	go func() { played <- s.Broadcaster.(rtmp.FilePlayer).PlayFile(streamKey, path, true) }()
+	t.Cleanup(func() {
+		s.Broadcaster.DestroyPublisher(streamKey)
+		if err := <-played; err != nil {
+			t.Errorf("PlayFile() = %v", err)
+		}
+	})
+	for !s.Broadcaster.StreamExists(streamKey) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestStreamIsRecorded checks that players of a file published with PlayFile are sent StreamIsRecorded before
+// NetStream.Play.Start, and players of live streams aren't.
+func TestStreamIsRecorded(t *testing.T) {
+	s := newTestServer()
+	playFile(t, s, "vod",
+		&flv.Tag{Type: flv.TagVideo, Timestamp: 0, Data: []byte{0x17, 0x01, 0}},
+		&flv.Tag{Type: flv.TagVideo, Timestamp: 40, Data: []byte{0x27, 0x01, 0}},
+	)
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+
+	for streamKey, recorded := range map[string]bool{"vod": true, "live": false} {
+		player := pipeStream(t, s)
+		player.SendCommand(player.StreamID, "play", 0, nil, streamKey, float64(-2000))
+		sentRecorded := false
+		for {
+			message, err := player.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message.TypeID == rtmp.UserControlMessage && bytes.Equal(message.Payload, []byte{0, byte(rtmp.EventStreamIsRecorded), 0, 0, 0, byte(player.StreamID)}) {
+				sentRecorded = true
+			}
+			if message.TypeID == rtmp.CommandMessageAMF0 {
+				if command, err := rtmptest.DecodeCommand(message); err == nil && command.Name == "onStatus" {
+					break
+				}
+			}
+		}
+		if sentRecorded != recorded {
+			t.Errorf("player of %s sent StreamIsRecorded before its first status: %t, want %t", streamKey, sentRecorded, recorded)
+		}
+	}
+}
+
+// TestGetStreamLength checks that getStreamLength is answered with the duration of recordings, and 0 for live and
+// unknown streams.
+func TestGetStreamLength(t *testing.T) {
+	s := newTestServer()
+	metadata, err := amf.Encode("onMetaData", amf0.ECMAArray{"duration": 12.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	playFile(t, s, "vod",
+		&flv.Tag{Type: flv.TagScriptData, Timestamp: 0, Data: metadata},
+		&flv.Tag{Type: flv.TagVideo, Timestamp: 0, Data: []byte{0x17, 0x01, 0}},
+		&flv.Tag{Type: flv.TagVideo, Timestamp: 40, Data: []byte{0x27, 0x01, 0}},
+	)
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	// The metadata of the file is cached once its first loop is played
+	for {
+		if stats, _ := s.Broadcaster.(rtmp.StatsBroadcaster).StreamStats("vod"); stats.VideoBytes > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	conn := pipeStream(t, s)
+	for streamKey, want := range map[string]float64{"vod": 12.5, "vod?token=x": 12.5, "live": 0, "unknown": 0} {
+		if err := conn.SendCommand(0, "getStreamLength", 7, nil, streamKey); err != nil {
+			t.Fatal(err)
+		}
+		result, err := conn.ExpectResult()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Name != "_result" || result.TransactionID != 7 || len(result.Args) != 1 || result.Args[0] != want {
+			t.Errorf("getStreamLength(%q) answered with %s %v %v, want _result 7 %v", streamKey, result.Name,
+				result.TransactionID, result.Args, want)
+		}
+	}
+}
+
+func TestFCSubscribe(t *testing.T) {
+	s := newTestServer()
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	conn := pipeStream(t, s)
+	if err := conn.SendCommand(0, "FCSubscribe", 5, nil, "live"); err != nil {
+		t.Fatal(err)
+	}
+	command, err := conn.ExpectCommand("onFCSubscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := command.Info()["code"]; code != "NetStream.Play.Start" {
+		t.Errorf("onFCSubscribe code = %v, want NetStream.Play.Start", code)
+	}
+	// The stream is still played with play
+	if err := conn.Play("live"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBandwidthCheck checks the commands clients are sent after connect and checkBandwidth, with and without the
+// bandwidth check.
+func TestBandwidthCheck(t *testing.T) {
+	tests := []struct {
+		name           string
+		bandwidthCheck bool
+		want           []string
+	}{
+		{"enabled", true, []string{"onBWDone 0", "_result 5", "onBWDone 0", "_result 6"}},
+		{"disabled", false, []string{"_result 6"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer()
+			s.BandwidthCheck = test.bandwidthCheck
+			conn, err := rtmptest.Pipe(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if err := conn.Connect("app"); err != nil {
+				t.Fatal(err)
+			}
+			conn.SendCommand(0, "checkBandwidth", 5, nil)
+			// The response to createStream follows everything sent before it
+			conn.SendCommand(0, "createStream", 6, nil)
+			var got []string
+			for {
+				command, err := conn.ReadCommand()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, fmt.Sprintf("%s %v", command.Name, command.TransactionID))
+				if command.Name == "_result" && command.TransactionID == 6 {
+					break
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("client was sent %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// TestTimestampRebasing joins a player to a stream at publisher timestamp 60000, and checks that the timestamps of the
+// media it's sent start from 0 after the sequence headers.
+func TestTimestampRebasing(t *testing.T) {
+	tests := []struct {
+		name     string
+		gopCache bool
+		want     []string
+	}{
+		{"live frames", false, []string{"video 0", "audio 0", "audio 0", "video 10", "video 50"}},
+		// The cached GOP starts the timeline, the frames muxed before it are sent with its first frame
+		{"cached GOP", true, []string{"video 0", "audio 0", "video 0", "video 40", "audio 70", "video 80", "video 120"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer()
+			if test.gopCache {
+				s.Broadcaster.(rtmp.GOPCacheBroadcaster).SetGOPCache(30)
+			}
+			publisher := pipeStream(t, s)
+			if err := publisher.Publish("live"); err != nil {
+				t.Fatal(err)
+			}
+			publisher.SendVideo([]byte{0x17, 0x00, 0, 0, 0}, 0)
+			publisher.SendAudio([]byte{0xaf, 0x00, 0x12, 0x10}, 0)
+			publisher.SendVideo([]byte{0x17, 0x01, 0, 0, 0}, 60000)
+			publisher.SendVideo([]byte{0x27, 0x01, 0, 0, 0}, 60040)
+			streamID := publisher.StreamID
+			if _, err := publisher.CreateStream(); err != nil {
+				t.Fatal(err)
+			}
+			publisher.StreamID = streamID
+
+			player := pipeStream(t, s)
+			if err := player.Play("live"); err != nil {
+				t.Fatal(err)
+			}
+			publisher.SendAudio([]byte{0xaf, 0x01, 0}, 60070)
+			publisher.SendVideo([]byte{0x27, 0x01, 0, 0, 0}, 60080)
+			publisher.SendVideo([]byte{0x17, 0x01, 0, 0, 0}, 60120)
+			var got []string
+			for len(got) < len(test.want) {
+				message, err := player.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch message.TypeID {
+				case rtmp.AudioMessage:
+					got = append(got, fmt.Sprintf("audio %d", message.Timestamp))
+				case rtmp.VideoMessage:
+					got = append(got, fmt.Sprintf("video %d", message.Timestamp))
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("player was sent %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// TestMediaOnUnknownStream checks that media sent on streams that weren't created isn't broadcast, and is only logged
+// for a bounded number of stream IDs.
+func TestMediaOnUnknownStream(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	s := newTestServer()
+	s.Logger = zap.New(core)
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	player := pipeStream(t, s)
+	if err := player.Play("live"); err != nil {
+		t.Fatal(err)
+	}
+
+	for streamID := uint32(10); streamID < 50; streamID++ {
+		if err := publisher.WriteMessage(rtmptest.VideoChannel, rtmp.VideoMessage, streamID, 0, []byte{0x17, 0x01, 0, 0, 0, 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := publisher.SendVideo([]byte{0x17, 0x01, 0, 0, 0, 2}, 40); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		message, err := player.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.TypeID == rtmp.VideoMessage {
+			if message.Payload[5] != 2 {
+				t.Errorf("player was sent video received on a stream that wasn't created")
+			}
+			break
+		}
+	}
+	if n := logs.FilterMessage("session: dropping video received on a stream that wasn't created").Len(); n != 16 {
+		t.Errorf("logged %d warnings, want 16", n)
+	}
+}
+
+// TestMultipleStreams publishes two streams from one connection and plays both from another one, and checks that the
+// media of each stream is routed by message stream ID.
+func TestMultipleStreams(t *testing.T) {
+	s := newTestServer()
+	publisher := pipeStream(t, s)
+	player := pipeStream(t, s)
+	publishStreams := make(map[string]uint32)
+	playStreams := make(map[uint32]string)
+	for i, streamKey := range []string{"a", "b"} {
+		if i > 0 {
+			if _, err := publisher.CreateStream(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := player.CreateStream(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := publisher.Publish(streamKey); err != nil {
+			t.Fatalf("publishing %s on stream %d: %v", streamKey, publisher.StreamID, err)
+		}
+		if err := player.Play(streamKey); err != nil {
+			t.Fatalf("playing %s on stream %d: %v", streamKey, player.StreamID, err)
+		}
+		publishStreams[streamKey] = publisher.StreamID
+		playStreams[player.StreamID] = streamKey
+	}
+	if len(playStreams) != 2 || publishStreams["a"] == publishStreams["b"] {
+		t.Fatalf("created the streams %v and %v, want two streams per connection", publishStreams, playStreams)
+	}
+
+	for i, streamKey := range []string{"a", "b", "a", "b"} {
+		payload := []byte{0x17, 0x01, 0, 0, 0, streamKey[0], byte(i)}
+		if err := publisher.WriteMessage(rtmptest.VideoChannel, rtmp.VideoMessage, publishStreams[streamKey], uint32(40*i), payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := make(map[string][]byte)
+	for len(got["a"])+len(got["b"]) < 4 {
+		message, err := player.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.TypeID != rtmp.VideoMessage {
+			continue
+		}
+		streamKey := playStreams[message.StreamID]
+		if message.Payload[5] != streamKey[0] {
+			t.Errorf("video of %c sent on the stream playing %q", message.Payload[5], streamKey)
+		}
+		got[streamKey] = append(got[streamKey], message.Payload[6])
+	}
+	if want := map[string][]byte{"a": {0, 2}, "b": {1, 3}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("player was sent frames %v, want %v", got, want)
+	}
+}
+
+// TestDeleteStream deletes one of the two streams published by a connection, and one of the two streams played by
+// another one, and checks that only the deleted streams are torn down.
+func TestDeleteStream(t *testing.T) {
+	s := newTestServer()
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("a"); err != nil {
+		t.Fatal(err)
+	}
+	deletedPublish := publisher.StreamID
+	if _, err := publisher.CreateStream(); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish("b"); err != nil {
+		t.Fatal(err)
+	}
+	playerA := pipeStream(t, s)
+	if err := playerA.Play("a"); err != nil {
+		t.Fatal(err)
+	}
+	playerB := pipeStream(t, s)
+	if err := playerB.Play("b"); err != nil {
+		t.Fatal(err)
+	}
+	deletedPlay := playerB.StreamID
+	if _, err := playerB.CreateStream(); err != nil {
+		t.Fatal(err)
+	}
+	if err := playerB.Play("b"); err != nil {
+		t.Fatal(err)
+	}
+	keptPlay := playerB.StreamID
+
+	publisher.SendCommand(0, "deleteStream", 0, nil, float64(deletedPublish))
+	playerB.SendCommand(0, "deleteStream", 0, nil, float64(deletedPlay))
+	if _, err := playerA.ExpectStatus("NetStream.Play.Stop"); err != nil {
+		t.Fatalf("the player of the deleted stream: %v", err)
+	}
+	// The stream key of the deleted stream can be published again
+	republisher := pipeStream(t, s)
+	if err := republisher.Publish("a"); err != nil {
+		t.Errorf("publishing the stream key of the deleted stream: %v", err)
+	}
+	if _, err := playerB.CreateStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Media sent on the deleted stream isn't broadcast anymore, and the other streams keep working
+	publisher.WriteMessage(rtmptest.VideoChannel, rtmp.VideoMessage, deletedPublish, 40, []byte{0x17, 0x01, 0, 0, 0, 1})
+	if err := publisher.SendVideo([]byte{0x17, 0x01, 0, 0, 0, 2}, 40); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := publisher.CreateStream(); err != nil {
+		t.Fatalf("the publisher disconnected after deleting one of its streams: %v", err)
+	}
+	for {
+		message, err := playerB.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.TypeID != rtmp.VideoMessage {
+			continue
+		}
+		if message.StreamID == deletedPlay {
+			t.Errorf("video sent on the deleted stream %d of the player", deletedPlay)
+		}
+		if message.Payload[5] != 2 {
+			t.Errorf("player was sent video received on the deleted stream of the publisher")
+		}
+		if message.StreamID == keptPlay {
+			break
+		}
+	}
+}
+
+func TestCheckPlayerCodecs(t *testing.T) {
+	tests := []struct {
+		name           string
+		sequenceHeader []byte
+		videoCodecs    float64
+		status         string
+	}{
+		{"HEVC stream, H.264 player", []byte{0x1c, 0x00, 0, 0, 0}, float64(video.SupportVidH264), "NetStream.Play.Failed"},
+		{"HEVC stream, player without codecs", []byte{0x1c, 0x00, 0, 0, 0}, 0, "NetStream.Play.Start"},
+		{"H.264 stream, H.264 player", []byte{0x17, 0x00, 0, 0, 0}, float64(video.SupportVidH264 | video.SupportVidVP6), "NetStream.Play.Start"},
+		{"H.264 stream, VP6 player", []byte{0x17, 0x00, 0, 0, 0}, float64(video.SupportVidVP6), "NetStream.Play.Failed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer()
+			s.CheckPlayerCodecs = true
+			publisher := pipeStream(t, s)
+			if err := publisher.Publish("live"); err != nil {
+				t.Fatal(err)
+			}
+			if err := publisher.SendVideo(test.sequenceHeader, 0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := publisher.CreateStream(); err != nil {
+				t.Fatal(err)
+			}
+
+			player, err := rtmptest.Pipe(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer player.Close()
+			player.SetDeadline(time.Now().Add(5 * time.Second))
+			commandObject := map[string]any{"app": "app", "tcUrl": "rtmp://localhost/app"}
+			if test.videoCodecs != 0 {
+				commandObject["videoCodecs"] = test.videoCodecs
+			}
+			if err := player.ConnectWith(commandObject); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := player.CreateStream(); err != nil {
+				t.Fatal(err)
+			}
+			player.SendCommand(player.StreamID, "play", 0, nil, "live", float64(-2000))
+			info, err := player.ExpectStatus(test.status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.status == "NetStream.Play.Failed" && info["level"] != "error" {
+				t.Errorf("NetStream.Play.Failed level = %v, want error", info["level"])
+			}
+		})
+	}
+}
+
+// TestEnhancedVideo publishes streams of codecs carried by Enhanced RTMP extended video headers, and checks that a late
+// player is sent their sequence header first, then the cached GOP and the following frames unchanged.
+func TestEnhancedVideo(t *testing.T) {
+	tests := []struct {
+		name           string
+		sequenceHeader []byte
+		keyframe       []byte
+		interframe     []byte
+	}{
+		{
+			"HEVC",
+			// HEVCDecoderConfigurationRecord, then an IDR and a trailing picture NAL unit (without a composition time
+			// offset for the latter, like FFmpeg sends them)
+			[]byte{0x90, 'h', 'v', 'c', '1', 0x01, 0x01, 0x60, 0x00, 0x00, 0x00, 0x90, 0x00},
+			[]byte{0x91, 'h', 'v', 'c', '1', 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x26, 0x01},
+			[]byte{0xa3, 'h', 'v', 'c', '1', 0x00, 0x00, 0x00, 0x05, 0x02, 0x01},
+		},
+		{
+			"AV1",
+			// AV1CodecConfigurationRecord, then a temporal delimiter and a frame OBU
+			[]byte{0x90, 'a', 'v', '0', '1', 0x81, 0x08, 0x0c, 0x00, 0x0a, 0x0b},
+			[]byte{0x91, 'a', 'v', '0', '1', 0x12, 0x00, 0x32, 0x10, 0x10},
+			[]byte{0xa1, 'a', 'v', '0', '1', 0x12, 0x00, 0x32, 0x08, 0x30},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer()
+			s.Broadcaster.(rtmp.GOPCacheBroadcaster).SetGOPCache(30)
+			publisher := pipeStream(t, s)
+			if err := publisher.Publish("live"); err != nil {
+				t.Fatal(err)
+			}
+			// A GOP the player missed, then the one it's primed with
+			frames := [][]byte{test.sequenceHeader, test.keyframe, test.interframe, test.keyframe, test.interframe}
+			for i, frame := range frames {
+				if err := publisher.SendVideo(frame, uint32(40*i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The round trip guarantees the frames were broadcast, and the publisher keeps sending on its stream
+			streamID := publisher.StreamID
+			if _, err := publisher.CreateStream(); err != nil {
+				t.Fatal(err)
+			}
+			publisher.StreamID = streamID
+
+			player := pipeStream(t, s)
+			if err := player.Play("live"); err != nil {
+				t.Fatal(err)
+			}
+			if err := publisher.SendVideo(test.interframe, 200); err != nil {
+				t.Fatal(err)
+			}
+			want := [][]byte{test.sequenceHeader, test.keyframe, test.interframe, test.interframe}
+			var got [][]byte
+			for len(got) < len(want) {
+				message, err := player.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if message.TypeID == rtmp.VideoMessage {
+					got = append(got, message.Payload)
+				}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("player was sent %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+// TestFCUnpublish stops publishing a stream with FCUnpublish the way OBS and FFmpeg do, and publishes it again on the
+// same connection after releaseStream.
+func TestFCUnpublish(t *testing.T) {
+	s := newTestServer()
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	publisher.SendVideo([]byte{0x17, 0x00, 0, 0, 0, 1}, 0)
+	player := pipeStream(t, s)
+	if err := player.Play("live"); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher.SendCommand(0, "FCUnpublish", 5, nil, "live")
+	if _, err := publisher.ExpectStatus("NetStream.Unpublish.Success"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := player.ExpectStatus("NetStream.Play.Stop"); err != nil {
+		t.Fatalf("the player of the unpublished stream: %v", err)
+	}
+
+	publisher.SendCommand(0, "releaseStream", 6, nil, "live")
+	publisher.SendCommand(0, "FCPublish", 7, nil, "live")
+	if _, err := publisher.CreateStream(); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatalf("publishing again after FCUnpublish: %v", err)
+	}
+	player = pipeStream(t, s)
+	if err := player.Play("live"); err != nil {
+		t.Fatal(err)
+	}
+	// The sequence header of the previous publication isn't sent to the players of the new one
+	publisher.SendVideo([]byte{0x17, 0x00, 0, 0, 0, 2}, 0)
+	for {
+		message, err := player.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.TypeID == rtmp.VideoMessage {
+			if message.Payload[5] != 2 {
+				t.Errorf("player was sent the sequence header of the previous publication")
+			}
+			break
+		}
+	}
+}
+
+// TestSkipMalformedMessages sends messages that can't be handled by a publisher, followed by a video message of several
+// chunks, and checks that they only end the session if SkipMalformedMessages isn't set.
+func TestSkipMalformedMessages(t *testing.T) {
+	malformed := []struct {
+		typeID  uint8
+		payload []byte
+	}{
+		// Metadata whose object is cut short
+		{rtmp.DataMessageAMF0, []byte{0x02, 0x00, 0x0a, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a', 0x03, 0x00, 0x05, 'w'}},
+		// A command whose name isn't a string
+		{rtmp.CommandMessageAMF0, []byte{0x00, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0}},
+		// A user control message too short for its event
+		{rtmp.UserControlMessage, []byte{0x00, 0x00, 0x00}},
+	}
+	for _, skip := range []bool{true, false} {
+		t.Run(fmt.Sprintf("skip=%t", skip), func(t *testing.T) {
+			core, logs := observer.New(zap.WarnLevel)
+			s := newTestServer()
+			s.Logger = zap.New(core)
+			s.SkipMalformedMessages = skip
+			publisher := pipeStream(t, s)
+			if err := publisher.Publish("live"); err != nil {
+				t.Fatal(err)
+			}
+			player := pipeStream(t, s)
+			if err := player.Play("live"); err != nil {
+				t.Fatal(err)
+			}
+			for _, message := range malformed {
+				csID, streamID := uint32(rtmptest.DataChannel), publisher.StreamID
+				if message.typeID == rtmp.UserControlMessage {
+					csID, streamID = 2, 0
+				}
+				publisher.WriteMessage(csID, message.typeID, streamID, 0, message.payload)
+			}
+			// Larger than the chunk size, so that the session reads it in sync only if it consumed the messages above
+			frame := append([]byte{0x17, 0x01, 0, 0, 0}, bytes.Repeat([]byte{0xab}, 500)...)
+			publisher.SendVideo(frame, 40)
+
+			_, err := publisher.CreateStream()
+			if !skip {
+				if err == nil {
+					t.Error("the session survived malformed messages without SkipMalformedMessages")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("the session ended after skipping malformed messages: %v", err)
+			}
+			if n := logs.FilterMessage("message manager: skipping message that couldn't be handled").Len(); n != len(malformed) {
+				t.Errorf("skipped %d messages, want %d", n, len(malformed))
+			}
+			for {
+				message, err := player.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if message.TypeID == rtmp.VideoMessage {
+					if !bytes.Equal(message.Payload, frame) {
+						t.Errorf("player was sent %d bytes of video, want the frame sent after the malformed messages", len(message.Payload))
+					}
+					break
+				}
+			}
+		})
+	}
+}
+
+// TestAMF3Commands sends connect and createStream in AMF3 command messages, whose command object is an AMF3 object
+// (after the AVM+ marker), as Flash Player does once objectEncoding is 3.
+func TestAMF3Commands(t *testing.T) {
+	conn, err := rtmptest.Pipe(newTestServer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	connect, _ := hex.DecodeString("00" + // AMF3 command message format
+		"020007636f6e6e656374" + // "connect"
+		"003ff0000000000000" + // 1
+		"11" + "0a0b01" + // AVM+ marker, and an anonymous object with the properties
+		"07617070" + "0600" + // "app": <reference to "app">
+		"0b746355726c" + "0629" + "72746d703a2f2f6c6f63616c686f73742f617070" + // "tcUrl": "rtmp://localhost/app"
+		"1d6f626a656374456e636f64696e67" + "0403" + // "objectEncoding": 3
+		"01")
+	createStream, _ := hex.DecodeString("00" + "02000c63726561746553747265616d" + "004000000000000000" + "05")
+	conn.WriteMessage(3, rtmp.CommandMessageAMF3, 0, 0, connect)
+	command, err := conn.ExpectResult()
+	if err != nil {
+		t.Fatalf("AMF3 connect: %v", err)
+	}
+	if info := command.Info(); info["code"] != rtmp.NetConnectionSucces || info["objectEncoding"] != 3.0 {
+		t.Errorf("AMF3 connect answered with %s %v, want it accepted with objectEncoding 3", command.Name, info)
+	}
+	conn.WriteMessage(3, rtmp.CommandMessageAMF3, 0, 0, createStream)
+	command, err = conn.ExpectResult()
+	if err != nil {
+		t.Fatalf("AMF3 createStream: %v", err)
+	}
+	if len(command.Args) == 0 || command.Args[len(command.Args)-1] != 1.0 {
+		t.Errorf("AMF3 createStream answered with %v, want stream 1", command.Args)
+	}
+	if command.Message.TypeID != rtmp.CommandMessageAMF3 {
+		t.Errorf("createStream answered in a message of type %d, want %d", command.Message.TypeID, rtmp.CommandMessageAMF3)
+	}
+}
+
+// TestCommandObjectEncoding checks that the commands sent after the response to connect are AMF3 command messages to
+// clients that negotiated AMF3, and AMF0 command messages otherwise.
+func TestCommandObjectEncoding(t *testing.T) {
+	tests := []struct {
+		objectEncoding float64
+		want           uint8
+	}{
+		{0, rtmp.CommandMessageAMF0},
+		{3, rtmp.CommandMessageAMF3},
+	}
+	for _, test := range tests {
+		conn, err := rtmptest.Pipe(newTestServer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := conn.ConnectWith(map[string]any{"app": "app", "objectEncoding": test.objectEncoding}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.CreateStream(); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.SendCommand(conn.StreamID, "publish", 0, nil, "live", "live"); err != nil {
+			t.Fatal(err)
+		}
+		command, err := conn.ExpectCommand("onStatus")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if command.Message.TypeID != test.want {
+			t.Errorf("objectEncoding %v: onStatus sent in a message of type %d, want %d", test.objectEncoding, command.Message.TypeID, test.want)
+		}
+		if code := command.Info()["code"]; code != "NetStream.Publish.Start" {
+			t.Errorf("objectEncoding %v: onStatus code %v, want NetStream.Publish.Start", test.objectEncoding, code)
+		}
+	}
+}
+
+// TestSeekLiveEdge checks that a player that can seek is reset to the live edge of the stream when it seeks, and sent
+// the sequence headers again, while the other players are told that seeking failed.
+func TestSeekLiveEdge(t *testing.T) {
+	s := newTestServer()
+	s.LiveSeek = true
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	avcSeqHeader := []byte{0x17, 0x00, 0, 0, 0, 0x01, 0x64}
+	if err := publisher.SendVideo(avcSeqHeader, 0); err != nil {
+		t.Fatal(err)
+	}
+	// The publisher is sent nothing back, so a round trip guarantees the sequence header was cached
+	if _, err := publisher.CreateStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		videoFunction float64
+		want          []string
+	}{
+		{"client seek", float64(rtmp.SupportVidClientSeek), []string{"NetStream.Play.Reset", "NetStream.Seek.Notify", "video sequence header"}},
+		{"no client seek", 0, []string{"NetStream.Seek.Failed"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			player, err := rtmptest.Pipe(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer player.Close()
+			player.SetDeadline(time.Now().Add(5 * time.Second))
+			if err := player.ConnectWith(map[string]any{"app": "app", "videoFunction": test.videoFunction}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := player.CreateStream(); err != nil {
+				t.Fatal(err)
+			}
+			if err := player.Play("live"); err != nil {
+				t.Fatal(err)
+			}
+			// Skip |RtmpSampleAccess and the sequence header sent on play
+			for {
+				message, err := player.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if message.TypeID == rtmp.VideoMessage {
+					break
+				}
+			}
+
+			if err := player.SendCommand(player.StreamID, "seek", 0, nil, float64(1000)); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for len(got) < len(test.want) {
+				message, err := player.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				switch message.TypeID {
+				case rtmp.CommandMessageAMF0:
+					command, err := rtmptest.DecodeCommand(message)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, command.Info()["code"].(string))
+				case rtmp.VideoMessage:
+					if !reflect.DeepEqual(message.Payload, avcSeqHeader) {
+						t.Fatalf("player was sent video %x, want the sequence header", message.Payload)
+					}
+					got = append(got, "video sequence header")
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("player was sent %q on seek, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// TestRecordNameMetadata checks that a publisher names its recording with the metadata it sends before its first frame,
+// and that the name it sends can't place the recording outside of the recording directory.
+func TestRecordNameMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]any
+		want     string
+	}{
+		{"named", map[string]any{"recordName": "show.flv"}, "show.flv"},
+		{"traversal", map[string]any{"recordName": "../../etc/cron.d/show"}, "..%2F..%2Fetc%2Fcron.d%2Fshow.flv"},
+		{"not named", map[string]any{"width": 1280.0}, "live.flv"},
+		{"frame first", nil, "live.flv"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer()
+			s.RecordDir = t.TempDir()
+			s.RecordNameMetadata = "recordName"
+			publisher := pipeStream(t, s)
+			if err := publisher.SendCommand(publisher.StreamID, "publish", 0, nil, "live", "record"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := publisher.ExpectStatus("NetStream.Publish.Start"); err != nil {
+				t.Fatal(err)
+			}
+			if test.metadata != nil {
+				publisher.SendMetadata(test.metadata)
+			}
+			publisher.SendVideo([]byte{0x17, 0x01, 0}, 0)
+			if _, err := publisher.ExpectStatus("NetStream.Record.Start"); err != nil {
+				t.Fatal(err)
+			}
+			publisher.SendCommand(0, "deleteStream", 0, nil, float64(publisher.StreamID))
+			if _, err := publisher.ExpectStatus("NetStream.Record.Stop"); err != nil {
+				t.Fatal(err)
+			}
+
+			entries, err := os.ReadDir(s.RecordDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			if !reflect.DeepEqual(names, []string{test.want}) {
+				t.Errorf("recorded %q, want %q", names, test.want)
+			}
+		})
+	}
+}
+
+// TestSequenceHeaderTimeout checks that a publisher sending frames without a sequence header is disconnected once
+// SequenceHeaderTimeout elapses, and that one that sent a sequence header isn't.
+func TestSequenceHeaderTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		frames       [][]byte
+		disconnected bool
+	}{
+		{"frames only", [][]byte{{0x17, 0x01, 0}, {0x27, 0x01, 0}}, true},
+		{"sequence header", [][]byte{{0x17, 0x00, 0}, {0x17, 0x01, 0}, {0x27, 0x01, 0}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer()
+			s.SequenceHeaderTimeout = 50 * time.Millisecond
+			publisher := pipeStream(t, s)
+			if err := publisher.Publish("live"); err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			for i, frame := range test.frames {
+				publisher.SendVideo(frame, uint32(40*i))
+			}
+
+			if !test.disconnected {
+				time.Sleep(3 * s.SequenceHeaderTimeout)
+				if _, err := publisher.CreateStream(); err != nil {
+					t.Errorf("publisher with a sequence header disconnected: %v", err)
+				}
+				return
+			}
+			info, err := publisher.ExpectStatus("NetStream.Failed")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed < s.SequenceHeaderTimeout {
+				t.Errorf("publisher failed after %s, before the timeout", elapsed)
+			}
+			if info["level"] != "error" {
+				t.Errorf("NetStream.Failed level = %v, want error", info["level"])
+			}
+			if _, err := publisher.ReadMessage(); err == nil {
+				t.Error("the connection is still open after NetStream.Failed")
+			}
+		})
+	}
+}
+
+func TestPublisherIdleTimeout(t *testing.T) {
+	s := newTestServer()
+	s.PublisherIdleTimeout = 100 * time.Millisecond
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	player := pipeStream(t, s)
+	if err := player.Play("live"); err != nil {
+		t.Fatal(err)
+	}
+	// The publisher keeps sending frames for longer than the timeout before going idle
+	for i := 0; i < 5; i++ {
+		if err := publisher.SendVideo([]byte{0x17, 0x01, 0}, uint32(40*i)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(s.PublisherIdleTimeout / 2)
+	}
+	if _, err := publisher.CreateStream(); err != nil {
+		t.Fatalf("publisher sending frames disconnected: %v", err)
+	}
+	idle := time.Now()
+
+	if _, err := player.ExpectStatus("NetStream.Play.Stop"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(idle); elapsed < s.PublisherIdleTimeout/2 {
+		t.Errorf("the stream stopped %s after the publisher went idle, before the timeout", elapsed)
+	}
+	// The response to CreateStream may be followed by messages the publisher didn't read yet
+	for {
+		if _, err := publisher.ReadMessage(); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Error("the idle publisher's connection is still open")
+			}
+			break
+		}
+	}
+}
+
+// TestStreamEOFAndDry checks that a player is sent StreamDry for its stream each time the publisher stalls, and
+// StreamEOF after NetStream.Play.Stop once the stream ends.
+func TestStreamEOFAndDry(t *testing.T) {
+	s := newTestServer()
+	s.StreamDryTimeout = 100 * time.Millisecond
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	// The player plays on its second stream, whose ID isn't the default one
+	player := pipeStream(t, s)
+	if _, err := player.CreateStream(); err != nil {
+		t.Fatal(err)
+	}
+	if err := player.Play("live"); err != nil {
+		t.Fatal(err)
+	}
+	streamID := byte(player.StreamID)
+	dry := []byte{0, byte(rtmp.EventStreamDry), 0, 0, 0, streamID}
+	eof := []byte{0, byte(rtmp.EventStreamEOF), 0, 0, 0, streamID}
+
+	// next returns the next user control message (other than StreamBegin) or status code sent to the player, skipping
+	// the frames
+	next := func() string {
+		t.Helper()
+		for {
+			message, err := player.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch message.TypeID {
+			case rtmp.UserControlMessage:
+				if len(message.Payload) >= 2 && binary.BigEndian.Uint16(message.Payload) != rtmp.EventStreamBegin {
+					return fmt.Sprintf("%x", message.Payload)
+				}
+			case rtmp.CommandMessageAMF0:
+				command, err := rtmptest.DecodeCommand(message)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if command.Name == "onStatus" {
+					return command.Info()["code"].(string)
+				}
+			}
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := publisher.SendVideo([]byte{0x17, 0x01, 0}, uint32(40*i)); err != nil {
+			t.Fatal(err)
+		}
+		sent := time.Now()
+		if got := next(); got != fmt.Sprintf("%x", dry) {
+			t.Fatalf("player was sent %s after frame %d, want StreamDry %x", got, i, dry)
+		}
+		if elapsed := time.Since(sent); elapsed < s.StreamDryTimeout/2 {
+			t.Errorf("StreamDry sent %s after frame %d, before the timeout", elapsed, i)
+		}
+	}
+
+	publisher.Close()
+	for _, want := range []string{"NetStream.Play.Stop", fmt.Sprintf("%x", eof)} {
+		if got := next(); got != want {
+			t.Errorf("player was sent %s at the end of the stream, want %s", got, want)
+		}
+	}
+}
+
+// TestSetChunkSizeBurst sends a Set Chunk Size message and a video message chunked with the new size in a single write,
+// and checks that the server applies the chunk size before reading the video message.
+func TestSetChunkSizeBurst(t *testing.T) {
+	s := newTestServer()
+	clientConn, serverConn := rtmptest.NewPipe()
+	go s.ServeConn(serverConn)
+	publisher, err := rtmptest.NewConn(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	publisher.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := publisher.Connect("app"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := publisher.CreateStream(); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	player := pipeStream(t, s)
+	if err := player.Play("live"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A keyframe larger than the default chunk size of 128 bytes, which fits in a single chunk of 4096 bytes
+	video := make([]byte, 3000)
+	video[0], video[1] = 0x17, 0x01
+	for i := 2; i < len(video); i++ {
+		video[i] = byte(i)
+	}
+	var burst bytes.Buffer
+	// Type 0 headers: chunk stream ID, timestamp, message length, message type ID and message stream ID
+	burst.Write([]byte{rtmp.ProtocolChannel, 0, 0, 0, 0, 0, 4, rtmp.SetChunkSize, 0, 0, 0, 0})
+	binary.Write(&burst, binary.BigEndian, uint32(4096))
+	burst.Write([]byte{rtmp.VideoChannel, 0, 0, 0, 0, byte(len(video) >> 8), byte(len(video)), rtmp.VideoMessage})
+	binary.Write(&burst, binary.LittleEndian, publisher.StreamID)
+	burst.Write(video)
+	if _, err := clientConn.Write(burst.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		message, err := player.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.TypeID == rtmp.VideoMessage {
+			if !bytes.Equal(message.Payload, video) {
+				t.Errorf("player received %d bytes of video, want the %d bytes published", len(message.Payload), len(video))
+			}
+			return
+		}
+	}
+}
+
+// TestSessionLogFields checks that the logs of a session identify it, and the stream it publishes once it's known.
+func TestSessionLogFields(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	s := newTestServer()
+	s.Logger = zap.New(core)
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	publisher.SendCommand(0, "deleteStream", 0, nil, float64(publisher.StreamID))
+	// Commands are handled in order, so the stream is deleted once the result of the next one is received
+	if _, err := publisher.CreateStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	sessionLogs := logs.FilterMessageSnippet("session:").All()
+	if len(sessionLogs) == 0 {
+		t.Fatal("no session logs")
+	}
+	sessionID, _ := sessionLogs[0].ContextMap()["session_id"].(string)
+	if sessionID == "" {
+		t.Fatalf("%q logged without session_id", sessionLogs[0].Message)
+	}
+	for _, entry := range sessionLogs {
+		fields := entry.ContextMap()
+		if fields["session_id"] != sessionID {
+			t.Errorf("%q logged with session_id %v, want %v", entry.Message, fields["session_id"], sessionID)
+		}
+		if _, ok := fields["remote_addr"]; !ok {
+			t.Errorf("%q logged without remote_addr", entry.Message)
+		}
+	}
+	destroyed := logs.FilterMessage("session: destroying publisher").All()
+	if len(destroyed) != 1 || destroyed[0].ContextMap()["stream_key"] != "live" {
+		t.Errorf("destroying the publisher logged %v, want it logged once with the stream key", destroyed)
+	}
+}
+
+// TestMediaBeforePublish checks that media sent on a stream before it's published isn't broadcast.
+func TestMediaBeforePublish(t *testing.T) {
+	s := newTestServer()
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	player := pipeStream(t, s)
+	if err := player.Play("live"); err != nil {
+		t.Fatal(err)
+	}
+
+	early := pipeStream(t, s)
+	early.SendVideo([]byte{0x17, 0x01, 0, 0, 0, 1}, 0)
+	early.SendAudio([]byte{0xaf, 0x01, 1}, 0)
+	early.SendMetadata(map[string]any{"width": 1.0})
+	// The early media is handled before the publish command, which fails since the stream is already published
+	early.SendCommand(early.StreamID, "publish", 0, nil, "live", "live")
+	if _, err := early.ExpectStatus("NetStream.Publish.BadName"); err != nil {
+		t.Fatal(err)
+	}
+	publisher.SendVideo([]byte{0x17, 0x01, 0, 0, 0, 2}, 40)
+
+	for {
+		message, err := player.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch message.TypeID {
+		case rtmp.AudioMessage:
+			t.Fatal("player was sent audio sent before publishing")
+		case rtmp.DataMessageAMF0:
+			// Players are also sent |RtmpSampleAccess
+			if bytes.Contains(message.Payload, []byte("onMetaData")) {
+				t.Fatal("player was sent metadata sent before publishing")
+			}
+		case rtmp.VideoMessage:
+			if message.Payload[5] != 2 {
+				t.Error("player was sent video sent before publishing")
+			}
+			return
+		}
+	}
+}
+
+// TestKeyframeStats publishes a stream with a keyframe every 2 seconds, and checks the keyframe stats of its publisher.
+func TestKeyframeStats(t *testing.T) {
+	s := newTestServer()
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	publisher.SendVideo([]byte{0x17, 0x00, 0}, 0)
+	for timestamp := uint32(0); timestamp <= 4000; timestamp += 500 {
+		frame := []byte{0x27, 0x01, 0}
+		if timestamp%2000 == 0 {
+			frame[0] = 0x17
+		}
+		publisher.SendVideo(frame, timestamp)
+	}
+	// Messages are handled in order, so the frames were handled once the result of the next command is received
+	if _, err := publisher.CreateStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	keyframes := s.Stats().Keyframes
+	if len(keyframes) != 1 {
+		t.Fatalf("got the keyframe stats of %d publishers, want 1", len(keyframes))
+	}
+	stats := keyframes[0]
+	if stats.StreamKey != "live" || stats.Keyframes != 3 || stats.KeyframeInterval != 2*time.Second {
+		t.Errorf("keyframe stats = %+v, want 3 keyframes of live every 2s", stats)
+	}
+	if stats.TimeToFirstKeyframe <= 0 {
+		t.Errorf("time to first keyframe = %s, want it measured", stats.TimeToFirstKeyframe)
+	}
+}
+
+// TestMalformedConnect checks that connect commands without a valid app are rejected, and that the server keeps
+// accepting connections afterwards.
+func TestMalformedConnect(t *testing.T) {
+	s := newTestServer()
+	for _, commandObject := range []any{map[string]any{"app": 5.0}, map[string]any{"tcUrl": "rtmp://localhost/app"}, nil} {
+		conn, err := rtmptest.Pipe(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.SendCommand(0, "connect", 1, commandObject)
+		command, err := conn.ExpectResult()
+		if command == nil {
+			t.Fatalf("connect with %v: %v", commandObject, err)
+		}
+		if command.Name != "_error" || command.Info()["code"] != rtmp.NetConnectionRejected {
+			t.Errorf("connect with %v answered with %s %v, want a rejection", commandObject, command.Name, command.Info())
+		}
+		if _, err := conn.ReadMessage(); err == nil {
+			t.Errorf("connection still open after rejecting connect with %v", commandObject)
+		}
+		conn.Close()
+	}
+	// Well-formed connections are still accepted
+	pipeStream(t, s)
+}
+
+func TestConnectUnknownApp(t *testing.T) {
+	conn, err := rtmptest.Pipe(newTestServer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.SendCommand(0, "connect", 1, map[string]any{"app": "other", "tcUrl": "rtmp://localhost/other"})
+	command, err := conn.ExpectResult()
+	if command == nil {
+		t.Fatalf("connect to an unknown app: %v", err)
+	}
+	if command.Name != "_error" || command.Info()["code"] != rtmp.NetConnectionRejected {
+		t.Errorf("connect to an unknown app answered with %s %v, want a rejection", command.Name, command.Info())
+	}
+	if description, _ := command.Info()["description"].(string); !strings.Contains(description, "other") {
+		t.Errorf("rejection description %q doesn't name the app", description)
+	}
+	if _, err := conn.ReadMessage(); err == nil {
+		t.Error("connection still open after rejecting an unknown app")
+	}
+}
+
+// TestPingRequest checks that ping requests are answered right away with a response echoing their timestamp.
+func TestPingRequest(t *testing.T) {
+	conn := pipeStream(t, newTestServer())
+	request := []byte{0, byte(rtmp.EventPingRequest), 0x01, 0x02, 0x03, 0x04}
+	if err := conn.WriteMessage(2, rtmp.UserControlMessage, 0, 0, request); err != nil {
+		t.Fatal(err)
+	}
+	// The StreamBegin of the stream may be read first
+	want := []byte{0, byte(rtmp.EventPingResponse), 0x01, 0x02, 0x03, 0x04}
+	for {
+		message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.TypeID != rtmp.UserControlMessage || len(message.Payload) < 2 {
+			continue
+		}
+		if event := binary.BigEndian.Uint16(message.Payload); event == rtmp.EventStreamBegin {
+			continue
+		}
+		if !bytes.Equal(message.Payload, want) {
+			t.Errorf("ping request answered with %x, want the ping response %x", message.Payload, want)
+		}
+		return
+	}
+}
+
+// sessionGuard accepts every publisher, sending its session.
+type sessionGuard chan *rtmp.Session
+
+func (g sessionGuard) Check(sess *rtmp.Session) bool {
+	g <- sess
+	return true
+}
+
+func (g sessionGuard) End(*rtmp.Session) {}
+
+// TestPing pings a publisher, which answers the ping with a response once a response to another ping was ignored, and
+// doesn't answer the next one.
+func TestPing(t *testing.T) {
+	s := newTestServer()
+	guard := make(sessionGuard, 1)
+	s.Broadcaster.SetSessionGuard(guard)
+	conn := pipeStream(t, s)
+	if err := conn.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	sess := <-guard
+
+	type result struct {
+		rtt time.Duration
+		err error
+	}
+	pinged := make(chan result, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() {
+		rtt, err := sess.Ping(ctx)
+		pinged <- result{rtt, err}
+	}()
+	var request []byte
+	for request == nil {
+		message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.TypeID == rtmp.UserControlMessage && len(message.Payload) == 6 && message.Payload[1] == byte(rtmp.EventPingRequest) {
+			request = message.Payload
+		}
+	}
+	// A response to a ping that wasn't requested doesn't end the ping
+	timestamp := binary.BigEndian.Uint32(request[2:])
+	unrequested := binary.BigEndian.AppendUint32([]byte{0, byte(rtmp.EventPingResponse)}, timestamp+1)
+	if err := conn.WriteMessage(2, rtmp.UserControlMessage, 0, 0, unrequested); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	response := binary.BigEndian.AppendUint32([]byte{0, byte(rtmp.EventPingResponse)}, timestamp)
+	if err := conn.WriteMessage(2, rtmp.UserControlMessage, 0, 0, response); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-pinged; r.err != nil || r.rtt < 20*time.Millisecond {
+		t.Errorf("Ping() = %s, %v, want a round-trip time of at least 20ms", r.rtt, r.err)
+	}
+
+	// Pings that aren't answered end with their context
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := sess.Ping(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Ping() without a response = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+// TestConnectAccessors checks that the session a guard is given reflects the connect command object of its client.
+func TestConnectAccessors(t *testing.T) {
+	tests := []struct {
+		name           string
+		commandObject  map[string]any
+		flashVer       string
+		swfUrl         string
+		objectEncoding float64
+	}{
+		{"encoder", map[string]any{
+			"app": "app?token=abc", "tcUrl": "rtmp://localhost/app?token=abc", "type": "nonprivate",
+			"flashVer": "FMLE/3.0 (compatible; FMSc/1.0)", "swfUrl": "rtmp://localhost/app?token=abc",
+		}, "FMLE/3.0 (compatible; FMSc/1.0)", "rtmp://localhost/app?token=abc", 0},
+		{"AMF3 player", map[string]any{
+			"app": "app?token=abc", "tcUrl": "rtmp://localhost/app?token=abc", "flashVer": "LNX 9,0,124,2",
+			"objectEncoding": 3.0,
+		}, "LNX 9,0,124,2", "", 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer()
+			guard := make(sessionGuard, 1)
+			s.Broadcaster.SetSessionGuard(guard)
+			conn, err := rtmptest.Pipe(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if err := conn.ConnectWith(test.commandObject); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.CreateStream(); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.Publish("live"); err != nil {
+				t.Fatal(err)
+			}
+			sess := <-guard
+			if sess.FlashVer() != test.flashVer || sess.SwfUrl() != test.swfUrl || sess.ObjectEncoding() != test.objectEncoding {
+				t.Errorf("FlashVer(), SwfUrl(), ObjectEncoding() = %q, %q, %v, want %q, %q, %v", sess.FlashVer(), sess.SwfUrl(),
+					sess.ObjectEncoding(), test.flashVer, test.swfUrl, test.objectEncoding)
+			}
+			if app, tcUrl := sess.App(), sess.TcUrl(); app != "app" || tcUrl != "rtmp://localhost/app?token=abc" {
+				t.Errorf("App(), TcUrl() = %q, %q, want app, rtmp://localhost/app?token=abc", app, tcUrl)
+			}
+		})
+	}
+}
+
+// paramsGuard accepts every publisher, recording its stream key and connect parameters.
+type paramsGuard struct {
+	streamKeys chan string
+	params     chan map[string]string
+}
+
+func (g paramsGuard) Check(sess *rtmp.Session) bool {
+	g.streamKeys <- sess.GetStreamKey()
+	g.params <- sess.ConnectParams()
+	return true
+}
+
+func (g paramsGuard) End(*rtmp.Session) {}
+
+func TestConnectParams(t *testing.T) {
+	tests := []struct {
+		name          string
+		commandObject map[string]any
+		streamKey     string
+		want          map[string]string
+	}{
+		{"without query", map[string]any{"app": "app", "tcUrl": "rtmp://localhost/app"}, "live", map[string]string{}},
+		{"tcUrl query", map[string]any{"app": "app?token=abc", "tcUrl": "rtmp://localhost/app?token=abc&region=eu"}, "live",
+			map[string]string{"token": "abc", "region": "eu"}},
+		{"stream key query", map[string]any{"app": "app", "tcUrl": "rtmp://localhost/app"}, "live?token=abc",
+			map[string]string{"token": "abc"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer()
+			guard := paramsGuard{streamKeys: make(chan string, 1), params: make(chan map[string]string, 1)}
+			s.Broadcaster.SetSessionGuard(guard)
+			conn, err := rtmptest.Pipe(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if err := conn.ConnectWith(test.commandObject); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.CreateStream(); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.Publish(test.streamKey); err != nil {
+				t.Fatal(err)
+			}
+			if streamKey := <-guard.streamKeys; streamKey != "live" {
+				t.Errorf("GetStreamKey() = %q, want live", streamKey)
+			}
+			if params := <-guard.params; !reflect.DeepEqual(params, test.want) {
+				t.Errorf("ConnectParams() = %v, want %v", params, test.want)
+			}
+		})
+	}
+}
+
+// roleGuard authorizes publishing and playing as configured.
+type roleGuard struct {
+	publish, play bool
+}
+
+func (g roleGuard) Check(*rtmp.Session) bool     { return g.publish }
+func (g roleGuard) CheckPlay(*rtmp.Session) bool { return g.play }
+func (g roleGuard) End(*rtmp.Session)            {}
+
+func TestPlayGuard(t *testing.T) {
+	tests := []struct {
+		name  string
+		guard roleGuard
+		// Status sent to the player. The guard is checked before the stream is looked up, so an authorized player of
+		// the stream that couldn't be published gets past it, and isn't sent NetStream.Play.Failed.
+		playStatus string
+	}{
+		{"publish only", roleGuard{publish: true}, "NetStream.Play.Failed"},
+		{"play only", roleGuard{play: true}, "NetStream.Play.StreamNotFound"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer()
+			s.Broadcaster.SetSessionGuard(test.guard)
+			publisher := pipeStream(t, s)
+			publisher.SendCommand(publisher.StreamID, "publish", 0, nil, "live", "live")
+			_, err := publisher.ExpectStatus("NetStream.Publish.Start")
+			if test.guard.publish && err != nil {
+				t.Fatalf("authorized publisher: %v", err)
+			}
+			if !test.guard.publish && err == nil {
+				t.Fatal("unauthorized publisher was sent NetStream.Publish.Start")
+			}
+
+			player := pipeStream(t, s)
+			player.SendCommand(player.StreamID, "play", 0, nil, "live", float64(-2000))
+			if _, err := player.ExpectStatus(test.playStatus); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// receivedCounter counts the bytes read from the client end of a connection, to acknowledge them.
+type receivedCounter struct {
+	net.Conn
+	received atomic.Uint32
+}
+
+func (c *receivedCounter) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Add(uint32(n))
+	return n, err
+}
+
+// TestAckFlowControl checks that with AckFlowControl, a player that doesn't acknowledge what it receives stops being
+// sent video once it has a window to acknowledge, and that video resumes at the next keyframe after it acknowledges.
+func TestAckFlowControl(t *testing.T) {
+	s := newTestServer()
+	s.AckFlowControl = true
+	// The player can be sent 40000 bytes without acknowledging them (twice the acknowledgement window)
+	s.WindowAckSize = 20000
+	publisher := pipeStream(t, s)
+	if err := publisher.Publish("live"); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.SetChunkSize(65536); err != nil {
+		t.Fatal(err)
+	}
+	client, server := rtmptest.NewPipe()
+	counter := &receivedCounter{Conn: client}
+	go s.ServeConn(server)
+	player, err := rtmptest.NewConn(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+	player.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := player.Connect("app"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := player.CreateStream(); err != nil {
+		t.Fatal(err)
+	}
+	if err := player.Play("live"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Frames of 10000 bytes, identified by their 6th byte
+	sendFrames := func(keyframe int, ids ...int) {
+		t.Helper()
+		for _, id := range ids {
+			frame := make([]byte, 10000)
+			frame[0], frame[1], frame[5] = 0x27, 0x01, byte(id)
+			if id == keyframe {
+				frame[0] = 0x17
+			}
+			if err := publisher.SendVideo(frame, uint32(id*40)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// receiveFrames returns the IDs of the frames the player receives until none arrive for a while
+	receiveFrames := func() []int {
+		t.Helper()
+		var ids []int
+		for {
+			player.SetDeadline(time.Now().Add(200 * time.Millisecond))
+			message, err := player.ReadMessage()
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				player.SetDeadline(time.Now().Add(5 * time.Second))
+				return ids
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if message.TypeID == rtmp.VideoMessage && len(message.Payload) == 10000 {
+				ids = append(ids, int(message.Payload[5]))
+			}
+		}
+	}
+
+	sendFrames(0, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9)
+	// Frames are sent until the window is reached, then dropped
+	if ids := receiveFrames(); len(ids) == 0 || len(ids) > 4 || !reflect.DeepEqual(ids, []int{0, 1, 2, 3}[:len(ids)]) {
+		t.Fatalf("player that didn't acknowledge received the frames %v, want up to the 4 first ones", ids)
+	}
+
+	ack := binary.BigEndian.AppendUint32(nil, counter.received.Load())
+	if err := player.WriteMessage(2, rtmp.Ack, 0, 0, ack); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		acknowledged := true
+		for _, session := range s.Stats().Sessions {
+			if session.UnacknowledgedBytes >= 20000 {
+				acknowledged = false
+			}
+		}
+		if acknowledged {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the server didn't receive the acknowledgement of the player")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The frames that depend on a dropped frame are still dropped, until the next keyframe
+	sendFrames(12, 10, 11, 12, 13)
+	if ids := receiveFrames(); !reflect.DeepEqual(ids, []int{12, 13}) {
+		t.Errorf("player that acknowledged received the frames %v, want [12 13]", ids)
+	}
+}
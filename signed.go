@@ -0,0 +1,82 @@
+package rtmp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var ErrInvalidSignature error = errors.New("signed url: missing or invalid signature")
+var ErrSignatureExpired error = errors.New("signed url: signature expired")
+
+// SignedURLGuard is a SessionGuard that only accepts stream keys signed with a shared secret, as in
+// rtmp://host/app/key?exp=1700000000&token=... (the parameters can also be in the tcUrl). The token is the hex encoded
+// HMAC-SHA256 of the stream key and the expiry time (a unix timestamp, in seconds). Use SignStreamKey to generate them.
+// Since a Broadcaster serves a single app, each app can have its own guard (and secret), see Server.Apps.
+type SignedURLGuard struct {
+	Secret []byte
+	// If true, playing a stream requires a signed stream key too. Otherwise, only publishing does.
+	RequireForPlay bool
+	// Returns the current time, to check expiry times. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+func NewSignedURLGuard(secret []byte) *SignedURLGuard {
+	return &SignedURLGuard{Secret: secret}
+}
+
+func (g *SignedURLGuard) Check(session *Session) bool {
+	return g.Validate(session.GetStreamKey(), session.ConnectParams()) == nil
+}
+
+func (g *SignedURLGuard) End(session *Session) {
+}
+
+func (g *SignedURLGuard) CheckPlay(session *Session) bool {
+	if !g.RequireForPlay {
+		return true
+	}
+	return g.Validate(session.GetStreamKey(), session.ConnectParams()) == nil
+}
+
+// SignStreamKey returns streamKey with the query parameters that make it valid until expiry.
+func (g *SignedURLGuard) SignStreamKey(streamKey string, expiry time.Time) string {
+	exp := strconv.FormatInt(expiry.Unix(), 10)
+	query := url.Values{
+		"exp":   {exp},
+		"token": {hex.EncodeToString(g.sign(streamKey, exp))},
+	}
+	return streamKey + "?" + query.Encode()
+}
+
+// Validate returns nil if params (the query parameters sent along with streamKey) hold a valid signature of streamKey
+// that hasn't expired yet. Otherwise, it returns ErrInvalidSignature or ErrSignatureExpired.
+func (g *SignedURLGuard) Validate(streamKey string, params map[string]string) error {
+	exp, token := params["exp"], params["token"]
+	expiry, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	signature, err := hex.DecodeString(token)
+	if err != nil || !hmac.Equal(signature, g.sign(streamKey, exp)) {
+		return ErrInvalidSignature
+	}
+	now := time.Now
+	if g.Now != nil {
+		now = g.Now
+	}
+	if now().Unix() >= expiry {
+		return ErrSignatureExpired
+	}
+	return nil
+}
+
+func (g *SignedURLGuard) sign(streamKey string, exp string) []byte {
+	mac := hmac.New(sha256.New, g.Secret)
+	mac.Write([]byte(streamKey + ":" + exp))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,63 @@
+package rtmp
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedURLGuard(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	g := NewSignedURLGuard([]byte("secret"))
+	g.Now = func() time.Time { return now }
+
+	tests := []struct {
+		name      string
+		streamKey string
+		signed    string
+		want      error
+	}{
+		{"valid", "live", g.SignStreamKey("live", now.Add(time.Minute)), nil},
+		{"expired", "live", g.SignStreamKey("live", now.Add(-time.Minute)), ErrSignatureExpired},
+		{"expires now", "live", g.SignStreamKey("live", now), ErrSignatureExpired},
+		{"other stream key", "other", g.SignStreamKey("live", now.Add(time.Minute)), ErrInvalidSignature},
+		{"other secret", "live", (&SignedURLGuard{Secret: []byte("other")}).SignStreamKey("live", now.Add(time.Minute)), ErrInvalidSignature},
+		{"no signature", "live", "live", ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, query, _ := strings.Cut(tt.signed, "?")
+			if err := g.Validate(tt.streamKey, queryParams(t, query)); !errors.Is(err, tt.want) {
+				t.Errorf("Validate(%q, %q) = %v, want %v", tt.streamKey, query, err, tt.want)
+			}
+		})
+	}
+
+	// Changing the expiry or the token of a valid signature invalidates it
+	_, query, _ := strings.Cut(g.SignStreamKey("live", now.Add(time.Minute)), "?")
+	params := queryParams(t, query)
+	for _, tampered := range []map[string]string{
+		{"exp": "1700003600", "token": params["token"]},
+		{"exp": params["exp"], "token": strings.Repeat("0", len(params["token"]))},
+		{"exp": params["exp"], "token": "not hex"},
+		{"exp": "later", "token": params["token"]},
+	} {
+		if err := g.Validate("live", tampered); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Validate() with the tampered parameters %v = %v, want ErrInvalidSignature", tampered, err)
+		}
+	}
+}
+
+func queryParams(t *testing.T, query string) map[string]string {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := make(map[string]string)
+	for name := range values {
+		params[name] = values.Get(name)
+	}
+	return params
+}
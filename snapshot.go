@@ -0,0 +1,26 @@
+package rtmp
+
+import "errors"
+
+var ErrSnapshotNotSupported error = errors.New("context store does not support snapshots")
+
+// ContextSnapshot is the state of a context that can be recovered in a new process, for example when handing over
+// to a new binary during a zero-downtime upgrade. It only holds metadata: live connections are not part of it.
+// A snapshot can be serialized with encoding/json.
+type ContextSnapshot struct {
+	// Stream keys that were registered when the snapshot was taken
+	Streams []string `json:"streams"`
+	// Cached AVC sequence headers, by stream key
+	AvcSequenceHeaders map[string][]byte `json:"avcSequenceHeaders"`
+	// Cached AAC sequence headers, by stream key
+	AacSequenceHeaders map[string][]byte `json:"aacSequenceHeaders"`
+	// Cached stream metadata (@setDataFrame), by stream key
+	Metadata map[string]map[string]any `json:"metadata"`
+}
+
+// Snapshotter is implemented by context stores that are able to save and restore their recoverable state. The
+// broadcasters created with NewBroadcaster implement it too, returning ErrSnapshotNotSupported if their context doesn't.
+type Snapshotter interface {
+	Snapshot() (*ContextSnapshot, error)
+	Restore(snapshot *ContextSnapshot) error
+}
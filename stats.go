@@ -0,0 +1,147 @@
+package rtmp
+
+import "time"
+
+// ServerStats is a snapshot of the activity of a server.
+type ServerStats struct {
+	// Time at which the snapshot was taken
+	Time time.Time
+	// Number of active connections
+	Connections int
+	// Number of streams being published, across the broadcasters that implement StreamListBroadcaster
+	Streams int
+	// Number of subscribers, across the streams counted in Streams
+	Subscribers int
+	// Memory used by the GOP caches, summed across the budgets of the broadcasters that implement
+	// GOPCacheBudgetBroadcaster (a budget shared by several broadcasters is counted once)
+	GOPCache GOPCacheBudgetStats
+	// Keyframe stats of every publisher connected to the server
+	Keyframes []KeyframeStats
+	// Stats of every session of the server
+	Sessions []SessionStats
+}
+
+// SessionStats is a snapshot of the activity of a session.
+type SessionStats struct {
+	ID string
+	// Time since the session started
+	Uptime time.Duration
+	// Bytes read from and written to the connection, including protocol overhead
+	BytesReceived uint64
+	BytesSent     uint64
+	// Bytes of the audio and video messages received (by publishers) and sent (to players)
+	AudioBytes uint64
+	VideoBytes uint64
+	// Bitrates of the audio and video messages received and sent, in bits per second, averaged over the last seconds
+	AudioBitrate uint64
+	VideoBitrate uint64
+	// Number of audio and video messages that couldn't be sent to the session
+	DroppedFrames uint64
+	// Bytes sent that the peer hasn't acknowledged yet. A value that keeps growing beyond the window acknowledgement
+	// size sent to the peer means that it's falling behind (or that it doesn't send acknowledgements).
+	UnacknowledgedBytes uint32
+}
+
+// StreamStats is a snapshot of the activity of a published stream.
+type StreamStats struct {
+	StreamKey string
+	// Whether the stream is a recording played with PlayFile, rather than a live stream
+	Recorded bool
+	// Time since the stream was published
+	Uptime      time.Duration
+	Subscribers int
+	// Bytes of the audio and video messages broadcast to the subscribers of the stream
+	AudioBytes uint64
+	VideoBytes uint64
+	// Bitrates of the audio and video of the stream, in bits per second, averaged over the last seconds
+	AudioBitrate uint64
+	VideoBitrate uint64
+}
+
+// Stats returns a snapshot of the current activity of the session. It's safe to call from any goroutine.
+func (session *Session) Stats() SessionStats {
+	stats := SessionStats{
+		ID:     session.id,
+		Uptime: time.Since(session.startTime),
+	}
+	stats.AudioBytes, stats.VideoBytes, stats.AudioBitrate, stats.VideoBitrate = session.traffic.get()
+	if session.messageManager != nil {
+		stats.BytesReceived = session.messageManager.chunkHandler.totalBytesReceived.Load()
+		stats.BytesSent = session.messageManager.chunkHandler.totalBytesSent.Load()
+		stats.DroppedFrames = session.messageManager.droppedFrames.Load()
+		stats.UnacknowledgedBytes = session.messageManager.chunkHandler.unacknowledgedBytes()
+	}
+	return stats
+}
+
+// StreamStats returns a snapshot of the current activity of the stream published with streamKey, and false if it
+// isn't published.
+func (b *broadcaster) StreamStats(streamKey string) (StreamStats, bool) {
+	if !b.context.StreamExists(streamKey) {
+		return StreamStats{}, false
+	}
+	stats := StreamStats{
+		StreamKey:   streamKey,
+		Subscribers: b.GetSubscriberCount(streamKey),
+	}
+	// Streams restored from a snapshot were published before the broadcaster existed, so their traffic is unknown
+	if value, ok := b.streams.Load(streamKey); ok {
+		stream := value.(*publishedStream)
+		stats.Uptime = time.Since(stream.publishTime)
+		stats.Recorded = stream.recorded
+		stats.AudioBytes, stats.VideoBytes, stats.AudioBitrate, stats.VideoBitrate = stream.traffic.get()
+	}
+	return stats, true
+}
+
+// Stats returns a snapshot of the current activity of the server.
+func (s *Server) Stats() ServerStats {
+	stats := ServerStats{
+		Time:        time.Now(),
+		Connections: s.ConnectionCount(),
+	}
+	s.sessions.Range(func(_, value any) bool {
+		session := value.(*Session)
+		if keyframeStats, publishing := session.KeyframeStats(); publishing {
+			stats.Keyframes = append(stats.Keyframes, keyframeStats)
+		}
+		stats.Sessions = append(stats.Sessions, session.Stats())
+		return true
+	})
+	budgets := make(map[*GOPCacheBudget]bool)
+	for _, broadcaster := range s.broadcasters() {
+		if cached, ok := broadcaster.(GOPCacheBudgetBroadcaster); ok {
+			if budget := cached.GetGOPCacheBudget(); budget != nil && !budgets[budget] {
+				budgets[budget] = true
+				budgetStats := budget.Stats()
+				stats.GOPCache.MaxBytes += budgetStats.MaxBytes
+				stats.GOPCache.UsedBytes += budgetStats.UsedBytes
+				stats.GOPCache.Evictions += budgetStats.Evictions
+			}
+		}
+		lister, ok := broadcaster.(StreamListBroadcaster)
+		if !ok {
+			continue
+		}
+		streamKeys := lister.GetStreamKeys()
+		stats.Streams += len(streamKeys)
+		for _, streamKey := range streamKeys {
+			stats.Subscribers += lister.GetSubscriberCount(streamKey)
+		}
+	}
+	return stats
+}
+
+// reportStats calls OnStats with a snapshot of the server's stats every StatsInterval, until done is closed.
+func (s *Server) reportStats(done <-chan struct{}) {
+	ticker := time.NewTicker(s.StatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.OnStats(s.Stats())
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package rtmp
+
+import (
+	"sync"
+	"time"
+)
+
+// Number of 1 second buckets over which bitrates are measured
+const bitrateWindow = 5
+
+// bitrateMeter measures a bitrate over a sliding window of the last bitrateWindow seconds.
+type bitrateMeter struct {
+	// Bytes counted during each second, indexed by unix second modulo bitrateWindow
+	buckets [bitrateWindow]uint64
+	// Unix seconds at which the meter started, and of the most recent bucket
+	start int64
+	last  int64
+}
+
+// advance moves the window forward to now, clearing the buckets of the seconds that went by without any bytes.
+func (m *bitrateMeter) advance(now time.Time) {
+	second := now.Unix()
+	if m.start == 0 {
+		m.start, m.last = second, second
+		return
+	}
+	if second-m.last >= bitrateWindow {
+		m.buckets = [bitrateWindow]uint64{}
+	} else {
+		for s := m.last + 1; s <= second; s++ {
+			m.buckets[s%bitrateWindow] = 0
+		}
+	}
+	if second > m.last {
+		m.last = second
+	}
+}
+
+func (m *bitrateMeter) add(now time.Time, n int) {
+	m.advance(now)
+	m.buckets[m.last%bitrateWindow] += uint64(n)
+}
+
+// bitrate returns the average bitrate in bits per second over the complete seconds of the window. The current second
+// is still being counted and the meter likely started in the middle of its first second, so both are left out.
+func (m *bitrateMeter) bitrate(now time.Time) uint64 {
+	m.advance(now)
+	first := m.last - (bitrateWindow - 1)
+	if first <= m.start {
+		first = m.start + 1
+	}
+	seconds := m.last - first
+	if seconds <= 0 {
+		return 0
+	}
+	var total uint64
+	for s := first; s < m.last; s++ {
+		total += m.buckets[s%bitrateWindow]
+	}
+	return total * 8 / uint64(seconds)
+}
+
+// mediaTraffic counts the audio and video bytes that flow through a session or a stream. It's updated from the
+// goroutines of the sessions and read by the stats accessors, so it's guarded by a mutex.
+type mediaTraffic struct {
+	mutex        sync.Mutex
+	audioBytes   uint64
+	videoBytes   uint64
+	audioBitrate bitrateMeter
+	videoBitrate bitrateMeter
+}
+
+func (t *mediaTraffic) addAudio(n int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.audioBytes += uint64(n)
+	t.audioBitrate.add(time.Now(), n)
+}
+
+func (t *mediaTraffic) addVideo(n int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.videoBytes += uint64(n)
+	t.videoBitrate.add(time.Now(), n)
+}
+
+// get returns the audio and video bytes counted so far, and their current bitrates (in bits per second).
+func (t *mediaTraffic) get() (audioBytes, videoBytes, audioBitrate, videoBitrate uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	return t.audioBytes, t.videoBytes, t.audioBitrate.bitrate(now), t.videoBitrate.bitrate(now)
+}
@@ -0,0 +1,78 @@
+package rtmp
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/codingpa-ws/rtmp/constants"
+)
+
+var ErrMissingStreamKey error = errors.New("no stream key in URL")
+
+// rtmpURL is an RTMP URL (rtmp://host[:port]/app[/instance]/streamKey[?query]) split in the parts a client needs to
+// connect to the server and play a stream.
+type rtmpURL struct {
+	// rtmp or rtmps
+	Scheme string
+	Host   string
+	// The default port of the scheme if the URL doesn't have one
+	Port string
+	// Every path segment but the last one (eg: "app/instance")
+	App       string
+	StreamKey string
+	// Query string of the URL, without the leading "?" (eg: an authentication token)
+	Query string
+}
+
+// parseURL parses an RTMP URL. URLs with a single path segment are treated as having an app but no stream key.
+// Trailing slashes are ignored.
+func parseURL(rawURL string) (*rtmpURL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rtmp" && u.Scheme != "rtmps" {
+		return nil, ErrInvalidScheme
+	}
+	parsed := &rtmpURL{
+		Scheme: u.Scheme,
+		Host:   u.Hostname(),
+		Port:   u.Port(),
+		Query:  u.RawQuery,
+	}
+	if parsed.Port == "" {
+		if parsed.Scheme == "rtmps" {
+			parsed.Port = constants.DefaultTLSPort
+		} else {
+			parsed.Port = constants.DefaultPort
+		}
+	}
+
+	path := strings.Trim(u.Path, "/")
+	if path == "" {
+		return parsed, nil
+	}
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		parsed.App = path[:i]
+		parsed.StreamKey = path[i+1:]
+	} else {
+		parsed.App = path
+	}
+	return parsed, nil
+}
+
+// Address returns the host:port address of the server.
+func (u *rtmpURL) Address() string {
+	return net.JoinHostPort(u.Host, u.Port)
+}
+
+// PlayName returns the stream name to send in the play command: the stream key, followed by the query string if any,
+// which is how servers expect parameters such as authentication tokens.
+func (u *rtmpURL) PlayName() string {
+	if u.Query == "" {
+		return u.StreamKey
+	}
+	return u.StreamKey + "?" + u.Query
+}
@@ -0,0 +1,61 @@
+package rtmp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		rawURL  string
+		want    *rtmpURL
+		address string
+	}{
+		{"rtmp://localhost/app/obs", &rtmpURL{Scheme: "rtmp", Host: "localhost", Port: "1935", App: "app", StreamKey: "obs"}, "localhost:1935"},
+		{"rtmp://host:1936/app/instance/streamKey", &rtmpURL{Scheme: "rtmp", Host: "host", Port: "1936", App: "app/instance", StreamKey: "streamKey"}, "host:1936"},
+		{"rtmp://host/app/key?token=x", &rtmpURL{Scheme: "rtmp", Host: "host", Port: "1935", App: "app", StreamKey: "key", Query: "token=x"}, "host:1935"},
+		// A single path segment is the app
+		{"rtmp://host/app?token=x", &rtmpURL{Scheme: "rtmp", Host: "host", Port: "1935", App: "app", Query: "token=x"}, "host:1935"},
+		{"rtmp://host/app/key/", &rtmpURL{Scheme: "rtmp", Host: "host", Port: "1935", App: "app", StreamKey: "key"}, "host:1935"},
+		{"rtmp://host", &rtmpURL{Scheme: "rtmp", Host: "host", Port: "1935"}, "host:1935"},
+		{"rtmp://host:/app/key", &rtmpURL{Scheme: "rtmp", Host: "host", Port: "1935", App: "app", StreamKey: "key"}, "host:1935"},
+		{"rtmps://host/live/key", &rtmpURL{Scheme: "rtmps", Host: "host", Port: "443", App: "live", StreamKey: "key"}, "host:443"},
+		{"rtmps://host:8443/live/key", &rtmpURL{Scheme: "rtmps", Host: "host", Port: "8443", App: "live", StreamKey: "key"}, "host:8443"},
+		{"rtmp://[::1]/app/key", &rtmpURL{Scheme: "rtmp", Host: "::1", Port: "1935", App: "app", StreamKey: "key"}, "[::1]:1935"},
+	}
+	for _, tt := range tests {
+		got, err := parseURL(tt.rawURL)
+		if err != nil {
+			t.Errorf("parseURL(%q) = %v", tt.rawURL, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseURL(%q) = %+v, want %+v", tt.rawURL, *got, *tt.want)
+		}
+		if address := got.Address(); address != tt.address {
+			t.Errorf("parseURL(%q).Address() = %q, want %q", tt.rawURL, address, tt.address)
+		}
+	}
+
+	for _, rawURL := range []string{"http://host/app/key", "host/app/key"} {
+		if _, err := parseURL(rawURL); !errors.Is(err, ErrInvalidScheme) {
+			t.Errorf("parseURL(%q) = %v, want ErrInvalidScheme", rawURL, err)
+		}
+	}
+}
+
+func TestPlayName(t *testing.T) {
+	for rawURL, want := range map[string]string{
+		"rtmp://host/app/key":             "key",
+		"rtmp://host/app/key?token=x&e=1": "key?token=x&e=1",
+	} {
+		u, err := parseURL(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := u.PlayName(); got != want {
+			t.Errorf("parseURL(%q).PlayName() = %q, want %q", rawURL, got, want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package video
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidAVCConfig error = errors.New("video: invalid AVC decoder configuration record")
+
+// ParseAVCConfig parses the AVCDecoderConfigurationRecord of an H264 sequence header, as cached by
+// SetAvcSequenceHeaderForPublisher (ie. the payload of the video message, with its video tag header). The record
+// alone, without the video tag header, is also accepted. It returns the SPS and PPS NAL units, and the size in bytes of
+// the NAL unit lengths that precede the NAL units of the frames. The returned slices share the memory of payload.
+func ParseAVCConfig(payload []byte) (sps [][]byte, pps [][]byte, nalLengthSize int, err error) {
+	record := payload
+	// The record starts with its version (1), which isn't a valid first byte of a video tag header (frame type 0)
+	if len(payload) > 0 && payload[0] != 1 {
+		header := ParseHeader(payload)
+		if header.Codec != H264 || !header.IsSequenceHeader() {
+			return nil, nil, 0, fmt.Errorf("%w: not an H264 sequence header", ErrInvalidAVCConfig)
+		}
+		// Frame type and codec, AVC packet type, and composition time
+		if len(payload) < 5 {
+			return nil, nil, 0, fmt.Errorf("%w: truncated video tag header", ErrInvalidAVCConfig)
+		}
+		record = payload[5:]
+	}
+	// Version, profile, profile compatibility, level, NAL length size and number of SPS
+	if len(record) < 6 {
+		return nil, nil, 0, fmt.Errorf("%w: truncated header", ErrInvalidAVCConfig)
+	}
+	if record[0] != 1 {
+		return nil, nil, 0, fmt.Errorf("%w: unsupported version %d", ErrInvalidAVCConfig, record[0])
+	}
+	nalLengthSize = int(record[4]&0x03) + 1
+	if nalLengthSize == 3 {
+		return nil, nil, 0, fmt.Errorf("%w: invalid NAL length size 3", ErrInvalidAVCConfig)
+	}
+
+	rest := record[6:]
+	if sps, rest, err = readParameterSets(rest, int(record[5]&0x1F)); err != nil {
+		return nil, nil, 0, fmt.Errorf("%w: SPS: %w", ErrInvalidAVCConfig, err)
+	}
+	if len(rest) < 1 {
+		return nil, nil, 0, fmt.Errorf("%w: missing number of PPS", ErrInvalidAVCConfig)
+	}
+	if pps, _, err = readParameterSets(rest[1:], int(rest[0])); err != nil {
+		return nil, nil, 0, fmt.Errorf("%w: PPS: %w", ErrInvalidAVCConfig, err)
+	}
+	return sps, pps, nalLengthSize, nil
+}
+
+// readParameterSets reads count parameter sets, each preceded by its 16 bits length, and returns them with the bytes
+// that follow them.
+func readParameterSets(b []byte, count int) (sets [][]byte, rest []byte, err error) {
+	sets = make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		if len(b) < 2 {
+			return nil, nil, errors.New("truncated length")
+		}
+		length := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+length {
+			return nil, nil, fmt.Errorf("truncated parameter set (%d of %d bytes)", len(b)-2, length)
+		}
+		sets = append(sets, b[2:2+length])
+		b = b[2+length:]
+	}
+	return sets, b, nil
+}
@@ -0,0 +1,85 @@
+package video
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// SPS and PPS of a 1280x720 stream at 30 fps published by OBS (x264, High profile, level 3.1)
+var (
+	x264SPS = []byte{
+		0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00,
+		0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60,
+	}
+	x264PPS = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+)
+
+// avcConfig returns the AVCDecoderConfigurationRecord of the parameter sets, with NAL unit lengths of 4 bytes.
+func avcConfig(sps [][]byte, pps [][]byte) []byte {
+	record := []byte{0x01, 0x64, 0x00, 0x1f, 0xff, 0xe0 | byte(len(sps))}
+	for _, set := range sps {
+		record = append(record, byte(len(set)>>8), byte(len(set)))
+		record = append(record, set...)
+	}
+	record = append(record, byte(len(pps)))
+	for _, set := range pps {
+		record = append(record, byte(len(set)>>8), byte(len(set)))
+		record = append(record, set...)
+	}
+	return record
+}
+
+func TestParseAVCConfig(t *testing.T) {
+	record := avcConfig([][]byte{x264SPS}, [][]byte{x264PPS})
+	sequenceHeader := append([]byte{0x17, 0x00, 0x00, 0x00, 0x00}, record...)
+	for name, payload := range map[string][]byte{"sequence header": sequenceHeader, "record": record} {
+		sps, pps, nalLengthSize, err := ParseAVCConfig(payload)
+		if err != nil {
+			t.Fatalf("ParseAVCConfig(%s) = %v", name, err)
+		}
+		if len(sps) != 1 || !bytes.Equal(sps[0], x264SPS) || len(pps) != 1 || !bytes.Equal(pps[0], x264PPS) {
+			t.Errorf("ParseAVCConfig(%s) = SPS %x, PPS %x, want %x and %x", name, sps, pps, x264SPS, x264PPS)
+		}
+		if nalLengthSize != 4 {
+			t.Errorf("ParseAVCConfig(%s) NAL length size = %d, want 4", name, nalLengthSize)
+		}
+	}
+
+	// Several parameter sets, and NAL unit lengths of 2 bytes
+	record = avcConfig([][]byte{x264SPS, {0x67, 0x42}}, [][]byte{x264PPS, {0x68, 0xce}, {0x68}})
+	record[4] = 0xfd
+	sps, pps, nalLengthSize, err := ParseAVCConfig(record)
+	if err != nil {
+		t.Fatalf("ParseAVCConfig() = %v", err)
+	}
+	if len(sps) != 2 || !bytes.Equal(sps[1], []byte{0x67, 0x42}) || len(pps) != 3 || !bytes.Equal(pps[2], []byte{0x68}) {
+		t.Errorf("ParseAVCConfig() = SPS %x, PPS %x, want 2 SPS and 3 PPS", sps, pps)
+	}
+	if nalLengthSize != 2 {
+		t.Errorf("ParseAVCConfig() NAL length size = %d, want 2", nalLengthSize)
+	}
+}
+
+func TestParseAVCConfigInvalid(t *testing.T) {
+	sequenceHeader := append([]byte{0x17, 0x00, 0x00, 0x00, 0x00}, avcConfig([][]byte{x264SPS}, [][]byte{x264PPS})...)
+	// Every truncation of the sequence header is an error, none of them panics
+	for i := 0; i < len(sequenceHeader); i++ {
+		if _, _, _, err := ParseAVCConfig(sequenceHeader[:i]); !errors.Is(err, ErrInvalidAVCConfig) {
+			t.Errorf("ParseAVCConfig() of the first %d bytes = %v, want ErrInvalidAVCConfig", i, err)
+		}
+	}
+
+	invalidLengthSize := append([]byte{}, sequenceHeader...)
+	invalidLengthSize[5+4] = 0xfe
+	for name, payload := range map[string][]byte{
+		"H264 keyframe":       {0x17, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x65, 0x88},
+		"HEVC sequence start": {0x90, 'h', 'v', 'c', '1', 0x01, 0x01, 0x60},
+		"version 2":           {0x17, 0x00, 0x00, 0x00, 0x00, 0x02, 0x64, 0x00, 0x1f, 0xff, 0xe0, 0x00},
+		"NAL length size 3":   invalidLengthSize,
+	} {
+		if _, _, _, err := ParseAVCConfig(payload); !errors.Is(err, ErrInvalidAVCConfig) {
+			t.Errorf("ParseAVCConfig(%s) = %v, want ErrInvalidAVCConfig", name, err)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package video
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidSPS error = errors.New("video: invalid SPS")
+
+// ParseSPS parses an H264 sequence parameter set NAL unit (eg: one of the SPS returned by ParseAVCConfig), and returns
+// the dimensions of the decoded pictures (after cropping), and the frame rate declared by its VUI timing info, or 0 if
+// it doesn't declare one.
+func ParseSPS(sps []byte) (width int, height int, frameRate float64, err error) {
+	if len(sps) < 4 || sps[0]&0x1F != 7 {
+		return 0, 0, 0, fmt.Errorf("%w: not an SPS NAL unit", ErrInvalidSPS)
+	}
+	r := &bitReader{b: removeEmulationPrevention(sps[1:])}
+	profile := r.bits(8)
+	// Constraint flags and level
+	r.skip(16)
+	r.ue() // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	separateColourPlane := false
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			separateColourPlane = r.flag()
+		}
+		r.ue()    // bit_depth_luma_minus8
+		r.ue()    // bit_depth_chroma_minus8
+		r.skip(1) // qpprime_y_zero_transform_bypass_flag
+		if r.flag() {
+			// seq_scaling_matrix_present_flag
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if !r.flag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				r.skipScalingList(size)
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	// pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.skip(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		cycle := r.ue()
+		for i := uint32(0); i < cycle && r.err == nil; i++ {
+			r.se() // offset_for_ref_frame
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+	widthInMbs := r.ue() + 1
+	heightInMapUnits := r.ue() + 1
+	frameMbsOnly := r.flag()
+	if !frameMbsOnly {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1) // direct_8x8_inference_flag
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if r.flag() {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	vui := r.flag()
+	if r.err != nil {
+		return 0, 0, 0, fmt.Errorf("%w: %w", ErrInvalidSPS, r.err)
+	}
+
+	// Fields (interlaced pictures) have half the height of frames, in macroblocks
+	fieldFactor := 2
+	if frameMbsOnly {
+		fieldFactor = 1
+	}
+	// Cropping is in chroma samples, of SubWidthC x SubHeightC luma samples (1 if the chroma planes are coded
+	// separately, or for monochrome pictures)
+	cropUnitX, cropUnitY := 1, fieldFactor
+	if !separateColourPlane && chromaFormat != 0 {
+		if chromaFormat != 3 {
+			cropUnitX = 2
+		}
+		if chromaFormat == 1 {
+			cropUnitY *= 2
+		}
+	}
+	width = int(widthInMbs)*16 - cropUnitX*int(cropLeft+cropRight)
+	height = fieldFactor*int(heightInMapUnits)*16 - cropUnitY*int(cropTop+cropBottom)
+	if width <= 0 || height <= 0 {
+		return 0, 0, 0, fmt.Errorf("%w: invalid dimensions %dx%d", ErrInvalidSPS, width, height)
+	}
+
+	if vui {
+		frameRate = r.vuiFrameRate()
+		// The VUI is optional information, the dimensions are still valid if it's truncated
+		if r.err != nil {
+			frameRate = 0
+		}
+	}
+	return width, height, frameRate, nil
+}
+
+// vuiFrameRate reads the VUI parameters up to the timing info, and returns the frame rate it declares.
+func (r *bitReader) vuiFrameRate() float64 {
+	if r.flag() {
+		// aspect_ratio_info_present_flag
+		if r.bits(8) == 255 {
+			// Extended_SAR: sar_width and sar_height
+			r.skip(32)
+		}
+	}
+	if r.flag() {
+		// overscan_info_present_flag
+		r.skip(1)
+	}
+	if r.flag() {
+		// video_signal_type_present_flag: video_format and video_full_range_flag
+		r.skip(4)
+		if r.flag() {
+			// colour_description_present_flag: colour_primaries, transfer_characteristics and matrix_coefficients
+			r.skip(24)
+		}
+	}
+	if r.flag() {
+		// chroma_loc_info_present_flag
+		r.ue()
+		r.ue()
+	}
+	if !r.flag() {
+		// timing_info_present_flag
+		return 0
+	}
+	unitsInTick := r.bits(32)
+	timeScale := r.bits(32)
+	if unitsInTick == 0 {
+		return 0
+	}
+	// A frame lasts 2 ticks (one per field)
+	return float64(timeScale) / float64(2*unitsInTick)
+}
+
+// removeEmulationPrevention returns the RBSP of a NAL unit, without the emulation prevention bytes (the 0x03 of
+// 0x000003) that keep the payload from containing start codes.
+func removeEmulationPrevention(b []byte) []byte {
+	rbsp := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, c)
+	}
+	return rbsp
+}
+
+// bitReader reads the bits of a NAL unit, MSB first. Reading past the end sets err, and every read that follows
+// returns 0.
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) bits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.b)*8 {
+			r.err = errors.New("truncated")
+			return 0
+		}
+		v = v<<1 | uint32(r.b[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) skip(n int) {
+	r.bits(n)
+}
+
+func (r *bitReader) flag() bool {
+	return r.bits(1) == 1
+}
+
+// ue reads an unsigned Exp-Golomb code: n leading zero bits, a 1, and n more bits.
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for !r.flag() {
+		if r.err != nil {
+			return 0
+		}
+		zeros++
+		if zeros > 31 {
+			r.err = errors.New("invalid Exp-Golomb code")
+			return 0
+		}
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code, which maps 1, 2, 3, 4... to 1, -1, 2, -2...
+func (r *bitReader) se() int32 {
+	u := r.ue()
+	if u&1 == 1 {
+		return int32((u + 1) / 2)
+	}
+	return -int32(u / 2)
+}
+
+func (r *bitReader) skipScalingList(size int) {
+	last, next := int32(8), int32(8)
+	for i := 0; i < size && r.err == nil; i++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
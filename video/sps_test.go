@@ -0,0 +1,210 @@
+package video
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// bitWriter writes the bits of an SPS, MSB first.
+type bitWriter struct {
+	b   []byte
+	pos int
+}
+
+func (w *bitWriter) bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>i&1) << (7 - w.pos%8)
+		w.pos++
+	}
+}
+
+func (w *bitWriter) flag(f bool) {
+	if f {
+		w.bits(1, 1)
+	} else {
+		w.bits(0, 1)
+	}
+}
+
+// ue writes v as an unsigned Exp-Golomb code.
+func (w *bitWriter) ue(v uint32) {
+	n := 0
+	for x := v + 1; x > 1; x >>= 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v+1, n+1)
+}
+
+// spsParams are the fields of a test SPS.
+type spsParams struct {
+	profile          uint32
+	chromaFormat     uint32
+	scalingMatrix    bool
+	pocType          uint32
+	widthInMbs       uint32
+	heightInMapUnits uint32
+	interlaced       bool
+	// left, right, top and bottom
+	crop [4]uint32
+	// VUI timing info, if timeScale isn't 0
+	unitsInTick, timeScale uint32
+}
+
+// encodeSPS returns the SPS NAL unit of p, with emulation prevention bytes.
+func encodeSPS(p spsParams) []byte {
+	w := &bitWriter{}
+	w.bits(p.profile, 8)
+	w.bits(0, 8)  // Constraint flags
+	w.bits(40, 8) // Level 4
+	w.ue(0)       // seq_parameter_set_id
+	if p.profile == 100 || p.profile == 244 {
+		w.ue(p.chromaFormat)
+		if p.chromaFormat == 3 {
+			w.flag(false) // separate_colour_plane_flag
+		}
+		w.ue(0) // bit_depth_luma_minus8
+		w.ue(0) // bit_depth_chroma_minus8
+		w.flag(false)
+		w.flag(p.scalingMatrix)
+		if p.scalingMatrix {
+			// A 4x4 scaling list whose deltas are all 0, and 7 lists that aren't present
+			w.flag(true)
+			for i := 0; i < 16; i++ {
+				w.ue(0)
+			}
+			for i := 1; i < 8; i++ {
+				w.flag(false)
+			}
+		}
+	}
+	w.ue(0) // log2_max_frame_num_minus4
+	w.ue(p.pocType)
+	switch p.pocType {
+	case 0:
+		w.ue(2) // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		w.flag(false)
+		w.ue(1) // offset_for_non_ref_pic: -1
+		w.ue(2) // offset_for_top_to_bottom_field: 1
+		w.ue(2) // 2 offsets for reference frames
+		w.ue(1)
+		w.ue(3)
+	}
+	w.ue(4) // max_num_ref_frames
+	w.flag(false)
+	w.ue(p.widthInMbs - 1)
+	w.ue(p.heightInMapUnits - 1)
+	w.flag(!p.interlaced)
+	if p.interlaced {
+		w.flag(false) // mb_adaptive_frame_field_flag
+	}
+	w.flag(true) // direct_8x8_inference_flag
+	w.flag(p.crop != [4]uint32{})
+	if p.crop != [4]uint32{} {
+		for _, c := range p.crop {
+			w.ue(c)
+		}
+	}
+	w.flag(p.timeScale != 0)
+	if p.timeScale != 0 {
+		// Extended SAR, video signal type with colour description, then the timing info
+		w.flag(true)
+		w.bits(255, 8)
+		w.bits(1, 16)
+		w.bits(1, 16)
+		w.flag(false)
+		w.flag(true)
+		w.bits(5, 3)
+		w.flag(false)
+		w.flag(true)
+		w.bits(0x010101, 24)
+		w.flag(false)
+		w.flag(true)
+		w.bits(p.unitsInTick, 32)
+		w.bits(p.timeScale, 32)
+		w.flag(true) // fixed_frame_rate_flag
+	}
+	w.bits(1, 1) // rbsp_stop_one_bit
+
+	sps := []byte{0x67}
+	zeros := 0
+	for _, c := range w.b {
+		if zeros >= 2 && c <= 3 {
+			sps = append(sps, 3)
+			zeros = 0
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		sps = append(sps, c)
+	}
+	return sps
+}
+
+func TestParseSPS(t *testing.T) {
+	tests := []struct {
+		name          string
+		sps           []byte
+		width, height int
+		frameRate     float64
+	}{
+		{"x264 720p", x264SPS, 1280, 720, 30},
+		{"1080p with a scaling matrix", encodeSPS(spsParams{
+			profile: 100, chromaFormat: 1, scalingMatrix: true, widthInMbs: 120, heightInMapUnits: 68,
+			crop: [4]uint32{0, 0, 0, 4}, unitsInTick: 1001, timeScale: 60000,
+		}), 1920, 1080, 29.97},
+		{"Baseline 480p without VUI", encodeSPS(spsParams{profile: 66, pocType: 2, widthInMbs: 40, heightInMapUnits: 30}), 640, 480, 0},
+		{"interlaced 1080i", encodeSPS(spsParams{
+			profile: 77, widthInMbs: 120, heightInMapUnits: 34, interlaced: true,
+			crop: [4]uint32{0, 0, 0, 2}, unitsInTick: 1, timeScale: 50,
+		}), 1920, 1080, 25},
+		{"cropped on the right, POC type 1", encodeSPS(spsParams{
+			profile: 66, pocType: 1, widthInMbs: 22, heightInMapUnits: 18, crop: [4]uint32{0, 4, 0, 0},
+		}), 344, 288, 0},
+		{"4:4:4, cropped in luma samples", encodeSPS(spsParams{
+			profile: 244, chromaFormat: 3, widthInMbs: 80, heightInMapUnits: 45, crop: [4]uint32{2, 2, 0, 0},
+		}), 1276, 720, 0},
+		{"monochrome", encodeSPS(spsParams{
+			profile: 100, chromaFormat: 0, widthInMbs: 20, heightInMapUnits: 15, crop: [4]uint32{0, 0, 1, 1},
+		}), 320, 238, 0},
+	}
+	for _, tt := range tests {
+		width, height, frameRate, err := ParseSPS(tt.sps)
+		if err != nil {
+			t.Errorf("ParseSPS(%s) = %v", tt.name, err)
+			continue
+		}
+		if width != tt.width || height != tt.height || math.Abs(frameRate-tt.frameRate) > 0.01 {
+			t.Errorf("ParseSPS(%s) = %dx%d at %v fps, want %dx%d at %v fps", tt.name, width, height, frameRate, tt.width,
+				tt.height, tt.frameRate)
+		}
+	}
+}
+
+func TestParseSPSInvalid(t *testing.T) {
+	sps := encodeSPS(spsParams{profile: 66, widthInMbs: 40, heightInMapUnits: 30})
+	for name, sps := range map[string][]byte{
+		"PPS":              x264PPS,
+		"empty":            nil,
+		"truncated":        sps[:5],
+		"cropped entirely": encodeSPS(spsParams{profile: 66, widthInMbs: 1, heightInMapUnits: 1, crop: [4]uint32{4, 4, 0, 0}}),
+	} {
+		if _, _, _, err := ParseSPS(sps); !errors.Is(err, ErrInvalidSPS) {
+			t.Errorf("ParseSPS(%s) = %v, want ErrInvalidSPS", name, err)
+		}
+	}
+
+	// A truncated VUI only loses the frame rate
+	sps = encodeSPS(spsParams{profile: 66, widthInMbs: 40, heightInMapUnits: 30, unitsInTick: 1, timeScale: 60})
+	if width, height, frameRate, err := ParseSPS(sps[:len(sps)-6]); err != nil || width != 640 || height != 480 || frameRate != 0 {
+		t.Errorf("ParseSPS() with a truncated VUI = %dx%d at %v fps, %v, want 640x480 without a frame rate", width, height,
+			frameRate, err)
+	}
+}
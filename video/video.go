@@ -1,5 +1,11 @@
 package video
 
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
 // As defined in the FLV spec: https://www.adobe.com/content/dam/acom/en/devnet/flv/video_file_format_spec_v10_1.pdf
 
 type FrameType uint8
@@ -22,8 +28,42 @@ const (
 	VP6AlphaChannel Codec = 5
 	ScreenVideoV2   Codec = 6
 	H264            Codec = 7
+	// Not part of the FLV spec, but used by most encoders and servers that support HEVC over (non-enhanced) RTMP
+	HEVC Codec = 12
+	// Not part of the FLV spec either. AV1 is only carried by Enhanced RTMP, this is the ID the server exposes it as.
+	AV1 Codec = 13
+)
+
+// Flags of the videoCodecs property of the connect command, which tells the codecs a player supports
+const (
+	SupportVidSorenson  uint16 = 0x0004
+	SupportVidHomebrew  uint16 = 0x0008
+	SupportVidVP6       uint16 = 0x0010
+	SupportVidVP6Alpha  uint16 = 0x0020
+	SupportVidHomebrewV uint16 = 0x0040
+	SupportVidH264      uint16 = 0x0080
 )
 
+// SupportFlag returns the videoCodecs flag of the codec c, or 0 if it doesn't have one (eg: HEVC).
+func (c Codec) SupportFlag() uint16 {
+	switch c {
+	case SorensonH263:
+		return SupportVidSorenson
+	case ScreenVideo:
+		return SupportVidHomebrew
+	case VP6:
+		return SupportVidVP6
+	case VP6AlphaChannel:
+		return SupportVidVP6Alpha
+	case ScreenVideoV2:
+		return SupportVidHomebrewV
+	case H264:
+		return SupportVidH264
+	default:
+		return 0
+	}
+}
+
 type AVCPacketType uint8
 
 const (
@@ -31,3 +71,167 @@ const (
 	AVCNALU           AVCPacketType = 1
 	AVCEndOfSequence  AVCPacketType = 2
 )
+
+// Enhanced RTMP (https://github.com/veovera/enhanced-rtmp) extends the video tag header to carry codecs that the FLV
+// spec doesn't define. The high bit of the first byte is set, the next 3 bits are the frame type and the low 4 bits
+// are the packet type, followed by the FourCC of the codec.
+const IsExHeader byte = 0x80
+
+// PacketType is the packet type of an Enhanced RTMP extended video tag header.
+type PacketType uint8
+
+const (
+	PacketTypeSequenceStart PacketType = 0
+	PacketTypeCodedFrames   PacketType = 1
+	PacketTypeSequenceEnd   PacketType = 2
+	// Coded frames without the composition time offset (it's 0)
+	PacketTypeCodedFramesX         PacketType = 3
+	PacketTypeMetadata             PacketType = 4
+	PacketTypeMPEG2TSSequenceStart PacketType = 5
+)
+
+// FourCC identifies the codec of an Enhanced RTMP extended video tag header.
+type FourCC [4]byte
+
+var FourCCHEVC = FourCC{'h', 'v', 'c', '1'}
+var FourCCAV1 = FourCC{'a', 'v', '0', '1'}
+
+// Codec returns the codec identified by the FourCC, or 0 if it isn't known.
+func (f FourCC) Codec() Codec {
+	switch f {
+	case FourCCHEVC:
+		return HEVC
+	case FourCCAV1:
+		return AV1
+	default:
+		return 0
+	}
+}
+
+// MetadataCodec returns the codec identified by the videocodecid property of onMetaData. Encoders write it either as
+// the codec ID of the FLV video tag header (eg: 7 for H264, by FFmpeg and older versions of OBS), or as the FourCC of
+// the codec, itself written as a string (eg: "hvc1", by OBS) or as a number (the FourCC read as a big endian integer,
+// by FFmpeg for Enhanced RTMP codecs). It returns false if the value doesn't identify a known codec.
+func MetadataCodec(value any) (Codec, bool) {
+	var fourCC FourCC
+	switch value := value.(type) {
+	case float64:
+		if value != math.Trunc(value) || value < 0 || value > math.MaxUint32 {
+			return 0, false
+		}
+		if value <= 0x0F {
+			switch codec := Codec(value); codec {
+			case SorensonH263, ScreenVideo, VP6, VP6AlphaChannel, ScreenVideoV2, H264, HEVC, AV1:
+				return codec, true
+			}
+			return 0, false
+		}
+		binary.BigEndian.PutUint32(fourCC[:], uint32(value))
+	case string:
+		if len(value) != len(fourCC) {
+			return 0, false
+		}
+		copy(fourCC[:], value)
+	default:
+		return 0, false
+	}
+	// FourCC.Codec only knows the codecs carried by extended headers, H264 is carried by FLV headers
+	if fourCC == (FourCC{'a', 'v', 'c', '1'}) {
+		return H264, true
+	}
+	codec := fourCC.Codec()
+	return codec, codec != 0
+}
+
+// Header is the video tag header at the beginning of the payload of a video message.
+type Header struct {
+	FrameType FrameType
+	Codec     Codec
+	// Whether the header is an Enhanced RTMP extended header, in which case FourCC is set
+	Extended bool
+	FourCC   FourCC
+	// Packet type of extended headers, or the AVCPacketType of H264 (and non-enhanced HEVC) frames. Both have the same
+	// values for sequence headers, frames and end of sequence.
+	PacketType PacketType
+}
+
+// ParseHeader parses the video tag header at the beginning of payload, either the FLV header (frame type and codec
+// ID) or an Enhanced RTMP extended header. Fields the payload is too short to have are left unset.
+func ParseHeader(payload []byte) Header {
+	var header Header
+	if len(payload) == 0 {
+		return header
+	}
+	if payload[0]&IsExHeader == 0 {
+		header.FrameType = FrameType((payload[0] >> 4) & 0x0F)
+		header.Codec = Codec(payload[0] & 0x0F)
+		if (header.Codec == H264 || header.Codec == HEVC) && len(payload) > 1 {
+			header.PacketType = PacketType(payload[1])
+		}
+		return header
+	}
+	header.Extended = true
+	header.FrameType = FrameType((payload[0] >> 4) & 0x07)
+	header.PacketType = PacketType(payload[0] & 0x0F)
+	if len(payload) >= 5 {
+		copy(header.FourCC[:], payload[1:5])
+		header.Codec = header.FourCC.Codec()
+	}
+	return header
+}
+
+// IsSequenceHeader returns whether the header is the one of a sequence header: the AVCDecoderConfigurationRecord of
+// H264, the HEVCDecoderConfigurationRecord of HEVC (with or without an extended header), or the
+// AV1CodecConfigurationRecord (or MPEG-2 TS descriptor) of AV1.
+func (h Header) IsSequenceHeader() bool {
+	if h.Codec == AV1 && h.PacketType == PacketTypeMPEG2TSSequenceStart {
+		return true
+	}
+	return h.Codec.HasSequenceHeader() && h.PacketType == PacketTypeSequenceStart
+}
+
+// HasSequenceHeader returns whether frames of the codec are decoded with a sequence header, which must be sent before
+// them.
+func (c Codec) HasSequenceHeader() bool {
+	return c == H264 || c == HEVC || c == AV1
+}
+
+func (t FrameType) String() string {
+	switch t {
+	case KeyFrame:
+		return "keyframe"
+	case InterFrame:
+		return "interframe"
+	case DisposableInterFrame:
+		return "disposable interframe"
+	case GeneratedKeyFrame:
+		return "generated keyframe"
+	case CommandFrame:
+		return "command frame"
+	default:
+		return fmt.Sprintf("FrameType(%d)", uint8(t))
+	}
+}
+
+func (c Codec) String() string {
+	switch c {
+	case SorensonH263:
+		return "SorensonH263"
+	case ScreenVideo:
+		return "ScreenVideo"
+	case VP6:
+		return "VP6"
+	case VP6AlphaChannel:
+		return "VP6Alpha"
+	case ScreenVideoV2:
+		return "ScreenVideoV2"
+	case H264:
+		return "H264"
+	case HEVC:
+		return "HEVC"
+	case AV1:
+		return "AV1"
+	default:
+		return fmt.Sprintf("Codec(%d)", uint8(c))
+	}
+}
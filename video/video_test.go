@@ -0,0 +1,120 @@
+package video
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Payloads of HEVC streams published by OBS (extended headers, with a composition time offset) and FFmpeg (coded
+// frames without one), followed by the beginning of the HEVCDecoderConfigurationRecord or the first NAL unit
+var (
+	hevcSequenceStart = []byte{0x90, 'h', 'v', 'c', '1', 0x01, 0x01, 0x60, 0x00, 0x00, 0x00, 0x90, 0x00}
+	hevcKeyframe      = []byte{0x91, 'h', 'v', 'c', '1', 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x26, 0x01}
+	hevcInterframe    = []byte{0xa3, 'h', 'v', 'c', '1', 0x00, 0x00, 0x00, 0x05, 0x02, 0x01}
+	hevcSequenceEnd   = []byte{0x92, 'h', 'v', 'c', '1'}
+)
+
+// Payloads of an AV1 stream published by OBS, followed by the AV1CodecConfigurationRecord (marker and version, profile
+// and level, flags) or the OBUs of the frame (a temporal delimiter, then a frame OBU)
+var (
+	av1SequenceStart = []byte{0x90, 'a', 'v', '0', '1', 0x81, 0x08, 0x0c, 0x00, 0x0a, 0x0b}
+	av1Keyframe      = []byte{0x91, 'a', 'v', '0', '1', 0x12, 0x00, 0x32, 0x10, 0x10}
+	av1Interframe    = []byte{0xa1, 'a', 'v', '0', '1', 0x12, 0x00, 0x32, 0x08, 0x30}
+)
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		name           string
+		payload        []byte
+		want           Header
+		sequenceHeader bool
+	}{
+		{"H264 sequence header", []byte{0x17, 0x00, 0, 0, 0, 0x01, 0x64}, Header{FrameType: KeyFrame, Codec: H264}, true},
+		{"H264 keyframe", []byte{0x17, 0x01, 0, 0, 0, 0x65}, Header{FrameType: KeyFrame, Codec: H264, PacketType: PacketTypeCodedFrames}, false},
+		{"non-enhanced HEVC sequence header", []byte{0x1c, 0x00, 0, 0, 0, 0x01}, Header{FrameType: KeyFrame, Codec: HEVC}, true},
+		{"Sorenson H263 frame", []byte{0x22, 0x00}, Header{FrameType: InterFrame, Codec: SorensonH263}, false},
+		{"HEVC sequence start", hevcSequenceStart,
+			Header{FrameType: KeyFrame, Codec: HEVC, Extended: true, FourCC: FourCCHEVC, PacketType: PacketTypeSequenceStart}, true},
+		{"HEVC keyframe", hevcKeyframe,
+			Header{FrameType: KeyFrame, Codec: HEVC, Extended: true, FourCC: FourCCHEVC, PacketType: PacketTypeCodedFrames}, false},
+		{"HEVC interframe", hevcInterframe,
+			Header{FrameType: InterFrame, Codec: HEVC, Extended: true, FourCC: FourCCHEVC, PacketType: PacketTypeCodedFramesX}, false},
+		{"HEVC sequence end", hevcSequenceEnd,
+			Header{FrameType: KeyFrame, Codec: HEVC, Extended: true, FourCC: FourCCHEVC, PacketType: PacketTypeSequenceEnd}, false},
+		{"AV1 sequence start", av1SequenceStart,
+			Header{FrameType: KeyFrame, Codec: AV1, Extended: true, FourCC: FourCCAV1, PacketType: PacketTypeSequenceStart}, true},
+		{"AV1 MPEG-2 TS sequence start", []byte{0x95, 'a', 'v', '0', '1', 0x80, 0x04},
+			Header{FrameType: KeyFrame, Codec: AV1, Extended: true, FourCC: FourCCAV1, PacketType: PacketTypeMPEG2TSSequenceStart}, true},
+		{"AV1 keyframe", av1Keyframe,
+			Header{FrameType: KeyFrame, Codec: AV1, Extended: true, FourCC: FourCCAV1, PacketType: PacketTypeCodedFrames}, false},
+		{"AV1 interframe", av1Interframe,
+			Header{FrameType: InterFrame, Codec: AV1, Extended: true, FourCC: FourCCAV1, PacketType: PacketTypeCodedFrames}, false},
+		{"unknown FourCC", []byte{0x91, 'v', 'p', '0', '9', 0x00},
+			Header{FrameType: KeyFrame, Extended: true, FourCC: FourCC{'v', 'p', '0', '9'}, PacketType: PacketTypeCodedFrames}, false},
+		// Too short to have a FourCC
+		{"truncated extended header", []byte{0x90, 'h', 'v'}, Header{FrameType: KeyFrame, Extended: true}, false},
+		{"empty", nil, Header{}, false},
+	}
+	for _, tt := range tests {
+		header := ParseHeader(tt.payload)
+		if header != tt.want {
+			t.Errorf("ParseHeader(%s) = %+v, want %+v", tt.name, header, tt.want)
+		}
+		if header.IsSequenceHeader() != tt.sequenceHeader {
+			t.Errorf("ParseHeader(%s).IsSequenceHeader() = %v, want %v", tt.name, header.IsSequenceHeader(), tt.sequenceHeader)
+		}
+	}
+}
+
+func TestMetadataCodec(t *testing.T) {
+	tests := []struct {
+		value  any
+		want   Codec
+		wantOK bool
+	}{
+		{7.0, H264, true},
+		{2.0, SorensonH263, true},
+		{"avc1", H264, true},
+		{"hvc1", HEVC, true},
+		// "hvc1" read as a big endian integer
+		{float64(0x68766331), HEVC, true},
+		{"av01", AV1, true},
+		{0.0, 0, false},
+		{15.0, 0, false},
+		{7.5, 0, false},
+		{-7.0, 0, false},
+		{"vp09", 0, false},
+		{"h264", 0, false},
+		{nil, 0, false},
+	}
+	for _, test := range tests {
+		codec, ok := MetadataCodec(test.value)
+		if ok != test.wantOK || (ok && codec != test.want) {
+			t.Errorf("MetadataCodec(%v) = %v, %t, want %v, %t", test.value, codec, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		value fmt.Stringer
+		want  string
+	}{
+		{H264, "H264"},
+		{HEVC, "HEVC"},
+		{AV1, "AV1"},
+		{SorensonH263, "SorensonH263"},
+		{VP6AlphaChannel, "VP6Alpha"},
+		{Codec(9), "Codec(9)"},
+		{KeyFrame, "keyframe"},
+		{InterFrame, "interframe"},
+		{DisposableInterFrame, "disposable interframe"},
+		{CommandFrame, "command frame"},
+		{FrameType(0), "FrameType(0)"},
+	}
+	for _, test := range tests {
+		if got := test.value.String(); got != test.want {
+			t.Errorf("%T(%d).String() = %q, want %q", test.value, test.value, got, test.want)
+		}
+	}
+}